@@ -0,0 +1,158 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+const benchmarkSize = 100000
+
+var benchmarkOrders = []int{4, 16, 64, 256}
+
+// benchmarkKeys returns size distinct keys in random order
+func benchmarkKeys(size int) [][]byte {
+	r := rand.New(rand.NewSource(1))
+	keys := make([][]byte, size)
+	for i, k := range r.Perm(size) {
+		keys[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(keys[i], uint64(k))
+	}
+	return keys
+}
+
+func benchmarkTree(b *testing.B, order int, keys [][]byte) *BPlusTree {
+	bpt, err := NewBPlusTree(SetOrder(order))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, key := range keys {
+		bpt.Put(key, key)
+	}
+	return bpt
+}
+
+func BenchmarkGet(b *testing.B) {
+	keys := benchmarkKeys(benchmarkSize)
+	for _, order := range benchmarkOrders {
+		b.Run(fmt.Sprintf("order=%d", order), func(b *testing.B) {
+			bpt := benchmarkTree(b, order, keys)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bpt.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	keys := benchmarkKeys(benchmarkSize)
+	for _, order := range benchmarkOrders {
+		b.Run(fmt.Sprintf("order=%d", order), func(b *testing.B) {
+			bpt, _ := NewBPlusTree(SetOrder(order))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%len(keys) == 0 && i > 0 {
+					b.StopTimer()
+					bpt, _ = NewBPlusTree(SetOrder(order))
+					b.StartTimer()
+				}
+				bpt.Put(keys[i%len(keys)], keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkDelete(b *testing.B) {
+	keys := benchmarkKeys(benchmarkSize)
+	for _, order := range benchmarkOrders {
+		b.Run(fmt.Sprintf("order=%d", order), func(b *testing.B) {
+			var bpt *BPlusTree
+			for i := 0; i < b.N; i++ {
+				if i%len(keys) == 0 {
+					b.StopTimer()
+					bpt = benchmarkTree(b, order, keys)
+					b.StartTimer()
+				}
+				bpt.Delete(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	keys := benchmarkKeys(benchmarkSize)
+	for _, order := range benchmarkOrders {
+		b.Run(fmt.Sprintf("order=%d", order), func(b *testing.B) {
+			bpt := benchmarkTree(b, order, keys)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// scan 100 consecutive keys
+				start := make([]byte, 8)
+				binary.BigEndian.PutUint64(start, uint64(i%(benchmarkSize-100)))
+				end := make([]byte, 8)
+				binary.BigEndian.PutUint64(end, uint64(i%(benchmarkSize-100)+100))
+				bpt.Scan(start, end, ScanOptions{}, func(key, value []byte) bool {
+					return true
+				})
+			}
+		})
+	}
+}
+
+func BenchmarkDeleteRange(b *testing.B) {
+	keys := benchmarkKeys(benchmarkSize)
+	for _, order := range benchmarkOrders {
+		b.Run(fmt.Sprintf("order=%d", order), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				bpt := benchmarkTree(b, order, keys)
+				start := make([]byte, 8)
+				binary.BigEndian.PutUint64(start, uint64(benchmarkSize/4))
+				end := make([]byte, 8)
+				binary.BigEndian.PutUint64(end, uint64(benchmarkSize/4*3))
+				b.StartTimer()
+
+				bpt.DeleteRange(start, end, ScanOptions{})
+			}
+		})
+	}
+}
+
+// BenchmarkReadMostly runs 50 lookups per put from parallel goroutines
+func BenchmarkReadMostly(b *testing.B) {
+	keys := benchmarkKeys(benchmarkSize)
+	modes := []struct {
+		name        string
+		concurrency Concurrency
+	}{
+		{"globallock", GlobalLock},
+		{"latchcrabbing", LatchCrabbing},
+		{"blink", BLink},
+		{"olc", OptimisticLockCoupling},
+		{"copyonwrite", CopyOnWrite},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			bpt, _ := NewBPlusTree(SetOrder(64), SetConcurrency(mode.concurrency))
+			for _, key := range keys {
+				bpt.Put(key, key)
+			}
+			var seed int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for i := 0; pb.Next(); i++ {
+					key := keys[r.Intn(len(keys))]
+					if i%50 == 0 {
+						bpt.Put(key, key)
+					} else {
+						bpt.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
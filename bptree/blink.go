@@ -0,0 +1,553 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A B-link tree (Lehman and Yao) gives every node a high key, the upper
+// bound of the keys of its subtree, and a right link to the next node of
+// the same level. A split moves the upper half of a node into a new right
+// sibling before the parent learns about it, so an operation arriving at
+// a node whose high key is not greater than its key follows the right link
+// instead of restarting. The content of a node is immutable once published:
+// writers latch the node, build its new content and publish it atomically,
+// so readers never take a latch nor wait for a writer.
+// Deletions don't rebalance, nodes may underflow and leaves may get empty.
+
+// blinkNode is a node of the B-link tree
+type blinkNode struct {
+	// serializes the writers of the node
+	latch sync.Mutex
+
+	// the current *blinkContent of the node
+	content atomic.Value
+}
+
+// blinkContent is the immutable content of a blinkNode
+type blinkContent struct {
+	// 0 for leaf node, the height above the leaves for internal node
+	level int
+
+	keys [][]byte
+
+	// only for leaf node, one value per key
+	values [][]byte
+
+	// only for internal node, one child more than keys
+	children []*blinkNode
+
+	// the bounds [lowKey, highKey) of the keys of the subtree, a nil
+	// bound is open. lowKey never changes, highKey shrinks on splits.
+	lowKey, highKey []byte
+
+	// the next node of the same level, nil for the most right node
+	right *blinkNode
+}
+
+func newBlinkNode(c *blinkContent) *blinkNode {
+	n := &blinkNode{}
+	n.content.Store(c)
+	return n
+}
+
+// load returns the current content of the node
+func (n *blinkNode) load() *blinkContent {
+	return n.content.Load().(*blinkContent)
+}
+
+// store publishes the new content of the node
+func (n *blinkNode) store(c *blinkContent) {
+	n.content.Store(c)
+}
+
+// blinkTree is the engine of BLink mode
+type blinkTree struct {
+	// the number of keys, accessed atomically, first for the alignment
+	size int64
+
+	bpt *BPlusTree
+
+	// the current *blinkNode at the top
+	root atomic.Value
+
+	// serializes the growth of the tree
+	rootLatch sync.Mutex
+}
+
+func newBlinkTree(bpt *BPlusTree) *blinkTree {
+	t := &blinkTree{bpt: bpt}
+	t.root.Store(newBlinkNode(&blinkContent{}))
+	return t
+}
+
+func (t *blinkTree) rootNode() *blinkNode {
+	return t.root.Load().(*blinkNode)
+}
+
+// covers returns true if the key lies below the high key of the node
+func (t *blinkTree) covers(c *blinkContent, key []byte) bool {
+	return c.highKey == nil || t.bpt.compare(key, c.highKey) < 0
+}
+
+// search returns the position of the first key which is not less than
+// the given key and true if that key equals the given key.
+func (t *blinkTree) search(c *blinkContent, key []byte) (int, bool) {
+	position := sort.Search(len(c.keys), func(i int) bool {
+		return t.bpt.compare(c.keys[i], key) >= 0
+	})
+	return position, position < len(c.keys) && t.bpt.compare(c.keys[position], key) == 0
+}
+
+// childPosition returns the position of the child which covers the given key
+func (t *blinkTree) childPosition(c *blinkContent, key []byte) int {
+	return sort.Search(len(c.keys), func(i int) bool {
+		return t.bpt.compare(key, c.keys[i]) < 0
+	})
+}
+
+// moveRight follows the right links from the node
+// to the one which covers the given key.
+func (t *blinkTree) moveRight(n *blinkNode, key []byte) (*blinkNode, *blinkContent) {
+	c := n.load()
+	for !t.covers(c, key) {
+		n = c.right
+		c = n.load()
+	}
+	return n, c
+}
+
+// findLeaf descends to the leaf which covers the given key without
+// latching. The node passed on each internal level is pushed onto the
+// stack, so a split can be posted to the parent.
+func (t *blinkTree) findLeaf(key []byte, stack []*blinkNode) (*blinkNode, *blinkContent, []*blinkNode) {
+	n, c := t.moveRight(t.rootNode(), key)
+	for c.level > 0 {
+		stack = append(stack, n)
+		n, c = t.moveRight(c.children[t.childPosition(c, key)], key)
+	}
+	return n, c, stack
+}
+
+// latchCovering latches the node and moves right with latch coupling
+// to the node which covers the given key, which is returned latched.
+func (t *blinkTree) latchCovering(n *blinkNode, key []byte) (*blinkNode, *blinkContent) {
+	n.latch.Lock()
+	c := n.load()
+	for !t.covers(c, key) {
+		right := c.right
+		right.latch.Lock()
+		n.latch.Unlock()
+		n, c = right, right.load()
+	}
+	return n, c
+}
+
+// get is Get for B-link trees, it takes no latch
+func (t *blinkTree) get(key []byte) ([]byte, bool) {
+	_, c, _ := t.findLeaf(key, nil)
+	if position, found := t.search(c, key); found {
+		return c.values[position], true
+	}
+	return nil, false
+}
+
+// put is Put for B-link trees, it latches the leaf and, while a split
+// travels up, one node of the level above.
+func (t *blinkTree) put(key, value []byte) ([]byte, bool) {
+	leaf, _, stack := t.findLeaf(key, nil)
+	n, c := t.latchCovering(leaf, key)
+
+	next := *c
+	position, found := t.search(c, key)
+	if found {
+		next.values = replaced(c.values, position, value)
+		n.store(&next)
+		n.latch.Unlock()
+		return c.values[position], true
+	}
+
+	next.keys = inserted(c.keys, position, key)
+	next.values = inserted(c.values, position, value)
+	atomic.AddInt64(&t.size, 1)
+	t.publish(n, &next, stack)
+	return nil, false
+}
+
+// publish publishes the new content of the latched node and releases
+// it. An overflowing node is split, and the split is posted to the level
+// above, whose node is latched before the child is released.
+func (t *blinkTree) publish(n *blinkNode, c *blinkContent, stack []*blinkNode) {
+	for len(c.keys) >= t.bpt.order {
+		left, separator, right := t.split(c)
+		rightNode := newBlinkNode(right)
+		left.right = rightNode
+		// the right node is reachable from now on
+		n.store(left)
+
+		var parent *blinkNode
+		if len(stack) > 0 {
+			parent, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		} else if parent = t.parentOf(n, c.level, separator, rightNode); parent == nil {
+			// the tree has grown a new root
+			n.latch.Unlock()
+			return
+		}
+
+		parent, pc := t.latchCovering(parent, separator)
+		n.latch.Unlock()
+
+		position := t.childPosition(pc, separator)
+		next := *pc
+		next.keys = inserted(pc.keys, position, separator)
+		next.children = inserted(pc.children, position+1, rightNode)
+		n, c = parent, &next
+	}
+	n.store(c)
+	n.latch.Unlock()
+}
+
+// split splits the overflowing content, the left half stays in the
+// node and the right half goes to a new node linked next to it.
+func (t *blinkTree) split(c *blinkContent) (*blinkContent, []byte, *blinkContent) {
+	middle := len(c.keys) / 2
+	separator := c.keys[middle]
+	left := &blinkContent{level: c.level, lowKey: c.lowKey, highKey: separator}
+	right := &blinkContent{level: c.level, lowKey: separator, highKey: c.highKey, right: c.right}
+
+	// the contents are immutable, so they may share the arrays
+	if c.level == 0 {
+		left.keys, left.values = c.keys[:middle:middle], c.values[:middle:middle]
+		right.keys, right.values = c.keys[middle:], c.values[middle:]
+	} else {
+		// the separator moves up
+		left.keys, left.children = c.keys[:middle:middle], c.children[:middle+1:middle+1]
+		right.keys, right.children = c.keys[middle+1:], c.children[middle+1:]
+	}
+	return left, separator, right
+}
+
+// parentOf returns the node to post the split of the latched node into,
+// when the descent didn't pass any node above its level. If the node is
+// the root, the tree grows a new root holding both halves and nil is
+// returned.
+func (t *blinkTree) parentOf(n *blinkNode, level int, separator []byte, right *blinkNode) *blinkNode {
+	for {
+		t.rootLatch.Lock()
+		root := t.rootNode()
+		rc := root.load()
+		if root == n {
+			t.root.Store(newBlinkNode(&blinkContent{
+				level:    level + 1,
+				keys:     [][]byte{separator},
+				children: []*blinkNode{n, right},
+			}))
+			t.rootLatch.Unlock()
+			return nil
+		}
+		if rc.level > level {
+			t.rootLatch.Unlock()
+
+			// the tree has grown since the descent
+			current, c := t.moveRight(root, separator)
+			for c.level > level+1 {
+				current, c = t.moveRight(c.children[t.childPosition(c, separator)], separator)
+			}
+			return current
+		}
+
+		// the root is being split by another writer, which
+		// latches no node until the new root is published
+		t.rootLatch.Unlock()
+		runtime.Gosched()
+	}
+}
+
+// delete is Delete for B-link trees, it only latches the leaf
+func (t *blinkTree) delete(key []byte) ([]byte, bool) {
+	leaf, _, _ := t.findLeaf(key, nil)
+	n, c := t.latchCovering(leaf, key)
+	defer n.latch.Unlock()
+
+	position, found := t.search(c, key)
+	if !found {
+		return nil, false
+	}
+	next := *c
+	next.keys = removed(c.keys, position)
+	next.values = removed(c.values, position)
+	n.store(&next)
+	atomic.AddInt64(&t.size, -1)
+	return c.values[position], true
+}
+
+// bulkLoad is BulkLoad for B-link trees. The empty root leaf stays latched
+// while the nodes are built, then it becomes the first leaf and the new
+// root is published. Writers which reached it meanwhile follow its right
+// link once they latch it.
+func (t *blinkTree) bulkLoad(src KVSource) error {
+	root := t.rootNode()
+	root.latch.Lock()
+	defer root.latch.Unlock()
+	if c := root.load(); t.rootNode() != root || c.level > 0 || len(c.keys) > 0 {
+		return ErrNotEmpty
+	}
+
+	runs, size, err := t.bpt.packRuns(src)
+	if err != nil || size == 0 {
+		return err
+	}
+	leaves, firstKeys := make([]*blinkNode, len(runs)), make([][]byte, len(runs))
+	for i, run := range runs {
+		leaves[i], firstKeys[i] = newBlinkNode(&blinkContent{keys: run.keys, values: run.values}), run.keys[0]
+	}
+	top := buildLevels(t.bpt, leaves, firstKeys, func(keys [][]byte, children []*blinkNode) *blinkNode {
+		return newBlinkNode(&blinkContent{level: children[0].load().level + 1, keys: keys, children: children})
+	})
+
+	// the contents aren't published yet, so their bounds
+	// and right links are set in place level by level
+	for level := []*blinkNode{top}; len(level) > 0; {
+		var children []*blinkNode
+		for i, n := range level {
+			c := n.load()
+			if i+1 < len(level) {
+				c.right = level[i+1]
+			}
+			for j, child := range c.children {
+				cc := child.load()
+				cc.lowKey, cc.highKey = c.lowKey, c.highKey
+				if j > 0 {
+					cc.lowKey = c.keys[j-1]
+				}
+				if j < len(c.keys) {
+					cc.highKey = c.keys[j]
+				}
+			}
+			children = append(children, c.children...)
+		}
+		level = children
+	}
+
+	// the root takes the place of the first leaf
+	first := leaves[0]
+	if top != first {
+		n := top
+		for n.load().children[0] != first {
+			n = n.load().children[0]
+		}
+		n.load().children[0] = root
+	} else {
+		top = root
+	}
+	root.store(first.load())
+	t.rootLatch.Lock()
+	t.root.Store(top)
+	t.rootLatch.Unlock()
+	atomic.AddInt64(&t.size, int64(size))
+	return nil
+}
+
+// firstLeaf returns the most left leaf, which is never replaced
+func (t *blinkTree) firstLeaf() *blinkNode {
+	n := t.rootNode()
+	for c := n.load(); c.level > 0; c = n.load() {
+		n = c.children[0]
+	}
+	return n
+}
+
+func (t *blinkTree) len() int {
+	return int(atomic.LoadInt64(&t.size))
+}
+
+func (t *blinkTree) seek(leaf interface{}, key []byte, exclusive bool) (interface{}, []byte, []byte) {
+	var n *blinkNode
+	switch {
+	case leaf != nil:
+		n = leaf.(*blinkNode)
+	case key == nil:
+		n = t.firstLeaf()
+	default:
+		n, _, _ = t.findLeaf(key, nil)
+	}
+	return blinkPair(t.forward(n, key, exclusive))
+}
+
+func (t *blinkTree) last(bound []byte) (interface{}, []byte, []byte) {
+	return blinkPair(t.lastBefore(bound))
+}
+
+// blinkPair returns the leaf and the pair at the position in the leaf
+func blinkPair(n *blinkNode, c *blinkContent, i int) (interface{}, []byte, []byte) {
+	if n == nil {
+		return nil, nil, nil
+	}
+	return n, c.keys[i], c.values[i]
+}
+
+// forward returns the leaf, its content and the position of the first key
+// after the given key, or of the key itself unless exclusive, starting from
+// the given leaf. Keys only move right, so any leaf left of the key may
+// start the search. The leaf is nil if there is no such key.
+func (t *blinkTree) forward(n *blinkNode, key []byte, exclusive bool) (*blinkNode, *blinkContent, int) {
+	for n != nil {
+		c := n.load()
+		i := 0
+		if key != nil {
+			var found bool
+			i, found = t.search(c, key)
+			if found && exclusive {
+				i++
+			}
+		}
+		if i < len(c.keys) {
+			return n, c, i
+		}
+		n = c.right
+	}
+	return nil, nil, 0
+}
+
+// lastBefore returns the leaf, its content and the position of the last key
+// before the bound, or of the largest key if the bound is nil. The leaf
+// is nil if there is no such key. As there are no left links, it descends
+// again with the low key of the leaf if the leaves before the bound are empty.
+func (t *blinkTree) lastBefore(bound []byte) (*blinkNode, *blinkContent, int) {
+	for {
+		n := t.leafBefore(bound)
+		lowKey := n.load().lowKey
+
+		// the keys before the bound may have moved right
+		var lastNode *blinkNode
+		var lastContent *blinkContent
+		lastPosition := 0
+		for n != nil {
+			c := n.load()
+			i := len(c.keys)
+			if bound != nil {
+				i, _ = t.search(c, bound)
+			}
+			if i > 0 {
+				lastNode, lastContent, lastPosition = n, c, i-1
+			}
+			if c.highKey == nil || bound != nil && t.bpt.compare(c.highKey, bound) >= 0 {
+				break
+			}
+			n = c.right
+		}
+		if lastNode != nil || lowKey == nil {
+			return lastNode, lastContent, lastPosition
+		}
+		bound = lowKey
+	}
+}
+
+// leafBefore descends to the leaf holding the keys right before the
+// bound, or to the most right leaf if the bound is nil.
+func (t *blinkTree) leafBefore(bound []byte) *blinkNode {
+	n := t.rootNode()
+	for {
+		c := n.load()
+		for c.right != nil && (bound == nil || t.bpt.compare(c.highKey, bound) < 0) {
+			n = c.right
+			c = n.load()
+		}
+		if c.level == 0 {
+			return n
+		}
+		i := len(c.keys)
+		if bound != nil {
+			i, _ = t.search(c, bound)
+		}
+		n = c.children[i]
+	}
+}
+
+// validate checks the invariants of the B-link tree. Writers must be
+// done, so that every split has been posted to the level above.
+func (t *blinkTree) validate() error {
+	root := t.rootNode()
+	rc := root.load()
+	if rc.lowKey != nil || rc.highKey != nil || rc.right != nil {
+		return errors.New("root has bounds or a right link")
+	}
+
+	size := 0
+	level := []*blinkNode{root}
+	for depth := rc.level; ; depth-- {
+		var children []*blinkNode
+		for i, n := range level {
+			c := n.load()
+			path := fmt.Sprintf("level %d node %d", depth, i)
+			if c.level != depth {
+				return fmt.Errorf("%s: node claims level %d", path, c.level)
+			}
+			var right *blinkNode
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			if c.right != right {
+				return fmt.Errorf("%s: node has a wrong right link", path)
+			}
+
+			for j, key := range c.keys {
+				if j > 0 && t.bpt.compare(c.keys[j-1], key) >= 0 {
+					return fmt.Errorf("%s: keys %q and %q are not in ascending order", path, c.keys[j-1], key)
+				}
+				if c.lowKey != nil && t.bpt.compare(key, c.lowKey) < 0 {
+					return fmt.Errorf("%s: key %q is less than the low key %q", path, key, c.lowKey)
+				}
+				if !t.covers(c, key) {
+					return fmt.Errorf("%s: key %q is not less than the high key %q", path, key, c.highKey)
+				}
+			}
+
+			if depth == 0 {
+				if len(c.values) != len(c.keys) || c.children != nil {
+					return fmt.Errorf("%s: leaf holds %d keys and %d values", path, len(c.keys), len(c.values))
+				}
+				size += len(c.keys)
+				continue
+			}
+			if len(c.children) != len(c.keys)+1 || c.values != nil {
+				return fmt.Errorf("%s: node holds %d keys and %d children", path, len(c.keys), len(c.children))
+			}
+			for j, child := range c.children {
+				lower, upper := c.lowKey, c.highKey
+				if j > 0 {
+					lower = c.keys[j-1]
+				}
+				if j < len(c.keys) {
+					upper = c.keys[j]
+				}
+				cc := child.load()
+				if !t.sameBound(cc.lowKey, lower) || !t.sameBound(cc.highKey, upper) {
+					return fmt.Errorf("%s: child %d has the bounds [%q, %q) instead of [%q, %q)", path, j, cc.lowKey, cc.highKey, lower, upper)
+				}
+			}
+			children = append(children, c.children...)
+		}
+		if depth == 0 {
+			break
+		}
+		level = children
+	}
+
+	if treeSize := atomic.LoadInt64(&t.size); int64(size) != treeSize {
+		return fmt.Errorf("size is %d but the tree holds %d keys", treeSize, size)
+	}
+	return nil
+}
+
+// sameBound returns true if both bounds are open or equal
+func (t *blinkTree) sameBound(a, b []byte) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return t.bpt.compare(a, b) == 0
+}
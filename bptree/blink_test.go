@@ -0,0 +1,286 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBLinkSequential(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	universe := 3000
+
+	for order := 3; order <= 8; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order), SetConcurrency(BLink))
+		expected := make(map[int]bool)
+		for i := 0; i < 4*universe; i++ {
+			k := r.Intn(universe)
+			if r.Intn(3) == 0 {
+				_, deleted := bpt.Delete(uint32Key(k))
+				assert.Equal(t, expected[k], deleted)
+				delete(expected, k)
+			} else {
+				bpt.Put(uint32Key(k), uint32Key(k))
+				expected[k] = true
+			}
+		}
+		// leave most leaves empty
+		for k := 0; k < universe; k++ {
+			if k%10 != 0 {
+				bpt.Delete(uint32Key(k))
+				delete(expected, k)
+			}
+		}
+		assert.NoError(t, bpt.Validate())
+		assert.Equal(t, len(expected), bpt.Size())
+
+		keys := make([]int, 0, len(expected))
+		for k := range expected {
+			keys = append(keys, k)
+		}
+		sort.Ints(keys)
+
+		i := 0
+		for it := bpt.Iterator(); it.Valid(); i++ {
+			key, value := it.Next()
+			assert.Equal(t, uint32Key(keys[i]), key)
+			assert.Equal(t, key, value)
+		}
+		assert.Equal(t, len(keys), i)
+
+		it := bpt.Iterator()
+		for it.SeekToLast(); it.Valid(); {
+			i--
+			key, _ := it.Prev()
+			assert.Equal(t, uint32Key(keys[i]), key)
+		}
+		assert.Equal(t, 0, i)
+
+		for k := 0; k < universe; k++ {
+			_, ok := bpt.Get(uint32Key(k))
+			assert.Equal(t, expected[k], ok)
+
+			it.Seek(uint32Key(k))
+			j := sort.SearchInts(keys, k)
+			assert.Equal(t, j < len(keys), it.Valid())
+			if j < len(keys) {
+				assert.Equal(t, uint32Key(keys[j]), it.Key())
+			}
+		}
+	}
+}
+
+func TestBLinkConcurrentReadersAndWriters(t *testing.T) {
+	writers, keysPerWriter, stableKeys, ops := 8, 400, 40, 1000
+
+	for _, order := range []int{3, 4, 16} {
+		bpt, _ := NewBPlusTree(SetOrder(order), SetConcurrency(BLink))
+		key := func(writer, i int) []byte {
+			return uint32Key(writer*keysPerWriter + i)
+		}
+		for w := 0; w < writers; w++ {
+			for i := 0; i < stableKeys; i++ {
+				bpt.Put(key(w, i), key(w, i))
+			}
+		}
+
+		var wg sync.WaitGroup
+		expected := make([]map[int]bool, writers)
+		for w := 0; w < writers; w++ {
+			expected[w] = make(map[int]bool)
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(w)))
+				for op := 0; op < ops; op++ {
+					i := stableKeys + r.Intn(keysPerWriter-stableKeys)
+					if r.Intn(3) == 0 {
+						_, deleted := bpt.Delete(key(w, i))
+						assert.Equal(t, expected[w][i], deleted)
+						delete(expected[w], i)
+					} else {
+						bpt.Put(key(w, i), key(w, i))
+						expected[w][i] = true
+					}
+				}
+			}(w)
+		}
+
+		done := make(chan struct{})
+		var readers sync.WaitGroup
+		readers.Add(3)
+		go func() {
+			defer readers.Done()
+			r := rand.New(rand.NewSource(time.Now().Unix()))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w, i := r.Intn(writers), r.Intn(stableKeys)
+				value, ok := bpt.Get(key(w, i))
+				assert.True(t, ok)
+				assert.Equal(t, key(w, i), value)
+			}
+		}()
+		for _, forward := range []bool{true, false} {
+			go func(forward bool) {
+				defer readers.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					stable := 0
+					var previous []byte
+					count := func(key []byte) {
+						if previous != nil {
+							cmp := bytes.Compare(previous, key)
+							assert.True(t, forward && cmp < 0 || !forward && cmp > 0)
+						}
+						previous = key
+						if int(binary.BigEndian.Uint32(key))%keysPerWriter < stableKeys {
+							stable++
+						}
+					}
+					if forward {
+						bpt.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+							count(key)
+							return true
+						})
+					} else {
+						it := bpt.Iterator()
+						for it.SeekToLast(); it.Valid(); {
+							key, _ := it.Prev()
+							count(key)
+						}
+					}
+					assert.Equal(t, writers*stableKeys, stable)
+				}
+			}(forward)
+		}
+
+		wg.Wait()
+		close(done)
+		readers.Wait()
+
+		assert.NoError(t, bpt.Validate())
+		size := writers * stableKeys
+		for w := 0; w < writers; w++ {
+			size += len(expected[w])
+			for i := stableKeys; i < keysPerWriter; i++ {
+				_, ok := bpt.Get(key(w, i))
+				assert.Equal(t, expected[w][i], ok)
+			}
+		}
+		assert.Equal(t, size, bpt.Size())
+	}
+}
+
+func TestBLinkReadersTakeNoLatch(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetOrder(4), SetConcurrency(BLink))
+	for k := 0; k < 1000; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+
+	// latch every node as if writers were stuck on all of them
+	var latched []*blinkNode
+	level := []*blinkNode{bpt.engine.(*blinkTree).rootNode()}
+	for len(level) > 0 {
+		var children []*blinkNode
+		for _, n := range level {
+			n.latch.Lock()
+			latched = append(latched, n)
+			children = append(children, n.load().children...)
+		}
+		level = children
+	}
+
+	value, ok := bpt.Get(uint32Key(500))
+	assert.True(t, ok)
+	assert.Equal(t, uint32Key(500), value)
+
+	count := 0
+	bpt.Scan(uint32Key(100), uint32Key(200), ScanOptions{}, func(key, value []byte) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 100, count)
+
+	it := bpt.Iterator()
+	it.SeekToLast()
+	key, _ := it.Prev()
+	assert.Equal(t, uint32Key(999), key)
+
+	for _, n := range latched {
+		n.latch.Unlock()
+	}
+}
+
+func TestBLinkBulkOperations(t *testing.T) {
+	keys, values := sortedPairs(1000)
+	bpt, err := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(5), SetConcurrency(BLink))
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, bpt.Size())
+
+	assert.Equal(t, 500, bpt.DeleteRange(uint32Key(250), uint32Key(750), ScanOptions{}))
+	assert.Equal(t, 500, bpt.Size())
+	_, ok := bpt.Get(uint32Key(500))
+	assert.False(t, ok)
+	assert.NoError(t, bpt.Validate())
+
+	bpt, _ = NewBPlusTree(SetConcurrency(BLink))
+	for _, key := range []string{"a", "ab", "abc", "b"} {
+		bpt.Put([]byte(key), []byte(key))
+	}
+	removed, err := bpt.DeletePrefix([]byte("ab"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 2, bpt.Size())
+
+	err = bpt.BulkLoad(NewSliceSource(keys, values))
+	assert.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestBLinkReadersFollowRightLinksAcrossSplits(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetOrder(4), SetConcurrency(BLink))
+	blink := bpt.engine.(*blinkTree)
+	for k := 0; k < 1000; k += 100 {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+
+	// a reader has reached the leaf of 500 and an iterator stands on 500
+	// when writers split that leaf many times over
+	stale, _, _ := blink.findLeaf(uint32Key(500), nil)
+	it := bpt.Iterator()
+	it.Seek(uint32Key(500))
+	for k := 501; k < 600; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+	assert.NotNil(t, stale.load().right)
+	assert.False(t, blink.covers(stale.load(), uint32Key(599)))
+
+	// the keys moved out of the leaf are found by chasing its right links
+	for k := 500; k < 600; k++ {
+		_, c := blink.moveRight(stale, uint32Key(k))
+		_, found := blink.search(c, uint32Key(k))
+		assert.True(t, found)
+	}
+
+	for k := 500; k < 600; k++ {
+		key, _ := it.Next()
+		assert.Equal(t, uint32Key(k), key)
+	}
+	key, _ := it.Next()
+	assert.Equal(t, uint32Key(600), key)
+	assert.NoError(t, bpt.Validate())
+}
@@ -3,6 +3,7 @@ package bptree
 import (
 	"bytes"
 	"errors"
+	"sync"
 )
 
 const (
@@ -22,6 +23,19 @@ func SetOrder(order int) Option {
 	}
 }
 
+// SetComparator sets the function used to order the keys, it must return
+// a negative number, zero or a positive number when a is less than, equal
+// to or greater than b. Keys are ordered by bytes.Compare by default.
+func SetComparator(compare func(a, b []byte) int) Option {
+	return func(bpt *BPlusTree) error {
+		if compare == nil {
+			return errors.New("comparator can't be nil")
+		}
+		bpt.compare = compare
+		return nil
+	}
+}
+
 type BPlusTree struct {
 	// root of the b plus tree
 	root *node
@@ -38,26 +52,75 @@ type BPlusTree struct {
 
 	// the min of number of keys allowed
 	minKeyNum int
+
+	// compare orders the keys of the tree
+	compare func(a, b []byte) int
+
+	// how full the nodes built by bulk loading are
+	fillFactor float64
+
+	// whether keys and values are copied on put and on get
+	copyMode CopyMode
+
+	// how the tree is synchronized between goroutines
+	concurrency Concurrency
+
+	// under LatchCrabbing, the operations on a single path hold treeLatch
+	// shared and the ones working on the whole tree hold it exclusively,
+	// rootLatch guards root and mostLeftNode and sizeLatch guards size.
+	// Under GlobalLock, readers hold treeLatch shared and writers exclusively.
+	treeLatch sync.RWMutex
+	rootLatch sync.RWMutex
+	sizeLatch sync.Mutex
+
+	// bumped whenever treeLatch is held exclusively, so iterators
+	// know that their leaf may have been detached
+	generation int
+
+	// stores the pairs of kv instead of root in BLink,
+	// OptimisticLockCoupling and CopyOnWrite modes, and in page files
+	engine engine
+
+	// the page file set by SetPageFile, the size of its pages, and
+	// the number of frames and the eviction policy of its buffer pool
+	pageFile       string
+	pageSize       int
+	bufferPoolSize int
+	evictionPolicy EvictionPolicy
 }
 
 // NewBPlusTree generates a new b plus tree by the given options
 func NewBPlusTree(options ...Option) (*BPlusTree, error) {
-	bpt := &BPlusTree{order: defaultOrder}
+	bpt := &BPlusTree{
+		order:      defaultOrder,
+		compare:    bytes.Compare,
+		fillFactor: defaultFillFactor,
+		copyMode:   defaultCopyMode,
+	}
 	for _, opt := range options {
 		if err := opt(bpt); err != nil {
 			return nil, err
 		}
 	}
 	bpt.minKeyNum = ceil(bpt.order, 2) - 1
+	if bpt.pageFile == "" {
+		bpt.engine = newEngine(bpt)
+		return bpt, nil
+	}
+	paged, err := openPagedTree(bpt)
+	if err != nil {
+		return nil, err
+	}
+	bpt.engine = paged
 	return bpt, nil
 }
 
 // Init inits a bpt whose root is nil
 func (bpt *BPlusTree) init(key, value []byte) {
 	keys := make([][]byte, bpt.order-1)
-	keys[0] = copyBytes(key)
+	keys[0] = bpt.copyOnPut(key)
 	pointers := make([]*pointer, bpt.order)
-	pointers[0] = &pointer{data: value}
+	pointers[0] = &pointer{data: bpt.copyOnPut(value)}
 	bpt.root = &node{
 		leaf:     true,
 		parent:   nil,
@@ -66,23 +129,30 @@ func (bpt *BPlusTree) init(key, value []byte) {
 		pointers: pointers,
 	}
 	bpt.mostLeftNode = bpt.root
-	bpt.size++
+	bpt.addSize(1)
 }
 
 // Get returns the value and true if the given key exists,
 // otherwise nil and false
 func (bpt *BPlusTree) Get(key []byte) ([]byte, bool) {
-	if bpt.root == nil {
+	if key == nil {
 		return nil, false
 	}
-	if key == nil {
+	if bpt.engine != nil {
+		value, ok := bpt.engine.get(key)
+		return bpt.copyOnGet(value), ok
+	}
+	if bpt.latched() {
+		return bpt.getLatched(key)
+	}
+	bpt.rlockTree()
+	defer bpt.runlockTree()
+	if bpt.root == nil {
 		return nil, false
 	}
 	targetLeaf := bpt.findLeafByKey(key)
-	for i := 0; i < targetLeaf.keyNums; i++ {
-		if bytes.Compare(key, targetLeaf.keys[i]) == 0 {
-			return targetLeaf.pointers[i].convertToValue(), true
-		}
+	if position, found := targetLeaf.search(key, bpt.compare); found {
+		return bpt.copyOnGet(targetLeaf.pointers[position].convertToValue()), true
 	}
 	return nil, false
 }
@@ -91,14 +161,8 @@ func (bpt *BPlusTree) Get(key []byte) ([]byte, bool) {
 func (bpt *BPlusTree) findLeafByKey(key []byte) *node {
 	current := bpt.root
 	for !current.leaf {
-		position := 0
 		// find the target leaf node level by level
-		for position < current.keyNums {
-			if bytes.Compare(key, current.keys[position]) < 0 {
-				break
-			}
-			position++
-		}
+		position := current.upperBound(key, bpt.compare)
 		current = current.pointers[position].convertToNode()
 	}
 	return current
@@ -107,13 +171,22 @@ func (bpt *BPlusTree) findLeafByKey(key []byte) *node {
 // Put insert a pair of kv into bpt, if the given key exists,
 // the given value will override its value.
 // Return old value and true if the given key exists, otherwise
-// nil and false.
+// nil and false. The old value is no longer referenced by the tree.
 func (bpt *BPlusTree) Put(key, value []byte) ([]byte, bool) {
-	if bpt.root == nil {
-		bpt.init(key, value)
+	if key == nil {
 		return nil, false
 	}
-	if key == nil {
+	if bpt.engine != nil {
+		return bpt.engine.put(bpt.copyOnPut(key), bpt.copyOnPut(value))
+	}
+	if bpt.latched() {
+		return bpt.putLatched(key, value)
+	}
+	bpt.lockTree()
+	defer bpt.unlockTree()
+	defer bpt.debugValidate()
+	if bpt.root == nil {
+		bpt.init(key, value)
 		return nil, false
 	}
 	targetLeaf := bpt.findLeafByKey(key)
@@ -123,21 +196,16 @@ func (bpt *BPlusTree) Put(key, value []byte) ([]byte, bool) {
 
 // putIntoLeaf puts a pair of kv into the given leaf node
 func (bpt *BPlusTree) putIntoLeaf(n *node, k, v []byte) ([]byte, bool) {
-	insertPos := 0
-	for insertPos < n.keyNums {
-		cmp := bytes.Compare(k, n.keys[insertPos])
-		if cmp == 0 {
-			// found the exact match
-			oldValue := n.pointers[insertPos].overrideValue(v)
-
-			return oldValue, true
-		} else if cmp < 0 {
-			// found the insert position,
-			// can break the loop
-			break
-		}
-		insertPos++
+	insertPos, found := n.search(k, bpt.compare)
+	if found {
+		// found the exact match
+		oldValue := n.pointers[insertPos].overrideValue(bpt.copyOnPut(v))
+
+		return oldValue, true
 	}
+	k, v = bpt.copyOnPut(k), bpt.copyOnPut(v)
+	// the splits below recount the nodes they create from their children
+	bpt.addCounts(n, 1)
 
 	// if we did not find the same key, we continue to insert
 	if n.keyNums < len(n.keys) {
@@ -179,23 +247,14 @@ func (bpt *BPlusTree) putIntoLeaf(n *node, k, v []byte) ([]byte, bool) {
 			parent = parent.parent
 		}
 	}
-	bpt.size++
+	bpt.addSize(1)
 	return nil, false
 }
 
 // putIntoParent puts the node into the parent and update the left and the right
 // pointers.
 func (bpt *BPlusTree) putIntoParent(parent *node, k []byte, l, r *node) {
-	insertPos := 0
-	for insertPos < parent.keyNums {
-		if bytes.Compare(k, parent.keys[insertPos]) < 0 {
-			// found the insert position,
-			// can break the loop
-			break
-		}
-
-		insertPos++
-	}
+	insertPos := parent.upperBound(k, bpt.compare)
 
 	// shift the keys and pointers
 	parent.pointers[parent.keyNums+1] = parent.pointers[parent.keyNums]
@@ -233,6 +292,7 @@ func (bpt *BPlusTree) putIntoNewRoot(key []byte, l, r *node) {
 
 	l.parent = newRoot
 	r.parent = newRoot
+	bpt.recount(newRoot)
 
 	bpt.root = newRoot
 }
@@ -240,16 +300,7 @@ func (bpt *BPlusTree) putIntoNewRoot(key []byte, l, r *node) {
 // putIntoParentAndSplit puts key in the parent, splits the node and returns the splitten
 // nodes with all fixed pointers.
 func (bpt *BPlusTree) putIntoParentAndSplit(parent *node, k []byte, l, r *node) ([]byte, *node, *node) {
-	insertPos := 0
-	for insertPos < parent.keyNums {
-		if bytes.Compare(k, parent.keys[insertPos]) < 0 {
-			// found the insert position,
-			// can break the loop
-			break
-		}
-
-		insertPos++
-	}
+	insertPos := parent.upperBound(k, bpt.compare)
 
 	right := &node{
 		leaf:     false,
@@ -324,6 +375,8 @@ func (bpt *BPlusTree) putIntoParentAndSplit(parent *node, k []byte, l, r *node)
 			p.convertToNode().parent = right
 		}
 	}
+	bpt.recount(left)
+	bpt.recount(right)
 
 	return middleKey, left, right
 }
@@ -356,6 +409,7 @@ func (bpt *BPlusTree) putIntoLeafAndSplit(n *node, insertPos int, k, v []byte) (
 	if err := right.setLastPointer(n.pointerToNextLeafNode()); err != nil {
 		panic(err)
 	}
+	right.setPreviousLeafNode(n)
 	right.keyNums = len(right.keys) - copyFrom
 
 	// the given node becomes the left node
@@ -381,15 +435,31 @@ func (bpt *BPlusTree) putIntoLeafAndSplit(n *node, insertPos int, k, v []byte) (
 	// insert into the node
 	insertNode.insertAt(insertPos, insertPos, k, &pointer{v})
 
+	// the right node is reachable by the previous link of the next leaf
+	// without latching the left node, so it's linked once it's complete
+	if next := right.nextLeafNode(); next != nil {
+		next.setPreviousLeafNode(right)
+	}
+
 	return left, right
 }
 
 // Delete deletes the key from the tree. Returns deleted value and true
-// if the key exists, otherwise nil and false.
+// if the key exists, otherwise nil and false. The deleted value is no
+// longer referenced by the tree.
 func (bpt *BPlusTree) Delete(key []byte) ([]byte, bool) {
+	if bpt.engine != nil {
+		return bpt.engine.delete(key)
+	}
+	if bpt.latched() {
+		return bpt.deleteLatched(key)
+	}
+	bpt.lockTree()
+	defer bpt.unlockTree()
 	if bpt.root == nil {
 		return nil, false
 	}
+	defer bpt.debugValidate()
 
 	leaf := bpt.findLeafByKey(key)
 
@@ -398,32 +468,37 @@ func (bpt *BPlusTree) Delete(key []byte) ([]byte, bool) {
 		return nil, false
 	}
 
-	bpt.size--
+	bpt.addSize(-1)
 
 	return value, true
 }
 
 // deleteAtLeafAndRebalance deletes the key from the given node and rebalances it.
 func (bpt *BPlusTree) deleteAtLeafAndRebalance(n *node, key []byte) ([]byte, bool) {
-	keyPos := n.keyPosition(key)
+	keyPos := n.keyPosition(key, bpt.compare)
 	if keyPos == -1 {
 		return nil, false
 	}
 
 	value := n.pointers[keyPos].convertToValue()
 	n.deleteAt(keyPos, keyPos)
+	bpt.addCounts(n, -1)
 
-	if n.parent == nil {
-		// deletion from the root
-		if n.keyNums == 0 {
-			// remove the root
-			bpt.root = nil
-		}
+	// the parent is only looked at when the node underflows,
+	// since it isn't latched otherwise
+	if n.keyNums < bpt.minKeyNum {
+		if n.parent == nil {
+			// deletion from the root
+			if n.keyNums == 0 {
+				// remove the root
+				bpt.root = nil
+				bpt.mostLeftNode = nil
+				n.dead = true
+			}
 
-		return value, true
-	}
+			return value, true
+		}
 
-	if n.keyNums < bpt.minKeyNum {
 		bpt.rebalancedFromLeafNode(n)
 	}
 
@@ -433,26 +508,22 @@ func (bpt *BPlusTree) deleteAtLeafAndRebalance(n *node, key []byte) ([]byte, boo
 }
 
 // removeFromIndex searches the key in the index (internal nodes and if finds it changes to
-// the leftmost key in the right subtree.
+// the leftmost key in the right subtree. The separators stay valid bounds
+// without it, so latched trees skip it rather than latching the whole path.
 func (bpt *BPlusTree) removeFromIndex(key []byte) {
+	if bpt.latched() {
+		return
+	}
 	current := bpt.root
 	for !current.leaf {
 		// until the leaf is reached
 
-		position := 0
-		for position < current.keyNums {
-			cmp := bytes.Compare(key, current.keys[position])
-			if cmp < 0 {
-				break
-			} else if cmp > 0 {
-				position += 1
-			} else if cmp == 0 {
-				// the key is found in the index
-				// take the right sub-tree and find the leftmost key
-				// and update the key
-				//current.keys[position] = current.pointers[position+1].convertToNode().findMostLeftKey()
-				current.keys[position] = findLeftMostKey(current.pointers[position+1].convertToNode())
-			}
+		position, found := current.search(key, bpt.compare)
+		if found {
+			// the key is found in the index
+			// take the right sub-tree and find the leftmost key
+			// and update the key
+			current.keys[position] = findLeftMostKey(current.pointers[position+1].convertToNode())
 		}
 
 		current = current.pointers[position].convertToNode()
@@ -462,60 +533,9 @@ func (bpt *BPlusTree) removeFromIndex(key []byte) {
 // rebalancedFromLeafNode starts rebalancing the tree from the leaf node.
 func (bpt *BPlusTree) rebalancedFromLeafNode(n *node) {
 	parent := n.parent
-
-	pointerPositionInParent := parent.getPointerPositionOfNode(n)
-	keyPositionInParent := pointerPositionInParent - 1
-	if keyPositionInParent < 0 {
-		keyPositionInParent = 0
+	if bpt.borrowOrMerge(n, parent) {
+		bpt.rebalanceParentNode(parent)
 	}
-
-	// trying to borrow for the leaf from any sibling
-
-	// check left sibling
-	leftSiblingPosition := pointerPositionInParent - 1
-	var leftSibling *node
-	if leftSiblingPosition >= 0 {
-		// if left sibling exists
-		leftSibling = parent.pointers[leftSiblingPosition].convertToNode()
-
-		if leftSibling.keyNums > bpt.minKeyNum {
-			// borrow from the left sibling
-			n.insertAt(0, 0, leftSibling.keys[leftSibling.keyNums-1], leftSibling.pointers[leftSibling.keyNums-1])
-			leftSibling.deleteAt(leftSibling.keyNums-1, leftSibling.keyNums-1)
-			parent.keys[keyPositionInParent] = n.keys[0]
-			return
-		}
-	}
-
-	rightSiblingPosition := pointerPositionInParent + 1
-	var rightSibling *node
-	if rightSiblingPosition < parent.keyNums+1 {
-		// if right sibling exists
-		rightSibling = parent.pointers[rightSiblingPosition].convertToNode()
-
-		if rightSibling.keyNums > bpt.minKeyNum {
-			// borrow from the right sibling
-			n.append(rightSibling.keys[0], rightSibling.pointers[0])
-			rightSibling.deleteAt(0, 0)
-			parent.keys[rightSiblingPosition-1] = rightSibling.keys[0]
-			return
-		}
-	}
-
-	// if we could borrow, we would borrow
-	// so, we just take the first available sibling and merge with it
-	// and the remove the navigator key and appropriate pointer
-
-	// merge nodes and remove the "navigator" key and appropriate
-	if leftSibling != nil {
-		leftSibling.copyFromRight(n)
-		parent.deleteAt(keyPositionInParent, pointerPositionInParent)
-	} else if rightSibling != nil {
-		n.copyFromRight(rightSibling)
-		parent.deleteAt(keyPositionInParent, rightSiblingPosition)
-	}
-
-	bpt.rebalanceParentNode(parent)
 }
 
 // rebalanceInternalNode rebalances the tree from the internal node. It expects that
@@ -524,6 +544,7 @@ func (bpt *BPlusTree) rebalanceParentNode(n *node) {
 		if n.keyNums == 0 {
 			bpt.root = n.pointers[0].convertToNode()
 			bpt.root.parent = nil
+			n.dead = true
 		}
 
 		return
@@ -535,14 +556,18 @@ func (bpt *BPlusTree) rebalanceParentNode(n *node) {
 	}
 
 	parent := n.parent
-
-	pointerPositionInParent := n.parent.getPointerPositionOfNode(n)
-	keyPositionInParent := pointerPositionInParent - 1
-	if keyPositionInParent < 0 {
-		keyPositionInParent = 0
+	if bpt.borrowOrMerge(n, parent) {
+		bpt.rebalanceParentNode(parent)
 	}
+}
+
+// borrowOrMerge lets the underflowing node borrow an entry from a sibling,
+// or merges it with a sibling if none can lend one. It returns true if the
+// nodes were merged, so the parent has lost an entry.
+func (bpt *BPlusTree) borrowOrMerge(n, parent *node) bool {
+	pointerPositionInParent := parent.getPointerPositionOfNode(n)
 
-	// trying to borrow for the internal node from any sibling
+	// trying to borrow for the node from any sibling
 
 	// check left sibling
 	leftSiblingPosition := pointerPositionInParent - 1
@@ -550,18 +575,12 @@ func (bpt *BPlusTree) rebalanceParentNode(n *node) {
 	if leftSiblingPosition >= 0 {
 		// if left sibling exists
 		leftSibling = parent.pointers[leftSiblingPosition].convertToNode()
+		bpt.lockSibling(leftSibling)
+		defer bpt.unlockSibling(leftSibling)
 
 		if leftSibling.keyNums > bpt.minKeyNum {
-			splitKey := parent.keys[keyPositionInParent]
-
-			// borrow from the left sibling
-			leftSibling.pointers[leftSibling.keyNums].convertToNode().parent = n
-			n.insertAt(0, 0, splitKey, leftSibling.pointers[leftSibling.keyNums])
-
-			parent.keys[keyPositionInParent] = leftSibling.keys[leftSibling.keyNums-1]
-			leftSibling.deleteAt(leftSibling.keyNums-1, leftSibling.keyNums)
-
-			return
+			bpt.borrowFromLeft(n, leftSibling, pointerPositionInParent)
+			return false
 		}
 	}
 
@@ -570,43 +589,92 @@ func (bpt *BPlusTree) rebalanceParentNode(n *node) {
 	if rightSiblingPosition < parent.keyNums+1 {
 		// if right sibling exists
 		rightSibling = parent.pointers[rightSiblingPosition].convertToNode()
+		bpt.lockSibling(rightSibling)
+		defer bpt.unlockSibling(rightSibling)
 
 		if rightSibling.keyNums > bpt.minKeyNum {
-			splitKeyPosition := rightSiblingPosition - 1
-			splitKey := parent.keys[splitKeyPosition]
-
-			// borrow from the right sibling
-			n.append(splitKey, rightSibling.pointers[0])
-
-			parent.keys[splitKeyPosition] = rightSibling.keys[0]
-			rightSibling.deleteAt(0, 0)
-			return
+			bpt.borrowFromRight(n, rightSibling, pointerPositionInParent)
+			return false
 		}
 	}
 
 	// if we could borrow, we would borrow
 	// so, we just take the first available sibling and merge with it
+	// and the remove the navigator key and appropriate pointer
 	if leftSibling != nil {
-		splitKey := parent.keys[keyPositionInParent]
+		bpt.merge(leftSibling, n, pointerPositionInParent)
+	} else if rightSibling != nil {
+		bpt.merge(n, rightSibling, rightSiblingPosition)
+	}
+	return true
+}
 
-		// incorporate the split key from parent for the merging
-		leftSibling.keys[leftSibling.keyNums] = splitKey
-		leftSibling.keyNums++
+// borrowFromLeft moves the last entry of the left sibling into the node,
+// pointerPosition is the position of the node in their parent.
+func (bpt *BPlusTree) borrowFromLeft(n, leftSibling *node, pointerPosition int) {
+	parent := n.parent
+	keyPositionInParent := pointerPosition - 1
 
-		leftSibling.copyFromRight(n)
+	if n.leaf {
+		n.insertAt(0, 0, leftSibling.keys[leftSibling.keyNums-1], leftSibling.pointers[leftSibling.keyNums-1])
+		leftSibling.deleteAt(leftSibling.keyNums-1, leftSibling.keyNums-1)
+		parent.keys[keyPositionInParent] = n.keys[0]
+		return
+	}
 
-		parent.deleteAt(keyPositionInParent, pointerPositionInParent)
-	} else if rightSibling != nil {
-		splitKey := parent.keys[keyPositionInParent]
+	// the split key of the parent moves down and
+	// the last key of the left sibling moves up
+	splitKey := parent.keys[keyPositionInParent]
+	child := leftSibling.pointers[leftSibling.keyNums].convertToNode()
+	child.parent = n
+	bpt.moveCount(child, leftSibling, n)
+	n.insertAt(0, 0, splitKey, leftSibling.pointers[leftSibling.keyNums])
 
-		n.keys[n.keyNums] = splitKey
-		n.keyNums++
+	parent.keys[keyPositionInParent] = leftSibling.keys[leftSibling.keyNums-1]
+	leftSibling.deleteAt(leftSibling.keyNums-1, leftSibling.keyNums)
+}
 
-		n.copyFromRight(rightSibling)
-		parent.deleteAt(keyPositionInParent, rightSiblingPosition)
+// borrowFromRight moves the first entry of the right sibling into the node,
+// pointerPosition is the position of the node in their parent.
+func (bpt *BPlusTree) borrowFromRight(n, rightSibling *node, pointerPosition int) {
+	parent := n.parent
+	splitKeyPosition := pointerPosition
+
+	if n.leaf {
+		n.append(rightSibling.keys[0], rightSibling.pointers[0])
+		rightSibling.deleteAt(0, 0)
+		parent.keys[splitKeyPosition] = rightSibling.keys[0]
+		return
 	}
 
-	bpt.rebalanceParentNode(parent)
+	// the split key of the parent moves down and
+	// the first key of the right sibling moves up
+	bpt.moveCount(rightSibling.pointers[0].convertToNode(), rightSibling, n)
+	n.append(parent.keys[splitKeyPosition], rightSibling.pointers[0])
+
+	parent.keys[splitKeyPosition] = rightSibling.keys[0]
+	rightSibling.deleteAt(0, 0)
+}
+
+// merge moves all the entries of the right node into the left node and
+// removes the "navigator" key and the pointer to the right node from their
+// parent, rightPosition is the position of the right node in the parent.
+func (bpt *BPlusTree) merge(left, right *node, rightPosition int) {
+	parent := left.parent
+	keyPositionInParent := rightPosition - 1
+
+	if !left.leaf {
+		// incorporate the split key from parent for the merging
+		left.keys[left.keyNums] = parent.keys[keyPositionInParent]
+		left.keyNums++
+		if bpt.counted() {
+			left.count += right.count
+		}
+	}
+	left.copyFromRight(right)
+	right.dead = true
+
+	parent.deleteAt(keyPositionInParent, rightPosition)
 }
 
 // ForEach traverses tree in ascending key order.
@@ -619,5 +687,19 @@ func (bpt *BPlusTree) ForEach(action func(key []byte, value []byte)) {
 
 // Size returns the size of the tree.
 func (bpt *BPlusTree) Size() int {
+	if bpt.engine != nil {
+		return bpt.engine.len()
+	}
+	if bpt.latched() {
+		bpt.sizeLatch.Lock()
+		defer bpt.sizeLatch.Unlock()
+	}
+	bpt.rlockTree()
+	defer bpt.runlockTree()
 	return bpt.size
 }
+
+// Compare compares two keys the way the tree orders them.
+func (bpt *BPlusTree) Compare(a, b []byte) int {
+	return bpt.compare(a, b)
+}
@@ -1,6 +1,7 @@
 package bptree
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
@@ -176,6 +177,43 @@ func TestPutAndGetRandomized(t *testing.T) {
 	}
 }
 
+func TestPutGetAndDeleteLargeOrders(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	size := 20000
+	keys := r.Perm(size)
+
+	for _, order := range []int{16, 64, 256} {
+		bpt, _ := NewBPlusTree(SetOrder(order))
+
+		for i, k := range keys {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(k))
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, uint32(i))
+			bpt.Put(key, value)
+		}
+
+		for i, k := range keys {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(k))
+
+			v, ok := bpt.Get(key)
+			assert.True(t, ok)
+			assert.Equal(t, uint32(i), binary.BigEndian.Uint32(v))
+		}
+
+		for i, k := range keys {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(k))
+
+			v, ok := bpt.Delete(key)
+			assert.True(t, ok)
+			assert.Equal(t, uint32(i), binary.BigEndian.Uint32(v))
+		}
+		assert.Equal(t, 0, bpt.Size())
+	}
+}
+
 func TestPutAndDeleteRandomized(t *testing.T) {
 	r := rand.New(rand.NewSource(time.Now().Unix()))
 	size := 10000
@@ -301,3 +339,55 @@ func TestNonExistentPointerPositionOf(t *testing.T) {
 	actual := bpt.root.getPointerPositionOfNode(bpt.root)
 	assert.Equal(t, -1, actual)
 }
+
+func TestReverseComparator(t *testing.T) {
+	reverse := func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}
+	for order := 3; order <= 7; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order), SetComparator(reverse))
+		for _, testData := range testDatas {
+			bpt.Put(testData.key, testData.value)
+		}
+
+		actual := make([][]byte, 0)
+		bpt.ForEach(func(key []byte, value []byte) {
+			actual = append(actual, key)
+		})
+		isSorted := sort.SliceIsSorted(actual, func(i, j int) bool {
+			return string(actual[i]) > string(actual[j])
+		})
+		assert.True(t, isSorted)
+		assert.Equal(t, len(testDatas), len(actual))
+
+		for _, testData := range testDatas {
+			value, deleted := bpt.Delete(testData.key)
+			assert.True(t, deleted)
+			assert.Equal(t, testData.value, value)
+		}
+		assert.Equal(t, 0, bpt.Size())
+	}
+}
+
+func TestCaseInsensitiveComparator(t *testing.T) {
+	caseInsensitive := func(a, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	}
+	bpt, _ := NewBPlusTree(SetComparator(caseInsensitive))
+
+	bpt.Put([]byte("Key"), []byte("1"))
+	oldValue, existed := bpt.Put([]byte("KEY"), []byte("2"))
+	assert.True(t, existed)
+	assert.Equal(t, "1", string(oldValue))
+
+	value, ok := bpt.Get([]byte("key"))
+	assert.True(t, ok)
+	assert.Equal(t, "2", string(value))
+	assert.Equal(t, 1, bpt.Size())
+}
+
+func TestNilComparator(t *testing.T) {
+	bpt, err := NewBPlusTree(SetComparator(nil))
+	assert.Error(t, err)
+	assert.Nil(t, bpt)
+}
@@ -0,0 +1,304 @@
+package bptree
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	defaultBufferPoolSize = 1024
+)
+
+// SetBufferPoolSize sets the number of pages the buffer pool of a tree
+// set by SetPageFile caches, 1024 by default.
+func SetBufferPoolSize(frames int) Option {
+	return func(bpt *BPlusTree) error {
+		if frames < 1 {
+			return errors.New("buffer pool size can't be less than 1")
+		}
+		bpt.bufferPoolSize = frames
+		return nil
+	}
+}
+
+// BufferPoolStats counts the page fetches of the buffer pool of a tree.
+type BufferPoolStats struct {
+	// fetches of a cached page, and of a page read from the file
+	Hits, Misses uint64
+
+	// pages evicted, and the ones among them written back as dirty
+	Evictions, WriteBacks uint64
+}
+
+// HitRate returns the share of the fetches which found their page cached.
+func (s BufferPoolStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// BufferPoolStats returns the counters of the buffer pool of a tree
+// set by SetPageFile, or zeros for trees in memory.
+func (bpt *BPlusTree) BufferPoolStats() BufferPoolStats {
+	t, ok := bpt.engine.(*pagedTree)
+	if !ok {
+		return BufferPoolStats{}
+	}
+	return t.pool.stats()
+}
+
+// bufferPool caches the pages of a page file in a fixed number of frames.
+// A fetched page is pinned in its frame until unpinned, and only unpinned
+// pages are evicted, written back if dirty. Fetching waits while every
+// frame is pinned. Pages are read and written back without holding the
+// pool, their frame is busy meanwhile and fetching its page waits. The
+// pages of a goroutine may be modified only while no other goroutine
+// fetches them.
+type bufferPool struct {
+	pager    *pager
+	replacer replacer
+
+	mu sync.Mutex
+
+	// signaled whenever a frame is unpinned or done with its I/O
+	released *sync.Cond
+
+	// the content, the page, the pin count, whether it is dirty and
+	// whether its page is being read or written back of every frame,
+	// and the frame of every cached page
+	frames [][]byte
+	pages  []pageID
+	pins   []int
+	dirty  []bool
+	busy   []bool
+	table  map[pageID]int
+
+	// frames holding no page
+	free []int
+
+	counters BufferPoolStats
+}
+
+func newBufferPool(p *pager, frames int, policy EvictionPolicy) *bufferPool {
+	bp := &bufferPool{
+		pager:    p,
+		replacer: newReplacer(policy, frames),
+		frames:   make([][]byte, frames),
+		pages:    make([]pageID, frames),
+		pins:     make([]int, frames),
+		dirty:    make([]bool, frames),
+		busy:     make([]bool, frames),
+		table:    make(map[pageID]int, frames),
+		free:     make([]int, frames),
+	}
+	bp.released = sync.NewCond(&bp.mu)
+	buf := make([]byte, frames*p.pageSize)
+	for f := range bp.frames {
+		bp.frames[f] = buf[f*p.pageSize : (f+1)*p.pageSize : (f+1)*p.pageSize]
+		bp.free[f] = frames - 1 - f
+	}
+	return bp
+}
+
+// fetch returns the page pinned in its frame, reading it from the file
+// unless it is cached.
+func (bp *bufferPool) fetch(id pageID) ([]byte, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for {
+		if f, ok := bp.table[id]; ok {
+			if bp.busy[f] {
+				bp.released.Wait()
+				continue
+			}
+			bp.counters.Hits++
+			bp.pins[f]++
+			bp.replacer.pin(f, id)
+			return bp.frames[f], nil
+		}
+		f, ok, err := bp.take()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// another goroutine may cache the page meanwhile
+			bp.released.Wait()
+			continue
+		}
+		if _, ok := bp.table[id]; ok {
+			// another goroutine cached the page while a page was written back
+			bp.free = append(bp.free, f)
+			continue
+		}
+
+		bp.install(f, id, false)
+		bp.busy[f] = true
+		bp.mu.Unlock()
+		err = bp.pager.read(id, bp.frames[f])
+		bp.mu.Lock()
+		bp.busy[f] = false
+		bp.released.Broadcast()
+		if err != nil {
+			bp.replacer.unpin(f)
+			bp.replacer.remove(f)
+			bp.drop(f)
+			return nil, err
+		}
+		bp.counters.Misses++
+		return bp.frames[f], nil
+	}
+}
+
+// create caches a new page of the file, zeroed, dirty and unpinned. A frame
+// still caching the page is reused, there must be one frame per page.
+func (bp *bufferPool) create(id pageID) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for {
+		if f, ok := bp.table[id]; ok {
+			if bp.busy[f] {
+				bp.released.Wait()
+				continue
+			}
+			bp.zero(f)
+			bp.dirty[f] = true
+			return nil
+		}
+		f, ok, err := bp.take()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			bp.released.Wait()
+			continue
+		}
+		if _, ok := bp.table[id]; ok {
+			// another goroutine cached the page while a page was written back
+			bp.free = append(bp.free, f)
+			continue
+		}
+		bp.zero(f)
+		bp.install(f, id, true)
+		bp.release(f)
+		return nil
+	}
+}
+
+func (bp *bufferPool) zero(f int) {
+	for i := range bp.frames[f] {
+		bp.frames[f][i] = 0
+	}
+}
+
+// take returns a frame holding no page, evicting one if needed, or false
+// if every frame is pinned. A dirty page is written back without holding
+// the pool, so anything may have changed once it returns.
+func (bp *bufferPool) take() (int, bool, error) {
+	if len(bp.free) > 0 {
+		f := bp.free[len(bp.free)-1]
+		bp.free = bp.free[:len(bp.free)-1]
+		return f, true, nil
+	}
+	f, ok := bp.replacer.victim()
+	if !ok {
+		return 0, false, nil
+	}
+	if bp.dirty[f] {
+		bp.busy[f] = true
+		bp.mu.Unlock()
+		err := bp.pager.write(bp.pages[f], bp.frames[f])
+		bp.mu.Lock()
+		bp.busy[f] = false
+		bp.released.Broadcast()
+		if err != nil {
+			// the page stays cached, to be written back later
+			bp.replacer.pin(f, bp.pages[f])
+			bp.replacer.unpin(f)
+			return 0, false, err
+		}
+		bp.counters.WriteBacks++
+	}
+	bp.counters.Evictions++
+	delete(bp.table, bp.pages[f])
+	bp.pages[f], bp.dirty[f] = 0, false
+	return f, true, nil
+}
+
+// install caches the page in the free frame, pinned once
+func (bp *bufferPool) install(f int, id pageID, dirty bool) {
+	bp.table[id] = f
+	bp.pages[f], bp.pins[f], bp.dirty[f] = id, 1, dirty
+	bp.replacer.pin(f, id)
+}
+
+// drop frees the frame of the page, which the replacer forgot
+func (bp *bufferPool) drop(f int) {
+	delete(bp.table, bp.pages[f])
+	bp.pages[f], bp.pins[f], bp.dirty[f] = 0, 0, false
+	bp.free = append(bp.free, f)
+	bp.released.Broadcast()
+}
+
+// unpin unpins the page fetched, dirty if it was modified
+func (bp *bufferPool) unpin(id pageID, dirty bool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	f := bp.table[id]
+	if dirty {
+		bp.dirty[f] = true
+	}
+	bp.release(f)
+}
+
+func (bp *bufferPool) release(f int) {
+	bp.pins[f]--
+	if bp.pins[f] == 0 {
+		bp.replacer.unpin(f)
+		bp.released.Broadcast()
+	}
+}
+
+// discard drops the unpinned page, which is freed, without writing it back
+func (bp *bufferPool) discard(id pageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for {
+		f, ok := bp.table[id]
+		if !ok {
+			return
+		}
+		if bp.busy[f] {
+			bp.released.Wait()
+			continue
+		}
+		bp.replacer.remove(f)
+		bp.drop(f)
+		return
+	}
+}
+
+// flush writes back every dirty page, which stay cached
+func (bp *bufferPool) flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for f := range bp.frames {
+		for bp.busy[f] {
+			bp.released.Wait()
+		}
+		if !bp.dirty[f] {
+			continue
+		}
+		if err := bp.pager.write(bp.pages[f], bp.frames[f]); err != nil {
+			return err
+		}
+		bp.dirty[f] = false
+	}
+	return nil
+}
+
+func (bp *bufferPool) stats() BufferPoolStats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.counters
+}
@@ -0,0 +1,196 @@
+package bptree
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPool returns a buffer pool of the frames over a new page file
+// holding the given number of pages besides the root.
+func testPool(t *testing.T, frames int, policy EvictionPolicy, pages int) *bufferPool {
+	p, err := openPager(filepath.Join(t.TempDir(), "pool.pages"), minPageSize)
+	assert.NoError(t, err)
+	t.Cleanup(func() { p.close() })
+	page := make([]byte, p.pageSize)
+	for i := 0; i < pages; i++ {
+		id, _ := p.allocate()
+		assert.NoError(t, p.write(id, page))
+	}
+	return newBufferPool(p, frames, policy)
+}
+
+func TestBufferPoolWritesBackDirtyPages(t *testing.T) {
+	bp := testPool(t, 2, LRU, 4)
+	for id := pageID(2); id <= 5; id++ {
+		page, err := bp.fetch(id)
+		assert.NoError(t, err)
+		page[0] = byte(id)
+		bp.unpin(id, id%2 == 0)
+	}
+	assert.Equal(t, BufferPoolStats{Misses: 4, Evictions: 2, WriteBacks: 1}, bp.stats())
+
+	// only the dirty pages reached the file
+	assert.NoError(t, bp.flush())
+	page := make([]byte, minPageSize)
+	for id := pageID(2); id <= 5; id++ {
+		bp.pager.read(id, page)
+		if id%2 == 0 {
+			assert.Equal(t, byte(id), page[0])
+		} else {
+			assert.Equal(t, byte(0), page[0])
+		}
+	}
+
+	page, _ = bp.fetch(4)
+	assert.Equal(t, byte(4), page[0])
+	bp.unpin(4, false)
+	assert.Equal(t, uint64(1), bp.stats().Hits)
+	assert.Equal(t, 0.2, bp.stats().HitRate())
+}
+
+func TestBufferPoolWaitsForAFrame(t *testing.T) {
+	bp := testPool(t, 1, LRU, 2)
+	bp.fetch(2)
+
+	fetched := make(chan []byte)
+	go func() {
+		page, _ := bp.fetch(3)
+		fetched <- page
+	}()
+	select {
+	case <-fetched:
+		t.Fatal("fetched a page while every frame is pinned")
+	case <-time.After(10 * time.Millisecond):
+	}
+	bp.unpin(2, false)
+	assert.NotNil(t, <-fetched)
+	assert.Equal(t, uint64(1), bp.stats().Evictions)
+}
+
+// gatedFile holds back the reads at an offset until the gate is closed
+type gatedFile struct {
+	pagerFile
+	offset        int64
+	reading, gate chan struct{}
+}
+
+func (f *gatedFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset == f.offset {
+		f.reading <- struct{}{}
+		<-f.gate
+	}
+	return f.pagerFile.ReadAt(p, offset)
+}
+
+func TestBufferPoolReadsWithoutHoldingThePool(t *testing.T) {
+	bp := testPool(t, 2, LRU, 3)
+	file := &gatedFile{pagerFile: bp.pager.file, offset: 3 * minPageSize, reading: make(chan struct{}), gate: make(chan struct{})}
+	bp.pager.file = file
+	page, _ := bp.fetch(2)
+	page[0] = 2
+	bp.unpin(2, true)
+
+	fetched := make(chan []byte)
+	for i := 0; i < 2; i++ {
+		go func() {
+			page, _ := bp.fetch(3)
+			fetched <- page
+		}()
+	}
+	<-file.reading
+
+	// other pages are fetched and written back while page 3 is read,
+	// and the second fetch of page 3 waits for the first one
+	page, _ = bp.fetch(4)
+	bp.unpin(4, false)
+	assert.Equal(t, uint64(1), bp.stats().WriteBacks)
+	select {
+	case <-fetched:
+		t.Fatal("fetched a page being read")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(file.gate)
+	assert.Equal(t, <-fetched, <-fetched)
+	assert.Equal(t, BufferPoolStats{Hits: 1, Misses: 3, Evictions: 1, WriteBacks: 1}, bp.stats())
+}
+
+func TestBufferPoolDiscard(t *testing.T) {
+	bp := testPool(t, 2, LRU, 2)
+	page, _ := bp.fetch(2)
+	page[0] = 1
+	bp.unpin(2, true)
+	bp.discard(2)
+	assert.NoError(t, bp.flush())
+
+	// the dirty page was dropped, not written
+	page, _ = bp.fetch(2)
+	assert.Equal(t, byte(0), page[0])
+	bp.unpin(2, false)
+	assert.Equal(t, BufferPoolStats{Misses: 2}, bp.stats())
+}
+
+func TestBufferPoolCreateReusesTheFrame(t *testing.T) {
+	bp := testPool(t, 2, LRU, 2)
+	page, _ := bp.fetch(2)
+	page[0] = 1
+	bp.unpin(2, false)
+
+	// the page freed and allocated again keeps a single frame, zeroed
+	assert.NoError(t, bp.create(2))
+	page, _ = bp.fetch(2)
+	assert.Equal(t, byte(0), page[0])
+	page[0] = 2
+	bp.unpin(2, true)
+	bp.fetch(3)
+	bp.unpin(3, false)
+	page, _ = bp.fetch(2)
+	assert.Equal(t, byte(2), page[0])
+	bp.unpin(2, false)
+	assert.Equal(t, BufferPoolStats{Hits: 2, Misses: 2}, bp.stats())
+
+	assert.NoError(t, bp.flush())
+	page = make([]byte, minPageSize)
+	bp.pager.read(2, page)
+	assert.Equal(t, byte(2), page[0])
+}
+
+func TestBufferPoolScanResistance(t *testing.T) {
+	rates := make(map[EvictionPolicy]float64)
+	for _, policy := range []EvictionPolicy{LRU, Clock, LRU2, TwoQueue} {
+		bp := testPool(t, 8, policy, 4+8*100)
+		hot, scanned := []pageID{2, 3, 4, 5}, pageID(6)
+		for round := 0; round < 100; round++ {
+			// four hot pages, then eight pages read once
+			for _, id := range hot {
+				bp.fetch(id)
+				bp.unpin(id, false)
+			}
+			for i := 0; i < 8; i++ {
+				bp.fetch(scanned)
+				bp.unpin(scanned, false)
+				scanned++
+			}
+		}
+		stats := bp.stats()
+		assert.Equal(t, uint64(100*12), stats.Hits+stats.Misses)
+		rates[policy] = stats.HitRate()
+	}
+
+	// the scans flush the hot pages out of LRU, not out of LRU2 and
+	// TwoQueue once they have seen them twice
+	assert.Equal(t, 0.0, rates[LRU])
+	assert.InDelta(t, 4*98/1200.0, rates[LRU2], 0.01)
+	assert.InDelta(t, 4*98/1200.0, rates[TwoQueue], 0.01)
+}
+
+func TestBufferPoolStats(t *testing.T) {
+	assert.Equal(t, 0.0, BufferPoolStats{}.HitRate())
+	bpt, _ := NewBPlusTree()
+	assert.Equal(t, BufferPoolStats{}, bpt.BufferPoolStats())
+
+	_, err := NewBPlusTree(SetBufferPoolSize(0))
+	assert.Error(t, err)
+}
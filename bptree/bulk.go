@@ -0,0 +1,320 @@
+package bptree
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	defaultFillFactor = 1.0
+)
+
+var (
+	// ErrNotSorted is returned when bulk loading keys which are not in
+	// ascending order.
+	ErrNotSorted = errors.New("keys are not in ascending order")
+
+	// ErrDuplicateKey is returned when bulk loading the same key twice.
+	ErrDuplicateKey = errors.New("duplicate key")
+
+	// ErrNotEmpty is returned when bulk loading into a tree that
+	// already stores keys.
+	ErrNotEmpty = errors.New("tree is not empty")
+)
+
+// KVSource is a stream of pairs of kv.
+type KVSource interface {
+	// Next returns the next pair of kv, or io.EOF once the
+	// stream is drained.
+	Next() (key, value []byte, err error)
+}
+
+// sliceSource streams the pairs of kv held by two slices
+type sliceSource struct {
+	keys   [][]byte
+	values [][]byte
+	i      int
+}
+
+// NewSliceSource returns a KVSource streaming keys[i] with values[i].
+func NewSliceSource(keys, values [][]byte) KVSource {
+	return &sliceSource{keys: keys, values: values}
+}
+
+func (s *sliceSource) Next() ([]byte, []byte, error) {
+	if s.i >= len(s.keys) || s.i >= len(s.values) {
+		return nil, nil, io.EOF
+	}
+	s.i++
+	return s.keys[s.i-1], s.values[s.i-1], nil
+}
+
+// SetFillFactor sets how full the nodes built by bulk loading are,
+// 1 packs every node to its capacity.
+func SetFillFactor(fillFactor float64) Option {
+	return func(bpt *BPlusTree) error {
+		if fillFactor <= 0 || fillFactor > 1 {
+			return errors.New("fill factor must be in (0, 1]")
+		}
+		bpt.fillFactor = fillFactor
+		return nil
+	}
+}
+
+// NewBPlusTreeFromSorted generates a new b plus tree by the given options
+// and bulk loads the pairs of kv streamed by src into it.
+func NewBPlusTreeFromSorted(src KVSource, options ...Option) (*BPlusTree, error) {
+	bpt, err := NewBPlusTree(options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := bpt.BulkLoad(src); err != nil {
+		return nil, err
+	}
+	return bpt, nil
+}
+
+// BulkLoad builds the tree bottom-up from the pairs of kv streamed by src,
+// whose keys must be in strictly ascending order. The tree must be empty.
+// Leaves are packed first and the internal levels are built on top of them,
+// so no key pays a root-to-leaf descent or a split. BLink and
+// OptimisticLockCoupling trees never shrink, so they must never have held
+// a key. Nothing is loaded if an error is returned.
+func (bpt *BPlusTree) BulkLoad(src KVSource) error {
+	if bpt.engine != nil {
+		return bpt.engine.bulkLoad(src)
+	}
+	bpt.lockTree()
+	defer bpt.unlockTree()
+	if bpt.root != nil {
+		return ErrNotEmpty
+	}
+
+	leaves, size, err := bpt.buildLeaves(src)
+	if err != nil || size == 0 {
+		return err
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		level = bpt.buildParents(level)
+	}
+
+	bpt.root = level[0]
+	bpt.mostLeftNode = leaves[0]
+	// Size reads it without locking the tree
+	bpt.addSize(size)
+	bpt.debugValidate()
+	return nil
+}
+
+// buildLeaves packs the streamed pairs of kv into linked leaves
+func (bpt *BPlusTree) buildLeaves(src KVSource) ([]*node, int, error) {
+	capacity := bpt.order - 1
+	perLeaf := bpt.nodeFill(capacity, bpt.minKeyNum)
+
+	leaves := make([]*node, 0)
+	var current *node
+	var lastKey []byte
+	size := 0
+	for {
+		key, value, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := bpt.checkAscending(lastKey, key); err != nil {
+			return nil, 0, err
+		}
+		lastKey = key
+
+		if current == nil || current.keyNums == perLeaf {
+			next := bpt.newLeafNode()
+			if current != nil {
+				current.setLastPointer(&pointer{next})
+				next.setPreviousLeafNode(current)
+			}
+			leaves = append(leaves, next)
+			current = next
+		}
+		current.append(bpt.copyOnPut(key), &pointer{bpt.copyOnPut(value)})
+		size++
+	}
+
+	// the last leaf may not be filled enough, so it borrows
+	// from or is merged into its left sibling
+	if len(leaves) > 1 && current.keyNums < bpt.minKeyNum {
+		left := current.previousLeafNode()
+		if left.keyNums+current.keyNums <= capacity {
+			left.copyFromRight(current)
+			leaves = leaves[:len(leaves)-1]
+		} else {
+			for current.keyNums < (left.keyNums+current.keyNums)/2 {
+				current.insertAt(0, 0, left.keys[left.keyNums-1], left.pointers[left.keyNums-1])
+				left.deleteAt(left.keyNums-1, left.keyNums-1)
+			}
+		}
+	}
+
+	return leaves, size, nil
+}
+
+// checkAscending returns an error unless the key may follow the last
+// key of a stream of sorted keys, the last key is nil at the beginning.
+func (bpt *BPlusTree) checkAscending(lastKey, key []byte) error {
+	if key == nil {
+		return errors.New("key can't be nil")
+	}
+	if lastKey != nil {
+		cmp := bpt.compare(lastKey, key)
+		if cmp == 0 {
+			return ErrDuplicateKey
+		}
+		if cmp > 0 {
+			return ErrNotSorted
+		}
+	}
+	return nil
+}
+
+// buildParents builds the level of internal nodes on top of the given nodes
+func (bpt *BPlusTree) buildParents(children []*node) []*node {
+	sizes := bpt.parentSizes(len(children))
+	parents := make([]*node, 0, len(sizes))
+	for _, size := range sizes {
+		parent := &node{
+			leaf:     false,
+			keys:     make([][]byte, bpt.order-1),
+			pointers: make([]*pointer, bpt.order),
+		}
+		parent.pointers[0] = &pointer{children[0]}
+		children[0].parent = parent
+		for _, child := range children[1:size] {
+			parent.append(findLeftMostKey(child), &pointer{child})
+		}
+		bpt.recount(parent)
+		children = children[size:]
+		parents = append(parents, parent)
+	}
+	return parents
+}
+
+// parentSizes returns the number of children of each parent
+// built on top of a level of the given number of nodes.
+func (bpt *BPlusTree) parentSizes(children int) []int {
+	perNode := bpt.nodeFill(bpt.order, bpt.minKeyNum+1)
+	sizes := make([]int, 0, children/perNode+1)
+	for i := 0; i+perNode <= children; i += perNode {
+		sizes = append(sizes, perNode)
+	}
+	if remainder := children % perNode; remainder > 0 {
+		if len(sizes) == 0 || remainder >= bpt.minKeyNum+1 {
+			sizes = append(sizes, remainder)
+		} else if last := len(sizes) - 1; perNode+remainder <= bpt.order {
+			sizes[last] += remainder
+		} else {
+			sizes[last] = (perNode + remainder) / 2
+			sizes = append(sizes, perNode+remainder-sizes[last])
+		}
+	}
+	return sizes
+}
+
+// bulkRun is the pairs of kv of a leaf of an engine being bulk loaded
+type bulkRun struct {
+	keys, values [][]byte
+}
+
+// packRuns packs the streamed pairs of kv into runs filled like the leaves
+// built by buildLeaves, for the engines to build their own leaves from.
+func (bpt *BPlusTree) packRuns(src KVSource) ([]bulkRun, int, error) {
+	capacity := bpt.order - 1
+	perLeaf := bpt.nodeFill(capacity, bpt.minKeyNum)
+
+	var runs []bulkRun
+	var lastKey []byte
+	size := 0
+	for {
+		key, value, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := bpt.checkAscending(lastKey, key); err != nil {
+			return nil, 0, err
+		}
+		lastKey = key
+
+		if len(runs) == 0 || len(runs[len(runs)-1].keys) == perLeaf {
+			runs = append(runs, bulkRun{keys: make([][]byte, 0, perLeaf), values: make([][]byte, 0, perLeaf)})
+		}
+		run := &runs[len(runs)-1]
+		run.keys = append(run.keys, bpt.copyOnPut(key))
+		run.values = append(run.values, bpt.copyOnPut(value))
+		size++
+	}
+
+	// the last run may not be filled enough, so it borrows
+	// from or is merged into the run before it
+	if last := len(runs) - 1; last > 0 && len(runs[last].keys) < bpt.minKeyNum {
+		left, right := runs[last-1], runs[last]
+		keys, values := concatenated(left.keys, right.keys), concatenated(left.values, right.values)
+		if len(keys) <= capacity {
+			runs[last-1] = bulkRun{keys: keys, values: values}
+			runs = runs[:last]
+		} else {
+			middle := len(keys) - len(keys)/2
+			runs[last-1] = bulkRun{keys: keys[:middle:middle], values: values[:middle:middle]}
+			runs[last] = bulkRun{keys: keys[middle:], values: values[middle:]}
+		}
+	}
+	return runs, size, nil
+}
+
+// buildLevels builds the internal levels of an engine on top of its leaves
+// like buildParents and returns the root. The first key of the subtree of
+// every node is given, and internal returns the node of the separators
+// and the children.
+func buildLevels[N any](bpt *BPlusTree, level []N, firstKeys [][]byte, internal func(keys [][]byte, children []N) N) N {
+	for len(level) > 1 {
+		sizes := bpt.parentSizes(len(level))
+		parents, parentKeys := make([]N, 0, len(sizes)), make([][]byte, 0, len(sizes))
+		for _, size := range sizes {
+			parents = append(parents, internal(firstKeys[1:size:size], level[:size:size]))
+			parentKeys = append(parentKeys, firstKeys[0])
+			level, firstKeys = level[size:], firstKeys[size:]
+		}
+		level, firstKeys = parents, parentKeys
+	}
+	return level[0]
+}
+
+// nodeFill returns the number of entries a node built by bulk loading
+// holds according to the fill factor.
+func (bpt *BPlusTree) nodeFill(capacity, min int) int {
+	fill := int(math.Round(bpt.fillFactor * float64(capacity)))
+	if fill < min {
+		fill = min
+	}
+	if fill < 1 {
+		fill = 1
+	}
+	if fill > capacity {
+		fill = capacity
+	}
+	return fill
+}
+
+// newLeafNode creates an empty leaf node
+func (bpt *BPlusTree) newLeafNode() *node {
+	return &node{
+		leaf:     true,
+		keys:     make([][]byte, bpt.order-1),
+		pointers: make([]*pointer, bpt.order),
+	}
+}
@@ -0,0 +1,256 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sortedPairs(size int) ([][]byte, [][]byte) {
+	keys := make([][]byte, size)
+	values := make([][]byte, size)
+	for i := 0; i < size; i++ {
+		keys[i] = make([]byte, 4)
+		binary.BigEndian.PutUint32(keys[i], uint32(i))
+		values[i] = make([]byte, 4)
+		binary.LittleEndian.PutUint32(values[i], uint32(i))
+	}
+	return keys, values
+}
+
+func TestBulkLoad(t *testing.T) {
+	for order := 3; order <= 7; order++ {
+		for _, fillFactor := range []float64{0.1, 0.5, 0.7, 1} {
+			for _, size := range []int{0, 1, 2, 3, 7, 10, 99, 1000} {
+				keys, values := sortedPairs(size)
+				bpt, err := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(order), SetFillFactor(fillFactor))
+				assert.NoError(t, err)
+				assert.Equal(t, size, bpt.Size())
+
+				for i, key := range keys {
+					value, ok := bpt.Get(key)
+					assert.True(t, ok)
+					assert.Equal(t, values[i], value)
+				}
+
+				i := 0
+				for it := bpt.Iterator(); it.Valid(); i++ {
+					key, _ := it.Next()
+					assert.Equal(t, keys[i], key)
+				}
+				assert.Equal(t, size, i)
+
+				it := bpt.Iterator()
+				for it.SeekToLast(); it.Valid(); {
+					i--
+					key, _ := it.Prev()
+					assert.Equal(t, keys[i], key)
+				}
+				assert.Equal(t, 0, i)
+			}
+		}
+	}
+}
+
+func TestBulkLoadThenMutate(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	size := 2000
+
+	for order := 3; order <= 7; order++ {
+		keys, values := sortedPairs(size)
+		bpt, err := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(order))
+		assert.NoError(t, err)
+
+		for _, i := range r.Perm(size) {
+			if i%2 == 0 {
+				value, deleted := bpt.Delete(keys[i])
+				assert.True(t, deleted)
+				assert.Equal(t, values[i], value)
+			} else {
+				oldValue, existed := bpt.Put(keys[i], keys[i])
+				assert.True(t, existed)
+				assert.Equal(t, values[i], oldValue)
+			}
+		}
+		assert.Equal(t, size/2, bpt.Size())
+
+		for i, key := range keys {
+			value, ok := bpt.Get(key)
+			assert.Equal(t, i%2 == 1, ok)
+			if ok {
+				assert.Equal(t, key, value)
+			}
+		}
+	}
+}
+
+func TestBulkLoadRejectsUnsortedInput(t *testing.T) {
+	keys := [][]byte{[]byte("1"), []byte("3"), []byte("2")}
+	_, err := NewBPlusTreeFromSorted(NewSliceSource(keys, keys))
+	assert.True(t, errors.Is(err, ErrNotSorted))
+
+	keys = [][]byte{[]byte("1"), []byte("2"), []byte("2")}
+	_, err = NewBPlusTreeFromSorted(NewSliceSource(keys, keys))
+	assert.True(t, errors.Is(err, ErrDuplicateKey))
+}
+
+func TestBulkLoadIntoNonEmptyTree(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	bpt.Put([]byte("1"), []byte("1"))
+
+	keys, values := sortedPairs(10)
+	err := bpt.BulkLoad(NewSliceSource(keys, values))
+	assert.True(t, errors.Is(err, ErrNotEmpty))
+}
+
+func TestBulkLoadEngines(t *testing.T) {
+	modes := map[string][]Option{
+		"BLink":                  {SetConcurrency(BLink)},
+		"OptimisticLockCoupling": {SetConcurrency(OptimisticLockCoupling)},
+		"CopyOnWrite":            {SetConcurrency(CopyOnWrite)},
+		"Paged":                  {SetPageSize(minPageSize), tempPageFile(t)},
+	}
+	for name, options := range modes {
+		for order := 3; order <= 6; order++ {
+			for _, fillFactor := range []float64{0.1, 0.7, 1} {
+				for _, size := range []int{0, 1, 2, 7, 99, 2000} {
+					keys, values := sortedPairs(size)
+					bpt, err := NewBPlusTreeFromSorted(NewSliceSource(keys, values),
+						append(options, SetOrder(order), SetFillFactor(fillFactor))...)
+					assert.NoError(t, err)
+					assert.Equal(t, size, bpt.Size(), name)
+					assert.NoError(t, bpt.Validate(), name)
+
+					i := 0
+					bpt.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+						assert.Equal(t, keys[i], key)
+						assert.Equal(t, values[i], value)
+						i++
+						return true
+					})
+					assert.Equal(t, size, i, name)
+
+					// the nodes keep working once loaded
+					for k := size; k < size+200; k++ {
+						bpt.Put(uint32Key(k), uint32Key(k))
+					}
+					for _, key := range keys {
+						_, deleted := bpt.Delete(key)
+						assert.True(t, deleted)
+					}
+					assert.Equal(t, 200, bpt.Size(), name)
+					assert.NoError(t, bpt.Validate(), name)
+					assert.NoError(t, bpt.Close())
+				}
+			}
+		}
+	}
+}
+
+func TestBulkLoadEnginesPackLeaves(t *testing.T) {
+	keys, values := sortedPairs(1000)
+	var leaves []int
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(6), SetConcurrency(BLink))
+	leaves = append(leaves, len(bpt.engine.(*blinkTree).firstLeaf().load().keys))
+	bpt, _ = NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(6), SetConcurrency(OptimisticLockCoupling))
+	leaves = append(leaves, len(bpt.engine.(*olcTree).findLeaf(nil).c.keys))
+	bpt, _ = NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(6), SetConcurrency(CopyOnWrite))
+	cow := bpt.engine.(*cowTree)
+	leaves = append(leaves, len(cow.descend(cow.load().node, func(n *cowNode) int { return 0 }).leaf().n.keys))
+
+	// putting the keys in order would leave the leaves half full
+	assert.Equal(t, []int{5, 5, 5}, leaves)
+
+	bpt, _ = NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetPageSize(minPageSize), tempPageFile(t))
+	paged := bpt.engine.(*pagedTree)
+	path, page := paged.descend(nil)
+	assert.Greater(t, len(path), 1)
+	assert.Greater(t, decodeNode(page).size(), minPageSize-(slotLen+leafCellHeaderLen+8))
+	paged.unpin(path[len(path)-1].id, false)
+	assert.NoError(t, bpt.Close())
+}
+
+func TestBulkLoadEnginesLoadNothingOnError(t *testing.T) {
+	keys, values := sortedPairs(1000)
+	keys[700] = keys[699]
+	for _, options := range [][]Option{
+		{SetConcurrency(BLink)},
+		{SetConcurrency(OptimisticLockCoupling)},
+		{SetConcurrency(CopyOnWrite)},
+		{SetPageSize(minPageSize), tempPageFile(t)},
+	} {
+		bpt, _ := NewBPlusTree(append(options, SetOrder(4))...)
+		assert.ErrorIs(t, bpt.BulkLoad(NewSliceSource(keys, values)), ErrDuplicateKey)
+		assert.Equal(t, 0, bpt.Size())
+		assert.NoError(t, bpt.Validate())
+
+		bpt.Put(keys[0], values[0])
+		assert.ErrorIs(t, bpt.BulkLoad(NewSliceSource(keys, values)), ErrNotEmpty)
+		assert.Equal(t, 1, bpt.Size())
+		assert.NoError(t, bpt.Validate())
+		assert.NoError(t, bpt.Close())
+	}
+}
+
+// gatedSource streams the pairs of its source, but holds back
+// the second one until the gate is closed.
+type gatedSource struct {
+	KVSource
+	started, gate chan struct{}
+	streamed      int
+}
+
+func (s *gatedSource) Next() ([]byte, []byte, error) {
+	if s.streamed == 1 {
+		close(s.started)
+		<-s.gate
+	}
+	s.streamed++
+	return s.KVSource.Next()
+}
+
+func TestBulkLoadEnginesKeepConcurrentWrites(t *testing.T) {
+	keys, values := sortedPairs(1000)
+	for _, options := range [][]Option{
+		{SetConcurrency(BLink)},
+		{SetConcurrency(OptimisticLockCoupling)},
+		{SetConcurrency(CopyOnWrite)},
+		{SetPageSize(minPageSize), tempPageFile(t)},
+	} {
+		bpt, _ := NewBPlusTree(append(options, SetOrder(4))...)
+		src := &gatedSource{KVSource: NewSliceSource(keys, values), started: make(chan struct{}), gate: make(chan struct{})}
+		loaded := make(chan error)
+		go func() {
+			loaded <- bpt.BulkLoad(src)
+		}()
+
+		// the write waits for the load, and lands in the loaded tree
+		<-src.started
+		written := make(chan struct{})
+		go func() {
+			bpt.Put(uint32Key(5000), uint32Key(5000))
+			close(written)
+		}()
+		close(src.gate)
+		assert.NoError(t, <-loaded)
+		<-written
+
+		assert.Equal(t, 1001, bpt.Size())
+		value, ok := bpt.Get(uint32Key(5000))
+		assert.True(t, ok)
+		assert.Equal(t, uint32Key(5000), value)
+		assert.NoError(t, bpt.Validate())
+		assert.NoError(t, bpt.Close())
+	}
+}
+
+func TestSetFillFactor(t *testing.T) {
+	for _, fillFactor := range []float64{-1, 0, 1.1} {
+		_, err := NewBPlusTree(SetFillFactor(fillFactor))
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,53 @@
+package bptree
+
+import "errors"
+
+// CopyMode decides whether the tree copies the keys and values passed
+// to it and the ones it hands out.
+type CopyMode int
+
+const (
+	// CopyOnPut copies the keys and values before storing them, so the
+	// caller may reuse its buffers after Put returns.
+	CopyOnPut CopyMode = 1 << iota
+
+	// CopyOnGet copies the keys and values before returning them from
+	// Get, Scan, ForEach and Iterator, so the caller may modify them.
+	CopyOnGet
+
+	// ZeroCopy neither copies on put nor on get, the caller must not
+	// modify any slice it passed to or received from the tree.
+	ZeroCopy CopyMode = 0
+)
+
+const (
+	defaultCopyMode = CopyOnPut
+)
+
+// SetCopyMode sets the ownership semantics of keys and values,
+// CopyOnPut and CopyOnGet can be combined.
+func SetCopyMode(mode CopyMode) Option {
+	return func(bpt *BPlusTree) error {
+		if mode&^(CopyOnPut|CopyOnGet) != 0 {
+			return errors.New("unknown copy mode")
+		}
+		bpt.copyMode = mode
+		return nil
+	}
+}
+
+// copyOnPut returns the slice to be stored in the tree
+func (bpt *BPlusTree) copyOnPut(s []byte) []byte {
+	if bpt.copyMode&CopyOnPut == 0 {
+		return s
+	}
+	return copyBytes(s)
+}
+
+// copyOnGet returns the slice to be handed out by the tree
+func (bpt *BPlusTree) copyOnGet(s []byte) []byte {
+	if bpt.copyMode&CopyOnGet == 0 {
+		return s
+	}
+	return copyBytes(s)
+}
@@ -0,0 +1,81 @@
+package bptree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyOnPut(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetOrder(3))
+
+	buffer := []byte("a")
+	value := []byte("1")
+	for _, c := range []byte("abcdefgh") {
+		buffer[0] = c
+		value[0] = c
+		bpt.Put(buffer, value)
+	}
+	buffer[0] = 'z'
+	value[0] = 'z'
+
+	keys := make([]string, 0)
+	bpt.ForEach(func(key, value []byte) {
+		assert.Equal(t, key, value)
+		keys = append(keys, string(key))
+	})
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g", "h"}, keys)
+}
+
+func TestCopyOnGet(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetCopyMode(CopyOnPut | CopyOnGet))
+	bpt.Put([]byte("a"), []byte("1"))
+
+	value, _ := bpt.Get([]byte("a"))
+	value[0] = '2'
+	value, _ = bpt.Get([]byte("a"))
+	assert.Equal(t, "1", string(value))
+
+	it := bpt.Iterator()
+	key, value := it.Next()
+	key[0] = 'b'
+	value[0] = '2'
+	value, ok := bpt.Get([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(value))
+
+	bpt.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+		key[0] = 'b'
+		return true
+	})
+	_, ok = bpt.Get([]byte("a"))
+	assert.True(t, ok)
+}
+
+func TestZeroCopy(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetCopyMode(ZeroCopy))
+
+	value := []byte("1")
+	bpt.Put([]byte("a"), value)
+	value[0] = '2'
+
+	// the tree shares the buffers with the caller
+	stored, _ := bpt.Get([]byte("a"))
+	assert.Equal(t, "2", string(stored))
+	stored[0] = '3'
+	assert.Equal(t, "3", string(value))
+}
+
+func TestCopyModeKeepsNilValues(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetCopyMode(CopyOnPut | CopyOnGet))
+	bpt.Put([]byte("a"), nil)
+
+	value, ok := bpt.Get([]byte("a"))
+	assert.True(t, ok)
+	assert.Nil(t, value)
+}
+
+func TestUnknownCopyMode(t *testing.T) {
+	_, err := NewBPlusTree(SetCopyMode(CopyMode(4)))
+	assert.Error(t, err)
+}
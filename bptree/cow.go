@@ -0,0 +1,563 @@
+package bptree
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A copy-on-write tree never modifies a published node. A writer copies
+// the nodes on the path from the root to the leaf it changes, together
+// with the siblings it borrows from or merges with, and publishes the new
+// root at once. The old root still leads to the old tree, so capturing it
+// is a snapshot, and readers need no latch. Leaves have no links, as a
+// link would make every copied leaf copy its neighbours too, positions
+// are paths from the root instead.
+
+// cowNode is an immutable node of the copy-on-write tree
+type cowNode struct {
+	keys [][]byte
+
+	// only for leaf node, one value per key
+	values [][]byte
+
+	// only for internal node, one child more than keys
+	children []*cowNode
+
+	// only for internal node, the number of keys in its subtree
+	count int
+}
+
+// cowInternal returns the internal node of the keys and children
+func cowInternal(keys [][]byte, children []*cowNode) *cowNode {
+	n := &cowNode{keys: keys, children: children}
+	for _, child := range children {
+		n.count += child.keyCount()
+	}
+	return n
+}
+
+func (n *cowNode) leaf() bool {
+	return n.children == nil
+}
+
+// keyCount returns the number of keys in the subtree of the node
+func (n *cowNode) keyCount() int {
+	if n.leaf() {
+		return len(n.keys)
+	}
+	return n.count
+}
+
+// cowRoot is a version of the copy-on-write tree
+type cowRoot struct {
+	node *cowNode
+	size int
+}
+
+// cowTree is the engine of CopyOnWrite mode
+type cowTree struct {
+	bpt *BPlusTree
+
+	// serializes the writers
+	writeLatch sync.Mutex
+
+	// the current *cowRoot
+	root atomic.Value
+}
+
+func newCOWTree(bpt *BPlusTree) *cowTree {
+	t := &cowTree{bpt: bpt}
+	t.root.Store(&cowRoot{node: &cowNode{}})
+	return t
+}
+
+// load returns the current version of the tree
+func (t *cowTree) load() *cowRoot {
+	return t.root.Load().(*cowRoot)
+}
+
+// search returns the position of the first key which is not less than
+// the given key and true if that key equals the given key.
+func (t *cowTree) search(n *cowNode, key []byte) (int, bool) {
+	position := sort.Search(len(n.keys), func(i int) bool {
+		return t.bpt.compare(n.keys[i], key) >= 0
+	})
+	return position, position < len(n.keys) && t.bpt.compare(n.keys[position], key) == 0
+}
+
+// childPosition returns the position of the child which covers the given
+// key, or of the most left child for a nil key.
+func (t *cowTree) childPosition(n *cowNode, key []byte) int {
+	if key == nil {
+		return 0
+	}
+	return sort.Search(len(n.keys), func(i int) bool {
+		return t.bpt.compare(key, n.keys[i]) < 0
+	})
+}
+
+// get is Get for copy-on-write trees, it takes no latch
+func (t *cowTree) get(key []byte) ([]byte, bool) {
+	n := t.load().node
+	for !n.leaf() {
+		n = n.children[t.childPosition(n, key)]
+	}
+	if position, found := t.search(n, key); found {
+		return n.values[position], true
+	}
+	return nil, false
+}
+
+// put is Put for copy-on-write trees
+func (t *cowTree) put(key, value []byte) ([]byte, bool) {
+	t.writeLatch.Lock()
+	defer t.writeLatch.Unlock()
+
+	root := t.load()
+	n, separator, right, old, found := t.insert(root.node, key, value)
+	if right != nil {
+		n = cowInternal([][]byte{separator}, []*cowNode{n, right})
+	}
+	size := root.size
+	if !found {
+		size++
+	}
+	t.root.Store(&cowRoot{node: n, size: size})
+	return old, found
+}
+
+// insert puts the pair of kv into the subtree and returns the copy of its
+// node, with the separator and the right half if the copy had to split.
+// The old value and true are returned if the key exists.
+func (t *cowTree) insert(n *cowNode, key, value []byte) (*cowNode, []byte, *cowNode, []byte, bool) {
+	if n.leaf() {
+		position, found := t.search(n, key)
+		if found {
+			next := &cowNode{keys: n.keys, values: replaced(n.values, position, value)}
+			return next, nil, nil, n.values[position], true
+		}
+		next := &cowNode{keys: inserted(n.keys, position, key), values: inserted(n.values, position, value)}
+		left, separator, right := t.split(next)
+		return left, separator, right, nil, false
+	}
+
+	position := t.childPosition(n, key)
+	child, separator, right, old, found := t.insert(n.children[position], key, value)
+	children := replaced(n.children, position, child)
+	if right == nil {
+		return cowInternal(n.keys, children), nil, nil, old, found
+	}
+	next := cowInternal(inserted(n.keys, position, separator), inserted(children, position+1, right))
+	left, separator, right := t.split(next)
+	return left, separator, right, old, found
+}
+
+// split splits the new node if it overflows, the separator and the
+// right half are nil otherwise.
+func (t *cowTree) split(n *cowNode) (*cowNode, []byte, *cowNode) {
+	if len(n.keys) < t.bpt.order {
+		return n, nil, nil
+	}
+	middle := len(n.keys) / 2
+	separator := n.keys[middle]
+	if n.leaf() {
+		left := &cowNode{keys: n.keys[:middle:middle], values: n.values[:middle:middle]}
+		right := &cowNode{keys: n.keys[middle:], values: n.values[middle:]}
+		return left, separator, right
+	}
+	// the separator moves up
+	left := cowInternal(n.keys[:middle:middle], n.children[:middle+1:middle+1])
+	right := cowInternal(n.keys[middle+1:], n.children[middle+1:])
+	return left, separator, right
+}
+
+// delete is Delete for copy-on-write trees
+func (t *cowTree) delete(key []byte) ([]byte, bool) {
+	t.writeLatch.Lock()
+	defer t.writeLatch.Unlock()
+
+	root := t.load()
+	n, old, found := t.remove(root.node, key)
+	if !found {
+		return nil, false
+	}
+	if !n.leaf() && len(n.keys) == 0 {
+		// the root has merged its last two children
+		n = n.children[0]
+	}
+	t.root.Store(&cowRoot{node: n, size: root.size - 1})
+	return old, true
+}
+
+// remove deletes the key from the subtree and returns the copy of its
+// node, which may underflow, with the deleted value and true if the key
+// exists. The node itself is returned if it doesn't.
+func (t *cowTree) remove(n *cowNode, key []byte) (*cowNode, []byte, bool) {
+	if n.leaf() {
+		position, found := t.search(n, key)
+		if !found {
+			return n, nil, false
+		}
+		next := &cowNode{keys: removed(n.keys, position), values: removed(n.values, position)}
+		return next, n.values[position], true
+	}
+
+	position := t.childPosition(n, key)
+	child, old, found := t.remove(n.children[position], key)
+	if !found {
+		return n, nil, false
+	}
+	next := cowInternal(n.keys, replaced(n.children, position, child))
+	if len(child.keys) < t.bpt.minKeyNum {
+		next = t.rebalance(next, position)
+	}
+	return next, old, true
+}
+
+// rebalance returns the copy of the new parent whose child at the position
+// underflows, after the child borrowed a key from a sibling or merged with it.
+func (t *cowTree) rebalance(parent *cowNode, position int) *cowNode {
+	child := parent.children[position]
+	if position > 0 {
+		if left := parent.children[position-1]; len(left.keys) > t.bpt.minKeyNum {
+			left, child, separator := t.borrowFromLeft(left, child, parent.keys[position-1])
+			return cowInternal(
+				replaced(parent.keys, position-1, separator),
+				replaced(replaced(parent.children, position-1, left), position, child),
+			)
+		}
+	}
+	if position+1 < len(parent.children) {
+		if right := parent.children[position+1]; len(right.keys) > t.bpt.minKeyNum {
+			child, right, separator := t.borrowFromRight(child, right, parent.keys[position])
+			return cowInternal(
+				replaced(parent.keys, position, separator),
+				replaced(replaced(parent.children, position, child), position+1, right),
+			)
+		}
+	}
+
+	// merge the child with its left sibling, or with the right one for the most left child
+	if position > 0 {
+		position--
+	}
+	merged := t.merge(parent.children[position], parent.children[position+1], parent.keys[position])
+	return cowInternal(
+		removed(parent.keys, position),
+		replaced(removed(parent.children, position+1), position, merged),
+	)
+}
+
+// borrowFromLeft moves the last key of the left sibling into the child and
+// returns the copies of both with their new separator.
+func (t *cowTree) borrowFromLeft(left, child *cowNode, separator []byte) (*cowNode, *cowNode, []byte) {
+	last := len(left.keys) - 1
+	if child.leaf() {
+		child = &cowNode{keys: inserted(child.keys, 0, left.keys[last]), values: inserted(child.values, 0, left.values[last])}
+		left = &cowNode{keys: left.keys[:last:last], values: left.values[:last:last]}
+		return left, child, child.keys[0]
+	}
+	// the separator moves down and the last key of the left sibling moves up
+	child = cowInternal(inserted(child.keys, 0, separator), inserted(child.children, 0, left.children[last+1]))
+	separator = left.keys[last]
+	left = cowInternal(left.keys[:last:last], left.children[:last+1:last+1])
+	return left, child, separator
+}
+
+// borrowFromRight moves the first key of the right sibling into the child
+// and returns the copies of both with their new separator.
+func (t *cowTree) borrowFromRight(child, right *cowNode, separator []byte) (*cowNode, *cowNode, []byte) {
+	end := len(child.keys)
+	if child.leaf() {
+		child = &cowNode{keys: inserted(child.keys, end, right.keys[0]), values: inserted(child.values, end, right.values[0])}
+		right = &cowNode{keys: right.keys[1:], values: right.values[1:]}
+		return child, right, right.keys[0]
+	}
+	// the separator moves down and the first key of the right sibling moves up
+	child = cowInternal(inserted(child.keys, end, separator), inserted(child.children, end+1, right.children[0]))
+	separator = right.keys[0]
+	right = cowInternal(right.keys[1:], right.children[1:])
+	return child, right, separator
+}
+
+// merge returns the node holding the keys of both siblings
+func (t *cowTree) merge(left, right *cowNode, separator []byte) *cowNode {
+	if left.leaf() {
+		return &cowNode{keys: concatenated(left.keys, right.keys), values: concatenated(left.values, right.values)}
+	}
+	// the separator moves down
+	return cowInternal(
+		concatenated(inserted(left.keys, len(left.keys), separator), right.keys),
+		concatenated(left.children, right.children),
+	)
+}
+
+// bulkLoad is BulkLoad for copy-on-write trees, the new
+// version is published at once
+func (t *cowTree) bulkLoad(src KVSource) error {
+	t.writeLatch.Lock()
+	defer t.writeLatch.Unlock()
+	if t.load().size != 0 {
+		return ErrNotEmpty
+	}
+
+	runs, size, err := t.bpt.packRuns(src)
+	if err != nil || size == 0 {
+		return err
+	}
+	leaves, firstKeys := make([]*cowNode, len(runs)), make([][]byte, len(runs))
+	for i, run := range runs {
+		leaves[i], firstKeys[i] = &cowNode{keys: run.keys, values: run.values}, run.keys[0]
+	}
+	t.root.Store(&cowRoot{node: buildLevels(t.bpt, leaves, firstKeys, cowInternal), size: size})
+	return nil
+}
+
+func (t *cowTree) len() int {
+	return t.load().size
+}
+
+// cowFrame is a node on the path of a cursor and the position taken in
+// it, the child of an internal node or the key of a leaf.
+type cowFrame struct {
+	n *cowNode
+	i int
+}
+
+// cowCursor is the path from a root to a key, it's the leaf of the
+// positions of the copy-on-write tree and is moved in place.
+type cowCursor struct {
+	root *cowNode
+	path []cowFrame
+}
+
+// descend returns the cursor down to the leaf reached by following
+// the chosen children, the position in the leaf is left to the caller.
+func (t *cowTree) descend(root *cowNode, child func(n *cowNode) int) *cowCursor {
+	c := &cowCursor{root: root}
+	n := root
+	for !n.leaf() {
+		i := child(n)
+		c.path = append(c.path, cowFrame{n: n, i: i})
+		n = n.children[i]
+	}
+	c.path = append(c.path, cowFrame{n: n})
+	return c
+}
+
+// leaf returns the frame of the leaf
+func (c *cowCursor) leaf() *cowFrame {
+	return &c.path[len(c.path)-1]
+}
+
+// pair returns the position of the cursor in the engine's terms
+func (c *cowCursor) pair() (interface{}, []byte, []byte) {
+	leaf := c.leaf()
+	return c, leaf.n.keys[leaf.i], leaf.n.values[leaf.i]
+}
+
+// next moves the cursor to the first key of the next leaf,
+// it returns false if there is none.
+func (c *cowCursor) next() bool {
+	depth := len(c.path) - 2
+	for depth >= 0 && c.path[depth].i+1 == len(c.path[depth].n.children) {
+		depth--
+	}
+	if depth < 0 {
+		return false
+	}
+	c.path[depth].i++
+	for depth++; depth < len(c.path); depth++ {
+		parent := c.path[depth-1]
+		c.path[depth] = cowFrame{n: parent.n.children[parent.i]}
+	}
+	return true
+}
+
+// previous moves the cursor to the last key of the previous
+// leaf, it returns false if there is none.
+func (c *cowCursor) previous() bool {
+	depth := len(c.path) - 2
+	for depth >= 0 && c.path[depth].i == 0 {
+		depth--
+	}
+	if depth < 0 {
+		return false
+	}
+	c.path[depth].i--
+	for depth++; depth < len(c.path); depth++ {
+		parent := c.path[depth-1]
+		n := parent.n.children[parent.i]
+		last := len(n.children) - 1
+		if n.leaf() {
+			last = len(n.keys) - 1
+		}
+		c.path[depth] = cowFrame{n: n, i: last}
+	}
+	return true
+}
+
+// seek continues from the cursor as long as it belongs to the current
+// root, and descends again otherwise.
+func (t *cowTree) seek(leaf interface{}, key []byte, exclusive bool) (interface{}, []byte, []byte) {
+	root := t.load().node
+	c, ok := leaf.(*cowCursor)
+	if !ok || c.root != root {
+		c = t.descend(root, func(n *cowNode) int {
+			return t.childPosition(n, key)
+		})
+	}
+
+	frame := c.leaf()
+	frame.i = 0
+	if key != nil {
+		var found bool
+		frame.i, found = t.search(frame.n, key)
+		if found && exclusive {
+			frame.i++
+		}
+	}
+	if frame.i == len(frame.n.keys) && !c.next() {
+		return nil, nil, nil
+	}
+	return c.pair()
+}
+
+func (t *cowTree) last(bound []byte) (interface{}, []byte, []byte) {
+	c := t.descend(t.load().node, func(n *cowNode) int {
+		if bound == nil {
+			return len(n.keys)
+		}
+		return t.childPosition(n, bound)
+	})
+
+	frame := c.leaf()
+	frame.i = len(frame.n.keys)
+	if bound != nil {
+		frame.i, _ = t.search(frame.n, bound)
+	}
+	frame.i--
+	if frame.i < 0 && !c.previous() {
+		return nil, nil, nil
+	}
+	return c.pair()
+}
+
+// rank is Rank for copy-on-write trees, it takes no latch
+func (t *cowTree) rank(key []byte) int {
+	rank := 0
+	n := t.load().node
+	for !n.leaf() {
+		position := t.childPosition(n, key)
+		for _, child := range n.children[:position] {
+			rank += child.keyCount()
+		}
+		n = n.children[position]
+	}
+	position, _ := t.search(n, key)
+	return rank + position
+}
+
+// selectAt is Select for copy-on-write trees, it takes no latch
+func (t *cowTree) selectAt(i int) ([]byte, []byte) {
+	n := t.load().node
+	if i >= n.keyCount() {
+		return nil, nil
+	}
+	for !n.leaf() {
+		position := 0
+		for ; position < len(n.keys) && i >= n.children[position].keyCount(); position++ {
+			i -= n.children[position].keyCount()
+		}
+		n = n.children[position]
+	}
+	return n.keys[i], n.values[i]
+}
+
+// snapshot returns the engine of a read-only tree holding the current version
+func (t *cowTree) snapshot(bpt *BPlusTree) *cowTree {
+	s := &cowTree{bpt: bpt}
+	s.root.Store(t.load())
+	return s
+}
+
+// validate checks the invariants of the copy-on-write tree, since versions
+// are immutable it may run while writers publish new ones.
+func (t *cowTree) validate() error {
+	root := t.load()
+	v := &cowValidator{t: t, leafDepth: -1}
+	if err := v.validateNode(root.node, "root", nil, nil, 0); err != nil {
+		return err
+	}
+	if v.size != root.size {
+		return fmt.Errorf("size is %d but the tree holds %d keys", root.size, v.size)
+	}
+	return nil
+}
+
+// cowValidator carries the state of a copy-on-write tree walk
+type cowValidator struct {
+	t         *cowTree
+	leafDepth int
+	size      int
+}
+
+// validateNode checks the subtree of the node, whose keys
+// must lie within [lower, upper), a nil bound is open.
+func (v *cowValidator) validateNode(n *cowNode, path string, lower, upper []byte, depth int) error {
+	compare := v.t.bpt.compare
+	for i, key := range n.keys {
+		if i > 0 && compare(n.keys[i-1], key) >= 0 {
+			return fmt.Errorf("%s: keys %q and %q are not in ascending order", path, n.keys[i-1], key)
+		}
+		if lower != nil && compare(key, lower) < 0 || upper != nil && compare(key, upper) >= 0 {
+			return fmt.Errorf("%s: key %q lies outside [%q, %q)", path, key, lower, upper)
+		}
+	}
+	if len(n.keys) >= v.t.bpt.order {
+		return fmt.Errorf("%s: node holds %d keys", path, len(n.keys))
+	}
+	if depth > 0 && len(n.keys) < v.t.bpt.minKeyNum {
+		return fmt.Errorf("%s: node holds %d keys, less than %d", path, len(n.keys), v.t.bpt.minKeyNum)
+	}
+
+	if n.leaf() {
+		if len(n.values) != len(n.keys) {
+			return fmt.Errorf("%s: leaf holds %d keys and %d values", path, len(n.keys), len(n.values))
+		}
+		if v.leafDepth == -1 {
+			v.leafDepth = depth
+		} else if v.leafDepth != depth {
+			return fmt.Errorf("%s: leaf at depth %d, expected %d", path, depth, v.leafDepth)
+		}
+		v.size += len(n.keys)
+		return nil
+	}
+
+	if len(n.children) != len(n.keys)+1 || n.values != nil {
+		return fmt.Errorf("%s: node holds %d keys and %d children", path, len(n.keys), len(n.children))
+	}
+	if depth == 0 && len(n.keys) == 0 {
+		return fmt.Errorf("%s: internal root holds no key", path)
+	}
+	count := 0
+	for i, child := range n.children {
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = n.keys[i-1]
+		}
+		if i < len(n.keys) {
+			childUpper = n.keys[i]
+		}
+		if err := v.validateNode(child, fmt.Sprintf("%s/%d", path, i), childLower, childUpper, depth+1); err != nil {
+			return err
+		}
+		count += child.keyCount()
+	}
+	if n.count != count {
+		return fmt.Errorf("%s: node counts %d keys but its subtree holds %d", path, n.count, count)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package bptree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyOnWriteSequential(t *testing.T) {
+	testSequential(t, CopyOnWrite)
+}
+
+func TestCopyOnWriteConcurrentReadersAndWriters(t *testing.T) {
+	testConcurrentReadersAndWriters(t, CopyOnWrite)
+}
+
+func TestCopyOnWriteCopiesThePathOnly(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetOrder(4), SetConcurrency(CopyOnWrite))
+	for k := 0; k < 1000; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+	cow := bpt.engine.(*cowTree)
+
+	for _, write := range []func(){
+		func() { bpt.Put(uint32Key(0), nil) },
+		func() { bpt.Put(uint32Key(1000), nil) },
+		func() { bpt.Delete(uint32Key(500)) },
+	} {
+		before := cow.load().node
+		write()
+		after := cow.load().node
+		assert.NoError(t, bpt.Validate())
+
+		// every level but the changed path is shared
+		for !before.leaf() {
+			copied := 0
+			for i, child := range before.children {
+				if i >= len(after.children) || after.children[i] != child {
+					copied++
+				}
+			}
+			assert.LessOrEqual(t, copied, 2)
+			before, after = before.children[len(before.children)/2], after.children[len(after.children)/2]
+		}
+	}
+}
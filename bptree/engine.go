@@ -0,0 +1,85 @@
+package bptree
+
+// engine stores the pairs of kv of a tree whose concurrency mode needs
+// nodes of its own. The leaf of a position is a hint for the engine to
+// continue from, which must stay safe to use whatever the writers do
+// meanwhile. Keys and values are stored and handed out as they are,
+// the tree copies them.
+type engine interface {
+	get(key []byte) ([]byte, bool)
+	put(key, value []byte) ([]byte, bool)
+	delete(key []byte) ([]byte, bool)
+
+	// len returns the number of keys
+	len() int
+
+	// seek returns the leaf and the pair of the first key after the given
+	// key, or of the key itself unless exclusive, starting from the leaf,
+	// or from the root if the leaf is nil. A nil key seeks the first key.
+	// The leaf is nil if there is no such key.
+	seek(leaf interface{}, key []byte, exclusive bool) (interface{}, []byte, []byte)
+
+	// last returns the leaf and the pair of the last key before the bound,
+	// or of the largest key if the bound is nil.
+	last(bound []byte) (interface{}, []byte, []byte)
+
+	// bulkLoad is BulkLoad, it builds the nodes bottom-up and
+	// publishes them at once
+	bulkLoad(src KVSource) error
+
+	// validate checks the invariants of the engine, writers must be done
+	validate() error
+}
+
+// newEngine returns the engine of the concurrency mode, or nil
+// if the mode works on the nodes of the tree itself.
+func newEngine(bpt *BPlusTree) engine {
+	switch bpt.concurrency {
+	case BLink:
+		return newBlinkTree(bpt)
+	case OptimisticLockCoupling:
+		return newOLCTree(bpt)
+	case CopyOnWrite:
+		return newCOWTree(bpt)
+	}
+	return nil
+}
+
+// scanEngine is Scan for trees with an engine
+func (bpt *BPlusTree) scanEngine(start, end []byte, opts ScanOptions, action func(key, value []byte) bool) {
+	leaf, key, value := bpt.engine.seek(nil, start, opts.ExcludeStart)
+	for leaf != nil && !bpt.afterEnd(key, end, opts) {
+		if !action(bpt.copyOnGet(key), bpt.copyOnGet(value)) {
+			return
+		}
+		leaf, key, value = bpt.engine.seek(leaf, key, true)
+	}
+}
+
+// deleteRangeEngine deletes the keys in the range one by one,
+// engines change a single path at a time.
+func (bpt *BPlusTree) deleteRangeEngine(r keyRange) int {
+	if r.empty() {
+		return 0
+	}
+	var keys [][]byte
+	leaf, key, _ := bpt.engine.seek(nil, r.start, r.excludeStart)
+	for leaf != nil && (r.afterEnd == nil || !r.afterEnd(key)) {
+		keys = append(keys, key)
+		leaf, key, _ = bpt.engine.seek(leaf, key, true)
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if _, deleted := bpt.engine.delete(key); deleted {
+			removed++
+		}
+	}
+	return removed
+}
+
+// setEngine positions the iterator at the pair found by the engine,
+// or past the end if the leaf is nil.
+func (it *Iterator) setEngine(leaf interface{}, key, value []byte) {
+	it.engineLeaf, it.key, it.value = leaf, key, value
+}
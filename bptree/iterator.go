@@ -1,21 +1,70 @@
 package bptree
 
-// Iterator returns a stateful Iterator for traversing the tree
-// in ascending key order.
+// Iterator is a stateful cursor over the pairs of kv of the tree.
+// It can be positioned with Seek, SeekToFirst and SeekToLast and
+// moved in both directions with Next and Prev.
 type Iterator struct {
-	next *node
+	bpt  *BPlusTree
+	leaf *node
 	i    int
+
+	// only for synchronized trees, the pair at the current position and
+	// the generation of the tree when it was found
+	key, value []byte
+	generation int
+
+	// only for trees with an engine, the leaf holding the current position
+	engineLeaf interface{}
 }
 
 // Iterator returns a stateful iterator that traverses the tree
 // in ascending key order.
 func (bpt *BPlusTree) Iterator() *Iterator {
-	return &Iterator{bpt.mostLeftNode, 0}
+	it := &Iterator{bpt: bpt}
+	it.SeekToFirst()
+	return it
+}
+
+// cached returns true if the iterator keeps the pair at its position
+// instead of reading it from the leaf, i.e. the tree is synchronized
+// or has an engine.
+func (it *Iterator) cached() bool {
+	return it.bpt.concurrency != Unsynchronized || it.bpt.engine != nil
+}
+
+// Valid returns true if the iterator is positioned at an element.
+func (it *Iterator) Valid() bool {
+	if it.cached() {
+		return it.key != nil
+	}
+	return it.leaf != nil && it.i < it.leaf.keyNums
 }
 
 // HasNext returns true if there is a next element.
 func (it *Iterator) HasNext() bool {
-	return it.next != nil && it.i < it.next.keyNums
+	return it.Valid()
+}
+
+// Key returns the key at the current position of the iteration.
+func (it *Iterator) Key() []byte {
+	if !it.Valid() {
+		panic("iterator is not valid")
+	}
+	if it.cached() {
+		return it.bpt.copyOnGet(it.key)
+	}
+	return it.bpt.copyOnGet(it.leaf.keys[it.i])
+}
+
+// Value returns the value at the current position of the iteration.
+func (it *Iterator) Value() []byte {
+	if !it.Valid() {
+		panic("iterator is not valid")
+	}
+	if it.cached() {
+		return it.bpt.copyOnGet(it.value)
+	}
+	return it.bpt.copyOnGet(it.leaf.pointers[it.i].convertToValue())
 }
 
 // Next returns a key and a value at the current position of the iteration
@@ -26,19 +75,145 @@ func (it *Iterator) Next() ([]byte, []byte) {
 		panic("there is no next node")
 	}
 
-	key, value := it.next.keys[it.i], it.next.pointers[it.i].convertToValue()
+	key, value := it.Key(), it.Value()
+	if it.bpt.engine != nil {
+		it.setEngine(it.bpt.engine.seek(it.engineLeaf, it.key, true))
+		return key, value
+	}
+	if it.bpt.latched() {
+		it.stepLatched(true)
+		return key, value
+	}
+	if it.bpt.concurrency == GlobalLock {
+		it.stepLocked(true)
+		return key, value
+	}
 
 	it.i++
-	if it.i == it.next.keyNums {
-		lastPointer := it.next.pointerToNextLeafNode()
-		if lastPointer != nil {
-			it.next = lastPointer.convertToNode()
+	if it.i == it.leaf.keyNums {
+		it.leaf = it.leaf.nextLeafNode()
+		it.i = 0
+	}
+
+	return key, value
+}
+
+// Prev returns a key and a value at the current position of the iteration
+// and moves the iterator backward.
+func (it *Iterator) Prev() ([]byte, []byte) {
+	if !it.Valid() {
+		panic("there is no previous node")
+	}
+
+	key, value := it.Key(), it.Value()
+	if it.bpt.engine != nil {
+		it.setEngine(it.bpt.engine.last(it.key))
+		return key, value
+	}
+	if it.bpt.latched() {
+		it.stepLatched(false)
+		return key, value
+	}
+	if it.bpt.concurrency == GlobalLock {
+		it.stepLocked(false)
+		return key, value
+	}
+
+	it.i--
+	if it.i < 0 {
+		it.leaf = it.leaf.previousLeafNode()
+		if it.leaf != nil {
+			it.i = it.leaf.keyNums - 1
 		} else {
-			it.next = nil
+			it.i = 0
 		}
+	}
+
+	return key, value
+}
 
+// Seek moves the iterator to the first key which is greater
+// than or equal to the given key.
+func (it *Iterator) Seek(key []byte) {
+	if it.bpt.engine != nil {
+		it.setEngine(it.bpt.engine.seek(nil, key, false))
+		return
+	}
+	if it.bpt.latched() {
+		it.bpt.treeLatch.RLock()
+		defer it.bpt.treeLatch.RUnlock()
+		it.seekLatched(key, false)
+		return
+	}
+	if it.bpt.concurrency == GlobalLock {
+		it.bpt.treeLatch.RLock()
+		defer it.bpt.treeLatch.RUnlock()
+		defer it.cacheLocked()
+	}
+	if it.bpt.root == nil {
+		it.leaf, it.i = nil, 0
+		return
+	}
+
+	it.leaf, it.i = it.bpt.seekLeaf(key, ScanOptions{})
+	if it.i == it.leaf.keyNums {
+		it.leaf = it.leaf.nextLeafNode()
 		it.i = 0
 	}
+}
 
-	return key, value
+// SeekToFirst moves the iterator to the smallest key.
+func (it *Iterator) SeekToFirst() {
+	if it.bpt.engine != nil {
+		it.setEngine(it.bpt.engine.seek(nil, nil, false))
+		return
+	}
+	if it.bpt.latched() {
+		it.bpt.treeLatch.RLock()
+		defer it.bpt.treeLatch.RUnlock()
+		it.seekLatched(nil, false)
+		return
+	}
+	if it.bpt.concurrency == GlobalLock {
+		it.bpt.treeLatch.RLock()
+		defer it.bpt.treeLatch.RUnlock()
+		defer it.cacheLocked()
+	}
+	it.i = 0
+	if it.bpt.root == nil {
+		it.leaf = nil
+		return
+	}
+	it.leaf = it.bpt.mostLeftNode
+}
+
+// SeekToLast moves the iterator to the largest key.
+func (it *Iterator) SeekToLast() {
+	if it.bpt.engine != nil {
+		it.setEngine(it.bpt.engine.last(nil))
+		return
+	}
+	if it.bpt.latched() {
+		it.bpt.treeLatch.RLock()
+		defer it.bpt.treeLatch.RUnlock()
+		it.seekLastLatched(nil)
+		return
+	}
+	if it.bpt.concurrency == GlobalLock {
+		it.bpt.treeLatch.RLock()
+		defer it.bpt.treeLatch.RUnlock()
+		defer it.cacheLocked()
+	}
+	it.i = 0
+	if it.bpt.root == nil {
+		it.leaf = nil
+		return
+	}
+
+	current := it.bpt.root
+	for !current.leaf {
+		current = current.pointers[current.keyNums].convertToNode()
+	}
+	it.leaf = current
+	it.i = current.keyNums - 1
 }
@@ -0,0 +1,103 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIteratorBothDirections(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	size := 2000
+	keys := r.Perm(size)
+
+	for order := 3; order <= 7; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order))
+		for _, k := range keys {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(k))
+			bpt.Put(key, key)
+		}
+		// delete every third key so that leaves get merged
+		expected := make([]uint32, 0)
+		for k := 0; k < size; k++ {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(k))
+			if k%3 == 0 {
+				bpt.Delete(key)
+			} else {
+				expected = append(expected, uint32(k))
+			}
+		}
+
+		forward := make([]uint32, 0)
+		for it := bpt.Iterator(); it.Valid(); {
+			key, _ := it.Next()
+			forward = append(forward, binary.BigEndian.Uint32(key))
+		}
+		assert.Equal(t, expected, forward)
+
+		backward := make([]uint32, 0)
+		it := bpt.Iterator()
+		for it.SeekToLast(); it.Valid(); {
+			key, _ := it.Prev()
+			backward = append(backward, binary.BigEndian.Uint32(key))
+		}
+		for i, j := 0, len(backward)-1; i < j; i, j = i+1, j-1 {
+			backward[i], backward[j] = backward[j], backward[i]
+		}
+		assert.Equal(t, expected, backward)
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	for order := 3; order <= 7; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order))
+		for _, testData := range testDatas {
+			bpt.Put(testData.key, testData.value)
+		}
+
+		it := bpt.Iterator()
+		it.Seek([]byte("16"))
+		assert.True(t, it.Valid())
+		assert.Equal(t, "16", string(it.Key()))
+		assert.Equal(t, "16", string(it.Value()))
+
+		it.Seek([]byte("17"))
+		assert.Equal(t, "18", string(it.Key()))
+		it.Prev()
+		assert.Equal(t, "16", string(it.Key()))
+		it.Next()
+		it.Next()
+		assert.Equal(t, "2", string(it.Key()))
+
+		it.Seek([]byte("75"))
+		assert.False(t, it.Valid())
+
+		it.SeekToFirst()
+		assert.Equal(t, "0", string(it.Key()))
+		it.Prev()
+		assert.False(t, it.Valid())
+
+		it.SeekToLast()
+		assert.Equal(t, "74", string(it.Key()))
+		it.Next()
+		assert.False(t, it.Valid())
+	}
+}
+
+func TestIteratorEmptyTree(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+
+	it := bpt.Iterator()
+	assert.False(t, it.Valid())
+	it.Seek([]byte("1"))
+	assert.False(t, it.Valid())
+	it.SeekToLast()
+	assert.False(t, it.Valid())
+	assert.Panics(t, func() { it.Key() })
+	assert.Panics(t, func() { it.Prev() })
+}
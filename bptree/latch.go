@@ -0,0 +1,511 @@
+package bptree
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Concurrency decides how the tree is synchronized between goroutines.
+type Concurrency int
+
+const (
+	// Unsynchronized doesn't synchronize at all, the tree must not be
+	// used by several goroutines at once unless all of them only read.
+	Unsynchronized Concurrency = iota
+
+	// LatchCrabbing guards every node by a read/write latch. Operations
+	// latch the nodes from the root down and release the ancestors as
+	// soon as a child is safe, i.e. it can't split or merge, so writers
+	// of disjoint key ranges run in parallel. Operations working on the
+	// whole tree, like BulkLoad, DeleteRange and Validate, lock it
+	// exclusively.
+	LatchCrabbing
+
+	// BLink turns the tree into a B-link tree, whose nodes have a high key
+	// and a link to their right sibling. Readers take no latch at all and
+	// recover from concurrent splits by following the right links, writers
+	// latch one node per level at a time. Deletions don't rebalance, and
+	// moving an Iterator backward descends from the root.
+	BLink
+
+	// OptimisticLockCoupling gives every node a version word. Readers take
+	// no latch, they check that the versions of the nodes they passed are
+	// unchanged and restart from the root otherwise. Writers lock only the
+	// nodes they modify and never wait while holding a lock. Full nodes are
+	// split on the way down, deletions don't rebalance, and moving an
+	// Iterator backward descends from the root.
+	OptimisticLockCoupling
+
+	// GlobalLock guards the whole tree by a single read/write mutex, the
+	// baseline to measure the other modes against. Scan holds it shared
+	// while calling action, so action must not modify the tree.
+	GlobalLock
+
+	// CopyOnWrite never modifies a published node. Writers copy the path
+	// from the root to the leaf they change and publish the new root at
+	// once, one writer at a time, and readers take no latch. Snapshot
+	// captures the current root, iterators keep their path from the root
+	// and descend again once a writer has published a new one.
+	CopyOnWrite
+)
+
+// SetConcurrency sets how the tree is synchronized, the tree is
+// Unsynchronized by default.
+func SetConcurrency(concurrency Concurrency) Option {
+	return func(bpt *BPlusTree) error {
+		if concurrency < Unsynchronized || concurrency > CopyOnWrite {
+			return errors.New("unknown concurrency")
+		}
+		bpt.concurrency = concurrency
+		return nil
+	}
+}
+
+// latched returns true if the nodes of the tree are latched
+func (bpt *BPlusTree) latched() bool {
+	return bpt.concurrency == LatchCrabbing
+}
+
+// lockTree locks the whole tree for an operation working on many
+// nodes, or for any write under GlobalLock.
+func (bpt *BPlusTree) lockTree() {
+	if !bpt.latched() && bpt.concurrency != GlobalLock {
+		return
+	}
+	bpt.treeLatch.Lock()
+	bpt.generation++
+}
+
+// unlockTree unlocks the tree locked by lockTree
+func (bpt *BPlusTree) unlockTree() {
+	if !bpt.latched() && bpt.concurrency != GlobalLock {
+		return
+	}
+	bpt.treeLatch.Unlock()
+}
+
+// rlockTree locks the tree shared for a read under GlobalLock
+func (bpt *BPlusTree) rlockTree() {
+	if bpt.concurrency == GlobalLock {
+		bpt.treeLatch.RLock()
+	}
+}
+
+// runlockTree unlocks the tree locked by rlockTree
+func (bpt *BPlusTree) runlockTree() {
+	if bpt.concurrency == GlobalLock {
+		bpt.treeLatch.RUnlock()
+	}
+}
+
+// lockSibling latches the sibling of a node being rebalanced exclusively,
+// their parent must already be latched.
+func (bpt *BPlusTree) lockSibling(n *node) {
+	if bpt.latched() {
+		n.latch.Lock()
+	}
+}
+
+// unlockSibling releases the latch taken by lockSibling
+func (bpt *BPlusTree) unlockSibling(n *node) {
+	if bpt.latched() {
+		n.latch.Unlock()
+	}
+}
+
+// addSize adds delta to the size of the tree
+func (bpt *BPlusTree) addSize(delta int) {
+	if bpt.latched() {
+		bpt.sizeLatch.Lock()
+		defer bpt.sizeLatch.Unlock()
+	}
+	bpt.size += delta
+}
+
+// towards returns the function choosing the child which holds the key,
+// or the most left child for a nil key.
+func (bpt *BPlusTree) towards(key []byte) func(n *node) int {
+	return func(n *node) int {
+		if key == nil {
+			return 0
+		}
+		return n.upperBound(key, bpt.compare)
+	}
+}
+
+// mostRight chooses the most right child
+func mostRight(n *node) int {
+	return n.keyNums
+}
+
+// findLeafLatched descends to a leaf following the chosen children with
+// read latches, each latch is released once the child is latched. It
+// returns the read latched leaf, or nil if the tree is empty.
+func (bpt *BPlusTree) findLeafLatched(child func(n *node) int) *node {
+	bpt.rootLatch.RLock()
+	current := bpt.root
+	if current == nil {
+		bpt.rootLatch.RUnlock()
+		return nil
+	}
+	current.latch.RLock()
+	bpt.rootLatch.RUnlock()
+
+	for !current.leaf {
+		next := current.pointers[child(current)].convertToNode()
+		next.latch.RLock()
+		current.latch.RUnlock()
+		current = next
+	}
+	return current
+}
+
+// writePath holds the write latches taken by a writer on its way down
+type writePath struct {
+	bpt *BPlusTree
+
+	// whether the root latch is held
+	rootLatched bool
+
+	// the latched nodes from the top down
+	nodes []*node
+}
+
+// latchForWrite descends to the leaf which holds the key with write
+// latches. Once a node is safe, the latches of its ancestors are
+// released, since the operation will not change them. The returned
+// path holds no node if the tree is empty.
+func (bpt *BPlusTree) latchForWrite(key []byte, safe func(n *node, isRoot bool) bool) *writePath {
+	bpt.rootLatch.Lock()
+	path := &writePath{bpt: bpt, rootLatched: true}
+
+	for current, isRoot := bpt.root, true; current != nil; isRoot = false {
+		current.latch.Lock()
+		if safe(current, isRoot) {
+			path.release()
+		}
+		path.nodes = append(path.nodes, current)
+		if current.leaf {
+			break
+		}
+		current = current.pointers[current.upperBound(key, bpt.compare)].convertToNode()
+	}
+	return path
+}
+
+// leaf returns the latched leaf, or nil if the tree is empty
+func (p *writePath) leaf() *node {
+	if len(p.nodes) == 0 {
+		return nil
+	}
+	return p.nodes[len(p.nodes)-1]
+}
+
+// release releases all the latches held
+func (p *writePath) release() {
+	if p.rootLatched {
+		p.bpt.rootLatch.Unlock()
+		p.rootLatched = false
+	}
+	for _, n := range p.nodes {
+		n.latch.Unlock()
+	}
+	p.nodes = p.nodes[:0]
+}
+
+// getLatched is Get for latched trees
+func (bpt *BPlusTree) getLatched(key []byte) ([]byte, bool) {
+	bpt.treeLatch.RLock()
+	defer bpt.treeLatch.RUnlock()
+
+	leaf := bpt.findLeafLatched(bpt.towards(key))
+	if leaf == nil {
+		return nil, false
+	}
+	defer leaf.latch.RUnlock()
+
+	if position, found := leaf.search(key, bpt.compare); found {
+		return bpt.copyOnGet(leaf.pointers[position].convertToValue()), true
+	}
+	return nil, false
+}
+
+// putLatched is Put for latched trees, a node is safe
+// if it can take one more key without splitting.
+func (bpt *BPlusTree) putLatched(key, value []byte) ([]byte, bool) {
+	bpt.treeLatch.RLock()
+	defer bpt.treeLatch.RUnlock()
+
+	path := bpt.latchForWrite(key, func(n *node, isRoot bool) bool {
+		return n.keyNums < len(n.keys)
+	})
+	defer path.release()
+
+	leaf := path.leaf()
+	if leaf == nil {
+		bpt.init(key, value)
+		return nil, false
+	}
+	return bpt.putIntoLeaf(leaf, key, value)
+}
+
+// deleteLatched is Delete for latched trees, a node is safe if it can
+// lose one key without underflowing, and the root if it keeps one key.
+func (bpt *BPlusTree) deleteLatched(key []byte) ([]byte, bool) {
+	bpt.treeLatch.RLock()
+	defer bpt.treeLatch.RUnlock()
+
+	path := bpt.latchForWrite(key, func(n *node, isRoot bool) bool {
+		if isRoot {
+			return n.keyNums > 1
+		}
+		return n.keyNums > bpt.minKeyNum
+	})
+	defer path.release()
+
+	leaf := path.leaf()
+	if leaf == nil {
+		return nil, false
+	}
+	value, deleted := bpt.deleteAtLeafAndRebalance(leaf, key)
+	if deleted {
+		bpt.addSize(-1)
+	}
+	return value, deleted
+}
+
+// scanLatched is Scan for latched trees, it holds no latch while calling action
+func (bpt *BPlusTree) scanLatched(start, end []byte, opts ScanOptions, action func(key, value []byte) bool) {
+	it := &Iterator{bpt: bpt}
+	bpt.treeLatch.RLock()
+	it.seekLatched(start, opts.ExcludeStart)
+	bpt.treeLatch.RUnlock()
+
+	for it.Valid() {
+		if bpt.afterEnd(it.key, end, opts) {
+			return
+		}
+		if !action(it.Next()) {
+			return
+		}
+	}
+}
+
+// Iterators of latched trees hold no latch between calls. They remember
+// the pair at their position instead and look for it again in their leaf,
+// which may have been changed, split or merged away in the meantime. When
+// moving to a neighbouring leaf, the current leaf is held until the
+// neighbour is latched, so no key can move between them unseen. Writers
+// latch siblings in the other direction, so the neighbour is only tried,
+// and on failure the iterator backs off and descends from the root again.
+
+// setLatched positions the iterator at the key of the read latched leaf
+func (it *Iterator) setLatched(leaf *node, i int) {
+	it.leaf, it.i = leaf, i
+	it.key, it.value = leaf.keys[i], leaf.pointers[i].convertToValue()
+	it.generation = it.bpt.generation
+}
+
+// invalidate moves the iterator past the end
+func (it *Iterator) invalidate() {
+	it.leaf, it.i = nil, 0
+	it.key, it.value = nil, nil
+}
+
+// seekLatched positions the iterator at the first key after the given
+// key, or at the key itself unless exclusive. A nil key seeks to the first key.
+func (it *Iterator) seekLatched(key []byte, exclusive bool) {
+	for {
+		leaf := it.bpt.findLeafLatched(it.bpt.towards(key))
+		if leaf == nil {
+			it.invalidate()
+			return
+		}
+		if it.forwardLatched(leaf, key, exclusive) {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// seekLastLatched positions the iterator at the last key before the
+// given key, or at the largest key if the key is nil.
+func (it *Iterator) seekLastLatched(key []byte) {
+	child := mostRight
+	if key != nil {
+		child = it.bpt.towards(key)
+	}
+	for {
+		leaf := it.bpt.findLeafLatched(child)
+		if leaf == nil {
+			it.invalidate()
+			return
+		}
+		if it.backwardLatched(leaf, key) {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// forwardLatched positions the iterator at the first key after the given
+// key, starting from the read latched leaf and moving right, and releases
+// the latch. It returns false if the next leaf couldn't be latched.
+func (it *Iterator) forwardLatched(leaf *node, key []byte, exclusive bool) bool {
+	for {
+		i := 0
+		if key != nil {
+			var found bool
+			i, found = leaf.search(key, it.bpt.compare)
+			if found && exclusive {
+				i++
+			}
+		}
+		if i < leaf.keyNums {
+			it.setLatched(leaf, i)
+			leaf.latch.RUnlock()
+			return true
+		}
+
+		next := leaf.nextLeafNode()
+		if next == nil {
+			leaf.latch.RUnlock()
+			it.invalidate()
+			return true
+		}
+		if !next.latch.TryRLock() {
+			leaf.latch.RUnlock()
+			return false
+		}
+		leaf.latch.RUnlock()
+		leaf = next
+	}
+}
+
+// backwardLatched positions the iterator at the last key before the given
+// key, starting from the read latched leaf and moving left, and releases
+// the latch. It returns false if the previous leaf couldn't be latched, or
+// has been merged away or split since the link was read.
+func (it *Iterator) backwardLatched(leaf *node, key []byte) bool {
+	for {
+		i := leaf.keyNums - 1
+		if key != nil {
+			i, _ = leaf.search(key, it.bpt.compare)
+			i--
+		}
+		if i >= 0 {
+			it.setLatched(leaf, i)
+			leaf.latch.RUnlock()
+			return true
+		}
+
+		previous := leaf.previousLeafNode()
+		if previous == nil {
+			leaf.latch.RUnlock()
+			it.invalidate()
+			return true
+		}
+		if !previous.latch.TryRLock() {
+			leaf.latch.RUnlock()
+			return false
+		}
+		if previous.dead || previous.nextLeafNode() != leaf {
+			previous.latch.RUnlock()
+			leaf.latch.RUnlock()
+			return false
+		}
+		leaf.latch.RUnlock()
+		leaf = previous
+	}
+}
+
+// stepLatched moves the iterator from its key forward or backward
+func (it *Iterator) stepLatched(forward bool) {
+	bpt := it.bpt
+	bpt.treeLatch.RLock()
+	defer bpt.treeLatch.RUnlock()
+
+	key, leaf := it.key, it.leaf
+	if it.generation == bpt.generation {
+		leaf.latch.RLock()
+		switch {
+		case !it.covers(leaf, key, forward):
+			leaf.latch.RUnlock()
+		case forward:
+			if it.forwardLatched(leaf, key, true) {
+				return
+			}
+		default:
+			if it.backwardLatched(leaf, key) {
+				return
+			}
+		}
+	}
+
+	// look for the key from the root
+	if forward {
+		it.seekLatched(key, true)
+	} else {
+		it.seekLastLatched(key)
+	}
+}
+
+// covers returns true if the keys after the given key, or before it when
+// moving backward, can't have left the read latched leaf for the other side.
+// Keys only leave a leaf at its front for the previous leaf and at its end
+// for the next one.
+func (it *Iterator) covers(leaf *node, key []byte, forward bool) bool {
+	if leaf.dead || leaf.keyNums == 0 {
+		return false
+	}
+	if forward {
+		return it.bpt.compare(leaf.keys[0], key) <= 0
+	}
+	return it.bpt.compare(leaf.keys[leaf.keyNums-1], key) >= 0
+}
+
+// Iterators of GlobalLock trees remember the pair at their position too,
+// and keep using their leaf as long as no writer has locked the tree since.
+
+// cacheLocked remembers the pair at the position of the iterator
+func (it *Iterator) cacheLocked() {
+	if it.leaf == nil || it.i >= it.leaf.keyNums {
+		it.invalidate()
+		return
+	}
+	it.key, it.value = it.leaf.keys[it.i], it.leaf.pointers[it.i].convertToValue()
+	it.generation = it.bpt.generation
+}
+
+// stepLocked moves the iterator of a GlobalLock tree from its key forward
+// or backward, the key is looked for again if the tree has been written.
+func (it *Iterator) stepLocked(forward bool) {
+	bpt := it.bpt
+	bpt.treeLatch.RLock()
+	defer bpt.treeLatch.RUnlock()
+	defer it.cacheLocked()
+
+	switch {
+	case it.generation == bpt.generation && forward:
+		it.i++
+	case it.generation == bpt.generation:
+		it.i--
+	case bpt.root == nil:
+		it.leaf = nil
+		return
+	default:
+		it.leaf, it.i = bpt.seekLeaf(it.key, ScanOptions{ExcludeStart: forward})
+		if !forward {
+			it.i--
+		}
+	}
+
+	if it.i == it.leaf.keyNums {
+		it.leaf, it.i = it.leaf.nextLeafNode(), 0
+	} else if it.i < 0 {
+		it.leaf = it.leaf.previousLeafNode()
+		if it.leaf != nil {
+			it.i = it.leaf.keyNums - 1
+		}
+	}
+}
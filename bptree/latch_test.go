@@ -0,0 +1,412 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetConcurrency(t *testing.T) {
+	_, err := NewBPlusTree(SetConcurrency(Concurrency(-1)))
+	assert.Error(t, err)
+	_, err = NewBPlusTree(SetConcurrency(CopyOnWrite + 1))
+	assert.Error(t, err)
+}
+
+func TestLatchCrabbingSequential(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	universe := 3000
+
+	for order := 3; order <= 8; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order), SetConcurrency(LatchCrabbing))
+		expected := make(map[int]bool)
+		for i := 0; i < 4*universe; i++ {
+			k := r.Intn(universe)
+			if r.Intn(3) == 0 {
+				_, deleted := bpt.Delete(uint32Key(k))
+				assert.Equal(t, expected[k], deleted)
+				delete(expected, k)
+			} else {
+				bpt.Put(uint32Key(k), uint32Key(k))
+				expected[k] = true
+			}
+		}
+		assert.NoError(t, bpt.Validate())
+		assert.Equal(t, len(expected), bpt.Size())
+
+		count := 0
+		for it := bpt.Iterator(); it.Valid(); count++ {
+			key, value := it.Next()
+			assert.Equal(t, key, value)
+		}
+		assert.Equal(t, len(expected), count)
+
+		it := bpt.Iterator()
+		for it.SeekToLast(); it.Valid(); count-- {
+			it.Prev()
+		}
+		assert.Equal(t, 0, count)
+
+		for k := 0; k < universe; k++ {
+			_, ok := bpt.Get(uint32Key(k))
+			assert.Equal(t, expected[k], ok)
+		}
+	}
+}
+
+func TestLatchCrabbingConcurrentWriters(t *testing.T) {
+	writers, keysPerWriter, stableKeys, ops := 8, 400, 40, 1000
+
+	for _, order := range []int{3, 4, 16} {
+		bpt, _ := NewBPlusTree(SetOrder(order), SetConcurrency(LatchCrabbing))
+		// every writer owns a range of keys, whose first keys are never
+		// touched, so the readers must always see them
+		key := func(writer, i int) []byte {
+			return uint32Key(writer*keysPerWriter + i)
+		}
+		for w := 0; w < writers; w++ {
+			for i := 0; i < stableKeys; i++ {
+				bpt.Put(key(w, i), key(w, i))
+			}
+		}
+
+		var wg sync.WaitGroup
+		expected := make([]map[int]bool, writers)
+		for w := 0; w < writers; w++ {
+			expected[w] = make(map[int]bool)
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(w)))
+				for op := 0; op < ops; op++ {
+					i := stableKeys + r.Intn(keysPerWriter-stableKeys)
+					switch r.Intn(3) {
+					case 0:
+						_, deleted := bpt.Delete(key(w, i))
+						assert.Equal(t, expected[w][i], deleted)
+						delete(expected[w], i)
+					case 1:
+						bpt.Put(key(w, i), key(w, i))
+						expected[w][i] = true
+					default:
+						value, ok := bpt.Get(key(w, i))
+						assert.Equal(t, expected[w][i], ok)
+						if ok {
+							assert.Equal(t, key(w, i), value)
+						}
+					}
+				}
+			}(w)
+		}
+
+		done := make(chan struct{})
+		var readers sync.WaitGroup
+		for _, forward := range []bool{true, false} {
+			readers.Add(1)
+			go func(forward bool) {
+				defer readers.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					stable := 0
+					var previous []byte
+					it := bpt.Iterator()
+					if !forward {
+						it.SeekToLast()
+					}
+					for it.Valid() {
+						var key []byte
+						if forward {
+							key, _ = it.Next()
+						} else {
+							key, _ = it.Prev()
+						}
+						if previous != nil {
+							cmp := bytes.Compare(previous, key)
+							assert.True(t, forward && cmp < 0 || !forward && cmp > 0)
+						}
+						previous = key
+						if int(binary.BigEndian.Uint32(key))%keysPerWriter < stableKeys {
+							stable++
+						}
+					}
+					assert.Equal(t, writers*stableKeys, stable)
+				}
+			}(forward)
+		}
+
+		wg.Wait()
+		close(done)
+		readers.Wait()
+
+		assert.NoError(t, bpt.Validate())
+		size := writers * stableKeys
+		for w := 0; w < writers; w++ {
+			size += len(expected[w])
+			for i := stableKeys; i < keysPerWriter; i++ {
+				_, ok := bpt.Get(key(w, i))
+				assert.Equal(t, expected[w][i], ok)
+			}
+		}
+		assert.Equal(t, size, bpt.Size())
+	}
+}
+
+func TestLatchCrabbingScanWhileDeletingRanges(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetOrder(5), SetConcurrency(LatchCrabbing))
+	for k := 0; k < 5000; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for k := 1000; k < 5000; k += 500 {
+			bpt.DeleteRange(uint32Key(k), uint32Key(k+250), ScanOptions{})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 20; round++ {
+			count := 0
+			bpt.Scan(nil, uint32Key(1000), ScanOptions{}, func(key, value []byte) bool {
+				assert.Equal(t, uint32Key(count), key)
+				count++
+				return true
+			})
+			assert.Equal(t, 1000, count)
+		}
+	}()
+	wg.Wait()
+
+	assert.NoError(t, bpt.Validate())
+	assert.Equal(t, 5000-8*250, bpt.Size())
+}
+
+func TestLatchCrabbingSizeWhileLoading(t *testing.T) {
+	keys, values := sortedPairs(1000)
+	bpt, _ := NewBPlusTree(SetOrder(4), SetConcurrency(LatchCrabbing))
+	loaded := make(chan error)
+	go func() {
+		loaded <- bpt.BulkLoad(NewSliceSource(keys, values))
+	}()
+
+	// the size is either before or after the load
+	for size := 0; size == 0; {
+		size = bpt.Size()
+		assert.True(t, size == 0 || size == 1000)
+		runtime.Gosched()
+	}
+	assert.NoError(t, <-loaded)
+
+	removed := make(chan int)
+	go func() {
+		removed <- bpt.DeleteRange(uint32Key(0), uint32Key(500), ScanOptions{})
+	}()
+	for size := 1000; size == 1000; {
+		size = bpt.Size()
+		assert.True(t, size == 1000 || size == 500)
+		runtime.Gosched()
+	}
+	assert.Equal(t, 500, <-removed)
+}
+
+func TestGlobalLockSequential(t *testing.T) {
+	testSequential(t, GlobalLock)
+}
+
+func TestGlobalLockConcurrentReadersAndWriters(t *testing.T) {
+	testConcurrentReadersAndWriters(t, GlobalLock)
+}
+
+// testSequential runs random puts and deletes on trees of the mode, built
+// with the options, which may leave most leaves empty, and checks all the
+// ways to read them.
+func testSequential(t *testing.T, concurrency Concurrency, options ...Option) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	universe := 3000
+
+	for order := 3; order <= 8; order++ {
+		bpt, _ := NewBPlusTree(append([]Option{SetOrder(order), SetConcurrency(concurrency)}, options...)...)
+		expected := make(map[int]bool)
+		for i := 0; i < 4*universe; i++ {
+			k := r.Intn(universe)
+			if r.Intn(3) == 0 {
+				_, deleted := bpt.Delete(uint32Key(k))
+				assert.Equal(t, expected[k], deleted)
+				delete(expected, k)
+			} else {
+				bpt.Put(uint32Key(k), uint32Key(k))
+				expected[k] = true
+			}
+		}
+		// leave most leaves empty
+		for k := 0; k < universe; k++ {
+			if k%10 != 0 {
+				bpt.Delete(uint32Key(k))
+				delete(expected, k)
+			}
+		}
+		assert.NoError(t, bpt.Validate())
+		assert.Equal(t, len(expected), bpt.Size())
+
+		keys := make([]int, 0, len(expected))
+		for k := range expected {
+			keys = append(keys, k)
+		}
+		sort.Ints(keys)
+
+		i := 0
+		for it := bpt.Iterator(); it.Valid(); i++ {
+			key, value := it.Next()
+			assert.Equal(t, uint32Key(keys[i]), key)
+			assert.Equal(t, key, value)
+		}
+		assert.Equal(t, len(keys), i)
+
+		it := bpt.Iterator()
+		for it.SeekToLast(); it.Valid(); {
+			i--
+			key, _ := it.Prev()
+			assert.Equal(t, uint32Key(keys[i]), key)
+		}
+		assert.Equal(t, 0, i)
+
+		for k := 0; k < universe; k++ {
+			_, ok := bpt.Get(uint32Key(k))
+			assert.Equal(t, expected[k], ok)
+
+			it.Seek(uint32Key(k))
+			j := sort.SearchInts(keys, k)
+			assert.Equal(t, j < len(keys), it.Valid())
+			if j < len(keys) {
+				assert.Equal(t, uint32Key(keys[j]), it.Key())
+			}
+		}
+	}
+}
+
+// testConcurrentReadersAndWriters runs writers of disjoint key ranges
+// against lookups, scans and backward iterations on trees of the mode,
+// built with the options.
+func testConcurrentReadersAndWriters(t *testing.T, concurrency Concurrency, options ...Option) {
+	writers, keysPerWriter, stableKeys, ops := 8, 400, 40, 1000
+
+	for _, order := range []int{3, 4, 16} {
+		bpt, _ := NewBPlusTree(append([]Option{SetOrder(order), SetConcurrency(concurrency)}, options...)...)
+		key := func(writer, i int) []byte {
+			return uint32Key(writer*keysPerWriter + i)
+		}
+		for w := 0; w < writers; w++ {
+			for i := 0; i < stableKeys; i++ {
+				bpt.Put(key(w, i), key(w, i))
+			}
+		}
+
+		var wg sync.WaitGroup
+		expected := make([]map[int]bool, writers)
+		for w := 0; w < writers; w++ {
+			expected[w] = make(map[int]bool)
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(w)))
+				for op := 0; op < ops; op++ {
+					i := stableKeys + r.Intn(keysPerWriter-stableKeys)
+					if r.Intn(3) == 0 {
+						_, deleted := bpt.Delete(key(w, i))
+						assert.Equal(t, expected[w][i], deleted)
+						delete(expected[w], i)
+					} else {
+						bpt.Put(key(w, i), key(w, i))
+						expected[w][i] = true
+					}
+				}
+			}(w)
+		}
+
+		done := make(chan struct{})
+		var readers sync.WaitGroup
+		readers.Add(3)
+		go func() {
+			defer readers.Done()
+			r := rand.New(rand.NewSource(time.Now().Unix()))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w, i := r.Intn(writers), r.Intn(stableKeys)
+				value, ok := bpt.Get(key(w, i))
+				assert.True(t, ok)
+				assert.Equal(t, key(w, i), value)
+			}
+		}()
+		for _, forward := range []bool{true, false} {
+			go func(forward bool) {
+				defer readers.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					stable := 0
+					var previous []byte
+					count := func(key []byte) {
+						if previous != nil {
+							cmp := bytes.Compare(previous, key)
+							assert.True(t, forward && cmp < 0 || !forward && cmp > 0)
+						}
+						previous = key
+						if int(binary.BigEndian.Uint32(key))%keysPerWriter < stableKeys {
+							stable++
+						}
+					}
+					if forward {
+						bpt.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+							count(key)
+							return true
+						})
+					} else {
+						it := bpt.Iterator()
+						for it.SeekToLast(); it.Valid(); {
+							key, _ := it.Prev()
+							count(key)
+						}
+					}
+					assert.Equal(t, writers*stableKeys, stable)
+				}
+			}(forward)
+		}
+
+		wg.Wait()
+		close(done)
+		readers.Wait()
+
+		assert.NoError(t, bpt.Validate())
+		size := writers * stableKeys
+		for w := 0; w < writers; w++ {
+			size += len(expected[w])
+			for i := stableKeys; i < keysPerWriter; i++ {
+				_, ok := bpt.Get(key(w, i))
+				assert.Equal(t, expected[w][i], ok)
+			}
+		}
+		assert.Equal(t, size, bpt.Size())
+	}
+}
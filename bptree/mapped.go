@@ -0,0 +1,373 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// A mapped tree serves a serialized tree in place from the file mapped into
+// memory, so the processes mapping the same file share its pages through
+// the page cache. Opening it reads the sparse index written after the
+// pairs, without decoding them. A lookup searches the index, then decodes
+// the pairs of a single block.
+
+const (
+	// the footer is the number of pairs, the order and the checksum
+	serialFooterLen = 8 + 4 + 4
+	serialHeaderLen = len(serialMagic) + 2
+)
+
+// MappedTree is a read-only tree mapped from a file written by WriteTo.
+// Unless it has the CopyOnGet copy mode, the keys and values it returns
+// point into the mapping: they must not be modified, nor used after Close.
+// It is safe for concurrent readers.
+type MappedTree struct {
+	bpt *BPlusTree
+	t   *mappedTree
+}
+
+// OpenMapped maps the serialized tree in the file at path. It checks the
+// header, the footer and the index only, so its cost doesn't grow with the
+// pairs, call Verify to check the whole file. It takes the options of
+// NewBPlusTree, the comparator must be the one the tree was written with.
+// A page file can't be set.
+func OpenMapped(path string, options ...Option) (*MappedTree, error) {
+	bpt, err := NewBPlusTree(options...)
+	if err != nil {
+		return nil, err
+	}
+	if bpt.pageFile != "" {
+		bpt.Close()
+		return nil, errors.New("a mapped tree can't have a page file")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// the mapping outlives the file
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < int64(serialHeaderLen) {
+		return nil, ErrUnknownFormat
+	}
+	if info.Size() != int64(int(info.Size())) {
+		return nil, fmt.Errorf("%s is too large to map", path)
+	}
+	data, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &mappedTree{bpt: bpt, data: data}
+	if err := t.load(); err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+	bpt.engine = t
+	return &MappedTree{bpt: bpt, t: t}, nil
+}
+
+// Get returns the value and true if the given key exists,
+// otherwise nil and false.
+func (m *MappedTree) Get(key []byte) ([]byte, bool) {
+	return m.bpt.Get(key)
+}
+
+// Scan traverses the pairs of kv of the tree like BPlusTree.Scan.
+func (m *MappedTree) Scan(start, end []byte, opts ScanOptions, action func(key, value []byte) bool) {
+	m.bpt.Scan(start, end, opts, action)
+}
+
+// Iterator returns an iterator over the tree in ascending key order.
+func (m *MappedTree) Iterator() *Iterator {
+	return m.bpt.Iterator()
+}
+
+// Size returns the number of keys of the tree.
+func (m *MappedTree) Size() int {
+	return m.bpt.Size()
+}
+
+// Rank returns the number of keys less than the given key like
+// BPlusTree.Rank, mapped trees always count their keys.
+func (m *MappedTree) Rank(key []byte) (int, error) {
+	return m.bpt.Rank(key)
+}
+
+// Select returns the pair of kv whose key has the given rank like
+// BPlusTree.Select.
+func (m *MappedTree) Select(i int) ([]byte, []byte, error) {
+	return m.bpt.Select(i)
+}
+
+// Verify checks the checksum of the file and that its pairs are sorted by
+// the comparator of the tree and match its index, and returns ErrCorrupted
+// if they don't. Until then, a damaged file reads as garbage.
+func (m *MappedTree) Verify() error {
+	return m.t.verify()
+}
+
+// Close unmaps the file. The tree, its iterators and the keys and
+// values it returned must not be used afterwards.
+func (m *MappedTree) Close() error {
+	return unmapFile(m.t.data)
+}
+
+// mappedTree is the engine of mapped trees, the leaf of a
+// position is the offset of its pair in the data.
+type mappedTree struct {
+	bpt  *BPlusTree
+	data []byte
+
+	// the offset of every serialIndexInterval-th pair from the first,
+	// and of the 0 ending the pairs
+	index []int
+	end   int
+	count int
+}
+
+// load checks the header and the footer of the serialized tree and reads
+// its index
+func (t *mappedTree) load() error {
+	data := t.data
+	if string(data[:len(serialMagic)]) != serialMagic ||
+		binary.BigEndian.Uint16(data[len(serialMagic):]) != serialVersion {
+		return ErrUnknownFormat
+	}
+	if len(data) < serialHeaderLen+1+serialFooterLen {
+		return ErrCorrupted
+	}
+	count := binary.BigEndian.Uint64(data[len(data)-serialFooterLen:])
+	blocks := (count + serialIndexInterval - 1) / serialIndexInterval
+	if blocks > uint64(len(data)-serialHeaderLen-1-serialFooterLen)/8 {
+		return ErrCorrupted
+	}
+	start := len(data) - serialFooterLen - 8*int(blocks)
+	end := start - 1
+	if data[end] != 0 || count == 0 && end != serialHeaderLen {
+		return ErrCorrupted
+	}
+
+	index := make([]int, blocks)
+	for i := range index {
+		offset := binary.BigEndian.Uint64(data[start+8*i:])
+		if offset >= uint64(end) || i == 0 && int(offset) != serialHeaderLen || i > 0 && int(offset) <= index[i-1] {
+			return ErrCorrupted
+		}
+		index[i] = int(offset)
+	}
+	t.index, t.end, t.count = index, end, int(count)
+	return nil
+}
+
+// verify checks the checksum, then decodes every pair, checking that the
+// keys ascend and that the index holds the offset of every block
+func (t *mappedTree) verify() error {
+	data := t.data
+	if crc32.Checksum(data[:len(data)-4], crcTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return ErrCorrupted
+	}
+	var last []byte
+	offset, count := serialHeaderLen, 0
+	for ; offset < t.end; count++ {
+		if count%serialIndexInterval == 0 &&
+			(count/serialIndexInterval >= len(t.index) || t.index[count/serialIndexInterval] != offset) {
+			return ErrCorrupted
+		}
+		key, _, next, ok := decodePair(data[:t.end], offset)
+		if !ok || key == nil {
+			return ErrCorrupted
+		}
+		if count > 0 && t.bpt.compare(last, key) >= 0 {
+			// the keys were sorted by another comparator, or damaged
+			return ErrCorrupted
+		}
+		last, offset = key, next
+	}
+	if count != t.count {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// decodePair returns the pair at the offset of the data and the offset of
+// the next one, or a nil key at the end of the pairs. It returns false if
+// the pair doesn't fit in the data.
+func decodePair(data []byte, offset int) ([]byte, []byte, int, bool) {
+	keyLen, n := binary.Uvarint(data[offset:])
+	if n <= 0 {
+		return nil, nil, 0, false
+	}
+	offset += n
+	if keyLen == 0 {
+		return nil, nil, offset, true
+	}
+	if keyLen-1 > uint64(len(data)-offset) {
+		return nil, nil, 0, false
+	}
+	key := data[offset : offset+int(keyLen-1)]
+	offset += len(key)
+
+	valueLen, n := binary.Uvarint(data[offset:])
+	if n <= 0 {
+		return nil, nil, 0, false
+	}
+	offset += n
+	if valueLen > uint64(len(data)-offset) {
+		return nil, nil, 0, false
+	}
+	value := data[offset : offset+int(valueLen)]
+	return key, value, offset + len(value), true
+}
+
+// pair returns the pair at the offset and the offset of the next one, or
+// a nil key and the end of the pairs at the end or if the pair is damaged
+func (t *mappedTree) pair(offset int) ([]byte, []byte, int) {
+	key, value, next, ok := decodePair(t.data[:t.end], offset)
+	if !ok {
+		return nil, nil, t.end
+	}
+	return key, value, next
+}
+
+// after returns true if the key comes after the bound, or is the bound
+// itself unless exclusive
+func (t *mappedTree) after(key, bound []byte, exclusive bool) bool {
+	c := t.bpt.compare(key, bound)
+	return c > 0 || c == 0 && !exclusive
+}
+
+// lowerBound returns the offset of the first pair after the key, or of the
+// key itself unless exclusive, or the end of the pairs if there is none.
+func (t *mappedTree) lowerBound(key []byte, exclusive bool) int {
+	offset, _ := t.lowerBoundRank(key, exclusive)
+	return offset
+}
+
+// lowerBoundRank is lowerBound, it also returns the rank of the pair
+func (t *mappedTree) lowerBoundRank(key []byte, exclusive bool) (int, int) {
+	// the pair is in the block before the first one starting after the key
+	block := sort.Search(len(t.index), func(i int) bool {
+		k, _, _ := t.pair(t.index[i])
+		return t.after(k, key, exclusive)
+	})
+	offset, rank := serialHeaderLen, 0
+	if block > 0 {
+		offset, rank = t.index[block-1], (block-1)*serialIndexInterval
+	}
+	skipped, skips := t.skip(offset, key, exclusive)
+	return skipped, rank + skips
+}
+
+// skip returns the offset of the first pair from the offset on which comes
+// after the key, or is the key itself unless exclusive, and the number of
+// pairs skipped
+func (t *mappedTree) skip(offset int, key []byte, exclusive bool) (int, int) {
+	skips := 0
+	for offset < t.end {
+		k, _, next := t.pair(offset)
+		if t.after(k, key, exclusive) {
+			break
+		}
+		offset = next
+		skips++
+	}
+	return offset, skips
+}
+
+func (t *mappedTree) get(key []byte) ([]byte, bool) {
+	k, value, _ := t.pair(t.lowerBound(key, false))
+	if k == nil || t.bpt.compare(k, key) != 0 {
+		return nil, false
+	}
+	return value, true
+}
+
+func (t *mappedTree) put(key, value []byte) ([]byte, bool) {
+	panic("bptree: mapped trees are read-only")
+}
+
+func (t *mappedTree) delete(key []byte) ([]byte, bool) {
+	panic("bptree: mapped trees are read-only")
+}
+
+func (t *mappedTree) bulkLoad(src KVSource) error {
+	panic("bptree: mapped trees are read-only")
+}
+
+func (t *mappedTree) len() int {
+	return t.count
+}
+
+func (t *mappedTree) seek(leaf interface{}, key []byte, exclusive bool) (interface{}, []byte, []byte) {
+	var offset int
+	if key == nil {
+		offset = serialHeaderLen
+	} else if hint, ok := leaf.(int); ok {
+		offset, _ = t.skip(hint, key, exclusive)
+	} else {
+		offset = t.lowerBound(key, exclusive)
+	}
+	k, value, _ := t.pair(offset)
+	if k == nil {
+		return nil, nil, nil
+	}
+	return offset, k, value
+}
+
+func (t *mappedTree) last(bound []byte) (interface{}, []byte, []byte) {
+	// the last block starting before the bound holds the last key before it
+	block := len(t.index)
+	if bound != nil {
+		block = sort.Search(len(t.index), func(i int) bool {
+			k, _, _ := t.pair(t.index[i])
+			return t.after(k, bound, false)
+		})
+	}
+	if block == 0 {
+		return nil, nil, nil
+	}
+	found := t.index[block-1]
+	for offset := found; offset < t.end; {
+		k, _, next := t.pair(offset)
+		if k == nil || bound != nil && t.after(k, bound, false) {
+			break
+		}
+		found, offset = offset, next
+	}
+	k, value, _ := t.pair(found)
+	if k == nil {
+		return nil, nil, nil
+	}
+	return found, k, value
+}
+
+func (t *mappedTree) rank(key []byte) int {
+	_, rank := t.lowerBoundRank(key, false)
+	return rank
+}
+
+// selectAt starts from the indexed pair before the rank
+func (t *mappedTree) selectAt(i int) ([]byte, []byte) {
+	if i >= t.count {
+		return nil, nil
+	}
+	offset := t.index[i/serialIndexInterval]
+	for j := 0; j < i%serialIndexInterval; j++ {
+		_, _, offset = t.pair(offset)
+	}
+	key, value, _ := t.pair(offset)
+	return key, value
+}
+
+func (t *mappedTree) validate() error {
+	return t.verify()
+}
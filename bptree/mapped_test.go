@@ -0,0 +1,199 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeMapped writes the tree serialized to a new file and returns its path
+func writeMapped(t *testing.T, bpt *BPlusTree) string {
+	path := filepath.Join(t.TempDir(), "tree")
+	data, err := bpt.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestMapped(t *testing.T) {
+	for _, size := range []int{0, 1, 31, 32, 33, 1000} {
+		// even keys only, the odd ones are missing
+		keys, values := sortedPairs(2 * size)
+		bpt, _ := NewBPlusTree()
+		for i := 0; i < size; i++ {
+			bpt.Put(keys[2*i], values[2*i])
+		}
+		m, err := OpenMapped(writeMapped(t, bpt))
+		assert.NoError(t, err)
+		assert.Equal(t, size, m.Size())
+		assert.NoError(t, m.bpt.Validate())
+
+		for i, key := range keys {
+			value, ok := m.Get(key)
+			assert.Equal(t, i%2 == 0, ok, "key %d", i)
+			if ok {
+				assert.Equal(t, values[i], value)
+			}
+		}
+
+		bounds := [][]byte{nil, {}, {0xff}}
+		if size > 0 {
+			bounds = append(bounds, keys[0], keys[size], keys[2*size-2], keys[2*size-1])
+		}
+		for _, start := range bounds {
+			for _, end := range bounds {
+				for _, opts := range []ScanOptions{{}, {ExcludeStart: true}, {IncludeEnd: true}, {ExcludeStart: true, IncludeEnd: true}} {
+					assert.Equal(t, scanKeys(bpt, start, end, opts), scanKeys(m.bpt, start, end, opts))
+				}
+			}
+		}
+
+		// both ways through the iterator
+		it := m.Iterator()
+		for i := 0; i < size; i++ {
+			key, value := it.Next()
+			assert.Equal(t, keys[2*i], key)
+			assert.Equal(t, values[2*i], value)
+		}
+		assert.False(t, it.Valid())
+		it.SeekToLast()
+		for i := size - 1; i >= 0; i-- {
+			key, _ := it.Prev()
+			assert.Equal(t, keys[2*i], key)
+		}
+		assert.False(t, it.Valid())
+		for i := 0; i < 2*size; i++ {
+			it.Seek(keys[i])
+			if i == 2*size-1 {
+				assert.False(t, it.Valid())
+			} else {
+				assert.Equal(t, keys[i+i%2], it.Key())
+			}
+		}
+		assert.NoError(t, m.Close())
+	}
+}
+
+func TestMappedZeroCopy(t *testing.T) {
+	keys, values := sortedPairs(100)
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values))
+	path := writeMapped(t, bpt)
+
+	// the pairs point into the mapping, unless copied on get
+	inMapping := func(m *MappedTree, p []byte) bool {
+		start := uintptr(unsafe.Pointer(&m.t.data[0]))
+		at := uintptr(unsafe.Pointer(&p[0]))
+		return at >= start && at < start+uintptr(len(m.t.data))
+	}
+	for _, mode := range []CopyMode{0, CopyOnGet} {
+		m, err := OpenMapped(path, SetCopyMode(mode))
+		assert.NoError(t, err)
+		value, _ := m.Get(keys[50])
+		assert.Equal(t, values[50], value)
+		assert.Equal(t, mode == 0, inMapping(m, value))
+		m.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+			assert.Equal(t, mode == 0, inMapping(m, key))
+			return true
+		})
+		assert.NoError(t, m.Close())
+	}
+
+	// many trees map the same file
+	a, _ := OpenMapped(path)
+	b, _ := OpenMapped(path)
+	va, _ := a.Get(keys[10])
+	vb, _ := b.Get(keys[10])
+	assert.Equal(t, va, vb)
+	assert.NoError(t, a.Close())
+	assert.NoError(t, b.Close())
+}
+
+func TestMappedCorrupted(t *testing.T) {
+	keys, values := sortedPairs(100)
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values))
+	data, _ := bpt.MarshalBinary()
+	path := filepath.Join(t.TempDir(), "tree")
+	open := func(data []byte, options ...Option) error {
+		assert.NoError(t, os.WriteFile(path, data, 0644))
+		m, err := OpenMapped(path, options...)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+
+		// damaged pairs aren't checked by OpenMapped, they read as
+		// garbage until verified
+		for _, key := range keys {
+			m.Get(key)
+			m.Rank(key)
+		}
+		for i := 0; i < m.Size(); i++ {
+			m.Select(i)
+		}
+		m.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+			return true
+		})
+		it := m.Iterator()
+		for it.SeekToLast(); it.Valid(); {
+			it.Prev()
+		}
+		return m.Verify()
+	}
+
+	// the pairs are only checked once verified
+	damaged := append([]byte(nil), data...)
+	damaged[serialHeaderLen+1] ^= 0x10
+	assert.NoError(t, os.WriteFile(path, damaged, 0644))
+	m, err := OpenMapped(path)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, m.Verify(), ErrCorrupted)
+	assert.ErrorIs(t, m.bpt.Validate(), ErrCorrupted)
+	m.Close()
+
+	for i := range data {
+		damaged := append([]byte(nil), data...)
+		damaged[i] ^= 0x10
+		assert.Error(t, open(damaged), "byte %d", i)
+		assert.Error(t, open(data[:i]), "truncated at %d", i)
+	}
+	assert.ErrorIs(t, open(append(data, 0)), ErrCorrupted)
+	assert.ErrorIs(t, open([]byte("not a tree")), ErrUnknownFormat)
+	newer := append([]byte(nil), data...)
+	newer[len(serialMagic)+1]++
+	assert.ErrorIs(t, open(newer), ErrUnknownFormat)
+
+	// a length past the end of the pairs, with a matching checksum
+	long := append([]byte(nil), data[:serialHeaderLen]...)
+	long = append(long, 0xff, 0x01, 0)
+	long = append(long, make([]byte, 8+serialFooterLen)...)
+	binary.BigEndian.PutUint64(long[serialHeaderLen+3:], uint64(serialHeaderLen))
+	binary.BigEndian.PutUint64(long[serialHeaderLen+3+8:], 1)
+	binary.BigEndian.PutUint32(long[len(long)-4:], crc32.Checksum(long[:len(long)-4], crcTable))
+	assert.ErrorIs(t, open(long), ErrCorrupted)
+
+	// the keys aren't sorted by the comparator of the tree
+	assert.ErrorIs(t, open(data, SetComparator(func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	})), ErrCorrupted)
+
+	assert.NoError(t, open(data))
+	_, err = OpenMapped(path, SetPageFile(filepath.Join(t.TempDir(), "pages")))
+	assert.Error(t, err)
+	_, err = OpenMapped(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestMappedReadOnly(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	bpt.Put([]byte("key"), []byte("value"))
+	m, _ := OpenMapped(writeMapped(t, bpt))
+	defer m.Close()
+	assert.Panics(t, func() { m.bpt.Put([]byte("key"), nil) })
+	assert.Panics(t, func() { m.bpt.Delete([]byte("key")) })
+}
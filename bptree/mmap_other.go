@@ -0,0 +1,23 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package bptree
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of the file into memory,
+// where mapping it isn't supported.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, int64(size)), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmapFile releases the memory returned by mapFile
+func unmapFile(data []byte) error {
+	return nil
+}
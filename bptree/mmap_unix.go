@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package bptree
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of the file read-only into memory,
+// sharing its pages with every process mapping it.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile unmaps the memory returned by mapFile
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -1,10 +1,15 @@
 package bptree
 
 import (
-	"bytes"
 	"errors"
+	"sync"
+	"sync/atomic"
 )
 
+// linearSearchThreshold is the number of keys up to which a node is
+// searched linearly, binary search does not pay off for tiny nodes.
+const linearSearchThreshold = 8
+
 type node struct {
 	// true for leaf node and false for internal node
 	leaf   bool
@@ -21,6 +26,37 @@ type node struct {
 	// The size of pointers equals to the size of key + 1,
 	// in leaf node, the last pointer pointed to the next leaf node.
 	pointers []*pointer
+
+	// only for leaf node, pointed to the previous leaf node. It's
+	// accessed atomically, since splits and merges update it without
+	// latching the node.
+	previous atomic.Value
+
+	// guards the node under LatchCrabbing
+	latch sync.RWMutex
+
+	// true once the node has been merged away or removed from the tree
+	dead bool
+
+	// only for internal node, the number of keys in its subtree.
+	// It's not maintained in latched trees, see counted.
+	count int
+}
+
+// keyCount returns the number of keys in the subtree of the node
+func (n *node) keyCount() int {
+	if n.leaf {
+		return n.keyNums
+	}
+	return n.count
+}
+
+// recount sums the key counts of the children of the internal node
+func (n *node) recount() {
+	n.count = 0
+	for i := 0; i <= n.keyNums; i++ {
+		n.count += n.pointers[i].convertToNode().keyCount()
+	}
 }
 
 // append appends the key and pointer to node
@@ -76,17 +112,96 @@ func (n *node) deleteAt(keyPosition, pointerPosition int) {
 	n.keyNums--
 }
 
+// deleteRange deletes the keys in [keyFrom, keyTo) and the pointers in
+// [pointerFrom, pointerFrom+keyTo-keyFrom).
+func (n *node) deleteRange(keyFrom, keyTo, pointerFrom int) {
+	count := keyTo - keyFrom
+	if count <= 0 {
+		return
+	}
+	pointerNums := n.keyNums
+	if !n.leaf {
+		pointerNums++
+	}
+
+	copy(n.keys[keyFrom:], n.keys[keyTo:n.keyNums])
+	for i := n.keyNums - count; i < n.keyNums; i++ {
+		n.keys[i] = nil
+	}
+	copy(n.pointers[pointerFrom:], n.pointers[pointerFrom+count:pointerNums])
+	for i := pointerNums - count; i < pointerNums; i++ {
+		n.pointers[i] = nil
+	}
+
+	n.keyNums -= count
+}
+
 // keyPosition returns key position of the given key
 // if it exists, otherwise -1
-func (n *node) keyPosition(key []byte) int {
-	for keyPosition := 0; keyPosition < n.keyNums; keyPosition++ {
-		if bytes.Compare(key, n.keys[keyPosition]) == 0 {
-			return keyPosition
-		}
+func (n *node) keyPosition(key []byte, compare func(a, b []byte) int) int {
+	if position, found := n.search(key, compare); found {
+		return position
 	}
 	return -1
 }
 
+// search returns the position of the first key which is not less than
+// the given key, and true if the key at that position equals the given key.
+func (n *node) search(key []byte, compare func(a, b []byte) int) (int, bool) {
+	low, high := 0, n.keyNums
+	if n.keyNums > linearSearchThreshold {
+		for low < high {
+			middle := int(uint(low+high) >> 1)
+			if compare(n.keys[middle], key) < 0 {
+				low = middle + 1
+			} else {
+				high = middle
+			}
+		}
+	} else {
+		for low < high && compare(n.keys[low], key) < 0 {
+			low++
+		}
+	}
+	return low, low < n.keyNums && compare(n.keys[low], key) == 0
+}
+
+// upperBound returns the position of the first key which is
+// greater than the given key.
+func (n *node) upperBound(key []byte, compare func(a, b []byte) int) int {
+	low, high := 0, n.keyNums
+	if n.keyNums > linearSearchThreshold {
+		for low < high {
+			middle := int(uint(low+high) >> 1)
+			if compare(key, n.keys[middle]) < 0 {
+				high = middle
+			} else {
+				low = middle + 1
+			}
+		}
+	} else {
+		for low < high && compare(key, n.keys[low]) >= 0 {
+			low++
+		}
+	}
+	return low
+}
+
+// firstPosition returns the position of the first key for which
+// pred returns true, pred must be monotone in key order.
+func (n *node) firstPosition(pred func(key []byte) bool) int {
+	low, high := 0, n.keyNums
+	for low < high {
+		middle := int(uint(low+high) >> 1)
+		if pred(n.keys[middle]) {
+			high = middle
+		} else {
+			low = middle + 1
+		}
+	}
+	return low
+}
+
 // getPointerPositionOfNode returns the pointer position of
 // the given node, but -1 if not found.
 func (n *node) getPointerPositionOfNode(target *node) int {
@@ -117,6 +232,28 @@ func (n *node) pointerToNextLeafNode() *pointer {
 	return n.pointers[len(n.pointers)-1]
 }
 
+// nextLeafNode returns the next leaf node, or nil if
+// the node is the most right leaf.
+func (n *node) nextLeafNode() *node {
+	lastPointer := n.pointerToNextLeafNode()
+	if lastPointer == nil {
+		return nil
+	}
+	return lastPointer.convertToNode()
+}
+
+// previousLeafNode returns the previous leaf node, or nil if
+// the node is the most left leaf.
+func (n *node) previousLeafNode() *node {
+	previous, _ := n.previous.Load().(*node)
+	return previous
+}
+
+// setPreviousLeafNode sets the previous leaf node
+func (n *node) setPreviousLeafNode(previous *node) {
+	n.previous.Store(previous)
+}
+
 // copyFromRight copies the keys and the pointer from the given node.
 func (n *node) copyFromRight(from *node) {
 	for i := 0; i < from.keyNums; i++ {
@@ -125,6 +262,9 @@ func (n *node) copyFromRight(from *node) {
 
 	if n.leaf {
 		n.setLastPointer(from.pointerToNextLeafNode())
+		if next := n.nextLeafNode(); next != nil {
+			next.setPreviousLeafNode(n)
+		}
 	} else {
 		n.pointers[n.keyNums] = from.pointers[from.keyNums]
 		n.pointers[n.keyNums].convertToNode().parent = n
@@ -0,0 +1,40 @@
+package bptree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeSearch(t *testing.T) {
+	for keyNums := 0; keyNums <= 3*linearSearchThreshold; keyNums++ {
+		n := &node{leaf: true, keys: make([][]byte, keyNums), keyNums: keyNums}
+		for i := 0; i < keyNums; i++ {
+			// even keys only: 0, 2, 4, ...
+			n.keys[i] = []byte{byte(2 * i)}
+		}
+
+		for k := -1; k <= 2*keyNums+1; k++ {
+			key := []byte{byte(k)}
+			if k < 0 {
+				key = []byte{}
+			}
+
+			expectedLower, expectedUpper := 0, 0
+			for i := 0; i < keyNums; i++ {
+				if bytes.Compare(n.keys[i], key) < 0 {
+					expectedLower++
+				}
+				if bytes.Compare(n.keys[i], key) <= 0 {
+					expectedUpper++
+				}
+			}
+
+			position, found := n.search(key, bytes.Compare)
+			assert.Equal(t, expectedLower, position)
+			assert.Equal(t, k >= 0 && k%2 == 0 && k < 2*keyNums, found)
+			assert.Equal(t, expectedUpper, n.upperBound(key, bytes.Compare))
+		}
+	}
+}
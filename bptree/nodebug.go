@@ -0,0 +1,7 @@
+//go:build !bptreedebug
+
+package bptree
+
+// debug enables the validation of the tree after every mutation,
+// build with -tags bptreedebug to turn it on.
+const debug = false
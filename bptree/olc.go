@@ -0,0 +1,705 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Optimistic lock coupling (Leis et al.) gives every node a version word,
+// which is odd while a writer holds the node and bumped when it releases
+// it. Readers never write shared memory: they read the version of a node
+// before using it and check it afterwards, and restart from the root if it
+// changed. Checking the parent after reading the version of the child
+// makes the step between them consistent. Writers lock a node by swapping
+// in the odd version only if it still holds the version they read, so
+// they never wait while holding a lock, and restart on failure too.
+// The content of a node is immutable once published like in a B-link tree,
+// which keeps readers of a node being modified away from torn reads.
+// Full nodes are split on the way down, so a split always finds room in
+// the parent. Deletions don't rebalance, leaves may get empty.
+//
+// Internal nodes count the keys of their subtrees. The counts are kept
+// apart from the versions, so that readers don't restart whenever a key
+// is put or deleted: a writer changing the number of keys of a leaf adds
+// to the counts from the root down, holding the count latch of a node
+// until it has added to the child, and publishes the leaf holding the
+// latch of its parent. A split of an internal node holds the count
+// latches of the node and of its parent, so it finds the counts of the
+// children in step with their keys.
+
+// olcNode is a node of the OLC tree
+type olcNode struct {
+	// odd while a writer holds the node, first for the alignment
+	version uint64
+
+	// the number of keys of the subtree of an internal node,
+	// accessed atomically and changed under countLatch
+	count      int64
+	countLatch sync.Mutex
+
+	// the current *olcContent of the node
+	content atomic.Value
+}
+
+// olcContent is the immutable content of an olcNode
+type olcContent struct {
+	leaf bool
+	keys [][]byte
+
+	// only for leaf node, one value per key
+	values [][]byte
+
+	// only for internal node, one child more than keys
+	children []*olcNode
+
+	// only for leaf node, the neighbouring leaves
+	previous, next *olcNode
+}
+
+func newOLCNode(c *olcContent) *olcNode {
+	n := &olcNode{}
+	n.content.Store(c)
+	return n
+}
+
+// load returns the current content of the node
+func (n *olcNode) load() *olcContent {
+	return n.content.Load().(*olcContent)
+}
+
+// store publishes the new content of the locked node
+func (n *olcNode) store(c *olcContent) {
+	n.content.Store(c)
+}
+
+// keyCount returns the number of keys of the subtree of the node
+func (n *olcNode) keyCount() int {
+	if c := n.load(); c.leaf {
+		return len(c.keys)
+	}
+	return int(atomic.LoadInt64(&n.count))
+}
+
+// readVersion returns the version of the word and false if it's locked
+func readVersion(word *uint64) (uint64, bool) {
+	version := atomic.LoadUint64(word)
+	return version, version&1 == 0
+}
+
+// checkVersion returns true if the word still holds the version
+func checkVersion(word *uint64, version uint64) bool {
+	return atomic.LoadUint64(word) == version
+}
+
+// upgradeVersion locks the word if it still holds the version
+func upgradeVersion(word *uint64, version uint64) bool {
+	return atomic.CompareAndSwapUint64(word, version, version+1)
+}
+
+// lockVersion locks the word whatever version it holds, waiting for its holder
+func lockVersion(word *uint64) {
+	for {
+		if version, ok := readVersion(word); ok && upgradeVersion(word, version) {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// unlockVersion unlocks the word locked by upgradeVersion with a new version
+func unlockVersion(word *uint64) {
+	atomic.AddUint64(word, 1)
+}
+
+// olcTree is the engine of OptimisticLockCoupling mode
+type olcTree struct {
+	// the version word of the root pointer, locked to replace the root
+	rootVersion uint64
+
+	// the number of keys, accessed atomically
+	size int64
+
+	bpt *BPlusTree
+
+	// the current *olcNode at the top
+	root atomic.Value
+}
+
+func newOLCTree(bpt *BPlusTree) *olcTree {
+	t := &olcTree{bpt: bpt}
+	t.root.Store(newOLCNode(&olcContent{leaf: true}))
+	return t
+}
+
+func (t *olcTree) rootNode() *olcNode {
+	return t.root.Load().(*olcNode)
+}
+
+// search returns the position of the first key which is not less than
+// the given key and true if that key equals the given key.
+func (t *olcTree) search(c *olcContent, key []byte) (int, bool) {
+	position := sort.Search(len(c.keys), func(i int) bool {
+		return t.bpt.compare(c.keys[i], key) >= 0
+	})
+	return position, position < len(c.keys) && t.bpt.compare(c.keys[position], key) == 0
+}
+
+// childPosition returns the position of the child which covers the given
+// key, or of the most left child for a nil key.
+func (t *olcTree) childPosition(c *olcContent, key []byte) int {
+	if key == nil {
+		return 0
+	}
+	return sort.Search(len(c.keys), func(i int) bool {
+		return t.bpt.compare(key, c.keys[i]) < 0
+	})
+}
+
+// descent is the position of an optimistic descent: the node, the version
+// it was read at, its content checked against that version, and the
+// version word guarding the link to the node with the version it was read at.
+type descent struct {
+	n       *olcNode
+	version uint64
+	c       *olcContent
+
+	parent        *olcNode
+	parentVersion uint64
+}
+
+// start reads the root, it returns false if the root is being replaced
+func (t *olcTree) start() (descent, bool) {
+	rootVersion, ok := readVersion(&t.rootVersion)
+	if !ok {
+		return descent{}, false
+	}
+	n := t.rootNode()
+	version, ok := readVersion(&n.version)
+	if !ok || !checkVersion(&t.rootVersion, rootVersion) {
+		return descent{}, false
+	}
+	d := descent{n: n, version: version, parentVersion: rootVersion}
+	return d, d.load()
+}
+
+// load loads the content of the node, it returns false if the node
+// has changed since its version was read.
+func (d *descent) load() bool {
+	d.c = d.n.load()
+	return checkVersion(&d.n.version, d.version)
+}
+
+// down moves to the child at the position, it returns false if a node
+// has changed, then the caller restarts.
+func (d *descent) down(position int) bool {
+	child := d.c.children[position]
+	version, ok := readVersion(&child.version)
+	if !ok || !checkVersion(&d.n.version, d.version) {
+		return false
+	}
+	d.parent, d.parentVersion = d.n, d.version
+	d.n, d.version = child, version
+	return d.load()
+}
+
+// parentWord returns the version word guarding the link to the node
+func (t *olcTree) parentWord(d *descent) *uint64 {
+	if d.parent == nil {
+		return &t.rootVersion
+	}
+	return &d.parent.version
+}
+
+// findLeaf descends to the leaf which covers the given key, or to the most
+// left leaf for a nil key, and restarts until no node changes on the way.
+func (t *olcTree) findLeaf(key []byte) descent {
+	for {
+		if d, ok := t.tryFindLeaf(key); ok {
+			return d
+		}
+		runtime.Gosched()
+	}
+}
+
+func (t *olcTree) tryFindLeaf(key []byte) (descent, bool) {
+	d, ok := t.start()
+	for ok && !d.c.leaf {
+		ok = d.down(t.childPosition(d.c, key))
+	}
+	return d, ok
+}
+
+// get is Get for OLC trees, it takes no lock
+func (t *olcTree) get(key []byte) ([]byte, bool) {
+	d := t.findLeaf(key)
+	if position, found := t.search(d.c, key); found {
+		return d.c.values[position], true
+	}
+	return nil, false
+}
+
+// put is Put for OLC trees, it locks the leaf only,
+// and the parent of a full node while splitting it.
+func (t *olcTree) put(key, value []byte) ([]byte, bool) {
+	for {
+		if old, found, ok := t.tryPut(key, value); ok {
+			return old, found
+		}
+		runtime.Gosched()
+	}
+}
+
+// tryPut puts the pair of kv, splitting the full nodes on the path and
+// restarting after each split. It returns false if any node changed.
+func (t *olcTree) tryPut(key, value []byte) ([]byte, bool, bool) {
+	d, ok := t.start()
+	for ok {
+		if len(d.c.keys) >= t.bpt.order-1 {
+			if !t.trySplit(&d) {
+				return nil, false, false
+			}
+			d, ok = t.start()
+			continue
+		}
+		if !d.c.leaf {
+			ok = d.down(t.childPosition(d.c, key))
+			continue
+		}
+
+		if !upgradeVersion(&d.n.version, d.version) {
+			return nil, false, false
+		}
+		// the content is still the one checked on the way down
+		c, next := d.c, *d.c
+		position, found := t.search(c, key)
+		if found {
+			next.values = replaced(c.values, position, value)
+			d.n.store(&next)
+		} else {
+			next.keys = inserted(c.keys, position, key)
+			next.values = inserted(c.values, position, value)
+			t.storeCounted(d.n, key, &next, 1)
+			atomic.AddInt64(&t.size, 1)
+		}
+		unlockVersion(&d.n.version)
+		if found {
+			return c.values[position], true, true
+		}
+		return nil, false, true
+	}
+	return nil, false, false
+}
+
+// storeCounted publishes the new content of the locked leaf, which covers
+// the key and holds delta keys more, and adds delta to the counts of its
+// ancestors.
+func (t *olcTree) storeCounted(leaf *olcNode, key []byte, c *olcContent, delta int64) {
+	// the root can't be replaced while the leaf is locked if it is the root,
+	// and is checked again once latched otherwise
+	n := t.rootNode()
+	for n != leaf {
+		n.countLatch.Lock()
+		if t.rootNode() == n {
+			break
+		}
+		n.countLatch.Unlock()
+		n = t.rootNode()
+	}
+	if n == leaf {
+		leaf.store(c)
+		return
+	}
+
+	for {
+		atomic.AddInt64(&n.count, delta)
+		nc := n.load()
+		child := nc.children[t.childPosition(nc, key)]
+		if child == leaf {
+			leaf.store(c)
+			n.countLatch.Unlock()
+			return
+		}
+		child.countLatch.Lock()
+		n.countLatch.Unlock()
+		n = child
+	}
+}
+
+// trySplit splits the full node of the descent, whose parent has room
+// since full nodes are split on the way down. It locks the parent, the
+// node and, for a leaf, its next leaf, and returns false if any of them
+// has changed since it was read. It then holds the count latches of the
+// parent and of an internal node while it moves its children.
+func (t *olcTree) trySplit(d *descent) bool {
+	parentWord := t.parentWord(d)
+	if !upgradeVersion(parentWord, d.parentVersion) {
+		return false
+	}
+	defer unlockVersion(parentWord)
+	if !upgradeVersion(&d.n.version, d.version) {
+		return false
+	}
+	defer unlockVersion(&d.n.version)
+
+	if !d.c.leaf {
+		if d.parent != nil {
+			d.parent.countLatch.Lock()
+			defer d.parent.countLatch.Unlock()
+		}
+		d.n.countLatch.Lock()
+		defer d.n.countLatch.Unlock()
+	}
+
+	total := d.n.keyCount()
+	left, separator, right := t.split(d.c)
+	rightNode := newOLCNode(right)
+	if !d.c.leaf {
+		for _, child := range right.children {
+			rightNode.count += int64(child.keyCount())
+		}
+		atomic.AddInt64(&d.n.count, -rightNode.count)
+	}
+	if d.c.leaf {
+		left.next, right.previous = rightNode, d.n
+		if next := d.c.next; next != nil {
+			version, ok := readVersion(&next.version)
+			if !ok || !upgradeVersion(&next.version, version) {
+				return false
+			}
+			defer unlockVersion(&next.version)
+			nc := *next.load()
+			nc.previous = rightNode
+			next.store(&nc)
+		}
+	}
+	d.n.store(left)
+
+	if d.parent == nil {
+		root := newOLCNode(&olcContent{
+			keys:     [][]byte{separator},
+			children: []*olcNode{d.n, rightNode},
+		})
+		root.count = int64(total)
+		t.root.Store(root)
+		return true
+	}
+	pc := d.parent.load()
+	position := t.childPosition(pc, separator)
+	next := *pc
+	next.keys = inserted(pc.keys, position, separator)
+	next.children = inserted(pc.children, position+1, rightNode)
+	d.parent.store(&next)
+	return true
+}
+
+// split splits the full content, the left half stays in
+// the node and the right half goes to a new node.
+func (t *olcTree) split(c *olcContent) (*olcContent, []byte, *olcContent) {
+	middle := len(c.keys) / 2
+	separator := c.keys[middle]
+	left := &olcContent{leaf: c.leaf, previous: c.previous}
+	right := &olcContent{leaf: c.leaf, next: c.next}
+
+	// the contents are immutable, so they may share the arrays
+	if c.leaf {
+		left.keys, left.values = c.keys[:middle:middle], c.values[:middle:middle]
+		right.keys, right.values = c.keys[middle:], c.values[middle:]
+	} else {
+		// the separator moves up
+		left.keys, left.children = c.keys[:middle:middle], c.children[:middle+1:middle+1]
+		right.keys, right.children = c.keys[middle+1:], c.children[middle+1:]
+	}
+	return left, separator, right
+}
+
+// delete is Delete for OLC trees, it only locks the leaf
+func (t *olcTree) delete(key []byte) ([]byte, bool) {
+	for {
+		d := t.findLeaf(key)
+		position, found := t.search(d.c, key)
+		if !found {
+			return nil, false
+		}
+		if !upgradeVersion(&d.n.version, d.version) {
+			runtime.Gosched()
+			continue
+		}
+		c, next := d.c, *d.c
+		next.keys = removed(c.keys, position)
+		next.values = removed(c.values, position)
+		t.storeCounted(d.n, key, &next, -1)
+		unlockVersion(&d.n.version)
+		atomic.AddInt64(&t.size, -1)
+		return c.values[position], true
+	}
+}
+
+// bulkLoad is BulkLoad for OLC trees. It locks the root pointer and the
+// empty root leaf, which becomes the first leaf, while the nodes are built,
+// so the operations arriving meanwhile restart until the tree is published.
+func (t *olcTree) bulkLoad(src KVSource) error {
+	lockVersion(&t.rootVersion)
+	defer unlockVersion(&t.rootVersion)
+	root := t.rootNode()
+	lockVersion(&root.version)
+	defer unlockVersion(&root.version)
+	if c := root.load(); !c.leaf || len(c.keys) > 0 {
+		return ErrNotEmpty
+	}
+
+	runs, size, err := t.bpt.packRuns(src)
+	if err != nil || size == 0 {
+		return err
+	}
+	leaves, firstKeys := make([]*olcNode, len(runs)), make([][]byte, len(runs))
+	contents := make([]*olcContent, len(runs))
+	for i, run := range runs {
+		contents[i], firstKeys[i] = &olcContent{leaf: true, keys: run.keys, values: run.values}, run.keys[0]
+		leaves[i] = root
+		if i > 0 {
+			leaves[i] = newOLCNode(contents[i])
+			contents[i].previous, contents[i-1].next = leaves[i-1], leaves[i]
+		}
+	}
+	// the locked root holds the first leaf before it is counted
+	root.store(contents[0])
+	top := buildLevels(t.bpt, leaves, firstKeys, func(keys [][]byte, children []*olcNode) *olcNode {
+		n := newOLCNode(&olcContent{keys: keys, children: children})
+		for _, child := range children {
+			n.count += int64(child.keyCount())
+		}
+		return n
+	})
+	t.root.Store(top)
+	atomic.AddInt64(&t.size, int64(size))
+	return nil
+}
+
+func (t *olcTree) len() int {
+	return int(atomic.LoadInt64(&t.size))
+}
+
+// rank is Rank for OLC trees, it takes no lock. The counts may lag behind
+// the keys while writers change them, so it is exact without writers only.
+func (t *olcTree) rank(key []byte) int {
+	for {
+		if rank, ok := t.tryRank(key); ok {
+			return rank
+		}
+		runtime.Gosched()
+	}
+}
+
+func (t *olcTree) tryRank(key []byte) (int, bool) {
+	rank := 0
+	d, ok := t.start()
+	for ok && !d.c.leaf {
+		position := t.childPosition(d.c, key)
+		for _, child := range d.c.children[:position] {
+			rank += child.keyCount()
+		}
+		ok = d.down(position)
+	}
+	if !ok {
+		return 0, false
+	}
+	position, _ := t.search(d.c, key)
+	return rank + position, true
+}
+
+// selectAt is Select for OLC trees, exact without writers only like rank
+func (t *olcTree) selectAt(i int) ([]byte, []byte) {
+	for {
+		if key, value, ok := t.trySelectAt(i); ok {
+			return key, value
+		}
+		runtime.Gosched()
+	}
+}
+
+func (t *olcTree) trySelectAt(i int) ([]byte, []byte, bool) {
+	d, ok := t.start()
+	for ok && !d.c.leaf {
+		position := 0
+		for ; position < len(d.c.keys) && i >= d.c.children[position].keyCount(); position++ {
+			i -= d.c.children[position].keyCount()
+		}
+		ok = d.down(position)
+	}
+	if !ok {
+		return nil, nil, false
+	}
+	if i >= len(d.c.keys) {
+		return nil, nil, true
+	}
+	return d.c.keys[i], d.c.values[i], true
+}
+
+// seek moves right from the leaf along the next links without checking
+// versions. Leaves never go away and their keys only move right, so each
+// loaded content is a consistent view of the keys not before the key.
+func (t *olcTree) seek(leaf interface{}, key []byte, exclusive bool) (interface{}, []byte, []byte) {
+	var n *olcNode
+	if leaf != nil {
+		n = leaf.(*olcNode)
+	} else {
+		n = t.findLeaf(key).n
+	}
+	for n != nil {
+		c := n.load()
+		i := 0
+		if key != nil {
+			var found bool
+			i, found = t.search(c, key)
+			if found && exclusive {
+				i++
+			}
+		}
+		if i < len(c.keys) {
+			return n, c.keys[i], c.values[i]
+		}
+		n = c.next
+	}
+	return nil, nil, nil
+}
+
+// last moves left from the leaf covering the bound, restarting if the
+// leaf the previous link was read from has changed meanwhile.
+func (t *olcTree) last(bound []byte) (interface{}, []byte, []byte) {
+	for {
+		if leaf, key, value, ok := t.tryLast(bound); ok {
+			return leaf, key, value
+		}
+		runtime.Gosched()
+	}
+}
+
+func (t *olcTree) tryLast(bound []byte) (interface{}, []byte, []byte, bool) {
+	d, ok := t.start()
+	for ok && !d.c.leaf {
+		position := len(d.c.keys)
+		if bound != nil {
+			position = t.childPosition(d.c, bound)
+		}
+		ok = d.down(position)
+	}
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	n, version, c := d.n, d.version, d.c
+	for {
+		i := len(c.keys)
+		if bound != nil {
+			i, _ = t.search(c, bound)
+		}
+		if i > 0 {
+			return n, c.keys[i-1], c.values[i-1], true
+		}
+		previous := c.previous
+		if previous == nil {
+			return nil, nil, nil, true
+		}
+		previousVersion, ok := readVersion(&previous.version)
+		if !ok {
+			return nil, nil, nil, false
+		}
+		pc := previous.load()
+		// a split of the previous leaf would have changed the link
+		if !checkVersion(&previous.version, previousVersion) || !checkVersion(&n.version, version) {
+			return nil, nil, nil, false
+		}
+		n, version, c = previous, previousVersion, pc
+	}
+}
+
+// validate checks the invariants of the OLC tree, writers must be done
+func (t *olcTree) validate() error {
+	if t.rootVersion&1 != 0 {
+		return errors.New("root pointer is locked")
+	}
+	v := &olcValidator{t: t, leafDepth: -1}
+	if err := v.validateNode(t.rootNode(), "root", nil, nil, 0); err != nil {
+		return err
+	}
+	if v.previous != nil && v.previous.load().next != nil {
+		return errors.New("most right leaf has a next leaf")
+	}
+	if treeSize := atomic.LoadInt64(&t.size); int64(v.size) != treeSize {
+		return fmt.Errorf("size is %d but the tree holds %d keys", treeSize, v.size)
+	}
+	return nil
+}
+
+// olcValidator carries the state of an OLC tree walk
+type olcValidator struct {
+	t         *olcTree
+	leafDepth int
+	size      int
+
+	// the leaf visited last, to check the leaf links
+	previous *olcNode
+}
+
+// validateNode checks the subtree of the node, whose keys
+// must lie within [lower, upper), a nil bound is open.
+func (v *olcValidator) validateNode(n *olcNode, path string, lower, upper []byte, depth int) error {
+	if n.version&1 != 0 {
+		return fmt.Errorf("%s: node is locked", path)
+	}
+	c := n.load()
+	compare := v.t.bpt.compare
+	for i, key := range c.keys {
+		if i > 0 && compare(c.keys[i-1], key) >= 0 {
+			return fmt.Errorf("%s: keys %q and %q are not in ascending order", path, c.keys[i-1], key)
+		}
+		if lower != nil && compare(key, lower) < 0 || upper != nil && compare(key, upper) >= 0 {
+			return fmt.Errorf("%s: key %q lies outside [%q, %q)", path, key, lower, upper)
+		}
+	}
+	if len(c.keys) >= v.t.bpt.order {
+		return fmt.Errorf("%s: node holds %d keys", path, len(c.keys))
+	}
+
+	if c.leaf {
+		if len(c.values) != len(c.keys) || c.children != nil {
+			return fmt.Errorf("%s: leaf holds %d keys and %d values", path, len(c.keys), len(c.values))
+		}
+		if v.leafDepth == -1 {
+			v.leafDepth = depth
+		} else if v.leafDepth != depth {
+			return fmt.Errorf("%s: leaf at depth %d, expected %d", path, depth, v.leafDepth)
+		}
+		if c.previous != v.previous || v.previous != nil && v.previous.load().next != n {
+			return fmt.Errorf("%s: leaf is not linked to the previous leaf", path)
+		}
+		v.previous = n
+		v.size += len(c.keys)
+		return nil
+	}
+
+	if len(c.children) != len(c.keys)+1 || c.values != nil {
+		return fmt.Errorf("%s: node holds %d keys and %d children", path, len(c.keys), len(c.children))
+	}
+	size := v.size
+	for i, child := range c.children {
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = c.keys[i-1]
+		}
+		if i < len(c.keys) {
+			childUpper = c.keys[i]
+		}
+		if err := v.validateNode(child, fmt.Sprintf("%s/%d", path, i), childLower, childUpper, depth+1); err != nil {
+			return err
+		}
+	}
+	if count := int(n.count); count != v.size-size {
+		return fmt.Errorf("%s: node counts %d keys but holds %d", path, count, v.size-size)
+	}
+	return nil
+}
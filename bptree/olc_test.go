@@ -0,0 +1,54 @@
+package bptree
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimisticLockCouplingSequential(t *testing.T) {
+	testSequential(t, OptimisticLockCoupling)
+}
+
+func TestOptimisticLockCouplingConcurrentReadersAndWriters(t *testing.T) {
+	testConcurrentReadersAndWriters(t, OptimisticLockCoupling)
+}
+
+func TestOptimisticLockCouplingReadersRestart(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetOrder(4), SetConcurrency(OptimisticLockCoupling))
+	for k := 0; k < 1000; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+	olc := bpt.engine.(*olcTree)
+
+	// a write bumps the version of the leaf only
+	leaf := olc.findLeaf(uint32Key(500))
+	root := olc.rootNode()
+	rootVersion := root.version
+	bpt.Put(uint32Key(500), uint32Key(0))
+	assert.Equal(t, leaf.version+2, leaf.n.version)
+	assert.Equal(t, rootVersion, root.version)
+
+	// readers of a locked leaf restart until it's unlocked
+	leaf = olc.findLeaf(uint32Key(500))
+	assert.True(t, upgradeVersion(&leaf.n.version, leaf.version))
+	done := make(chan []byte)
+	go func() {
+		value, _ := bpt.Get(uint32Key(500))
+		done <- value
+	}()
+
+	value, ok := bpt.Get(uint32Key(0))
+	assert.True(t, ok)
+	assert.Equal(t, uint32Key(0), value)
+	select {
+	case <-done:
+		t.Fatal("reader went through a locked leaf")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlockVersion(&leaf.n.version)
+	assert.Equal(t, uint32Key(0), <-done)
+	assert.NoError(t, bpt.Validate())
+}
@@ -0,0 +1,71 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A value too large for a cell of its leaf is stored in a chain of overflow
+// pages, filled in order. They are read and written past the buffer pool,
+// like free pages, so that large values don't evict the nodes. The pool
+// drops the pages it may still cache when they are allocated and freed.
+
+// storeValue returns the value of the leaf cell of the pair of kv, written
+// to new overflow pages unless the pair fits a cell.
+func (t *pagedTree) storeValue(key, value []byte) pagedValue {
+	if slotLen+leafCellHeaderLen+len(key)+len(value) <= t.maxCellSize() {
+		return pagedValue{data: value}
+	}
+	capacity := t.pager.pageSize - pageHeaderLen
+	ids := make([]pageID, ceil(len(value), capacity))
+	for i := range ids {
+		id, err := t.pager.allocate()
+		must(err)
+		t.pool.discard(id)
+		ids[i] = id
+	}
+	page := make([]byte, t.pager.pageSize)
+	for i, id := range ids {
+		chunk := value[i*capacity:]
+		if len(chunk) > capacity {
+			chunk = chunk[:capacity]
+		}
+		for j := range page {
+			page[j] = 0
+		}
+		page[0] = pageOverflow
+		binary.BigEndian.PutUint16(page[2:], uint16(len(chunk)))
+		if i+1 < len(ids) {
+			setPageLink(page, overflowLink, ids[i+1])
+		}
+		copy(page[pageHeaderLen:], chunk)
+		must(t.pager.write(id, page))
+	}
+	return pagedValue{overflow: ids[0], length: len(value)}
+}
+
+// loadValue returns a copy of the value of a leaf cell, and frees
+// its overflow pages if it is removed from the leaf.
+func (t *pagedTree) loadValue(v pagedValue, removed bool) []byte {
+	if v.overflow == 0 {
+		return copyBytes(v.data)
+	}
+	value := make([]byte, 0, v.length)
+	page := make([]byte, t.pager.pageSize)
+	for id := v.overflow; id != 0; {
+		must(t.pager.read(id, page))
+		if pageType(page) != pageOverflow || pageCount(page) > len(page)-pageHeaderLen || len(value)+pageCount(page) > v.length {
+			must(fmt.Errorf("overflow page %d is broken", id))
+		}
+		value = append(value, page[pageHeaderLen:pageHeaderLen+pageCount(page)]...)
+		next := pageLink(page, overflowLink)
+		if removed {
+			t.free(id)
+		}
+		id = next
+	}
+	if len(value) != v.length {
+		must(fmt.Errorf("overflow pages at %d hold %d bytes instead of %d", v.overflow, len(value), v.length))
+	}
+	return value
+}
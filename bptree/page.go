@@ -0,0 +1,312 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Every page of a page file but the first holds a node or is free. A node
+// page starts with a header: its type, the number of its slots, and either
+// the previous and next leaves for a leaf or the most left child and the
+// number of keys of its subtree for an internal node. The slots follow, the
+// offsets of the cells in key order, and the cells fill the page from its
+// end. A leaf cell is the length of the key, the length of the value, the
+// key and the value, unless the value is too large for a cell and goes to
+// a chain of overflow pages. An internal cell is the length of the key,
+// the child on the right of the key, the number of keys of its subtree,
+// and the key. An overflow page holds the number of its bytes where
+// a node holds the number of its slots, the next overflow page where the
+// previous leaf goes, and the bytes after the header. A free page only
+// holds the next free page, where the previous leaf goes.
+
+// pageID is the position of a page in the page file, 0 is the meta page
+// so it means no page.
+type pageID uint32
+
+const (
+	pageLeaf = iota + 1
+	pageInternal
+	pageFree
+	pageOverflow
+)
+
+const (
+	pageHeaderLen = 16
+	slotLen       = 2
+
+	leafCellHeaderLen     = 4
+	internalCellHeaderLen = 14
+
+	// the length of value marking a cell whose value overflows, which
+	// holds the first overflow page and the length of the value instead
+	overflowValue  = 0xffff
+	overflowRefLen = 8
+)
+
+func pageType(p []byte) byte {
+	return p[0]
+}
+
+func pageCount(p []byte) int {
+	return int(binary.BigEndian.Uint16(p[2:]))
+}
+
+// pageLink returns the id stored in the header at the offset, the previous
+// leaf or the most left child at 4 and the next leaf at 8.
+func pageLink(p []byte, offset int) pageID {
+	return pageID(binary.BigEndian.Uint32(p[offset:]))
+}
+
+func setPageLink(p []byte, offset int, id pageID) {
+	binary.BigEndian.PutUint32(p[offset:], uint32(id))
+}
+
+const (
+	prevLink     = 4
+	mostLeftLink = 4
+	nextLink     = 8
+	freeLink     = 4
+	overflowLink = 4
+
+	// the number of keys of the subtree of the most left child
+	mostLeftCount = 8
+)
+
+func cell(p []byte, i int) []byte {
+	return p[binary.BigEndian.Uint16(p[pageHeaderLen+i*slotLen:]):]
+}
+
+// pageKey returns the key at the position of the page, in place
+func pageKey(p []byte, i int) []byte {
+	c := cell(p, i)
+	keyLen := int(binary.BigEndian.Uint16(c))
+	if pageType(p) == pageLeaf {
+		return c[leafCellHeaderLen : leafCellHeaderLen+keyLen]
+	}
+	return c[internalCellHeaderLen : internalCellHeaderLen+keyLen]
+}
+
+// pageValue returns the value at the position of the leaf page, in place
+// unless it overflows the page
+func pageValue(p []byte, i int) pagedValue {
+	c := cell(p, i)
+	keyLen, valueLen := int(binary.BigEndian.Uint16(c)), int(binary.BigEndian.Uint16(c[2:]))
+	c = c[leafCellHeaderLen+keyLen:]
+	if valueLen == overflowValue {
+		return pagedValue{overflow: pageLink(c, 0), length: int(binary.BigEndian.Uint32(c[4:]))}
+	}
+	return pagedValue{data: c[:valueLen]}
+}
+
+// pagedValue is the value of a leaf cell, either in place or
+// in the chain of overflow pages starting at overflow
+type pagedValue struct {
+	data []byte
+
+	overflow pageID
+	length   int
+}
+
+// size returns the bytes the value takes in its cell
+func (v pagedValue) size() int {
+	if v.overflow != 0 {
+		return overflowRefLen
+	}
+	return len(v.data)
+}
+
+// pageChild returns the child at the position of the internal page,
+// the most left child is at 0 and the one right of key i at i+1.
+func pageChild(p []byte, i int) pageID {
+	if i == 0 {
+		return pageLink(p, mostLeftLink)
+	}
+	return pageID(binary.BigEndian.Uint32(cell(p, i-1)[2:]))
+}
+
+// pageChildCount returns the number of keys of the subtree of the child at
+// the position of the internal page.
+func pageChildCount(p []byte, i int) uint64 {
+	if i == 0 {
+		return binary.BigEndian.Uint64(p[mostLeftCount:])
+	}
+	return binary.BigEndian.Uint64(cell(p, i-1)[6:])
+}
+
+func setPageChildCount(p []byte, i int, count uint64) {
+	if i == 0 {
+		binary.BigEndian.PutUint64(p[mostLeftCount:], count)
+		return
+	}
+	binary.BigEndian.PutUint64(cell(p, i-1)[6:], count)
+}
+
+// pageSearch returns the position of the first key of the page which is
+// not less than the given key and true if that key equals the given key.
+func pageSearch(p []byte, key []byte, compare func(a, b []byte) int) (int, bool) {
+	count := pageCount(p)
+	position := sort.Search(count, func(i int) bool {
+		return compare(pageKey(p, i), key) >= 0
+	})
+	return position, position < count && compare(pageKey(p, position), key) == 0
+}
+
+// pageChildPosition returns the position of the child of the internal page
+// which covers the given key, or of the most left child for a nil key.
+func pageChildPosition(p []byte, key []byte, compare func(a, b []byte) int) int {
+	if key == nil {
+		return 0
+	}
+	return sort.Search(pageCount(p), func(i int) bool {
+		return compare(key, pageKey(p, i)) < 0
+	})
+}
+
+// pagedNode is a node page decoded for a writer to change it
+type pagedNode struct {
+	leaf bool
+	keys [][]byte
+
+	// only for leaf node, one value per key, and the neighbour leaves
+	values     []pagedValue
+	prev, next pageID
+
+	// only for internal node, one child more than keys,
+	// and the number of keys of the subtree of every child
+	children []pageID
+	counts   []uint64
+}
+
+// decodeNode returns the node of the page, sharing no memory with it
+func decodeNode(p []byte) *pagedNode {
+	count := pageCount(p)
+	n := &pagedNode{leaf: pageType(p) == pageLeaf, keys: make([][]byte, count)}
+	for i := range n.keys {
+		n.keys[i] = copyBytes(pageKey(p, i))
+	}
+	if n.leaf {
+		n.values = make([]pagedValue, count)
+		for i := range n.values {
+			n.values[i] = pageValue(p, i)
+			n.values[i].data = copyBytes(n.values[i].data)
+		}
+		n.prev, n.next = pageLink(p, prevLink), pageLink(p, nextLink)
+		return n
+	}
+	n.children, n.counts = make([]pageID, count+1), make([]uint64, count+1)
+	for i := range n.children {
+		n.children[i], n.counts[i] = pageChild(p, i), pageChildCount(p, i)
+	}
+	return n
+}
+
+// keyCount returns the number of keys of the subtree of the node
+func (n *pagedNode) keyCount() uint64 {
+	if n.leaf {
+		return uint64(len(n.keys))
+	}
+	var count uint64
+	for _, c := range n.counts {
+		count += c
+	}
+	return count
+}
+
+// cellSize returns the bytes taken by the entry at the position, its slot included
+func (n *pagedNode) cellSize(i int) int {
+	if n.leaf {
+		return slotLen + leafCellHeaderLen + len(n.keys[i]) + n.values[i].size()
+	}
+	return slotLen + internalCellHeaderLen + len(n.keys[i])
+}
+
+// size returns the bytes taken by the encoded node
+func (n *pagedNode) size() int {
+	size := pageHeaderLen
+	for i := range n.keys {
+		size += n.cellSize(i)
+	}
+	return size
+}
+
+// encode encodes the node into the page, which it must fit
+func (n *pagedNode) encode(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+	binary.BigEndian.PutUint16(p[2:], uint16(len(n.keys)))
+	if n.leaf {
+		p[0] = pageLeaf
+		setPageLink(p, prevLink, n.prev)
+		setPageLink(p, nextLink, n.next)
+	} else {
+		p[0] = pageInternal
+		setPageLink(p, mostLeftLink, n.children[0])
+		binary.BigEndian.PutUint64(p[mostLeftCount:], n.counts[0])
+	}
+
+	end := len(p)
+	for i, key := range n.keys {
+		size := n.cellSize(i) - slotLen
+		end -= size
+		c := p[end : end+size]
+		binary.BigEndian.PutUint16(c, uint16(len(key)))
+		if n.leaf {
+			copy(c[leafCellHeaderLen:], key)
+			if v := n.values[i]; v.overflow != 0 {
+				binary.BigEndian.PutUint16(c[2:], overflowValue)
+				setPageLink(c, leafCellHeaderLen+len(key), v.overflow)
+				binary.BigEndian.PutUint32(c[leafCellHeaderLen+len(key)+4:], uint32(v.length))
+			} else {
+				binary.BigEndian.PutUint16(c[2:], uint16(len(v.data)))
+				copy(c[leafCellHeaderLen+len(key):], v.data)
+			}
+		} else {
+			binary.BigEndian.PutUint32(c[2:], uint32(n.children[i+1]))
+			binary.BigEndian.PutUint64(c[6:], n.counts[i+1])
+			copy(c[internalCellHeaderLen:], key)
+		}
+		binary.BigEndian.PutUint16(p[pageHeaderLen+i*slotLen:], uint16(end))
+	}
+}
+
+// split splits the node in two halves of about the same size. The
+// separator is the first key of the right half for leaves, and the key
+// moved up between both halves for internal nodes. The halves keep
+// the links of the node, which the caller fixes.
+func (n *pagedNode) split() (*pagedNode, []byte, *pagedNode) {
+	half, size, m := n.size()/2, pageHeaderLen, 0
+	for m < len(n.keys)-1 && size+n.cellSize(m) <= half {
+		size += n.cellSize(m)
+		m++
+	}
+	if m == 0 {
+		m = 1
+	}
+
+	left := &pagedNode{leaf: n.leaf, prev: n.prev, next: n.next}
+	right := &pagedNode{leaf: n.leaf, prev: n.prev, next: n.next}
+	if n.leaf {
+		left.keys, left.values = n.keys[:m:m], n.values[:m:m]
+		right.keys, right.values = n.keys[m:], n.values[m:]
+		return left, right.keys[0], right
+	}
+	left.keys, left.children, left.counts = n.keys[:m:m], n.children[:m+1:m+1], n.counts[:m+1:m+1]
+	right.keys, right.children, right.counts = n.keys[m+1:], n.children[m+1:], n.counts[m+1:]
+	return left, n.keys[m], right
+}
+
+// merged returns the node holding the entries of both nodes, the
+// separator between them comes down for internal nodes.
+func merged(left *pagedNode, separator []byte, right *pagedNode) *pagedNode {
+	n := &pagedNode{leaf: left.leaf, prev: left.prev, next: right.next}
+	if left.leaf {
+		n.keys = concatenated(left.keys, right.keys)
+		n.values = concatenated(left.values, right.values)
+		return n
+	}
+	n.keys = concatenated(append(left.keys[:len(left.keys):len(left.keys)], separator), right.keys)
+	n.children = concatenated(left.children, right.children)
+	n.counts = concatenated(left.counts, right.counts)
+	return n
+}
@@ -0,0 +1,941 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// A paged tree keeps its nodes in fixed-size pages of a file instead of
+// memory, children and neighbour leaves are page ids. Pages are fetched
+// through a buffer pool, which caches a fixed number of them. Readers
+// search the pages in place, pinning one page at a time, writers decode
+// the pages they change into pagedNodes and encode them back. Nodes hold
+// as many pairs of kv as fit in a page, so the order of the tree is
+// ignored, and a node is split once it overflows its page and merged or
+// redistributed once it fills less than a quarter. Internal pages count
+// the keys of the subtree of every child, writers hold the latch of the
+// tree while they change them. A failure to read or write the file stops
+// the operation, the tree does nothing from then on.
+
+// ErrKeyTooLarge is returned by BulkLoad into a paged tree, and Put panics
+// with it, for a key which takes more than a quarter of a page.
+var ErrKeyTooLarge = errors.New("key too large for a page")
+
+// SetPageFile stores the tree in the page file at path, created if needed,
+// so it can hold more than the memory. The tree is safe for concurrent use
+// whatever its concurrency, readers share a latch and writers hold it
+// exclusively. Keys may take up to a quarter of a page, about 1000 bytes
+// for pages of 4096 bytes, Put panics on longer ones. Values
+// too large for a page go to overflow pages. Failing to read or write the
+// file is reported by Err. Changed pages are written back when evicted
+// from the buffer pool and by Close, which must be called for the file to
+// hold the tree: opening a file whose tree wasn't closed fails with
+// ErrNotClosed.
+func SetPageFile(path string) Option {
+	return func(bpt *BPlusTree) error {
+		if path == "" {
+			return errors.New("page file path can't be empty")
+		}
+		bpt.pageFile = path
+		return nil
+	}
+}
+
+// SetPageSize sets the size of the pages of a page file created by
+// SetPageFile, a power of two between 512 and 32768, 4096 by default.
+// An existing page file keeps its own size.
+func SetPageSize(size int) Option {
+	return func(bpt *BPlusTree) error {
+		if size < minPageSize || size > maxPageSize || size&(size-1) != 0 {
+			return fmt.Errorf("page size must be a power of two between %d and %d", minPageSize, maxPageSize)
+		}
+		bpt.pageSize = size
+		return nil
+	}
+}
+
+// Close closes the page file of a tree set by SetPageFile, the tree must
+// not be used afterwards. It does nothing for trees in memory.
+func (bpt *BPlusTree) Close() error {
+	if c, ok := bpt.engine.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Err returns the first failure to read or write the page file of a tree
+// set by SetPageFile. The tree finds no key and changes nothing once it
+// failed, and Close returns the failure. It is nil for trees in memory.
+func (bpt *BPlusTree) Err() error {
+	if t, ok := bpt.engine.(*pagedTree); ok {
+		return t.err()
+	}
+	return nil
+}
+
+// pagedTree is the engine of the trees stored in a page file
+type pagedTree struct {
+	bpt   *BPlusTree
+	pager *pager
+	pool  *bufferPool
+
+	// readers hold it shared and writers exclusively
+	latch sync.RWMutex
+
+	// the pagedFailure which stopped the tree, if any
+	failure atomic.Value
+
+	// bumped whenever a page is freed, so iterators know
+	// that the page of their leaf may hold anything
+	generation uint64
+}
+
+func openPagedTree(bpt *BPlusTree) (*pagedTree, error) {
+	pageSize := bpt.pageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	p, err := openPager(bpt.pageFile, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	frames := bpt.bufferPoolSize
+	if frames == 0 {
+		frames = defaultBufferPoolSize
+	}
+	return &pagedTree{bpt: bpt, pager: p, pool: newBufferPool(p, frames, bpt.evictionPolicy)}, nil
+}
+
+// pagedFailure is the panic of must, recovered by the operation
+type pagedFailure struct {
+	err error
+}
+
+// must stops the operation on a failed read or write of the page file
+func must(err error) {
+	if err != nil {
+		panic(pagedFailure{fmt.Errorf("bptree: page file: %w", err)})
+	}
+}
+
+// recoverFailure records the failure which stopped the operation, and
+// returns it in err unless nil. It must be deferred by the operations.
+func (t *pagedTree) recoverFailure(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	f, ok := r.(pagedFailure)
+	if !ok {
+		panic(r)
+	}
+	t.failure.CompareAndSwap(nil, f)
+	if err != nil {
+		*err = t.err()
+	}
+}
+
+// err returns the failure which stopped the tree, if any
+func (t *pagedTree) err() error {
+	if f, ok := t.failure.Load().(pagedFailure); ok {
+		return f.err
+	}
+	return nil
+}
+
+// maxKeySize returns the most bytes a key may take, so that its cell fits
+// in an internal node, which is larger than in a leaf even when the value
+// goes to overflow pages.
+func (t *pagedTree) maxKeySize() int {
+	return t.maxCellSize() - slotLen - internalCellHeaderLen
+}
+
+// maxCellSize returns the most bytes a pair of kv may take in a leaf,
+// so that every overflowing node splits into halves which fit.
+func (t *pagedTree) maxCellSize() int {
+	return (t.pager.pageSize - pageHeaderLen) / 4
+}
+
+// minNodeSize returns the bytes below which a node which is not
+// the root is merged or redistributed.
+func (t *pagedTree) minNodeSize() int {
+	return pageHeaderLen + (t.pager.pageSize-pageHeaderLen)/4
+}
+
+// fillSize returns the bytes a node built by bulk loading
+// takes according to the fill factor.
+func (t *pagedTree) fillSize() int {
+	size := pageHeaderLen + int(math.Round(t.bpt.fillFactor*float64(t.pager.pageSize-pageHeaderLen)))
+	if size < t.minNodeSize() {
+		size = t.minNodeSize()
+	}
+	return size
+}
+
+// fetch returns the page pinned in the buffer pool
+func (t *pagedTree) fetch(id pageID) []byte {
+	page, err := t.pool.fetch(id)
+	must(err)
+	return page
+}
+
+// unpin unpins the page fetched, dirty if it was modified
+func (t *pagedTree) unpin(id pageID, dirty bool) {
+	t.pool.unpin(id, dirty)
+}
+
+func (t *pagedTree) node(id pageID) *pagedNode {
+	n := decodeNode(t.fetch(id))
+	t.unpin(id, false)
+	return n
+}
+
+func (t *pagedTree) write(id pageID, n *pagedNode) {
+	n.encode(t.fetch(id))
+	t.unpin(id, true)
+}
+
+func (t *pagedTree) allocate() pageID {
+	id, err := t.pager.allocate()
+	must(err)
+	must(t.pool.create(id))
+	return id
+}
+
+// link returns the id stored in the header of the page at the offset
+func (t *pagedTree) link(id pageID, offset int) pageID {
+	link := pageLink(t.fetch(id), offset)
+	t.unpin(id, false)
+	return link
+}
+
+func (t *pagedTree) free(id pageID) {
+	t.generation++
+	t.pool.discard(id)
+	must(t.pager.free(id))
+}
+
+// pagedFrame is a page on the path from the root, and the
+// position of the child taken in it.
+type pagedFrame struct {
+	id       pageID
+	position int
+}
+
+// descend returns the path from the root to the leaf which covers the key,
+// or to the most left leaf for a nil key, and the page of the leaf, which
+// the caller unpins.
+func (t *pagedTree) descend(key []byte) ([]pagedFrame, []byte) {
+	var path []pagedFrame
+	id := t.pager.root
+	for {
+		page := t.fetch(id)
+		if pageType(page) == pageLeaf {
+			return append(path, pagedFrame{id: id}), page
+		}
+		position := pageChildPosition(page, key, t.bpt.compare)
+		path = append(path, pagedFrame{id: id, position: position})
+		child := pageChild(page, position)
+		t.unpin(id, false)
+		id = child
+	}
+}
+
+func (t *pagedTree) get(key []byte) ([]byte, bool) {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	if t.err() != nil {
+		return nil, false
+	}
+	defer t.recoverFailure(nil)
+	path, page := t.descend(key)
+	defer t.unpin(path[len(path)-1].id, false)
+	position, found := pageSearch(page, key, t.bpt.compare)
+	if !found {
+		return nil, false
+	}
+	return t.loadValue(pageValue(page, position), false), true
+}
+
+func (t *pagedTree) put(key, value []byte) ([]byte, bool) {
+	if len(key) > t.maxKeySize() {
+		panic(fmt.Errorf("bptree: %w, it takes %d bytes out of %d", ErrKeyTooLarge, len(key), t.maxKeySize()))
+	}
+	t.latch.Lock()
+	defer t.latch.Unlock()
+	if t.err() != nil {
+		return nil, false
+	}
+	defer t.recoverFailure(nil)
+	path, page := t.descend(key)
+	position, found := pageSearch(page, key, t.bpt.compare)
+	n := decodeNode(page)
+	t.unpin(path[len(path)-1].id, false)
+	if found {
+		oldValue := t.loadValue(n.values[position], true)
+		n.values[position] = t.storeValue(key, value)
+		t.writeBack(path, n, 0)
+		return oldValue, true
+	}
+	n.keys = inserted(n.keys, position, key)
+	n.values = inserted(n.values, position, t.storeValue(key, value))
+	t.pager.count++
+	t.writeBack(path, n, 1)
+	return nil, false
+}
+
+// writeBack writes the changed node at the end of the path, splitting
+// it and then its ancestors as long as they overflow their page, and adds
+// delta to the counts of the ancestors of the last node written.
+func (t *pagedTree) writeBack(path []pagedFrame, n *pagedNode, delta int) {
+	depth := len(path) - 1
+	for ; n.size() > t.pager.pageSize; depth-- {
+		id := path[depth].id
+		left, separator, right := n.split()
+		rightID := t.allocate()
+		t.writeHalves(id, left, rightID, right)
+		if depth == 0 {
+			root := &pagedNode{
+				keys:     [][]byte{separator},
+				children: []pageID{id, rightID},
+				counts:   []uint64{left.keyCount(), right.keyCount()},
+			}
+			t.pager.root = t.allocate()
+			t.write(t.pager.root, root)
+			return
+		}
+		parent := t.node(path[depth-1].id)
+		position := path[depth-1].position
+		parent.keys = inserted(parent.keys, position, separator)
+		parent.children = inserted(parent.children, position+1, rightID)
+		parent.counts = inserted(replaced(parent.counts, position, left.keyCount()), position+1, right.keyCount())
+		n = parent
+	}
+	t.write(path[depth].id, n)
+	t.addCounts(path[:depth], delta)
+}
+
+// addCounts adds delta to the count of the child taken
+// in every page of the path
+func (t *pagedTree) addCounts(path []pagedFrame, delta int) {
+	if delta == 0 {
+		return
+	}
+	for _, frame := range path {
+		page := t.fetch(frame.id)
+		setPageChildCount(page, frame.position, pageChildCount(page, frame.position)+uint64(delta))
+		t.unpin(frame.id, true)
+	}
+}
+
+// writeHalves writes the halves of a split node into their pages,
+// linking them between the neighbours of the node if they are leaves.
+func (t *pagedTree) writeHalves(leftID pageID, left *pagedNode, rightID pageID, right *pagedNode) {
+	if left.leaf {
+		left.next, right.prev = rightID, leftID
+		if right.next != 0 {
+			t.setPrev(right.next, rightID)
+		}
+	}
+	t.write(leftID, left)
+	t.write(rightID, right)
+}
+
+// setPrev links the leaf to its new previous leaf
+func (t *pagedTree) setPrev(id, prev pageID) {
+	setPageLink(t.fetch(id), prevLink, prev)
+	t.unpin(id, true)
+}
+
+// bulkLoad is BulkLoad for paged trees. The pairs of kv are packed into
+// leaf pages as they are streamed, filled up to the fill factor, and only
+// the first key of every page is kept to build the internal pages on top
+// of them. The empty root page becomes the first leaf.
+func (t *pagedTree) bulkLoad(src KVSource) (err error) {
+	t.latch.Lock()
+	defer t.latch.Unlock()
+	if err := t.err(); err != nil {
+		return err
+	}
+	defer t.recoverFailure(&err)
+	if t.pager.count != 0 {
+		return ErrNotEmpty
+	}
+
+	root := t.pager.root
+	leaves := &pagedLevel{t: t, leaf: true, reuse: root}
+	var lastKey []byte
+	size := 0
+	for {
+		key, value, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = t.bpt.checkAscending(lastKey, key)
+		}
+		if err == nil && len(key) > t.maxKeySize() {
+			err = ErrKeyTooLarge
+		}
+		if err != nil {
+			leaves.discard(root)
+			return err
+		}
+		lastKey = key
+		leaves.add(key, t.storeValue(key, value), 0, 1)
+		size++
+	}
+	if size == 0 {
+		return nil
+	}
+
+	level := leaves
+	level.finish()
+	for len(level.ids) > 1 {
+		parents := &pagedLevel{t: t}
+		for i, id := range level.ids {
+			parents.add(level.firstKeys[i], pagedValue{}, id, level.counts[i])
+		}
+		parents.finish()
+		level = parents
+	}
+	t.pager.root = level.ids[0]
+	t.pager.count = uint64(size)
+	return nil
+}
+
+// pagedLevel is a level of a paged tree being bulk loaded. It keeps its
+// last two nodes in memory, so that the last one can be merged into or
+// redistributed with its left sibling once the level is complete.
+type pagedLevel struct {
+	t    *pagedTree
+	leaf bool
+
+	// the page taken by the first node instead of a new one, if any
+	reuse pageID
+
+	// the pages of the level, the first keys of their subtrees
+	// and the number of their keys
+	ids       []pageID
+	firstKeys [][]byte
+	counts    []uint64
+
+	// the values of the level stored in overflow pages
+	overflows []pagedValue
+
+	previous, last *pagedNode
+	lastSize       int
+}
+
+// add appends the pair of kv to a leaf level, or the child whose subtree
+// starts with the key and holds count keys to an internal level. The
+// count of a pair is 1.
+func (l *pagedLevel) add(key []byte, value pagedValue, child pageID, count uint64) {
+	if value.overflow != 0 {
+		l.overflows = append(l.overflows, value)
+	}
+	n := l.last
+	if n != nil {
+		cellSize := slotLen + internalCellHeaderLen + len(key)
+		if l.leaf {
+			cellSize = slotLen + leafCellHeaderLen + len(key) + value.size()
+		}
+		// an internal node holds one key at least
+		if l.lastSize+cellSize <= l.t.fillSize() || !l.leaf && len(n.keys) == 0 {
+			n.keys = append(n.keys, key)
+			if l.leaf {
+				n.values = append(n.values, value)
+			} else {
+				n.children, n.counts = append(n.children, child), append(n.counts, count)
+			}
+			l.lastSize += cellSize
+			l.counts[len(l.counts)-1] += count
+			return
+		}
+	}
+
+	id := l.reuse
+	if id == 0 {
+		id = l.t.allocate()
+	}
+	l.reuse = 0
+	next := &pagedNode{leaf: l.leaf}
+	if l.leaf {
+		next.keys, next.values = [][]byte{key}, []pagedValue{value}
+	} else {
+		next.children, next.counts = []pageID{child}, []uint64{count}
+	}
+	if n != nil {
+		if l.leaf {
+			n.next, next.prev = id, l.ids[len(l.ids)-1]
+		}
+		if l.previous != nil {
+			l.t.write(l.ids[len(l.ids)-2], l.previous)
+		}
+		l.previous = n
+	}
+	l.last, l.lastSize = next, next.size()
+	l.ids, l.firstKeys, l.counts = append(l.ids, id), append(l.firstKeys, key), append(l.counts, count)
+}
+
+// discard frees the pages of a leaf level which failed to load,
+// but the page of the first leaf, which is the empty root again.
+func (l *pagedLevel) discard(root pageID) {
+	for _, value := range l.overflows {
+		l.t.loadValue(value, true)
+	}
+	for _, id := range l.ids {
+		if id != root {
+			l.t.free(id)
+		}
+	}
+	l.t.write(root, &pagedNode{leaf: true})
+}
+
+// finish writes the last two nodes of the level, the last one merged into
+// or redistributed with its left sibling if it fills too little.
+func (l *pagedLevel) finish() {
+	last := len(l.ids) - 1
+	if l.previous == nil {
+		l.t.write(l.ids[last], l.last)
+		return
+	}
+	leftID, rightID := l.ids[last-1], l.ids[last]
+	if l.lastSize >= l.t.minNodeSize() && (l.leaf || len(l.last.keys) > 0) {
+		l.t.write(leftID, l.previous)
+		l.t.write(rightID, l.last)
+		return
+	}
+	all := merged(l.previous, l.firstKeys[last], l.last)
+	if all.size() <= l.t.pager.pageSize {
+		l.t.write(leftID, all)
+		l.t.free(rightID)
+		l.counts[last-1] += l.counts[last]
+		l.ids, l.firstKeys, l.counts = l.ids[:last], l.firstKeys[:last], l.counts[:last]
+		return
+	}
+	left, separator, right := all.split()
+	l.t.writeHalves(leftID, left, rightID, right)
+	l.firstKeys[last] = separator
+	l.counts[last-1], l.counts[last] = left.keyCount(), right.keyCount()
+}
+
+func (t *pagedTree) delete(key []byte) ([]byte, bool) {
+	t.latch.Lock()
+	defer t.latch.Unlock()
+	if t.err() != nil {
+		return nil, false
+	}
+	defer t.recoverFailure(nil)
+	path, page := t.descend(key)
+	position, found := pageSearch(page, key, t.bpt.compare)
+	var n *pagedNode
+	if found {
+		n = decodeNode(page)
+	}
+	t.unpin(path[len(path)-1].id, false)
+	if !found {
+		return nil, false
+	}
+	oldValue := t.loadValue(n.values[position], true)
+	n.keys = removed(n.keys, position)
+	n.values = removed(n.values, position)
+	t.pager.count--
+	t.rebalance(path, n, -1)
+	return oldValue, true
+}
+
+// rebalance writes the changed node at the end of the path, merging it with
+// or redistributing it with a sibling as long as it fills too little of its
+// page, and collapses an internal root left with a single child. It adds
+// delta to the counts of the ancestors of the last node written.
+func (t *pagedTree) rebalance(path []pagedFrame, n *pagedNode, delta int) {
+	for depth := len(path) - 1; depth > 0; depth-- {
+		if n.size() >= t.minNodeSize() {
+			t.write(path[depth].id, n)
+			t.addCounts(path[:depth], delta)
+			return
+		}
+		position := path[depth-1].position
+		parent := t.node(path[depth-1].id)
+
+		// the node goes with its left sibling, or its right one if it has none
+		l := position - 1
+		if l < 0 {
+			l = 0
+		}
+		leftID, rightID := parent.children[l], parent.children[l+1]
+		left, right := n, n
+		if l == position {
+			right = t.node(rightID)
+		} else {
+			left = t.node(leftID)
+		}
+
+		all := merged(left, parent.keys[l], right)
+		if all.size() <= t.pager.pageSize {
+			if all.leaf && all.next != 0 {
+				t.setPrev(all.next, leftID)
+			}
+			t.write(leftID, all)
+			t.free(rightID)
+			parent.keys = removed(parent.keys, l)
+			parent.children = removed(parent.children, l+1)
+			parent.counts = removed(replaced(parent.counts, l, all.keyCount()), l+1)
+			n = parent
+			continue
+		}
+		// the new separator may be longer than the old one
+		// and overflow the parent
+		newLeft, separator, newRight := all.split()
+		t.writeHalves(leftID, newLeft, rightID, newRight)
+		parent.keys = replaced(parent.keys, l, separator)
+		parent.counts = replaced(replaced(parent.counts, l, newLeft.keyCount()), l+1, newRight.keyCount())
+		t.writeBack(path[:depth], parent, delta)
+		return
+	}
+	if !n.leaf && len(n.keys) == 0 {
+		t.free(path[0].id)
+		t.pager.root = n.children[0]
+		return
+	}
+	t.write(path[0].id, n)
+}
+
+// rank is Rank for paged trees, it adds the counts
+// of the children left of the path to the key
+func (t *pagedTree) rank(key []byte) int {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	if t.err() != nil {
+		return 0
+	}
+	defer t.recoverFailure(nil)
+	var rank uint64
+	id := t.pager.root
+	page := t.fetch(id)
+	for pageType(page) != pageLeaf {
+		position := pageChildPosition(page, key, t.bpt.compare)
+		for i := 0; i < position; i++ {
+			rank += pageChildCount(page, i)
+		}
+		child := pageChild(page, position)
+		t.unpin(id, false)
+		id, page = child, t.fetch(child)
+	}
+	defer t.unpin(id, false)
+	position, _ := pageSearch(page, key, t.bpt.compare)
+	return int(rank) + position
+}
+
+// selectAt is Select for paged trees
+func (t *pagedTree) selectAt(i int) ([]byte, []byte) {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	if t.err() != nil || uint64(i) >= t.pager.count {
+		return nil, nil
+	}
+	defer t.recoverFailure(nil)
+	rank := uint64(i)
+	id := t.pager.root
+	page := t.fetch(id)
+	for pageType(page) != pageLeaf {
+		position := 0
+		for ; position < pageCount(page) && rank >= pageChildCount(page, position); position++ {
+			rank -= pageChildCount(page, position)
+		}
+		child := pageChild(page, position)
+		t.unpin(id, false)
+		id, page = child, t.fetch(child)
+	}
+	defer t.unpin(id, false)
+	return copyBytes(pageKey(page, int(rank))), t.loadValue(pageValue(page, int(rank)), false)
+}
+
+func (t *pagedTree) len() int {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	return int(t.pager.count)
+}
+
+// pagedHint is the leaf of an iterator, the page id and the generation
+// of the tree when it was found
+type pagedHint struct {
+	id         pageID
+	generation uint64
+}
+
+// seek continues from the leaf if no page was freed since it was found,
+// and it holds a key not after the given key and either a key after it or
+// a next leaf starting after it.
+func (t *pagedTree) seek(leaf interface{}, key []byte, exclusive bool) (interface{}, []byte, []byte) {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	if t.err() != nil {
+		return nil, nil, nil
+	}
+	defer t.recoverFailure(nil)
+	id, page, position := pageID(0), []byte(nil), -1
+	if hint, ok := leaf.(pagedHint); ok && hint.generation == t.generation && key != nil {
+		id, page = hint.id, t.fetch(hint.id)
+		if pageType(page) == pageLeaf {
+			position = t.position(page, key, exclusive)
+		}
+		if position > 0 && position == pageCount(page) {
+			// the leaf may not cover the key anymore, unless
+			// the next leaf starts after it
+			if id, page = t.follow(id, page, nextLink); page == nil {
+				return nil, nil, nil
+			}
+			position = t.position(page, key, exclusive)
+			if position != 0 {
+				position = -1
+			}
+		} else if position == 0 {
+			position = -1
+		}
+		if position < 0 {
+			t.unpin(id, false)
+		}
+	}
+	if position < 0 {
+		var path []pagedFrame
+		path, page = t.descend(key)
+		id, position = path[len(path)-1].id, 0
+		if key != nil {
+			position = t.position(page, key, exclusive)
+		}
+	}
+	for position == pageCount(page) {
+		if id, page = t.follow(id, page, nextLink); page == nil {
+			return nil, nil, nil
+		}
+		position = 0
+	}
+	defer t.unpin(id, false)
+	return pagedHint{id, t.generation}, copyBytes(pageKey(page, position)), t.loadValue(pageValue(page, position), false)
+}
+
+// follow unpins the leaf and fetches the leaf it links to at the offset,
+// or returns a nil page if there is none.
+func (t *pagedTree) follow(id pageID, page []byte, link int) (pageID, []byte) {
+	next := pageLink(page, link)
+	t.unpin(id, false)
+	if next == 0 {
+		return 0, nil
+	}
+	return next, t.fetch(next)
+}
+
+// position returns the position of the first key of the leaf page after
+// the given key, or of the key itself unless exclusive.
+func (t *pagedTree) position(page []byte, key []byte, exclusive bool) int {
+	position, found := pageSearch(page, key, t.bpt.compare)
+	if found && exclusive {
+		position++
+	}
+	return position
+}
+
+func (t *pagedTree) last(bound []byte) (interface{}, []byte, []byte) {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	if t.err() != nil {
+		return nil, nil, nil
+	}
+	defer t.recoverFailure(nil)
+	id := t.pager.root
+	page := t.fetch(id)
+	for pageType(page) != pageLeaf {
+		position := pageCount(page)
+		if bound != nil {
+			position = pageChildPosition(page, bound, t.bpt.compare)
+		}
+		child := pageChild(page, position)
+		t.unpin(id, false)
+		id, page = child, t.fetch(child)
+	}
+	position := pageCount(page)
+	if bound != nil {
+		position, _ = pageSearch(page, bound, t.bpt.compare)
+	}
+	for position == 0 {
+		if id, page = t.follow(id, page, prevLink); page == nil {
+			return nil, nil, nil
+		}
+		position = pageCount(page)
+	}
+	defer t.unpin(id, false)
+	return pagedHint{id, t.generation}, copyBytes(pageKey(page, position-1)), t.loadValue(pageValue(page, position-1), false)
+}
+
+// Close writes back the pages changed and the meta
+// page, syncs and closes the page file.
+func (t *pagedTree) Close() error {
+	t.latch.Lock()
+	defer t.latch.Unlock()
+	if err := t.err(); err != nil {
+		t.pager.file.Close()
+		return err
+	}
+	if err := t.pool.flush(); err != nil {
+		t.pager.file.Close()
+		return err
+	}
+	return t.pager.close()
+}
+
+func (t *pagedTree) validate() (err error) {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	if err := t.err(); err != nil {
+		return err
+	}
+	defer t.recoverFailure(&err)
+	v := &pagedValidator{t: t, leafDepth: -1, seen: make(map[pageID]bool)}
+	if err := v.validatePage(t.pager.root, "root", nil, nil, 0); err != nil {
+		return err
+	}
+	if v.lastLeaf != 0 {
+		if next := t.link(v.lastLeaf, nextLink); next != 0 {
+			return fmt.Errorf("last leaf %d links to next leaf %d", v.lastLeaf, next)
+		}
+	}
+	if uint64(v.size) != t.pager.count {
+		return fmt.Errorf("size is %d but the tree holds %d keys", t.pager.count, v.size)
+	}
+
+	// free pages are read past the buffer pool, which holds none
+	page := make([]byte, t.pager.pageSize)
+	for id := t.pager.freeHead; id != 0; id = pageLink(page, freeLink) {
+		if v.seen[id] || uint32(id) >= t.pager.pages {
+			return fmt.Errorf("free page %d is in use or out of the file", id)
+		}
+		if err := t.pager.read(id, page); err != nil {
+			return err
+		}
+		if pageType(page) != pageFree {
+			return fmt.Errorf("page %d on the free list is not free", id)
+		}
+		v.seen[id] = true
+	}
+	if pages := 1 + len(v.seen); uint32(pages) != t.pager.pages {
+		return fmt.Errorf("file holds %d pages but %d are in use or free", t.pager.pages, pages)
+	}
+	return nil
+}
+
+// pagedValidator carries the state of a paged tree walk
+type pagedValidator struct {
+	t         *pagedTree
+	leafDepth int
+	size      int
+
+	// the pages reached, and the last leaf, whose next leaf is the one to come
+	seen     map[pageID]bool
+	lastLeaf pageID
+}
+
+// validatePage checks the subtree of the page, whose keys
+// must lie within [lower, upper), a nil bound is open.
+func (v *pagedValidator) validatePage(id pageID, path string, lower, upper []byte, depth int) error {
+	if id == 0 || uint32(id) >= v.t.pager.pages || v.seen[id] {
+		return fmt.Errorf("%s: page %d is out of the file or reached twice", path, id)
+	}
+	v.seen[id] = true
+	page := v.t.fetch(id)
+	typ := pageType(page)
+	if typ != pageLeaf && typ != pageInternal {
+		v.t.unpin(id, false)
+		return fmt.Errorf("%s: page %d is of type %d", path, id, typ)
+	}
+	n := decodeNode(page)
+	v.t.unpin(id, false)
+	compare := v.t.bpt.compare
+	for i, key := range n.keys {
+		if i > 0 && compare(n.keys[i-1], key) >= 0 {
+			return fmt.Errorf("%s: keys %q and %q are not in ascending order", path, n.keys[i-1], key)
+		}
+		if lower != nil && compare(key, lower) < 0 || upper != nil && compare(key, upper) >= 0 {
+			return fmt.Errorf("%s: key %q lies outside [%q, %q)", path, key, lower, upper)
+		}
+	}
+	if n.size() > v.t.pager.pageSize {
+		return fmt.Errorf("%s: node takes %d bytes", path, n.size())
+	}
+
+	if n.leaf {
+		if depth > 0 && len(n.keys) == 0 {
+			return fmt.Errorf("%s: leaf holds no key", path)
+		}
+		if v.leafDepth == -1 {
+			v.leafDepth = depth
+		} else if v.leafDepth != depth {
+			return fmt.Errorf("%s: leaf at depth %d, expected %d", path, depth, v.leafDepth)
+		}
+		if n.prev != v.lastLeaf {
+			return fmt.Errorf("%s: leaf links to previous leaf %d, expected %d", path, n.prev, v.lastLeaf)
+		}
+		if v.lastLeaf != 0 {
+			if next := v.t.link(v.lastLeaf, nextLink); next != id {
+				return fmt.Errorf("%s: previous leaf links to next leaf %d, expected %d", path, next, id)
+			}
+		}
+		v.lastLeaf = id
+		v.size += len(n.keys)
+		for _, value := range n.values {
+			if err := v.validateOverflow(path, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(n.keys) == 0 {
+		return fmt.Errorf("%s: internal node holds no key", path)
+	}
+	for i, child := range n.children {
+		size := v.size
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = n.keys[i-1]
+		}
+		if i < len(n.keys) {
+			childUpper = n.keys[i]
+		}
+		if err := v.validatePage(child, fmt.Sprintf("%s/%d", path, i), childLower, childUpper, depth+1); err != nil {
+			return err
+		}
+		if uint64(v.size-size) != n.counts[i] {
+			return fmt.Errorf("%s: child %d counts %d keys but holds %d", path, i, n.counts[i], v.size-size)
+		}
+	}
+	return nil
+}
+
+// validateOverflow checks the chain of overflow pages of the value
+func (v *pagedValidator) validateOverflow(path string, value pagedValue) error {
+	page := make([]byte, v.t.pager.pageSize)
+	length := 0
+	for id := value.overflow; id != 0; id = pageLink(page, overflowLink) {
+		if uint32(id) >= v.t.pager.pages || v.seen[id] {
+			return fmt.Errorf("%s: overflow page %d is out of the file or reached twice", path, id)
+		}
+		v.seen[id] = true
+		if err := v.t.pager.read(id, page); err != nil {
+			return err
+		}
+		if pageType(page) != pageOverflow {
+			return fmt.Errorf("%s: overflow page %d is of type %d", path, id, pageType(page))
+		}
+		length += pageCount(page)
+	}
+	if length != value.length {
+		return fmt.Errorf("%s: overflow pages hold %d bytes of a value of %d", path, length, value.length)
+	}
+	return nil
+}
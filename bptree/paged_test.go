@@ -0,0 +1,336 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tempPageFile sets a new page file in a temporary directory
+// to every tree built with it.
+func tempPageFile(t *testing.T) Option {
+	dir, files := t.TempDir(), 0
+	return func(bpt *BPlusTree) error {
+		files++
+		return SetPageFile(filepath.Join(dir, fmt.Sprintf("%d.pages", files)))(bpt)
+	}
+}
+
+func TestPagedSequential(t *testing.T) {
+	testSequential(t, Unsynchronized, SetPageSize(minPageSize), tempPageFile(t))
+}
+
+func TestPagedConcurrentReadersAndWriters(t *testing.T) {
+	testConcurrentReadersAndWriters(t, Unsynchronized, SetPageSize(minPageSize), tempPageFile(t))
+}
+
+func TestPagedReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.pages")
+	bpt, err := NewBPlusTree(SetPageFile(path), SetPageSize(1024))
+	assert.NoError(t, err)
+	for k := 0; k < 5000; k++ {
+		bpt.Put(uint32Key(k), []byte(fmt.Sprint(k)))
+	}
+	for k := 0; k < 5000; k += 3 {
+		bpt.Delete(uint32Key(k))
+	}
+	assert.NoError(t, bpt.Close())
+
+	// the page size of the file wins over the option
+	bpt, err = NewBPlusTree(SetPageFile(path), SetPageSize(4096))
+	assert.NoError(t, err)
+	assert.Equal(t, 1024, bpt.engine.(*pagedTree).pager.pageSize)
+	assert.NoError(t, bpt.Validate())
+	assert.Equal(t, 3333, bpt.Size())
+	for k := 0; k < 5000; k++ {
+		value, ok := bpt.Get(uint32Key(k))
+		assert.Equal(t, k%3 != 0, ok)
+		if ok {
+			assert.Equal(t, fmt.Sprint(k), string(value))
+		}
+	}
+	assert.NoError(t, bpt.Close())
+}
+
+func TestPagedReopenWithoutClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.pages")
+	bpt, _ := NewBPlusTree(SetPageFile(path), SetPageSize(minPageSize), SetBufferPoolSize(4))
+	for k := 0; k < 2000; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+
+	// evicted pages have reached the file, but not the meta page
+	pager := bpt.engine.(*pagedTree).pager
+	assert.Greater(t, bpt.BufferPoolStats().WriteBacks, uint64(0))
+	assert.NoError(t, pager.file.Close())
+	_, err := NewBPlusTree(SetPageFile(path))
+	assert.ErrorIs(t, err, ErrNotClosed)
+}
+
+func TestPagedVariableLengthKeys(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	bpt, _ := NewBPlusTree(tempPageFile(t), SetPageSize(minPageSize))
+	maxCell := bpt.engine.(*pagedTree).maxCellSize()
+
+	expected := make(map[string]string)
+	var live []string
+	for i := 0; i < 5000; i++ {
+		if len(live) > 0 && r.Intn(3) == 0 {
+			j := r.Intn(len(live))
+			_, deleted := bpt.Delete([]byte(live[j]))
+			assert.True(t, deleted)
+			delete(expected, live[j])
+			live[j] = live[len(live)-1]
+			live = live[:len(live)-1]
+			continue
+		}
+		key := make([]byte, 8+r.Intn(maxCell/2-8))
+		r.Read(key)
+		value := make([]byte, r.Intn(maxCell-len(key)-slotLen-leafCellHeaderLen+1))
+		if r.Intn(10) == 0 {
+			// it goes to overflow pages
+			value = make([]byte, r.Intn(4*minPageSize))
+		}
+		r.Read(value)
+		bpt.Put(key, value)
+		expected[string(key)] = string(value)
+		live = append(live, string(key))
+	}
+	assert.NoError(t, bpt.Validate())
+	assert.Equal(t, len(expected), bpt.Size())
+
+	keys := make([]string, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	i := 0
+	bpt.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+		assert.Equal(t, keys[i], string(key))
+		assert.Equal(t, expected[keys[i]], string(value))
+		i++
+		return true
+	})
+	assert.Equal(t, len(keys), i)
+
+	// keys longer than a cell holding a value in overflow pages are refused
+	maxKey := bpt.engine.(*pagedTree).maxKeySize()
+	assert.PanicsWithError(t, fmt.Sprintf("bptree: %v, it takes %d bytes out of %d", ErrKeyTooLarge, maxKey+1, maxKey), func() {
+		bpt.Put(make([]byte, maxKey+1), nil)
+	})
+	assert.NoError(t, bpt.Err())
+	assert.Equal(t, len(expected), bpt.Size())
+	bpt.Put(make([]byte, maxKey), make([]byte, maxCell))
+	assert.Equal(t, len(expected)+1, bpt.Size())
+	assert.NoError(t, bpt.Validate())
+	assert.NoError(t, bpt.Close())
+
+	pairs := [][]byte{make([]byte, maxKey+1)}
+	bpt, _ = NewBPlusTree(tempPageFile(t), SetPageSize(minPageSize))
+	assert.ErrorIs(t, bpt.BulkLoad(NewSliceSource(pairs, pairs)), ErrKeyTooLarge)
+	assert.NoError(t, bpt.Close())
+}
+
+func TestPagedLargeValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.pages")
+	bpt, _ := NewBPlusTree(SetPageFile(path), SetPageSize(minPageSize), SetBufferPoolSize(4))
+	pager := bpt.engine.(*pagedTree).pager
+	value := func(k, size int) []byte {
+		return bytes.Repeat(uint32Key(k), size/4)
+	}
+	sizes := []int{0, 400, 2000, 100 << 10}
+	for k, size := range sizes {
+		bpt.Put(uint32Key(k), value(k, size))
+	}
+	pages := pager.pages
+	assert.Greater(t, pages, uint32(100<<10/minPageSize))
+	assert.NoError(t, bpt.Validate())
+	assert.NoError(t, bpt.Close())
+
+	bpt, _ = NewBPlusTree(SetPageFile(path), SetBufferPoolSize(4))
+	pager = bpt.engine.(*pagedTree).pager
+	for k, size := range sizes {
+		got, ok := bpt.Get(uint32Key(k))
+		assert.True(t, ok)
+		assert.Equal(t, value(k, size), got)
+	}
+
+	// replaced and deleted values give their overflow pages back
+	for k, size := range sizes {
+		old, _ := bpt.Put(uint32Key(k), value(k+1, size))
+		assert.Equal(t, value(k, size), old)
+	}
+	assert.Equal(t, pages, pager.pages)
+	it := bpt.Iterator()
+	it.SeekToLast()
+	key, last := it.Prev()
+	assert.Equal(t, uint32Key(3), key)
+	assert.Equal(t, value(4, sizes[3]), last)
+	for k, size := range sizes {
+		old, _ := bpt.Delete(uint32Key(k))
+		assert.Equal(t, value(k+1, size), old)
+	}
+	assert.NoError(t, bpt.Validate())
+	for k, size := range sizes {
+		bpt.Put(uint32Key(k), value(k, size))
+	}
+	assert.Equal(t, pages, pager.pages)
+	assert.NoError(t, bpt.Validate())
+	assert.NoError(t, bpt.Close())
+}
+
+func TestPagedFailure(t *testing.T) {
+	bpt, _ := NewBPlusTree(tempPageFile(t), SetPageSize(minPageSize), SetBufferPoolSize(4))
+	for k := 0; k < 2000; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+	assert.NoError(t, bpt.Err())
+
+	// the file fails under the tree, which stops instead of panicking
+	bpt.engine.(*pagedTree).pager.file.Close()
+	for k := 0; k < 2000; k++ {
+		bpt.Put(uint32Key(k), nil)
+	}
+	assert.ErrorIs(t, bpt.Err(), os.ErrClosed)
+	_, ok := bpt.Get(uint32Key(0))
+	assert.False(t, ok)
+	_, deleted := bpt.Delete(uint32Key(0))
+	assert.False(t, deleted)
+	assert.False(t, bpt.Iterator().Valid())
+	_, err := bpt.Rank(uint32Key(0))
+	assert.ErrorIs(t, err, os.ErrClosed)
+	_, _, err = bpt.Select(0)
+	assert.ErrorIs(t, err, os.ErrClosed)
+	assert.ErrorIs(t, bpt.Validate(), os.ErrClosed)
+	assert.ErrorIs(t, bpt.Close(), os.ErrClosed)
+
+	bpt, _ = NewBPlusTree()
+	assert.NoError(t, bpt.Err())
+}
+
+func TestPagedIteratorsOverFreedLeaves(t *testing.T) {
+	for _, frames := range []int{16, 32, 64} {
+		bpt, _ := NewBPlusTree(tempPageFile(t), SetPageSize(minPageSize), SetBufferPoolSize(frames))
+		for k := 0; k < 3000; k++ {
+			bpt.Put(uint32Key(k), uint32Key(k))
+		}
+		var its []*Iterator
+		for k := 500; k < 1500; k += 20 {
+			it := bpt.Iterator()
+			it.Seek(uint32Key(k))
+			its = append(its, it)
+		}
+
+		// the leaves of the iterators are freed, then their pages reused
+		assert.Equal(t, 1000, bpt.DeleteRange(uint32Key(500), uint32Key(1500), ScanOptions{}))
+		for i, it := range its {
+			key, _ := it.Next()
+			assert.Equal(t, uint32Key(500+20*i), key)
+			assert.Equal(t, uint32Key(1500), it.Key())
+		}
+		for k := 500; k < 1500; k++ {
+			bpt.Put(uint32Key(k), uint32Key(k))
+		}
+		assert.NoError(t, bpt.Err())
+		assert.NoError(t, bpt.Validate())
+		assert.Equal(t, 3000, bpt.Size())
+		assert.NoError(t, bpt.Close())
+	}
+}
+
+func TestPagedReusesFreePages(t *testing.T) {
+	bpt, _ := NewBPlusTree(tempPageFile(t), SetPageSize(minPageSize))
+	pager := bpt.engine.(*pagedTree).pager
+	for round := 0; round < 3; round++ {
+		for k := 0; k < 2000; k++ {
+			bpt.Put(uint32Key(k), uint32Key(k))
+		}
+		if round == 0 {
+			assert.Greater(t, pager.pages, uint32(50))
+		}
+		pages := pager.pages
+		assert.Equal(t, 2000, bpt.DeleteRange(nil, nil, ScanOptions{}))
+		assert.NoError(t, bpt.Validate())
+
+		// every page but the meta page and the root leaf is free,
+		// and the next round takes them back
+		assert.Equal(t, pages, pager.pages)
+		free, page := 0, make([]byte, pager.pageSize)
+		for id := pager.freeHead; id != 0; id = pageLink(page, freeLink) {
+			assert.NoError(t, pager.read(id, page))
+			free++
+		}
+		assert.Equal(t, int(pages)-2, free)
+	}
+	assert.NoError(t, bpt.Close())
+}
+
+func TestPagedOptions(t *testing.T) {
+	for _, size := range []int{0, 256, 1000, 65536} {
+		_, err := NewBPlusTree(tempPageFile(t), SetPageSize(size))
+		assert.Error(t, err)
+	}
+	_, err := NewBPlusTree(SetPageFile(""))
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "not a tree")
+	os.WriteFile(path, []byte("not a page file"), 0644)
+	_, err = NewBPlusTree(SetPageFile(path))
+	assert.ErrorIs(t, err, ErrNotPageFile)
+
+	bpt, _ := NewBPlusTree(tempPageFile(t), SetConcurrency(CopyOnWrite))
+	_, err = bpt.Snapshot()
+	assert.ErrorIs(t, err, ErrNoSnapshot)
+	assert.NoError(t, bpt.Close())
+
+	// trees in memory have nothing to close
+	bpt, _ = NewBPlusTree()
+	assert.NoError(t, bpt.Close())
+}
+
+func TestPagedSmallBufferPool(t *testing.T) {
+	for _, policy := range []EvictionPolicy{LRU, Clock, LRU2, TwoQueue} {
+		path := filepath.Join(t.TempDir(), "tree.pages")
+		bpt, _ := NewBPlusTree(SetPageFile(path), SetPageSize(minPageSize), SetBufferPoolSize(4), SetEvictionPolicy(policy))
+		r := rand.New(rand.NewSource(int64(policy)))
+		expected := make(map[int]bool)
+		for i := 0; i < 6000; i++ {
+			k := r.Intn(2000)
+			if r.Intn(3) == 0 {
+				_, deleted := bpt.Delete(uint32Key(k))
+				assert.Equal(t, expected[k], deleted)
+				delete(expected, k)
+			} else {
+				bpt.Put(uint32Key(k), uint32Key(k))
+				expected[k] = true
+			}
+		}
+		assert.NoError(t, bpt.Validate())
+		stats := bpt.BufferPoolStats()
+		assert.Greater(t, stats.WriteBacks, uint64(0))
+		assert.Greater(t, stats.Evictions, stats.WriteBacks)
+		assert.Greater(t, stats.HitRate(), 0.5)
+		assert.NoError(t, bpt.Close())
+
+		// the pages written back and flushed make up the tree
+		bpt, _ = NewBPlusTree(SetPageFile(path))
+		assert.NoError(t, bpt.Validate())
+		assert.Equal(t, len(expected), bpt.Size())
+		for k := 0; k < 2000; k++ {
+			_, ok := bpt.Get(uint32Key(k))
+			assert.Equal(t, expected[k], ok)
+		}
+		assert.NoError(t, bpt.Close())
+	}
+}
+
+func TestPagedConcurrentReadersAndWritersSmallBufferPool(t *testing.T) {
+	testConcurrentReadersAndWriters(t, Unsynchronized, SetPageSize(minPageSize), SetBufferPoolSize(2), tempPageFile(t))
+}
@@ -0,0 +1,215 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The first page of a page file is its meta page: a magic string, the
+// version of the format, the page size, the root, the number of pages, the
+// head of the list of free pages and the number of keys, in big endian,
+// then whether the tree was closed. Pages are written back whenever they
+// are evicted, so a file whose tree wasn't closed may hold any mix of old
+// and new pages, and a meta page which matches none of them.
+
+const (
+	pageFileMagic   = "BPTPAGE\x00"
+	pageFileVersion = 1
+
+	defaultPageSize = 4096
+	minPageSize     = 512
+
+	// slots hold offsets of 16 bits
+	maxPageSize = 32768
+
+	metaLen = len(pageFileMagic) + 2 + 4 + 4 + 4 + 4 + 8 + 1
+)
+
+var (
+	// ErrNotPageFile is returned when opening a file which is not a page
+	// file, or one of a newer version of the format.
+	ErrNotPageFile = errors.New("not a page file")
+
+	// ErrNotClosed is returned when opening a page file whose tree was
+	// not closed, which may not hold a tree anymore.
+	ErrNotClosed = errors.New("page file was not closed")
+)
+
+// pager reads and writes the pages of a page file and allocates them.
+// Node pages go through the buffer pool, free pages, overflow pages and
+// the meta page are read and written directly. It is not safe for concurrent writers.
+type pager struct {
+	file     pagerFile
+	pageSize int
+
+	// the content of the meta page
+	root     pageID
+	pages    uint32
+	freeHead pageID
+	count    uint64
+}
+
+// pagerFile is the file of a pager, an *os.File but in tests
+type pagerFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// openPager opens the page file at path, or creates it with a single empty
+// leaf as root and pages of the given size. An existing file keeps its size.
+// The file is marked open until closed before any page is written.
+func openPager(path string, pageSize int) (*pager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &pager{file: file, pageSize: pageSize}
+	info, err := file.Stat()
+	if err == nil {
+		if info.Size() == 0 {
+			err = p.create()
+		} else {
+			err = p.readMeta()
+		}
+	}
+	if err == nil {
+		err = p.writeMeta(false)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// create initializes an empty page file
+func (p *pager) create() error {
+	p.pages = 1
+	root, err := p.allocate()
+	if err != nil {
+		return err
+	}
+	page := make([]byte, p.pageSize)
+	(&pagedNode{leaf: true}).encode(page)
+	if err := p.write(root, page); err != nil {
+		return err
+	}
+	p.root = root
+	return nil
+}
+
+func (p *pager) readMeta() error {
+	meta := make([]byte, metaLen)
+	if _, err := p.file.ReadAt(meta, 0); err != nil {
+		if err == io.EOF {
+			return ErrNotPageFile
+		}
+		return err
+	}
+	if string(meta[:len(pageFileMagic)]) != pageFileMagic {
+		return ErrNotPageFile
+	}
+	meta = meta[len(pageFileMagic):]
+	if binary.BigEndian.Uint16(meta) != pageFileVersion {
+		return ErrNotPageFile
+	}
+	p.pageSize = int(binary.BigEndian.Uint32(meta[2:]))
+	p.root = pageID(binary.BigEndian.Uint32(meta[6:]))
+	p.pages = binary.BigEndian.Uint32(meta[10:])
+	p.freeHead = pageID(binary.BigEndian.Uint32(meta[14:]))
+	p.count = binary.BigEndian.Uint64(meta[18:])
+	if p.pageSize < minPageSize || p.pageSize > maxPageSize || p.root == 0 || uint32(p.root) >= p.pages {
+		return ErrNotPageFile
+	}
+	if meta[26] == 0 {
+		return ErrNotClosed
+	}
+	return nil
+}
+
+// writeMeta writes the meta page, marking whether the tree is closed
+func (p *pager) writeMeta(closed bool) error {
+	meta := make([]byte, p.pageSize)
+	copy(meta, pageFileMagic)
+	m := meta[len(pageFileMagic):]
+	binary.BigEndian.PutUint16(m, pageFileVersion)
+	binary.BigEndian.PutUint32(m[2:], uint32(p.pageSize))
+	binary.BigEndian.PutUint32(m[6:], uint32(p.root))
+	binary.BigEndian.PutUint32(m[10:], p.pages)
+	binary.BigEndian.PutUint32(m[14:], uint32(p.freeHead))
+	binary.BigEndian.PutUint64(m[18:], p.count)
+	if closed {
+		m[26] = 1
+	}
+	return p.write(0, meta)
+}
+
+// read reads the page into buf, which is a page long
+func (p *pager) read(id pageID, buf []byte) error {
+	if id == 0 || uint32(id) >= p.pages {
+		return fmt.Errorf("page %d out of the %d pages of the file", id, p.pages)
+	}
+	_, err := p.file.ReadAt(buf, int64(id)*int64(p.pageSize))
+	return err
+}
+
+// write writes buf, which is a page long, to the page
+func (p *pager) write(id pageID, buf []byte) error {
+	_, err := p.file.WriteAt(buf, int64(id)*int64(p.pageSize))
+	return err
+}
+
+// allocate returns a page which is free, taking it from the list of free
+// pages or growing the file. The content of the page is undefined.
+func (p *pager) allocate() (pageID, error) {
+	if p.freeHead == 0 {
+		p.pages++
+		return pageID(p.pages - 1), nil
+	}
+	id := p.freeHead
+	page := make([]byte, p.pageSize)
+	if err := p.read(id, page); err != nil {
+		return 0, err
+	}
+	if pageType(page) != pageFree {
+		return 0, fmt.Errorf("page %d on the free list is not free", id)
+	}
+	p.freeHead = pageLink(page, freeLink)
+	return id, nil
+}
+
+// free puts the page on the list of free pages
+func (p *pager) free(id pageID) error {
+	page := make([]byte, p.pageSize)
+	page[0] = pageFree
+	setPageLink(page, freeLink, p.freeHead)
+	if err := p.write(id, page); err != nil {
+		return err
+	}
+	p.freeHead = id
+	return nil
+}
+
+// close syncs the pages, then writes the meta page marked
+// closed, syncs and closes the file
+func (p *pager) close() error {
+	err := p.file.Sync()
+	if err == nil {
+		err = p.writeMeta(true)
+	}
+	if err == nil {
+		err = p.file.Sync()
+	}
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package bptree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ScanPrefix traverses the pairs of kv whose keys start with the prefix
+// in ascending key order. The traversal stops as soon as action returns
+// false. Keys sharing a prefix must be adjacent in key order, which
+// holds for the default comparator.
+func (bpt *BPlusTree) ScanPrefix(prefix []byte, action func(key, value []byte) bool) {
+	if prefix == nil {
+		return
+	}
+	afterPrefix := bpt.afterPrefix(prefix)
+	bpt.Scan(prefix, nil, ScanOptions{}, func(key, value []byte) bool {
+		if afterPrefix(key) {
+			return false
+		}
+		return action(key, value)
+	})
+}
+
+// DeletePrefix deletes all the keys starting with the prefix and returns
+// their number. The keys are removed in batches instead of one by one,
+// and the tree is rebalanced once afterwards. Keys sharing a prefix must
+// be adjacent in key order, which holds for the default comparator.
+func (bpt *BPlusTree) DeletePrefix(prefix []byte) (int, error) {
+	if prefix == nil {
+		return 0, errors.New("prefix can't be nil")
+	}
+	bpt.lockTree()
+	defer bpt.unlockTree()
+	defer bpt.debugValidate()
+
+	return bpt.deleteRange(keyRange{start: prefix, afterEnd: bpt.afterPrefix(prefix)}), nil
+}
+
+// afterPrefix returns a function reporting whether a key lies after all
+// the keys starting with the prefix.
+func (bpt *BPlusTree) afterPrefix(prefix []byte) func(key []byte) bool {
+	return func(key []byte) bool {
+		return !bytes.HasPrefix(key, prefix) && bpt.compare(key, prefix) > 0
+	}
+}
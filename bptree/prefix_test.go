@@ -0,0 +1,157 @@
+package bptree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanPrefix(t *testing.T) {
+	for order := 3; order <= 7; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order))
+		for tenant := 0; tenant < 20; tenant++ {
+			for i := 0; i < 10; i++ {
+				key := []byte(fmt.Sprintf("tenant/%d/%d", tenant, i))
+				bpt.Put(key, key)
+			}
+		}
+
+		keys := make([]string, 0)
+		bpt.ScanPrefix([]byte("tenant/1/"), func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		assert.Equal(t, 10, len(keys))
+		for _, key := range keys {
+			assert.True(t, strings.HasPrefix(key, "tenant/1/"))
+		}
+
+		count := 0
+		bpt.ScanPrefix([]byte("tenant/1"), func(key, value []byte) bool {
+			count++
+			return true
+		})
+		// tenant/1/ and tenant/10/ to tenant/19/
+		assert.Equal(t, 110, count)
+
+		count = 0
+		bpt.ScanPrefix([]byte("tenant/3/"), func(key, value []byte) bool {
+			count++
+			return count < 4
+		})
+		assert.Equal(t, 4, count)
+
+		bpt.ScanPrefix([]byte("tenant/99/"), func(key, value []byte) bool {
+			assert.Fail(t, "no key has the prefix")
+			return true
+		})
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	tenants := 30
+
+	for order := 3; order <= 8; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order))
+		perTenant := make([]int, tenants)
+		for i := 0; i < 3000; i++ {
+			tenant := r.Intn(tenants)
+			key := []byte(fmt.Sprintf("tenant/%02d/%d", tenant, i))
+			bpt.Put(key, key)
+			perTenant[tenant]++
+		}
+		assert.NoError(t, bpt.Validate())
+
+		size := bpt.Size()
+		for _, tenant := range r.Perm(tenants) {
+			deleted, err := bpt.DeletePrefix([]byte(fmt.Sprintf("tenant/%02d/", tenant)))
+			assert.NoError(t, err)
+			assert.Equal(t, perTenant[tenant], deleted)
+			if !assert.NoError(t, bpt.Validate()) {
+				return
+			}
+
+			size -= deleted
+			assert.Equal(t, size, bpt.Size())
+			bpt.ForEach(func(key, value []byte) {
+				assert.False(t, strings.HasPrefix(string(key), fmt.Sprintf("tenant/%02d/", tenant)))
+			})
+		}
+		assert.Equal(t, 0, bpt.Size())
+	}
+}
+
+func TestDeletePrefixRandomized(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+
+	for order := 3; order <= 8; order++ {
+		for round := 0; round < 50; round++ {
+			bpt, _ := NewBPlusTree(SetOrder(order))
+			expected := make(map[string]bool)
+			for i := 0; i < 1+r.Intn(500); i++ {
+				key := fmt.Sprintf("%d", r.Intn(100000))
+				bpt.Put([]byte(key), []byte(key))
+				expected[key] = true
+			}
+
+			for i := 0; i < 5; i++ {
+				prefix := fmt.Sprintf("%d", 1+r.Intn(99))
+				prefix = prefix[:1+r.Intn(len(prefix))]
+				removed := 0
+				for key := range expected {
+					if strings.HasPrefix(key, prefix) {
+						delete(expected, key)
+						removed++
+					}
+				}
+
+				deleted, err := bpt.DeletePrefix([]byte(prefix))
+				assert.NoError(t, err)
+				assert.Equal(t, removed, deleted)
+				if !assert.NoError(t, bpt.Validate()) {
+					return
+				}
+			}
+
+			keys := make([]string, 0, len(expected))
+			for key := range expected {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			actual := make([]string, 0, len(expected))
+			bpt.ForEach(func(key, value []byte) {
+				actual = append(actual, string(key))
+			})
+			assert.Equal(t, keys, actual)
+
+			// the tree keeps working after deletion
+			for _, key := range keys {
+				_, deleted := bpt.Delete([]byte(key))
+				assert.True(t, deleted)
+			}
+			assert.NoError(t, bpt.Validate())
+		}
+	}
+}
+
+func TestDeleteEmptyPrefix(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	for _, testData := range testDatas {
+		bpt.Put(testData.key, testData.value)
+	}
+
+	deleted, err := bpt.DeletePrefix([]byte{})
+	assert.NoError(t, err)
+	assert.Equal(t, len(testDatas), deleted)
+	assert.Equal(t, 0, bpt.Size())
+	assert.NoError(t, bpt.Validate())
+
+	_, err = bpt.DeletePrefix(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,258 @@
+package bptree
+
+// keyRange describes the keys from start up to the first key for which
+// afterEnd returns true. A nil start or afterEnd leaves that side open.
+// afterEnd must be monotone in key order.
+type keyRange struct {
+	start        []byte
+	excludeStart bool
+	afterEnd     func(key []byte) bool
+}
+
+// boundedRange returns the range between start and end
+func (bpt *BPlusTree) boundedRange(start, end []byte, opts ScanOptions) keyRange {
+	r := keyRange{start: start, excludeStart: opts.ExcludeStart}
+	if end != nil {
+		r.afterEnd = func(key []byte) bool {
+			return bpt.afterEnd(key, end, opts)
+		}
+	}
+	return r
+}
+
+// empty returns true if no key can lie in the range
+func (r keyRange) empty() bool {
+	return r.start != nil && r.afterEnd != nil && r.afterEnd(r.start)
+}
+
+// startChild returns the position of the child of the internal node
+// which holds the first key of the range.
+func (bpt *BPlusTree) startChild(n *node, r keyRange) int {
+	if r.start == nil {
+		return 0
+	}
+	return n.upperBound(r.start, bpt.compare)
+}
+
+// endChild returns the position of the child of the internal node
+// which holds the last key of the range.
+func (bpt *BPlusTree) endChild(n *node, r keyRange) int {
+	if r.afterEnd == nil {
+		return n.keyNums
+	}
+	return n.firstPosition(r.afterEnd)
+}
+
+// descend returns the leaf reached by following the chosen children from the root
+func (bpt *BPlusTree) descend(child func(n *node) int) *node {
+	current := bpt.root
+	for !current.leaf {
+		current = current.pointers[child(current)].convertToNode()
+	}
+	return current
+}
+
+// DeleteRange deletes all the keys between start and end and returns
+// their number. A nil start or end leaves that side of the range open,
+// opts sets the bounds like for Scan. The leaves and subtrees covered by
+// the range are detached as a whole, only the paths to both ends of the
+// range are repaired.
+func (bpt *BPlusTree) DeleteRange(start, end []byte, opts ScanOptions) int {
+	bpt.lockTree()
+	defer bpt.unlockTree()
+	defer bpt.debugValidate()
+
+	return bpt.deleteRange(bpt.boundedRange(start, end, opts))
+}
+
+// deleteRange deletes all the keys in the range and returns their number.
+// The subtrees lying completely inside the range are detached at once,
+// the nodes on the paths to both ends of the range are trimmed and then
+// rebalanced in a single pass, so no key pays a descent of its own.
+func (bpt *BPlusTree) deleteRange(r keyRange) int {
+	if bpt.engine != nil {
+		return bpt.deleteRangeEngine(r)
+	}
+	if bpt.root == nil || r.empty() {
+		return 0
+	}
+	if r.start == nil && r.afterEnd == nil {
+		removed := bpt.size
+		bpt.root, bpt.mostLeftNode = nil, nil
+		bpt.addSize(-removed)
+		return removed
+	}
+
+	startPath := func(n *node) int {
+		return bpt.startChild(n, r)
+	}
+	endPath := func(n *node) int {
+		return bpt.endChild(n, r)
+	}
+	var startLeaf, endLeaf *node
+	if r.start != nil {
+		startLeaf = bpt.descend(startPath)
+	}
+	if r.afterEnd != nil {
+		endLeaf = bpt.descend(endPath)
+	}
+
+	removed := bpt.removeRange(bpt.root, r)
+	if removed == 0 {
+		return 0
+	}
+	bpt.addSize(-removed)
+
+	// the leaves between both ends have been detached
+	if startLeaf != endLeaf {
+		if startLeaf != nil {
+			var next *pointer
+			if endLeaf != nil {
+				next = &pointer{endLeaf}
+			}
+			startLeaf.setLastPointer(next)
+		} else {
+			bpt.mostLeftNode = endLeaf
+		}
+		if endLeaf != nil {
+			endLeaf.setPreviousLeafNode(startLeaf)
+		}
+	}
+
+	bpt.rebalancePath(startPath)
+	bpt.rebalancePath(endPath)
+	return removed
+}
+
+// removeRange removes the keys in the range from the subtree of n and
+// returns their number. It leaves the nodes unbalanced and the leaves
+// around the range unlinked, but it never removes the last child of a node.
+func (bpt *BPlusTree) removeRange(n *node, r keyRange) int {
+	if n.leaf {
+		from := 0
+		if r.start != nil {
+			var found bool
+			from, found = n.search(r.start, bpt.compare)
+			if found && r.excludeStart {
+				from++
+			}
+		}
+		to := n.keyNums
+		if r.afterEnd != nil {
+			to = n.firstPosition(r.afterEnd)
+		}
+		if from >= to {
+			return 0
+		}
+		n.deleteRange(from, to, from)
+		return to - from
+	}
+
+	removed := bpt.removeFromChildren(n, r)
+	if bpt.counted() {
+		n.count -= removed
+	}
+	return removed
+}
+
+// removeFromChildren is removeRange for the children of the internal node
+func (bpt *BPlusTree) removeFromChildren(n *node, r keyRange) int {
+	startPosition, endPosition := bpt.startChild(n, r), bpt.endChild(n, r)
+	if r.start != nil && r.afterEnd != nil && startPosition == endPosition {
+		return bpt.removeRange(n.pointers[startPosition].convertToNode(), r)
+	}
+
+	// the children at the bounded ends are covered partially
+	removed := 0
+	first, last := startPosition, endPosition
+	if r.start != nil {
+		removed += bpt.removeRange(n.pointers[startPosition].convertToNode(), keyRange{start: r.start, excludeStart: r.excludeStart})
+		first++
+	}
+	if r.afterEnd != nil {
+		removed += bpt.removeRange(n.pointers[endPosition].convertToNode(), keyRange{afterEnd: r.afterEnd})
+		last--
+	}
+
+	// the children between them are covered completely
+	if first > last {
+		return removed
+	}
+	for i := first; i <= last; i++ {
+		removed += bpt.countKeys(n.pointers[i].convertToNode())
+	}
+	if first > 0 {
+		// drop the navigator keys on the left of the children
+		n.deleteRange(first-1, last, first)
+	} else {
+		// drop the navigator keys on the right of the children
+		n.deleteRange(0, last+1, 0)
+	}
+	return removed
+}
+
+// rebalancePath restores the occupancy of the nodes on the path chosen by
+// child, which may hold any number of keys after removeRange.
+func (bpt *BPlusTree) rebalancePath(child func(n *node) int) {
+	for {
+		bpt.collapseRoot()
+		if bpt.root == nil {
+			return
+		}
+
+		// find the deepest underflowing node on the path
+		var underflow *node
+		for current := bpt.root; ; current = current.pointers[child(current)].convertToNode() {
+			if current != bpt.root && current.keyNums < bpt.minKeyNum {
+				underflow = current
+			}
+			if current.leaf {
+				break
+			}
+		}
+		if underflow == nil {
+			return
+		}
+		bpt.rebalanceNode(underflow)
+	}
+}
+
+// rebalanceNode lets the underflowing node borrow a single entry from or
+// merge with a sibling. If the node is an only child, its parent is
+// rebalanced first to give it siblings.
+func (bpt *BPlusTree) rebalanceNode(n *node) {
+	parent := n.parent
+	if parent.keyNums == 0 {
+		if parent != bpt.root {
+			bpt.rebalanceNode(parent)
+		}
+		return
+	}
+
+	bpt.borrowOrMerge(n, parent)
+}
+
+// collapseRoot removes the roots which hold no keys
+func (bpt *BPlusTree) collapseRoot() {
+	for bpt.root != nil && bpt.root.keyNums == 0 {
+		if bpt.root.leaf {
+			bpt.root = nil
+			bpt.mostLeftNode = nil
+			return
+		}
+		bpt.root = bpt.root.pointers[0].convertToNode()
+		bpt.root.parent = nil
+	}
+}
+
+// countKeys returns the number of keys in the subtree of n
+func (bpt *BPlusTree) countKeys(n *node) int {
+	if n.leaf || bpt.counted() {
+		return n.keyCount()
+	}
+	count := 0
+	for i := 0; i <= n.keyNums; i++ {
+		count += bpt.countKeys(n.pointers[i].convertToNode())
+	}
+	return count
+}
@@ -0,0 +1,115 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uint32Key(k int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(k))
+	return key
+}
+
+func TestDeleteRangeRandomized(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	universe := 2000
+
+	for order := 3; order <= 8; order++ {
+		for round := 0; round < 30; round++ {
+			bpt, _ := NewBPlusTree(SetOrder(order))
+			expected := make(map[int]bool)
+			for i := 0; i < r.Intn(universe); i++ {
+				k := r.Intn(universe)
+				bpt.Put(uint32Key(k), uint32Key(k))
+				expected[k] = true
+			}
+
+			for i := 0; i < 5; i++ {
+				start, end := r.Intn(universe), r.Intn(universe)
+				if start > end {
+					start, end = end, start
+				}
+				opts := ScanOptions{ExcludeStart: r.Intn(2) == 0, IncludeEnd: r.Intn(2) == 0}
+				var startKey, endKey []byte
+				if r.Intn(8) > 0 {
+					startKey = uint32Key(start)
+				}
+				if r.Intn(8) > 0 {
+					endKey = uint32Key(end)
+				}
+
+				removed := 0
+				for k := range expected {
+					inRange := (startKey == nil || k > start || (k == start && !opts.ExcludeStart)) &&
+						(endKey == nil || k < end || (k == end && opts.IncludeEnd))
+					if inRange {
+						delete(expected, k)
+						removed++
+					}
+				}
+
+				assert.Equal(t, removed, bpt.DeleteRange(startKey, endKey, opts))
+				if !assert.NoError(t, bpt.Validate()) {
+					return
+				}
+				assert.Equal(t, len(expected), bpt.Size())
+			}
+
+			for k := 0; k < universe; k++ {
+				_, ok := bpt.Get(uint32Key(k))
+				assert.Equal(t, expected[k], ok)
+			}
+
+			// the tree keeps working after deletion
+			for k := 0; k < universe; k += 3 {
+				bpt.Put(uint32Key(k), uint32Key(k))
+			}
+			assert.NoError(t, bpt.Validate())
+		}
+	}
+}
+
+func TestDeleteRangeBounds(t *testing.T) {
+	for order := 3; order <= 7; order++ {
+		build := func() *BPlusTree {
+			bpt, _ := NewBPlusTree(SetOrder(order))
+			for _, testData := range testDatas {
+				bpt.Put(testData.key, testData.value)
+			}
+			return bpt
+		}
+
+		bpt := build()
+		assert.Equal(t, 3, bpt.DeleteRange([]byte("15"), []byte("2"), ScanOptions{}))
+		assert.Equal(t, []string{"0", "1", "11", "14", "2", "25", "33", "42", "60", "7", "74"}, scanKeys(bpt, nil, nil, ScanOptions{}))
+
+		bpt = build()
+		assert.Equal(t, 3, bpt.DeleteRange([]byte("15"), []byte("2"), ScanOptions{ExcludeStart: true, IncludeEnd: true}))
+		assert.Equal(t, []string{"0", "1", "11", "14", "15", "25", "33", "42", "60", "7", "74"}, scanKeys(bpt, nil, nil, ScanOptions{}))
+
+		bpt = build()
+		assert.Equal(t, 3, bpt.DeleteRange(nil, []byte("14"), ScanOptions{}))
+		assert.Equal(t, "14", string(bpt.Iterator().Key()))
+
+		bpt = build()
+		assert.Equal(t, 3, bpt.DeleteRange([]byte("6"), nil, ScanOptions{}))
+		it := bpt.Iterator()
+		it.SeekToLast()
+		assert.Equal(t, "42", string(it.Key()))
+
+		bpt = build()
+		assert.Equal(t, 0, bpt.DeleteRange([]byte("2"), []byte("15"), ScanOptions{}))
+		assert.Equal(t, 0, bpt.DeleteRange([]byte("2"), []byte("2"), ScanOptions{}))
+		assert.Equal(t, len(testDatas), bpt.Size())
+
+		assert.Equal(t, len(testDatas), bpt.DeleteRange(nil, nil, ScanOptions{}))
+		assert.Equal(t, 0, bpt.Size())
+		assert.NoError(t, bpt.Validate())
+		assert.Equal(t, 0, bpt.DeleteRange(nil, nil, ScanOptions{}))
+	}
+}
@@ -0,0 +1,131 @@
+package bptree
+
+import (
+	"errors"
+)
+
+// Internal nodes count the keys of their subtrees, so the rank of a key
+// and the key of a rank are found in a single descent. Writers add to the
+// counts of the ancestors of the leaf they change, and recount the nodes
+// they split, merge or redistribute.
+
+// ErrNotCounted is returned by Rank and Select for LatchCrabbing and BLink
+// trees, which don't count the keys of their subtrees.
+var ErrNotCounted = errors.New("tree doesn't count the keys of its subtrees")
+
+// ranker is implemented by the engines which find ranks without walking
+// the keys
+type ranker interface {
+	// rank returns the number of keys less than the key
+	rank(key []byte) int
+
+	// selectAt returns the pair of the key of rank i,
+	// or nils if i is out of range
+	selectAt(i int) ([]byte, []byte)
+}
+
+// counted returns true if the internal nodes of the tree count the keys
+// of their subtrees. Writers of latched trees release the ancestors of
+// the nodes they change, so they can't maintain them.
+func (bpt *BPlusTree) counted() bool {
+	return !bpt.latched()
+}
+
+// addCounts adds delta to the key counts of the ancestors of the node
+func (bpt *BPlusTree) addCounts(n *node, delta int) {
+	if !bpt.counted() {
+		return
+	}
+	for current := n.parent; current != nil; current = current.parent {
+		current.count += delta
+	}
+}
+
+// moveCount moves the key count of the child from one internal node to
+// the other, the child has just moved between them.
+func (bpt *BPlusTree) moveCount(child, from, to *node) {
+	if !bpt.counted() {
+		return
+	}
+	count := child.keyCount()
+	from.count -= count
+	to.count += count
+}
+
+// recount recounts the keys of the subtree of the internal node
+func (bpt *BPlusTree) recount(n *node) {
+	if bpt.counted() {
+		n.recount()
+	}
+}
+
+// Rank returns the number of keys less than the given key in O(log n). It
+// returns ErrNotCounted for LatchCrabbing and BLink trees, and the failure
+// of a paged tree. OptimisticLockCoupling trees count the keys of their
+// subtrees while writers change them, so the rank is exact without
+// writers only.
+func (bpt *BPlusTree) Rank(key []byte) (int, error) {
+	r, ok := bpt.engine.(ranker)
+	if !ok && (!bpt.counted() || bpt.engine != nil) {
+		return 0, ErrNotCounted
+	}
+	if key == nil {
+		return 0, bpt.Err()
+	}
+	if ok {
+		return r.rank(key), bpt.Err()
+	}
+
+	bpt.rlockTree()
+	defer bpt.runlockTree()
+	if bpt.root == nil {
+		return 0, nil
+	}
+	rank := 0
+	current := bpt.root
+	for !current.leaf {
+		position := current.upperBound(key, bpt.compare)
+		for i := 0; i < position; i++ {
+			rank += current.pointers[i].convertToNode().keyCount()
+		}
+		current = current.pointers[position].convertToNode()
+	}
+	position, _ := current.search(key, bpt.compare)
+	return rank + position, nil
+}
+
+// Select returns the pair of kv whose key has the given rank, i.e. the
+// i-th smallest key from 0, in O(log n), or nils if i is out of range.
+// It fails like Rank.
+func (bpt *BPlusTree) Select(i int) ([]byte, []byte, error) {
+	r, ok := bpt.engine.(ranker)
+	if !ok && (!bpt.counted() || bpt.engine != nil) {
+		return nil, nil, ErrNotCounted
+	}
+	if i < 0 {
+		return nil, nil, bpt.Err()
+	}
+	if ok {
+		key, value := r.selectAt(i)
+		return bpt.copyOnGet(key), bpt.copyOnGet(value), bpt.Err()
+	}
+
+	bpt.rlockTree()
+	defer bpt.runlockTree()
+	if bpt.root == nil || i >= bpt.size {
+		return nil, nil, nil
+	}
+	current := bpt.root
+	for !current.leaf {
+		position := 0
+		for ; position < current.keyNums; position++ {
+			count := current.pointers[position].convertToNode().keyCount()
+			if i < count {
+				break
+			}
+			i -= count
+		}
+		current = current.pointers[position].convertToNode()
+	}
+	return bpt.copyOnGet(current.keys[i]), bpt.copyOnGet(current.pointers[i].convertToValue()), nil
+}
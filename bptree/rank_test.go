@@ -0,0 +1,158 @@
+package bptree
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertRanks checks Rank and Select against the sorted keys of the
+// universe which the tree holds
+func assertRanks(t *testing.T, bpt *BPlusTree, universe int, expected map[int]bool) {
+	rank := 0
+	for k := 0; k < universe; k++ {
+		r, err := bpt.Rank(uint32Key(k))
+		assert.NoError(t, err)
+		assert.Equal(t, rank, r, "rank of %d", k)
+		if !expected[k] {
+			continue
+		}
+		key, value, err := bpt.Select(rank)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32Key(k), key, "select %d", rank)
+		assert.Equal(t, uint32Key(k), value, "select %d", rank)
+		rank++
+	}
+	r, _ := bpt.Rank(uint32Key(universe))
+	assert.Equal(t, rank, r)
+	key, value, err := bpt.Select(rank)
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+	assert.Nil(t, value)
+	key, _, _ = bpt.Select(-1)
+	assert.Nil(t, key)
+	r, _ = bpt.Rank(nil)
+	assert.Equal(t, 0, r)
+}
+
+func TestRankSelect(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	universe := 500
+
+	for _, concurrency := range []Concurrency{Unsynchronized, OptimisticLockCoupling, GlobalLock, CopyOnWrite, -1} {
+		for order := 3; order <= 6; order++ {
+			options := []Option{SetOrder(order), SetConcurrency(concurrency)}
+			if concurrency == -1 {
+				// paged, whose nodes are as large as their pages
+				options = []Option{SetPageSize(minPageSize), tempPageFile(t)}
+			}
+			bpt, _ := NewBPlusTree(options...)
+			expected := make(map[int]bool)
+			assertRanks(t, bpt, universe, expected)
+			for i := 0; i < 4*universe; i++ {
+				k := r.Intn(universe)
+				if r.Intn(3) == 0 {
+					bpt.Delete(uint32Key(k))
+					delete(expected, k)
+				} else {
+					bpt.Put(uint32Key(k), uint32Key(k))
+					expected[k] = true
+				}
+			}
+			assert.NoError(t, bpt.Validate())
+			assertRanks(t, bpt, universe, expected)
+
+			// the counts survive a range deletion
+			bpt.DeleteRange(uint32Key(universe/4), uint32Key(universe/2), ScanOptions{})
+			for k := universe / 4; k < universe/2; k++ {
+				delete(expected, k)
+			}
+			assert.NoError(t, bpt.Validate())
+			assertRanks(t, bpt, universe, expected)
+		}
+	}
+}
+
+func TestRankSelectNotCounted(t *testing.T) {
+	for _, concurrency := range []Concurrency{LatchCrabbing, BLink} {
+		bpt, _ := NewBPlusTree(SetConcurrency(concurrency))
+		bpt.Put(uint32Key(1), uint32Key(1))
+		_, err := bpt.Rank(uint32Key(1))
+		assert.ErrorIs(t, err, ErrNotCounted)
+		_, _, err = bpt.Select(0)
+		assert.ErrorIs(t, err, ErrNotCounted)
+	}
+}
+
+func TestRankSelectBulkLoaded(t *testing.T) {
+	keys, values := sortedPairs(1000)
+	for _, concurrency := range []Concurrency{Unsynchronized, OptimisticLockCoupling, CopyOnWrite} {
+		for _, fillFactor := range []float64{0.5, 1} {
+			bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(4), SetFillFactor(fillFactor), SetConcurrency(concurrency))
+			assert.NoError(t, bpt.Validate())
+			for i, key := range keys {
+				rank, err := bpt.Rank(key)
+				assert.NoError(t, err)
+				assert.Equal(t, i, rank)
+				k, v, err := bpt.Select(i)
+				assert.NoError(t, err)
+				assert.Equal(t, key, k)
+				assert.Equal(t, values[i], v)
+			}
+		}
+	}
+}
+
+func TestRankSelectReadOnly(t *testing.T) {
+	keys, values := sortedPairs(200)
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetConcurrency(CopyOnWrite))
+
+	// a snapshot keeps the ranks of its version
+	snapshot, _ := bpt.Snapshot()
+	bpt.Delete(keys[0])
+	rank, err := snapshot.Rank(keys[10])
+	assert.NoError(t, err)
+	assert.Equal(t, 10, rank)
+	rank, _ = bpt.Rank(keys[10])
+	assert.Equal(t, 9, rank)
+	key, _, err := snapshot.Select(0)
+	assert.NoError(t, err)
+	assert.Equal(t, keys[0], key)
+
+	m, err := OpenMapped(writeMapped(t, snapshot.bpt))
+	assert.NoError(t, err)
+	defer m.Close()
+	for i, key := range keys {
+		rank, err := m.Rank(key)
+		assert.NoError(t, err)
+		assert.Equal(t, i, rank)
+		k, v, err := m.Select(i)
+		assert.NoError(t, err)
+		assert.Equal(t, key, k)
+		assert.Equal(t, values[i], v)
+	}
+	rank, _ = m.Rank([]byte{0xff})
+	assert.Equal(t, len(keys), rank)
+	key, _, _ = m.Select(len(keys))
+	assert.Nil(t, key)
+}
+
+func TestRankSelectPaged(t *testing.T) {
+	keys, values := sortedPairs(3000)
+	bpt, _ := NewBPlusTree(SetPageFile(filepath.Join(t.TempDir(), "tree.pages")), SetPageSize(minPageSize))
+	defer bpt.Close()
+	assert.NoError(t, bpt.BulkLoad(NewSliceSource(keys, values)))
+	assert.NoError(t, bpt.Validate())
+	for i, key := range keys {
+		rank, err := bpt.Rank(key)
+		assert.NoError(t, err)
+		assert.Equal(t, i, rank)
+		k, v, err := bpt.Select(i)
+		assert.NoError(t, err)
+		assert.Equal(t, key, k)
+		assert.Equal(t, values[i], v)
+	}
+}
@@ -0,0 +1,322 @@
+package bptree
+
+import (
+	"container/list"
+	"errors"
+)
+
+// EvictionPolicy decides which page the buffer pool of a paged tree
+// evicts when it needs a frame.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used page.
+	LRU EvictionPolicy = iota
+
+	// Clock sweeps the frames like the hand of a clock, giving a second
+	// chance to every page used since the hand last passed it. It
+	// approximates LRU without reordering anything on a hit.
+	Clock
+
+	// LRU2 is LRU-K with K = 2, it evicts the page whose second most
+	// recent use is the oldest, pages used only once first. The uses of
+	// recently evicted pages are remembered, so a scan using every page
+	// once doesn't flush the pages used over and over.
+	LRU2
+
+	// TwoQueue keeps the pages used once in a FIFO queue and the pages
+	// used again in an LRU queue, and evicts from the FIFO queue first.
+	// The pages recently evicted from the FIFO queue are remembered, and
+	// go to the LRU queue once used again. It resists scans like LRU2
+	// at the cost of LRU.
+	TwoQueue
+)
+
+// SetEvictionPolicy sets the eviction policy of the buffer pool of a tree
+// set by SetPageFile, LRU by default.
+func SetEvictionPolicy(policy EvictionPolicy) Option {
+	return func(bpt *BPlusTree) error {
+		if policy < LRU || policy > TwoQueue {
+			return errors.New("unknown eviction policy")
+		}
+		bpt.evictionPolicy = policy
+		return nil
+	}
+}
+
+// replacer tracks the uses of the frames of a buffer pool and picks the
+// frame to evict among the unpinned ones. The pool serializes the calls.
+type replacer interface {
+	// pin records a use of the page in the frame, which
+	// can't be evicted until unpinned
+	pin(frame int, page pageID)
+
+	// unpin makes the frame a candidate for eviction
+	unpin(frame int)
+
+	// victim returns an unpinned frame and forgets it,
+	// or false if every frame is pinned
+	victim() (int, bool)
+
+	// remove forgets the unpinned frame, whose page is gone
+	remove(frame int)
+}
+
+// newReplacer returns the replacer of the policy for the frames
+func newReplacer(policy EvictionPolicy, frames int) replacer {
+	switch policy {
+	case Clock:
+		return &clockReplacer{
+			used:     make([]bool, frames),
+			unpinned: make([]bool, frames),
+		}
+	case LRU2:
+		return &lru2Replacer{
+			pages:    make([]pageID, frames),
+			uses:     make([][2]uint64, frames),
+			unpinned: make([]bool, frames),
+			evicted:  list.New(),
+			history:  make(map[pageID]*list.Element),
+		}
+	case TwoQueue:
+		return &twoQueueReplacer{
+			once:     list.New(),
+			again:    list.New(),
+			elements: make([]*list.Element, frames),
+			queues:   make([]*list.List, frames),
+			pages:    make([]pageID, frames),
+			unpinned: make([]bool, frames),
+			evicted:  list.New(),
+			ghosts:   make(map[pageID]*list.Element),
+		}
+	}
+	return &lruReplacer{
+		uses:     list.New(),
+		elements: make([]*list.Element, frames),
+		unpinned: make([]bool, frames),
+	}
+}
+
+// lruReplacer orders the frames from the most recently used to the least
+type lruReplacer struct {
+	uses     *list.List
+	elements []*list.Element
+	unpinned []bool
+}
+
+func (r *lruReplacer) pin(frame int, _ pageID) {
+	if e := r.elements[frame]; e != nil {
+		r.uses.MoveToFront(e)
+	} else {
+		r.elements[frame] = r.uses.PushFront(frame)
+	}
+	r.unpinned[frame] = false
+}
+
+func (r *lruReplacer) unpin(frame int) {
+	r.unpinned[frame] = true
+}
+
+func (r *lruReplacer) victim() (int, bool) {
+	for e := r.uses.Back(); e != nil; e = e.Prev() {
+		if frame := e.Value.(int); r.unpinned[frame] {
+			r.remove(frame)
+			return frame, true
+		}
+	}
+	return 0, false
+}
+
+func (r *lruReplacer) remove(frame int) {
+	if e := r.elements[frame]; e != nil {
+		r.uses.Remove(e)
+	}
+	r.elements[frame], r.unpinned[frame] = nil, false
+}
+
+// clockReplacer keeps a used bit per frame, cleared as the hand passes
+type clockReplacer struct {
+	used     []bool
+	unpinned []bool
+	hand     int
+}
+
+func (r *clockReplacer) pin(frame int, _ pageID) {
+	r.used[frame], r.unpinned[frame] = true, false
+}
+
+func (r *clockReplacer) unpin(frame int) {
+	r.unpinned[frame] = true
+}
+
+func (r *clockReplacer) victim() (int, bool) {
+	// the first round clears the used bits, the second finds a victim
+	for i := 0; i < 2*len(r.used); i++ {
+		frame := r.hand
+		r.hand = (r.hand + 1) % len(r.used)
+		if !r.unpinned[frame] {
+			continue
+		}
+		if r.used[frame] {
+			r.used[frame] = false
+			continue
+		}
+		r.remove(frame)
+		return frame, true
+	}
+	return 0, false
+}
+
+func (r *clockReplacer) remove(frame int) {
+	r.used[frame], r.unpinned[frame] = false, false
+}
+
+// lru2Replacer keeps the times of the last two uses of every frame, and
+// of as many pages evicted lately as there are frames.
+type lru2Replacer struct {
+	// the page, the last use and the one before, 0 if none, of every frame
+	pages    []pageID
+	uses     [][2]uint64
+	unpinned []bool
+	clock    uint64
+
+	// the pages evicted lately with their uses, oldest at the back
+	evicted *list.List
+	history map[pageID]*list.Element
+}
+
+// lru2Ghost is a page evicted lately, with its uses
+type lru2Ghost struct {
+	page pageID
+	uses [2]uint64
+}
+
+func (r *lru2Replacer) pin(frame int, page pageID) {
+	uses := r.uses[frame]
+	if ghost, ok := r.history[page]; ok && uses[0] == 0 {
+		uses = r.evicted.Remove(ghost).(lru2Ghost).uses
+		delete(r.history, page)
+	}
+	r.clock++
+	r.pages[frame], r.uses[frame] = page, [2]uint64{r.clock, uses[0]}
+	r.unpinned[frame] = false
+}
+
+func (r *lru2Replacer) unpin(frame int) {
+	r.unpinned[frame] = true
+}
+
+// victim picks the frame whose second to last use is the oldest, frames
+// used once have an infinite distance and go first, least recently used
+// first among them.
+func (r *lru2Replacer) victim() (int, bool) {
+	victim, found := 0, false
+	for frame, unpinned := range r.unpinned {
+		if !unpinned {
+			continue
+		}
+		if !found || r.older(frame, victim) {
+			victim, found = frame, true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	page := r.pages[victim]
+	r.history[page] = r.evicted.PushFront(lru2Ghost{page: page, uses: r.uses[victim]})
+	if r.evicted.Len() > len(r.uses) {
+		delete(r.history, r.evicted.Remove(r.evicted.Back()).(lru2Ghost).page)
+	}
+	r.remove(victim)
+	return victim, true
+}
+
+// older returns true if frame a goes before frame b
+func (r *lru2Replacer) older(a, b int) bool {
+	ua, ub := r.uses[a], r.uses[b]
+	if (ua[1] == 0) != (ub[1] == 0) {
+		return ua[1] == 0
+	}
+	if ua[1] == 0 {
+		return ua[0] < ub[0]
+	}
+	return ua[1] < ub[1]
+}
+
+func (r *lru2Replacer) remove(frame int) {
+	r.pages[frame], r.uses[frame], r.unpinned[frame] = 0, [2]uint64{}, false
+}
+
+// twoQueueReplacer keeps the frames used once in the FIFO queue once and
+// the frames used again in the LRU queue again, newest in front, and the
+// pages evicted from once lately in the FIFO queue evicted.
+type twoQueueReplacer struct {
+	once, again *list.List
+	elements    []*list.Element
+
+	// the queue, nil if none, and the page of every frame
+	queues   []*list.List
+	pages    []pageID
+	unpinned []bool
+
+	// the ghosts of the pages evicted from once lately,
+	// as many as there are frames, oldest at the back
+	evicted *list.List
+	ghosts  map[pageID]*list.Element
+}
+
+func (r *twoQueueReplacer) pin(frame int, page pageID) {
+	switch r.queues[frame] {
+	case nil:
+		if ghost, ok := r.ghosts[page]; ok {
+			r.evicted.Remove(ghost)
+			delete(r.ghosts, page)
+			r.elements[frame], r.queues[frame] = r.again.PushFront(frame), r.again
+		} else {
+			r.elements[frame], r.queues[frame] = r.once.PushFront(frame), r.once
+		}
+	case r.once:
+		r.once.Remove(r.elements[frame])
+		r.elements[frame], r.queues[frame] = r.again.PushFront(frame), r.again
+	default:
+		r.again.MoveToFront(r.elements[frame])
+	}
+	r.pages[frame], r.unpinned[frame] = page, false
+}
+
+func (r *twoQueueReplacer) unpin(frame int) {
+	r.unpinned[frame] = true
+}
+
+func (r *twoQueueReplacer) victim() (int, bool) {
+	for _, queue := range []*list.List{r.once, r.again} {
+		for e := queue.Back(); e != nil; e = e.Prev() {
+			frame := e.Value.(int)
+			if !r.unpinned[frame] {
+				continue
+			}
+			if queue == r.once {
+				r.haunt(r.pages[frame])
+			}
+			r.remove(frame)
+			return frame, true
+		}
+	}
+	return 0, false
+}
+
+// haunt remembers the page evicted from once, forgetting the oldest ghost
+func (r *twoQueueReplacer) haunt(page pageID) {
+	r.ghosts[page] = r.evicted.PushFront(page)
+	if r.evicted.Len() > len(r.pages) {
+		delete(r.ghosts, r.evicted.Remove(r.evicted.Back()).(pageID))
+	}
+}
+
+func (r *twoQueueReplacer) remove(frame int) {
+	if queue := r.queues[frame]; queue != nil {
+		queue.Remove(r.elements[frame])
+	}
+	r.elements[frame], r.queues[frame], r.unpinned[frame] = nil, nil, false
+	r.pages[frame] = 0
+}
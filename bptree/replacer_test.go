@@ -0,0 +1,80 @@
+package bptree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// victims evicts every unpinned frame of the replacer, in order
+func victims(r replacer) []int {
+	var frames []int
+	for {
+		frame, ok := r.victim()
+		if !ok {
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// use pins and unpins the frames in order, frame i holds page i+1
+func use(r replacer, frames ...int) {
+	for _, frame := range frames {
+		r.pin(frame, pageID(frame+1))
+		r.unpin(frame)
+	}
+}
+
+func TestReplacerVictims(t *testing.T) {
+	for _, tc := range []struct {
+		policy  EvictionPolicy
+		uses    []int
+		victims []int
+	}{
+		{LRU, []int{0, 1, 2, 0}, []int{1, 2, 0}},
+		{Clock, []int{0, 1, 2}, []int{0, 1, 2}},
+		{LRU2, []int{0, 0, 1, 2, 2}, []int{1, 0, 2}},
+		{LRU2, []int{0, 1, 1, 2}, []int{0, 2, 1}},
+		{TwoQueue, []int{0, 1, 0, 2}, []int{1, 2, 0}},
+	} {
+		r := newReplacer(tc.policy, 4)
+		use(r, tc.uses...)
+		assert.Equal(t, tc.victims, victims(r), "policy %d", tc.policy)
+	}
+}
+
+func TestReplacerSkipsPinnedFrames(t *testing.T) {
+	for _, policy := range []EvictionPolicy{LRU, Clock, LRU2, TwoQueue} {
+		r := newReplacer(policy, 4)
+		use(r, 0, 1, 2)
+		r.pin(3, 4)
+		r.pin(1, 2)
+		r.remove(2)
+		assert.Equal(t, []int{0}, victims(r), "policy %d", policy)
+
+		// frames come back once unpinned, evicted frames once used again
+		r.unpin(1)
+		use(r, 0)
+		assert.ElementsMatch(t, []int{0, 1}, victims(r), "policy %d", policy)
+	}
+}
+
+func TestReplacerClockSecondChance(t *testing.T) {
+	r := newReplacer(Clock, 3)
+	use(r, 0, 1, 2)
+	frame, _ := r.victim()
+	assert.Equal(t, 0, frame)
+
+	// the hand cleared the used bit of 1 and 2, 1 is used again
+	use(r, 0, 1)
+	frame, _ = r.victim()
+	assert.Equal(t, 2, frame)
+}
+
+func TestSetEvictionPolicy(t *testing.T) {
+	_, err := NewBPlusTree(SetEvictionPolicy(EvictionPolicy(-1)))
+	assert.Error(t, err)
+	_, err = NewBPlusTree(SetEvictionPolicy(TwoQueue + 1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+package bptree
+
+// ScanOptions controls the bounds of a Scan. The zero value
+// scans the half-open range [start, end).
+type ScanOptions struct {
+	// ExcludeStart excludes the start key itself from the range.
+	ExcludeStart bool
+
+	// IncludeEnd includes the end key itself in the range.
+	IncludeEnd bool
+}
+
+// Scan traverses the pairs of kv whose keys are between start and end
+// in ascending key order. A nil start or end leaves that side of the
+// range open. The traversal stops as soon as action returns false.
+func (bpt *BPlusTree) Scan(start, end []byte, opts ScanOptions, action func(key, value []byte) bool) {
+	if bpt.engine != nil {
+		bpt.scanEngine(start, end, opts, action)
+		return
+	}
+	if bpt.latched() {
+		bpt.scanLatched(start, end, opts, action)
+		return
+	}
+	bpt.rlockTree()
+	defer bpt.runlockTree()
+	if bpt.root == nil {
+		return
+	}
+
+	leaf, i := bpt.seekLeaf(start, opts)
+	for leaf != nil {
+		for ; i < leaf.keyNums; i++ {
+			key := leaf.keys[i]
+			if bpt.afterEnd(key, end, opts) {
+				return
+			}
+			if !action(bpt.copyOnGet(key), bpt.copyOnGet(leaf.pointers[i].convertToValue())) {
+				return
+			}
+		}
+
+		leaf = leaf.nextLeafNode()
+		i = 0
+	}
+}
+
+// seekLeaf returns the leaf and the position of the first key which is
+// not before start. The position may equal the key number of the leaf,
+// in which case the first key is the first one of the next leaf.
+func (bpt *BPlusTree) seekLeaf(start []byte, opts ScanOptions) (*node, int) {
+	if start == nil {
+		return bpt.mostLeftNode, 0
+	}
+
+	leaf := bpt.findLeafByKey(start)
+	i, found := leaf.search(start, bpt.compare)
+	if found && opts.ExcludeStart {
+		i++
+	}
+	return leaf, i
+}
+
+// afterEnd returns true if the key lies after the upper bound
+func (bpt *BPlusTree) afterEnd(key, end []byte, opts ScanOptions) bool {
+	if end == nil {
+		return false
+	}
+	cmp := bpt.compare(key, end)
+	return cmp > 0 || (cmp == 0 && !opts.IncludeEnd)
+}
@@ -0,0 +1,60 @@
+package bptree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scanKeys(bpt *BPlusTree, start, end []byte, opts ScanOptions) []string {
+	keys := make([]string, 0)
+	bpt.Scan(start, end, opts, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	return keys
+}
+
+func TestScanBounds(t *testing.T) {
+	for order := 3; order <= 7; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order))
+		for _, testData := range testDatas {
+			bpt.Put(testData.key, testData.value)
+		}
+
+		assert.Equal(t, []string{"15", "16", "18"}, scanKeys(bpt, []byte("15"), []byte("2"), ScanOptions{}))
+		assert.Equal(t, []string{"16", "18", "2"}, scanKeys(bpt, []byte("15"), []byte("2"), ScanOptions{ExcludeStart: true, IncludeEnd: true}))
+		assert.Equal(t, []string{"16", "18"}, scanKeys(bpt, []byte("150"), []byte("19"), ScanOptions{}))
+		assert.Equal(t, []string{"0", "1", "11"}, scanKeys(bpt, nil, []byte("14"), ScanOptions{}))
+		assert.Equal(t, []string{"60", "7", "74"}, scanKeys(bpt, []byte("6"), nil, ScanOptions{}))
+		assert.Equal(t, len(testDatas), len(scanKeys(bpt, nil, nil, ScanOptions{})))
+		assert.Empty(t, scanKeys(bpt, []byte("8"), nil, ScanOptions{}))
+		assert.Empty(t, scanKeys(bpt, []byte("2"), []byte("2"), ScanOptions{}))
+		assert.Equal(t, []string{"2"}, scanKeys(bpt, []byte("2"), []byte("2"), ScanOptions{IncludeEnd: true}))
+	}
+}
+
+func TestScanStopsEarly(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		bpt.Put(key, key)
+	}
+
+	keys := make([]string, 0)
+	bpt.Scan([]byte("010"), nil, ScanOptions{}, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 3
+	})
+	assert.Equal(t, []string{"010", "011", "012"}, keys)
+}
+
+func TestScanEmptyTree(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	assert.Empty(t, scanKeys(bpt, nil, nil, ScanOptions{}))
+
+	bpt.Put([]byte("1"), []byte("1"))
+	bpt.Delete([]byte("1"))
+	assert.Empty(t, scanKeys(bpt, nil, nil, ScanOptions{}))
+}
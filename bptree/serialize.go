@@ -0,0 +1,304 @@
+package bptree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// A serialized tree is a header, its pairs of kv in ascending key order and
+// a footer. The header is a magic string and the version of the format.
+// Every pair is the uvarint length of the key plus one, the key, the uvarint
+// length of the value and the value, and a 0 length ends the pairs. A
+// sparse index follows, the offset of every 32nd pair from the first as
+// 8 bytes, so that a mapped tree finds its pairs without decoding them. The
+// footer is the number of pairs, the order of the tree and the CRC-32C of
+// everything before it, in big endian.
+
+const (
+	serialMagic   = "BPT\x00"
+	serialVersion = 1
+
+	serialIndexInterval = 32
+
+	// bounds the lengths read, so a damaged one can't allocate everything
+	maxSerialLen = 1 << 30
+)
+
+var (
+	// ErrUnknownFormat is returned when reading something which is not
+	// a serialized tree, or one of a newer version of the format.
+	ErrUnknownFormat = errors.New("unknown serialized tree format")
+
+	// ErrCorrupted is returned when reading a serialized tree which is
+	// damaged or truncated.
+	ErrCorrupted = errors.New("corrupted serialized tree")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WriteTo writes the pairs of kv of the tree to w in the serialized format
+// and returns the number of bytes written. Concurrent writers may or may
+// not show through, write a Snapshot to checkpoint a consistent version.
+func (bpt *BPlusTree) WriteTo(w io.Writer) (int64, error) {
+	sw := &serialWriter{w: bufio.NewWriter(w)}
+	sw.write([]byte(serialMagic))
+	sw.writeUint(serialVersion, 2)
+
+	var count uint64
+	var index []int64
+	bpt.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+		if count%serialIndexInterval == 0 {
+			index = append(index, sw.n)
+		}
+		sw.writeUvarint(uint64(len(key)) + 1)
+		sw.write(key)
+		sw.writeUvarint(uint64(len(value)))
+		sw.write(value)
+		count++
+		return sw.err == nil
+	})
+	sw.writeUvarint(0)
+	for _, offset := range index {
+		sw.writeUint(uint64(offset), 8)
+	}
+
+	sw.writeUint(count, 8)
+	sw.writeUint(uint64(bpt.order), 4)
+	sw.writeUint(uint64(sw.crc), 4)
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	return sw.n, sw.err
+}
+
+// serialWriter writes a serialized tree, keeping its checksum
+// and the first error.
+type serialWriter struct {
+	w   *bufio.Writer
+	crc uint32
+	n   int64
+	err error
+}
+
+func (sw *serialWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	n, err := sw.w.Write(p)
+	sw.crc = crc32.Update(sw.crc, crcTable, p[:n])
+	sw.n += int64(n)
+	sw.err = err
+}
+
+func (sw *serialWriter) writeUvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	sw.write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+// writeUint writes the size lower bytes of x in big endian
+func (sw *serialWriter) writeUint(x uint64, size int) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	sw.write(buf[8-size:])
+}
+
+// ReadFrom bulk loads the tree with the serialized tree read from r and
+// returns the number of bytes read. The tree must be empty, and keeps its
+// own order and options. Nothing is loaded unless the whole serialized tree
+// is read and checked. r is read past the serialized tree unless it is an
+// io.ByteReader.
+func (bpt *BPlusTree) ReadFrom(r io.Reader) (int64, error) {
+	return bpt.readFrom(r, false)
+}
+
+// readFrom is ReadFrom, exact tells whether r must end with the tree
+func (bpt *BPlusTree) readFrom(r io.Reader, exact bool) (int64, error) {
+	if bpt.Size() != 0 {
+		return 0, ErrNotEmpty
+	}
+	br, ok := r.(serialByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	sr := &serialReader{r: br, exact: exact}
+
+	magic := make([]byte, len(serialMagic))
+	if err := sr.read(magic); err != nil {
+		return sr.n, err
+	}
+	if string(magic) != serialMagic {
+		return sr.n, ErrUnknownFormat
+	}
+	version, err := sr.readUint(2)
+	if err != nil {
+		return sr.n, err
+	}
+	if version != serialVersion {
+		return sr.n, ErrUnknownFormat
+	}
+
+	err = bpt.BulkLoad(sr)
+	if errors.Is(err, ErrNotSorted) || errors.Is(err, ErrDuplicateKey) {
+		// the keys were sorted by another comparator, or damaged
+		err = ErrCorrupted
+	}
+	return sr.n, err
+}
+
+// serialByteReader is what serialReader reads from
+type serialByteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// serialReader streams the pairs of kv of a serialized tree as a KVSource,
+// and checks the footer once the pairs are read.
+type serialReader struct {
+	r     serialByteReader
+	crc   uint32
+	n     int64
+	count uint64
+
+	// the offsets the index must hold
+	index []int64
+
+	// whether r must end right after the footer
+	exact bool
+
+	// the byte read by ReadByte
+	b [1]byte
+}
+
+func (sr *serialReader) read(p []byte) error {
+	n, err := io.ReadFull(sr.r, p)
+	sr.crc = crc32.Update(sr.crc, crcTable, p[:n])
+	sr.n += int64(n)
+	return corrupted(err)
+}
+
+func (sr *serialReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err != nil {
+		return 0, corrupted(err)
+	}
+	sr.b[0] = b
+	sr.crc = crc32.Update(sr.crc, crcTable, sr.b[:])
+	sr.n++
+	return b, nil
+}
+
+func (sr *serialReader) readUint(size int) (uint64, error) {
+	var buf [8]byte
+	if err := sr.read(buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// readBytes reads length bytes into a new slice
+func (sr *serialReader) readBytes(length uint64) ([]byte, error) {
+	if length > maxSerialLen {
+		return nil, ErrCorrupted
+	}
+	p := make([]byte, length)
+	return p, sr.read(p)
+}
+
+// corrupted reports a stream ending too early as a corruption
+func corrupted(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupted
+	}
+	return err
+}
+
+// Next returns the next pair of kv, or io.EOF once the pairs are read
+// and the footer is checked.
+func (sr *serialReader) Next() ([]byte, []byte, error) {
+	offset := sr.n
+	keyLen, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, nil, corrupted(err)
+	}
+	if keyLen == 0 {
+		return nil, nil, sr.checkFooter()
+	}
+	if sr.count%serialIndexInterval == 0 {
+		sr.index = append(sr.index, offset)
+	}
+	key, err := sr.readBytes(keyLen - 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	valueLen, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, nil, corrupted(err)
+	}
+	value, err := sr.readBytes(valueLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	sr.count++
+	return key, value, nil
+}
+
+// checkFooter returns io.EOF if the index and the footer match the pairs
+// read
+func (sr *serialReader) checkFooter() error {
+	for _, expected := range sr.index {
+		offset, err := sr.readUint(8)
+		if err != nil {
+			return err
+		}
+		if offset != uint64(expected) {
+			return ErrCorrupted
+		}
+	}
+	count, err := sr.readUint(8)
+	if err != nil {
+		return err
+	}
+	// the order of the tree written doesn't constrain the one read into
+	if _, err := sr.readUint(4); err != nil {
+		return err
+	}
+	sum := sr.crc
+	expected, err := sr.readUint(4)
+	if err != nil {
+		return err
+	}
+	if uint32(expected) != sum || count != sr.count {
+		return ErrCorrupted
+	}
+	if sr.exact {
+		if _, err := sr.r.ReadByte(); err != io.EOF {
+			return ErrCorrupted
+		}
+	}
+	return io.EOF
+}
+
+// MarshalBinary returns the tree in the serialized format of WriteTo.
+func (bpt *BPlusTree) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := bpt.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary loads the serialized tree like ReadFrom, data must hold
+// nothing else. The tree must have been built by NewBPlusTree.
+func (bpt *BPlusTree) UnmarshalBinary(data []byte) error {
+	_, err := bpt.readFrom(bytes.NewReader(data), true)
+	return err
+}
+
+// WriteTo writes the pairs of kv of the snapshot like BPlusTree.WriteTo.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	return s.bpt.WriteTo(w)
+}
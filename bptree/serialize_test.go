@@ -0,0 +1,131 @@
+package bptree
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerialize(t *testing.T) {
+	for _, concurrency := range []Concurrency{Unsynchronized, LatchCrabbing, BLink, OptimisticLockCoupling, GlobalLock, CopyOnWrite} {
+		for _, size := range []int{0, 1, 10, 1000} {
+			keys, values := sortedPairs(size)
+			bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetOrder(5))
+			var buf bytes.Buffer
+			n, err := bpt.WriteTo(&buf)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(buf.Len()), n)
+
+			loaded, _ := NewBPlusTree(SetOrder(4), SetConcurrency(concurrency))
+			read, err := loaded.ReadFrom(&buf)
+			assert.NoError(t, err)
+			assert.Equal(t, n, read)
+			assert.Equal(t, size, loaded.Size())
+			assert.NoError(t, loaded.Validate())
+			i := 0
+			loaded.Scan(nil, nil, ScanOptions{}, func(key, value []byte) bool {
+				assert.Equal(t, keys[i], key)
+				assert.Equal(t, values[i], value)
+				i++
+				return true
+			})
+			assert.Equal(t, size, i)
+
+			data, err := bpt.MarshalBinary()
+			assert.NoError(t, err)
+			unmarshaled, _ := NewBPlusTree(SetConcurrency(concurrency))
+			assert.NoError(t, unmarshaled.UnmarshalBinary(data))
+			assert.Equal(t, size, unmarshaled.Size())
+			if size > 0 {
+				assert.ErrorIs(t, unmarshaled.UnmarshalBinary(data), ErrNotEmpty)
+			}
+		}
+	}
+}
+
+func TestSerializePaged(t *testing.T) {
+	keys, values := sortedPairs(5000)
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values))
+	data, _ := bpt.MarshalBinary()
+
+	path := filepath.Join(t.TempDir(), "tree.pages")
+	paged, _ := NewBPlusTree(SetPageFile(path), SetPageSize(minPageSize))
+	assert.NoError(t, paged.UnmarshalBinary(data))
+	assert.NoError(t, paged.Close())
+
+	paged, _ = NewBPlusTree(SetPageFile(path))
+	assert.Equal(t, 5000, paged.Size())
+	assert.NoError(t, paged.Validate())
+	written, _ := paged.MarshalBinary()
+	assert.Equal(t, data, written)
+	assert.NoError(t, paged.Close())
+}
+
+func TestSerializeCorrupted(t *testing.T) {
+	keys, values := sortedPairs(10)
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values))
+	data, _ := bpt.MarshalBinary()
+
+	// every damaged byte is caught, and nothing is loaded
+	for i := range data {
+		damaged := append([]byte(nil), data...)
+		damaged[i] ^= 0x10
+		loaded, _ := NewBPlusTree()
+		assert.Error(t, loaded.UnmarshalBinary(damaged), "byte %d", i)
+		assert.Equal(t, 0, loaded.Size())
+	}
+	for i := range data {
+		loaded, _ := NewBPlusTree()
+		assert.Error(t, loaded.UnmarshalBinary(data[:i]), "truncated at %d", i)
+		assert.Equal(t, 0, loaded.Size())
+	}
+
+	loaded, _ := NewBPlusTree()
+	assert.ErrorIs(t, loaded.UnmarshalBinary(append(data, 0)), ErrCorrupted)
+	assert.ErrorIs(t, loaded.UnmarshalBinary([]byte("not a tree")), ErrUnknownFormat)
+	newer := append([]byte(nil), data...)
+	newer[len(serialMagic)+1]++
+	assert.ErrorIs(t, loaded.UnmarshalBinary(newer), ErrUnknownFormat)
+
+	// the keys aren't sorted by the comparator of the tree read into
+	reversed, _ := NewBPlusTree(SetComparator(func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}))
+	assert.ErrorIs(t, reversed.UnmarshalBinary(data), ErrCorrupted)
+}
+
+func TestSerializeStream(t *testing.T) {
+	keys, values := sortedPairs(100)
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values))
+	var buf bytes.Buffer
+	bpt.WriteTo(&buf)
+	buf.WriteString("rest")
+
+	// a ByteReader isn't read past the tree
+	r := bytes.NewReader(buf.Bytes())
+	loaded, _ := NewBPlusTree()
+	_, err := loaded.ReadFrom(r)
+	assert.NoError(t, err)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "rest", string(rest))
+}
+
+func TestSerializeSnapshot(t *testing.T) {
+	keys, values := sortedPairs(100)
+	bpt, _ := NewBPlusTreeFromSorted(NewSliceSource(keys, values), SetConcurrency(CopyOnWrite))
+	snapshot, _ := bpt.Snapshot()
+	for _, key := range keys[:50] {
+		bpt.Delete(key)
+	}
+
+	var buf bytes.Buffer
+	_, err := snapshot.WriteTo(&buf)
+	assert.NoError(t, err)
+	loaded, _ := NewBPlusTree()
+	_, err = loaded.ReadFrom(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, loaded.Size())
+}
@@ -0,0 +1,67 @@
+package bptree
+
+import (
+	"errors"
+)
+
+// ErrNoSnapshot is returned when taking a snapshot of a tree
+// which is not in CopyOnWrite mode.
+var ErrNoSnapshot = errors.New("snapshots need CopyOnWrite concurrency")
+
+// Snapshot is a read-only view of a CopyOnWrite tree as it was when the
+// snapshot was taken, later writes to the tree don't show through it. It
+// pins the nodes that writers have copied since, and nothing else.
+type Snapshot struct {
+	bpt *BPlusTree
+}
+
+// Snapshot captures the current version of the tree in O(1).
+func (bpt *BPlusTree) Snapshot() (*Snapshot, error) {
+	t, ok := bpt.engine.(*cowTree)
+	if !ok {
+		return nil, ErrNoSnapshot
+	}
+	view := &BPlusTree{
+		order:       bpt.order,
+		minKeyNum:   bpt.minKeyNum,
+		compare:     bpt.compare,
+		fillFactor:  bpt.fillFactor,
+		copyMode:    bpt.copyMode,
+		concurrency: bpt.concurrency,
+	}
+	view.engine = t.snapshot(view)
+	return &Snapshot{bpt: view}, nil
+}
+
+// Get returns the value and true if the given key existed when
+// the snapshot was taken, otherwise nil and false.
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	return s.bpt.Get(key)
+}
+
+// Scan traverses the pairs of kv of the snapshot like BPlusTree.Scan.
+func (s *Snapshot) Scan(start, end []byte, opts ScanOptions, action func(key, value []byte) bool) {
+	s.bpt.Scan(start, end, opts, action)
+}
+
+// Iterator returns an iterator over the snapshot in ascending key order.
+func (s *Snapshot) Iterator() *Iterator {
+	return s.bpt.Iterator()
+}
+
+// Rank returns the number of keys of the snapshot less than the given key
+// like BPlusTree.Rank, snapshots always count their keys.
+func (s *Snapshot) Rank(key []byte) (int, error) {
+	return s.bpt.Rank(key)
+}
+
+// Select returns the pair of kv of the snapshot whose key has the given
+// rank like BPlusTree.Select.
+func (s *Snapshot) Select(i int) ([]byte, []byte, error) {
+	return s.bpt.Select(i)
+}
+
+// Size returns the number of keys of the snapshot.
+func (s *Snapshot) Size() int {
+	return s.bpt.Size()
+}
@@ -0,0 +1,95 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	_, err := bpt.Snapshot()
+	assert.ErrorIs(t, err, ErrNoSnapshot)
+
+	bpt, _ = NewBPlusTree(SetOrder(3), SetConcurrency(CopyOnWrite))
+	empty, err := bpt.Snapshot()
+	assert.NoError(t, err)
+	for k := 0; k < 100; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+	snapshot, _ := bpt.Snapshot()
+
+	bpt.Put(uint32Key(0), []byte("changed"))
+	bpt.Put(uint32Key(100), uint32Key(100))
+	bpt.Delete(uint32Key(50))
+	bpt.DeleteRange(uint32Key(60), uint32Key(70), ScanOptions{})
+	assert.Equal(t, 90, bpt.Size())
+
+	assert.Equal(t, 0, empty.Size())
+	assert.False(t, empty.Iterator().Valid())
+	assert.Equal(t, 100, snapshot.Size())
+	value, ok := snapshot.Get(uint32Key(0))
+	assert.True(t, ok)
+	assert.Equal(t, uint32Key(0), value)
+	_, ok = snapshot.Get(uint32Key(50))
+	assert.True(t, ok)
+	_, ok = snapshot.Get(uint32Key(100))
+	assert.False(t, ok)
+
+	count := 0
+	snapshot.Scan(uint32Key(60), uint32Key(70), ScanOptions{IncludeEnd: true}, func(key, value []byte) bool {
+		assert.Equal(t, uint32Key(60+count), key)
+		count++
+		return true
+	})
+	assert.Equal(t, 11, count)
+
+	it := snapshot.Iterator()
+	for k := 0; k < 100; k++ {
+		key, _ := it.Next()
+		assert.Equal(t, uint32Key(k), key)
+	}
+	assert.False(t, it.Valid())
+	for it.SeekToLast(); it.Valid(); count++ {
+		it.Prev()
+	}
+	assert.Equal(t, 111, count)
+	assert.NoError(t, bpt.Validate())
+}
+
+func TestSnapshotWhileWriting(t *testing.T) {
+	bpt, _ := NewBPlusTree(SetOrder(5), SetConcurrency(CopyOnWrite))
+	for k := 0; k < 1000; k++ {
+		bpt.Put(uint32Key(k), uint32Key(k))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for k := 0; k < 1000; k++ {
+			bpt.Put(uint32Key(1000+k), nil)
+			bpt.Delete(uint32Key(k))
+		}
+	}()
+
+	// every snapshot holds consecutive keys
+	for round := 0; round < 20; round++ {
+		snapshot, _ := bpt.Snapshot()
+		var first []byte
+		count := 0
+		for it := snapshot.Iterator(); it.Valid(); count++ {
+			key, _ := it.Next()
+			if first == nil {
+				first = key
+			}
+			assert.Equal(t, uint32Key(int(binary.BigEndian.Uint32(first))+count), key)
+		}
+		assert.Equal(t, snapshot.Size(), count)
+		assert.GreaterOrEqual(t, count, 1000)
+	}
+	wg.Wait()
+	assert.Equal(t, 1000, bpt.Size())
+}
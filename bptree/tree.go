@@ -0,0 +1,440 @@
+package bptree
+
+import (
+	"errors"
+	"sort"
+)
+
+// Ordered is a constraint that permits any type whose values
+// can be ordered by the < operator.
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+// Compare compares two ordered values, it returns -1, 0 or 1
+// when a is less than, equal to or greater than b.
+func Compare[K Ordered](a, b K) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Tree is a b plus tree with typed keys and values. Keys and values
+// are stored as they are, without being encoded or boxed.
+type Tree[K any, V any] struct {
+	// root of the b plus tree
+	root *treeNode[K, V]
+
+	// the most left node
+	mostLeftNode *treeNode[K, V]
+
+	// the order of branching factor of b plus tree,
+	// that is, the capacity for internal nodes.
+	order int
+
+	// the number of keys
+	size int
+
+	// the min of number of keys allowed
+	minKeyNum int
+
+	// compare orders the keys of the tree
+	compare func(a, b K) int
+}
+
+// treeNode is the node of Tree. For leaf node, values holds one value
+// per key, for internal node, children holds one child more than keys.
+type treeNode[K any, V any] struct {
+	leaf   bool
+	parent *treeNode[K, V]
+
+	keys     []K
+	values   []V
+	children []*treeNode[K, V]
+
+	// only for leaf node, pointed to the neighbour leaf nodes.
+	next, previous *treeNode[K, V]
+}
+
+// NewTree generates a new typed b plus tree of the given order whose
+// keys are ordered by compare.
+func NewTree[K any, V any](order int, compare func(a, b K) int) (*Tree[K, V], error) {
+	if order < 3 {
+		return nil, errors.New("order can't be less than 3")
+	}
+	if compare == nil {
+		return nil, errors.New("comparator can't be nil")
+	}
+	return &Tree[K, V]{
+		order:     order,
+		minKeyNum: ceil(order, 2) - 1,
+		compare:   compare,
+	}, nil
+}
+
+// NewOrderedTree generates a new typed b plus tree of the given order
+// whose keys are ordered by the < operator.
+func NewOrderedTree[K Ordered, V any](order int) (*Tree[K, V], error) {
+	return NewTree[K, V](order, Compare[K])
+}
+
+// newNode allocates a node with the room for one overflowing entry
+func (t *Tree[K, V]) newNode(leaf bool) *treeNode[K, V] {
+	n := &treeNode[K, V]{
+		leaf: leaf,
+		keys: make([]K, 0, t.order),
+	}
+	if leaf {
+		n.values = make([]V, 0, t.order)
+	} else {
+		n.children = make([]*treeNode[K, V], 0, t.order+1)
+	}
+	return n
+}
+
+// search returns the position of the first key which is not less than
+// the given key and true if that key equals the given key.
+func (t *Tree[K, V]) search(n *treeNode[K, V], key K) (int, bool) {
+	position := sort.Search(len(n.keys), func(i int) bool {
+		return t.compare(n.keys[i], key) >= 0
+	})
+	return position, position < len(n.keys) && t.compare(n.keys[position], key) == 0
+}
+
+// childPosition returns the position of the child which covers the given key
+func (t *Tree[K, V]) childPosition(n *treeNode[K, V], key K) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return t.compare(key, n.keys[i]) < 0
+	})
+}
+
+// findLeafByKey finds the leaf which stores the given key
+func (t *Tree[K, V]) findLeafByKey(key K) *treeNode[K, V] {
+	current := t.root
+	for !current.leaf {
+		current = current.children[t.childPosition(current, key)]
+	}
+	return current
+}
+
+// Get returns the value and true if the given key exists,
+// otherwise the zero value and false
+func (t *Tree[K, V]) Get(key K) (V, bool) {
+	var zero V
+	if t.root == nil {
+		return zero, false
+	}
+	leaf := t.findLeafByKey(key)
+	if position, found := t.search(leaf, key); found {
+		return leaf.values[position], true
+	}
+	return zero, false
+}
+
+// Put insert a pair of kv into the tree, if the given key exists,
+// the given value will override its value.
+// Return old value and true if the given key exists, otherwise
+// the zero value and false.
+func (t *Tree[K, V]) Put(key K, value V) (V, bool) {
+	var zero V
+	if t.root == nil {
+		t.root = t.newNode(true)
+		t.mostLeftNode = t.root
+	}
+
+	leaf := t.findLeafByKey(key)
+	position, found := t.search(leaf, key)
+	if found {
+		oldValue := leaf.values[position]
+		leaf.values[position] = value
+		return oldValue, true
+	}
+
+	leaf.keys = insertAt(leaf.keys, position, key)
+	leaf.values = insertAt(leaf.values, position, value)
+	t.size++
+
+	if len(leaf.keys) > t.order-1 {
+		t.splitLeaf(leaf)
+	}
+	return zero, false
+}
+
+// splitLeaf splits the overflowing leaf, the tree is right-biased,
+// so the first key of the right node becomes the "middle" key.
+func (t *Tree[K, V]) splitLeaf(left *treeNode[K, V]) {
+	middlePos := len(left.keys) / 2
+	right := t.newNode(true)
+	right.keys = append(right.keys, left.keys[middlePos:]...)
+	right.values = append(right.values, left.values[middlePos:]...)
+	left.keys = truncate(left.keys, middlePos)
+	left.values = truncate(left.values, middlePos)
+
+	right.next = left.next
+	if right.next != nil {
+		right.next.previous = right
+	}
+	right.previous = left
+	left.next = right
+
+	t.putIntoParent(left, right.keys[0], right)
+}
+
+// splitInternal splits the overflowing internal node, the middle key
+// moves up into the parent.
+func (t *Tree[K, V]) splitInternal(left *treeNode[K, V]) {
+	middlePos := len(left.keys) / 2
+	middleKey := left.keys[middlePos]
+	right := t.newNode(false)
+	right.keys = append(right.keys, left.keys[middlePos+1:]...)
+	right.children = append(right.children, left.children[middlePos+1:]...)
+	for _, child := range right.children {
+		child.parent = right
+	}
+	left.keys = truncate(left.keys, middlePos)
+	left.children = truncate(left.children, middlePos+1)
+
+	t.putIntoParent(left, middleKey, right)
+}
+
+// putIntoParent puts the key and the right node next to the left node
+// into their parent, the parent is split if it overflows.
+func (t *Tree[K, V]) putIntoParent(left *treeNode[K, V], key K, right *treeNode[K, V]) {
+	parent := left.parent
+	if parent == nil {
+		// new root
+		parent = t.newNode(false)
+		parent.children = append(parent.children, left)
+		left.parent = parent
+		t.root = parent
+	}
+
+	position := t.childPosition(parent, key)
+	parent.keys = insertAt(parent.keys, position, key)
+	parent.children = insertAt(parent.children, position+1, right)
+	right.parent = parent
+
+	if len(parent.keys) > t.order-1 {
+		t.splitInternal(parent)
+	}
+}
+
+// Delete deletes the key from the tree. Returns deleted value and true
+// if the key exists, otherwise the zero value and false.
+func (t *Tree[K, V]) Delete(key K) (V, bool) {
+	var zero V
+	if t.root == nil {
+		return zero, false
+	}
+
+	leaf := t.findLeafByKey(key)
+	position, found := t.search(leaf, key)
+	if !found {
+		return zero, false
+	}
+
+	value := leaf.values[position]
+	leaf.keys = deleteAt(leaf.keys, position)
+	leaf.values = deleteAt(leaf.values, position)
+	t.size--
+
+	if leaf.parent == nil {
+		// deletion from the root
+		if len(leaf.keys) == 0 {
+			t.root = nil
+			t.mostLeftNode = nil
+		}
+	} else if len(leaf.keys) < t.minKeyNum {
+		t.rebalance(leaf)
+	}
+	return value, true
+}
+
+// rebalance fixes the underflowing node by borrowing from or merging
+// with one of its siblings.
+func (t *Tree[K, V]) rebalance(n *treeNode[K, V]) {
+	parent := n.parent
+	position := 0
+	for parent.children[position] != n {
+		position++
+	}
+
+	var left, right *treeNode[K, V]
+	if position > 0 {
+		left = parent.children[position-1]
+		if len(left.keys) > t.minKeyNum {
+			t.borrowFromLeft(n, left, position-1)
+			return
+		}
+	}
+	if position < len(parent.children)-1 {
+		right = parent.children[position+1]
+		if len(right.keys) > t.minKeyNum {
+			t.borrowFromRight(n, right, position)
+			return
+		}
+	}
+
+	if left != nil {
+		t.merge(left, n, position-1)
+	} else {
+		t.merge(n, right, position)
+	}
+
+	if parent.parent == nil {
+		if len(parent.keys) == 0 {
+			// the root has been drained
+			t.root = parent.children[0]
+			t.root.parent = nil
+		}
+	} else if len(parent.keys) < t.minKeyNum {
+		t.rebalance(parent)
+	}
+}
+
+// borrowFromLeft moves the last entry of the left sibling into the node
+func (t *Tree[K, V]) borrowFromLeft(n, left *treeNode[K, V], separatorPos int) {
+	parent := n.parent
+	last := len(left.keys) - 1
+	if n.leaf {
+		n.keys = insertAt(n.keys, 0, left.keys[last])
+		n.values = insertAt(n.values, 0, left.values[last])
+		left.keys = truncate(left.keys, last)
+		left.values = truncate(left.values, last)
+		parent.keys[separatorPos] = n.keys[0]
+		return
+	}
+
+	child := left.children[last+1]
+	n.keys = insertAt(n.keys, 0, parent.keys[separatorPos])
+	n.children = insertAt(n.children, 0, child)
+	child.parent = n
+	parent.keys[separatorPos] = left.keys[last]
+	left.keys = truncate(left.keys, last)
+	left.children = truncate(left.children, last+1)
+}
+
+// borrowFromRight moves the first entry of the right sibling into the node
+func (t *Tree[K, V]) borrowFromRight(n, right *treeNode[K, V], separatorPos int) {
+	parent := n.parent
+	if n.leaf {
+		n.keys = append(n.keys, right.keys[0])
+		n.values = append(n.values, right.values[0])
+		right.keys = deleteAt(right.keys, 0)
+		right.values = deleteAt(right.values, 0)
+		parent.keys[separatorPos] = right.keys[0]
+		return
+	}
+
+	child := right.children[0]
+	n.keys = append(n.keys, parent.keys[separatorPos])
+	n.children = append(n.children, child)
+	child.parent = n
+	parent.keys[separatorPos] = right.keys[0]
+	right.keys = deleteAt(right.keys, 0)
+	right.children = deleteAt(right.children, 0)
+}
+
+// merge moves all the entries of the right node into the left node
+// and removes the right node from their parent.
+func (t *Tree[K, V]) merge(left, right *treeNode[K, V], separatorPos int) {
+	parent := left.parent
+	if left.leaf {
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+		left.next = right.next
+		if left.next != nil {
+			left.next.previous = left
+		}
+	} else {
+		left.keys = append(left.keys, parent.keys[separatorPos])
+		left.keys = append(left.keys, right.keys...)
+		for _, child := range right.children {
+			child.parent = left
+		}
+		left.children = append(left.children, right.children...)
+	}
+
+	parent.keys = deleteAt(parent.keys, separatorPos)
+	parent.children = deleteAt(parent.children, separatorPos+1)
+}
+
+// Scan traverses the pairs of kv whose keys are between start and end
+// in ascending key order. A nil start or end leaves that side of the
+// range open. The traversal stops as soon as action returns false.
+func (t *Tree[K, V]) Scan(start, end *K, opts ScanOptions, action func(key K, value V) bool) {
+	if t.root == nil {
+		return
+	}
+
+	leaf, i := t.mostLeftNode, 0
+	if start != nil {
+		leaf = t.findLeafByKey(*start)
+		var found bool
+		i, found = t.search(leaf, *start)
+		if found && opts.ExcludeStart {
+			i++
+		}
+	}
+
+	for leaf != nil {
+		for ; i < len(leaf.keys); i++ {
+			if end != nil {
+				cmp := t.compare(leaf.keys[i], *end)
+				if cmp > 0 || (cmp == 0 && !opts.IncludeEnd) {
+					return
+				}
+			}
+			if !action(leaf.keys[i], leaf.values[i]) {
+				return
+			}
+		}
+
+		leaf = leaf.next
+		i = 0
+	}
+}
+
+// ForEach traverses tree in ascending key order.
+func (t *Tree[K, V]) ForEach(action func(key K, value V)) {
+	t.Scan(nil, nil, ScanOptions{}, func(key K, value V) bool {
+		action(key, value)
+		return true
+	})
+}
+
+// Size returns the size of the tree.
+func (t *Tree[K, V]) Size() int {
+	return t.size
+}
+
+// insertAt inserts the element at the given position of the slice
+func insertAt[T any](s []T, position int, e T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[position+1:], s[position:])
+	s[position] = e
+	return s
+}
+
+// deleteAt deletes the element at the given position of the slice
+func deleteAt[T any](s []T, position int) []T {
+	copy(s[position:], s[position+1:])
+	return truncate(s, len(s)-1)
+}
+
+// truncate shortens the slice to the given length and clears the
+// elements behind it, so they can be garbage collected.
+func truncate[T any](s []T, length int) []T {
+	var zero T
+	for i := length; i < len(s); i++ {
+		s[i] = zero
+	}
+	return s[:length]
+}
@@ -0,0 +1,136 @@
+package bptree
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type order struct {
+	id     uint64
+	amount int
+}
+
+func TestTreePutGetDeleteRandomized(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	size := 10000
+	ids := r.Perm(size)
+
+	for o := 3; o <= 7; o++ {
+		tree, err := NewOrderedTree[uint64, *order](o)
+		assert.NoError(t, err)
+
+		for i, id := range ids {
+			oldValue, existed := tree.Put(uint64(id), &order{id: uint64(id), amount: i})
+			assert.False(t, existed)
+			assert.Nil(t, oldValue)
+		}
+		assert.Equal(t, size, tree.Size())
+
+		for i, id := range ids {
+			value, ok := tree.Get(uint64(id))
+			assert.True(t, ok)
+			assert.Equal(t, i, value.amount)
+		}
+
+		previous := uint64(0)
+		count := 0
+		tree.ForEach(func(key uint64, value *order) {
+			if count > 0 {
+				assert.Less(t, previous, key)
+			}
+			assert.Equal(t, key, value.id)
+			previous = key
+			count++
+		})
+		assert.Equal(t, size, count)
+
+		for i, id := range ids {
+			value, deleted := tree.Delete(uint64(id))
+			assert.True(t, deleted)
+			assert.Equal(t, i, value.amount)
+
+			_, ok := tree.Get(uint64(id))
+			assert.False(t, ok)
+		}
+		assert.Equal(t, 0, tree.Size())
+	}
+}
+
+func TestTreePutOverrides(t *testing.T) {
+	tree, _ := NewOrderedTree[string, int](4)
+
+	oldValue, existed := tree.Put("a", 1)
+	assert.False(t, existed)
+	assert.Equal(t, 0, oldValue)
+
+	oldValue, existed = tree.Put("a", 2)
+	assert.True(t, existed)
+	assert.Equal(t, 1, oldValue)
+
+	value, ok := tree.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, 1, tree.Size())
+}
+
+func TestTreeScan(t *testing.T) {
+	for o := 3; o <= 7; o++ {
+		tree, _ := NewOrderedTree[int, int](o)
+		for i := 0; i < 100; i += 2 {
+			tree.Put(i, i)
+		}
+
+		scan := func(start, end *int, opts ScanOptions) []int {
+			keys := make([]int, 0)
+			tree.Scan(start, end, opts, func(key, value int) bool {
+				keys = append(keys, key)
+				return true
+			})
+			return keys
+		}
+		ref := func(i int) *int {
+			return &i
+		}
+
+		assert.Equal(t, []int{10, 12, 14}, scan(ref(10), ref(16), ScanOptions{}))
+		assert.Equal(t, []int{12, 14, 16}, scan(ref(10), ref(16), ScanOptions{ExcludeStart: true, IncludeEnd: true}))
+		assert.Equal(t, []int{12, 14}, scan(ref(11), ref(15), ScanOptions{}))
+		assert.Equal(t, []int{0, 2}, scan(nil, ref(4), ScanOptions{}))
+		assert.Equal(t, []int{96, 98}, scan(ref(95), nil, ScanOptions{}))
+		assert.Empty(t, scan(ref(99), nil, ScanOptions{}))
+	}
+}
+
+func TestTreeCustomComparator(t *testing.T) {
+	tree, err := NewTree[string, int](3, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	assert.NoError(t, err)
+
+	words := []string{"delta", "Alpha", "charlie", "Bravo", "echo"}
+	for i, word := range words {
+		tree.Put(word, i)
+	}
+	_, existed := tree.Put("ALPHA", 10)
+	assert.True(t, existed)
+
+	keys := make([]string, 0)
+	tree.ForEach(func(key string, value int) {
+		keys = append(keys, strings.ToLower(key))
+	})
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Equal(t, len(words), len(keys))
+}
+
+func TestNewTreeInvalidArguments(t *testing.T) {
+	_, err := NewOrderedTree[int, int](2)
+	assert.Error(t, err)
+
+	_, err = NewTree[int, int](4, nil)
+	assert.Error(t, err)
+}
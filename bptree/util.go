@@ -8,8 +8,42 @@ func ceil(a, b int) int {
 }
 
 func copyBytes(s []byte) []byte {
+	if s == nil {
+		return nil
+	}
 	c := make([]byte, len(s))
 	copy(c, s)
 
 	return c
 }
+
+// inserted returns a copy of the slice with the element inserted at the given position
+func inserted[T any](s []T, position int, e T) []T {
+	c := make([]T, len(s)+1)
+	copy(c, s[:position])
+	c[position] = e
+	copy(c[position+1:], s[position:])
+	return c
+}
+
+// removed returns a copy of the slice without the element at the given position
+func removed[T any](s []T, position int) []T {
+	c := make([]T, len(s)-1)
+	copy(c, s[:position])
+	copy(c[position:], s[position+1:])
+	return c
+}
+
+// replaced returns a copy of the slice with the element at the given position replaced
+func replaced[T any](s []T, position int, e T) []T {
+	c := make([]T, len(s))
+	copy(c, s)
+	c[position] = e
+	return c
+}
+
+// concatenated returns a new slice holding the elements of both slices
+func concatenated[T any](a, b []T) []T {
+	c := make([]T, 0, len(a)+len(b))
+	return append(append(c, a...), b...)
+}
@@ -0,0 +1,201 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Validate walks the whole tree and checks its structural invariants:
+// key ordering, separators, occupancy, parent pointers, the key counts
+// of the subtrees, the leaf chain, the most left node and the size. It
+// returns a descriptive error for the first violation found.
+func (bpt *BPlusTree) Validate() error {
+	bpt.lockTree()
+	defer bpt.unlockTree()
+	return bpt.validate()
+}
+
+// validate is Validate without locking the tree
+func (bpt *BPlusTree) validate() error {
+	if bpt.engine != nil {
+		return bpt.engine.validate()
+	}
+	if bpt.root == nil {
+		if bpt.size != 0 {
+			return fmt.Errorf("empty tree has size %d", bpt.size)
+		}
+		if bpt.mostLeftNode != nil {
+			return errors.New("empty tree has a most left node")
+		}
+		return nil
+	}
+	if bpt.root.parent != nil {
+		return errors.New("root has a parent")
+	}
+
+	v := &validator{bpt: bpt, leafDepth: -1}
+	if err := v.validateNode(bpt.root, "root", nil, nil, 0); err != nil {
+		return err
+	}
+
+	if v.size != bpt.size {
+		return fmt.Errorf("size is %d but the tree holds %d keys", bpt.size, v.size)
+	}
+	if bpt.mostLeftNode != v.leaves[0] {
+		return errors.New("most left node is not the first leaf")
+	}
+	for i, leaf := range v.leaves {
+		var previous, next *node
+		if i > 0 {
+			previous = v.leaves[i-1]
+		}
+		if i < len(v.leaves)-1 {
+			next = v.leaves[i+1]
+		}
+		if leaf.previousLeafNode() != previous {
+			return fmt.Errorf("leaf %d of %d has a wrong previous link", i, len(v.leaves))
+		}
+		if leaf.nextLeafNode() != next {
+			return fmt.Errorf("leaf %d of %d has a wrong next link", i, len(v.leaves))
+		}
+	}
+	return nil
+}
+
+// debugValidate panics if the tree is broken in debug builds, the
+// caller must hold the whole tree.
+func (bpt *BPlusTree) debugValidate() {
+	if !debug {
+		return
+	}
+	if err := bpt.validate(); err != nil {
+		panic(err)
+	}
+}
+
+// validator holds the state collected while walking the tree
+type validator struct {
+	bpt *BPlusTree
+
+	// the leaves in ascending key order
+	leaves []*node
+
+	// the depth of the leaves
+	leafDepth int
+
+	// the number of keys in the leaves
+	size int
+}
+
+// validateNode validates the subtree of n, all of whose keys must lie in
+// [lower, upper), a nil bound is open. path describes the position of n.
+func (v *validator) validateNode(n *node, path string, lower, upper []byte, depth int) error {
+	bpt := v.bpt
+	isRoot := n == bpt.root
+
+	if len(n.keys) != bpt.order-1 || len(n.pointers) != bpt.order {
+		return fmt.Errorf("%s: node has %d keys and %d pointers allocated", path, len(n.keys), len(n.pointers))
+	}
+	if n.keyNums > bpt.order-1 {
+		return fmt.Errorf("%s: node holds %d keys, more than %d", path, n.keyNums, bpt.order-1)
+	}
+	if isRoot && n.keyNums == 0 {
+		return fmt.Errorf("%s: root holds no keys", path)
+	}
+	if !isRoot && n.keyNums < bpt.minKeyNum {
+		return fmt.Errorf("%s: node holds %d keys, less than %d", path, n.keyNums, bpt.minKeyNum)
+	}
+
+	for i := 0; i < n.keyNums; i++ {
+		key := n.keys[i]
+		if key == nil {
+			return fmt.Errorf("%s: key %d is nil", path, i)
+		}
+		if i > 0 && bpt.compare(n.keys[i-1], key) >= 0 {
+			return fmt.Errorf("%s: keys %q and %q are not in ascending order", path, n.keys[i-1], key)
+		}
+		if lower != nil && bpt.compare(key, lower) < 0 {
+			return fmt.Errorf("%s: key %q is less than its separator %q", path, key, lower)
+		}
+		if upper != nil && bpt.compare(key, upper) >= 0 {
+			return fmt.Errorf("%s: key %q is not less than its separator %q", path, key, upper)
+		}
+	}
+	for i := n.keyNums; i < len(n.keys); i++ {
+		if n.keys[i] != nil {
+			return fmt.Errorf("%s: unused key %d is not cleaned up", path, i)
+		}
+	}
+
+	if n.leaf {
+		return v.validateLeaf(n, path, depth)
+	}
+
+	for i := n.keyNums + 1; i < len(n.pointers); i++ {
+		if n.pointers[i] != nil {
+			return fmt.Errorf("%s: unused pointer %d is not cleaned up", path, i)
+		}
+	}
+	count := 0
+	for i := 0; i <= n.keyNums; i++ {
+		childPath := fmt.Sprintf("%s/%d", path, i)
+		if n.pointers[i] == nil {
+			return fmt.Errorf("%s: pointer is nil", childPath)
+		}
+		child, ok := n.pointers[i].data.(*node)
+		if !ok {
+			return fmt.Errorf("%s: pointer of an internal node doesn't point to a node", childPath)
+		}
+		if child.parent != n {
+			return fmt.Errorf("%s: node has a wrong parent", childPath)
+		}
+
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = n.keys[i-1]
+		}
+		if i < n.keyNums {
+			childUpper = n.keys[i]
+		}
+		if err := v.validateNode(child, childPath, childLower, childUpper, depth+1); err != nil {
+			return err
+		}
+		count += child.keyCount()
+	}
+	if bpt.counted() && n.count != count {
+		return fmt.Errorf("%s: node counts %d keys but its subtree holds %d", path, n.count, count)
+	}
+	return nil
+}
+
+// validateLeaf validates the values and the depth of the leaf and collects it
+func (v *validator) validateLeaf(n *node, path string, depth int) error {
+	if v.leafDepth == -1 {
+		v.leafDepth = depth
+	} else if v.leafDepth != depth {
+		return fmt.Errorf("%s: leaf is at depth %d, but other leaves are at depth %d", path, depth, v.leafDepth)
+	}
+
+	for i := 0; i < n.keyNums; i++ {
+		if n.pointers[i] == nil {
+			return fmt.Errorf("%s: value %d is nil", path, i)
+		}
+		if _, ok := n.pointers[i].data.([]byte); !ok {
+			return fmt.Errorf("%s: pointer %d of a leaf doesn't point to a value", path, i)
+		}
+	}
+	for i := n.keyNums; i < len(n.pointers)-1; i++ {
+		if n.pointers[i] != nil {
+			return fmt.Errorf("%s: unused pointer %d is not cleaned up", path, i)
+		}
+	}
+	if last := n.pointerToNextLeafNode(); last != nil {
+		if _, ok := last.data.(*node); !ok {
+			return fmt.Errorf("%s: last pointer of a leaf doesn't point to a node", path)
+		}
+	}
+
+	v.leaves = append(v.leaves, n)
+	v.size += n.keyNums
+	return nil
+}
@@ -0,0 +1,96 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRandomizedOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	size := 500
+
+	for order := 3; order <= 8; order++ {
+		bpt, _ := NewBPlusTree(SetOrder(order))
+		assert.NoError(t, bpt.Validate())
+
+		for i := 0; i < 4*size; i++ {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(r.Intn(size)))
+			if r.Intn(3) == 0 {
+				bpt.Delete(key)
+			} else {
+				bpt.Put(key, key)
+			}
+			if !assert.NoError(t, bpt.Validate()) {
+				return
+			}
+		}
+
+		for k := 0; k < size; k++ {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(k))
+			bpt.Delete(key)
+			if !assert.NoError(t, bpt.Validate()) {
+				return
+			}
+		}
+		assert.Equal(t, 0, bpt.Size())
+	}
+}
+
+func TestValidateAfterEmptyingTheRoot(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	bpt.Put([]byte("1"), []byte("1"))
+	bpt.Delete([]byte("1"))
+	assert.NoError(t, bpt.Validate())
+
+	bpt.Put([]byte("2"), []byte("2"))
+	assert.NoError(t, bpt.Validate())
+}
+
+func TestValidatePutNilKeyIntoEmptyTree(t *testing.T) {
+	bpt, _ := NewBPlusTree()
+	bpt.Put(nil, []byte("1"))
+	assert.Equal(t, 0, bpt.Size())
+	assert.NoError(t, bpt.Validate())
+}
+
+func TestValidateDetectsCorruption(t *testing.T) {
+	build := func() *BPlusTree {
+		bpt, _ := NewBPlusTree(SetOrder(3))
+		for _, testData := range testDatas {
+			bpt.Put(testData.key, testData.value)
+		}
+		assert.NoError(t, bpt.Validate())
+		return bpt
+	}
+
+	bpt := build()
+	bpt.size++
+	assert.Error(t, bpt.Validate())
+
+	bpt = build()
+	bpt.mostLeftNode = bpt.mostLeftNode.nextLeafNode()
+	assert.Error(t, bpt.Validate())
+
+	bpt = build()
+	leaf := bpt.mostLeftNode.nextLeafNode()
+	leaf.keys[0], leaf.keys[1] = leaf.keys[1], leaf.keys[0]
+	assert.Error(t, bpt.Validate())
+
+	bpt = build()
+	bpt.mostLeftNode.nextLeafNode().setPreviousLeafNode(nil)
+	assert.Error(t, bpt.Validate())
+
+	bpt = build()
+	bpt.root.keys[0] = []byte("00")
+	assert.Error(t, bpt.Validate())
+
+	bpt = build()
+	bpt.mostLeftNode.parent = bpt.root
+	assert.Error(t, bpt.Validate())
+}
@@ -0,0 +1,99 @@
+package dreamingdb
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dreamingdb/bptree"
+)
+
+// DB is a transactional key-value store over a BPlusTree. Every committed
+// value is stored with the version of the commit that wrote it, so a
+// transaction can tell at commit time whether what it read has changed.
+// Deleted keys keep a tombstone with the version of the deleting commit,
+// so a key deleted and put again never goes back to an older version.
+type DB struct {
+	// the number of committed keys which aren't deleted, accessed
+	// atomically, first for the alignment
+	size int64
+
+	tree *bptree.BPlusTree
+
+	// serializes the validation and the writes of the commits
+	commitLatch sync.Mutex
+
+	// the version of the last commit, guarded by commitLatch
+	version uint64
+
+	// the id of the last transaction begun
+	lastTxnID uint64
+
+	// the key locks of the pessimistic transactions
+	locks       *lockManager
+	lockTimeout time.Duration
+}
+
+// New returns an empty DB whose tree is built with the given options.
+// The tree is CopyOnWrite unless the options choose another concurrent
+// mode, so transactions read it without latching. Transactions order keys
+// by the comparator of the tree, which must only find equal the keys made
+// of the same bytes, since keys are locked and tracked by their bytes.
+func New(options ...bptree.Option) (*DB, error) {
+	options = append([]bptree.Option{bptree.SetConcurrency(bptree.CopyOnWrite)}, options...)
+	tree, err := bptree.NewBPlusTree(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{
+		tree:        tree,
+		locks:       newLockManager(),
+		lockTimeout: defaultLockTimeout,
+	}, nil
+}
+
+// SetLockTimeout sets how long a PessimisticTxn waits for a lock before
+// it fails with ErrLockTimeout, 0 waits until the lock is granted. It must
+// be called before any transaction begins.
+func (db *DB) SetLockTimeout(timeout time.Duration) {
+	db.lockTimeout = timeout
+}
+
+func (db *DB) nextTxnID() uint64 {
+	return atomic.AddUint64(&db.lastTxnID, 1)
+}
+
+// Size returns the number of committed keys.
+func (db *DB) Size() int {
+	return int(atomic.LoadInt64(&db.size))
+}
+
+// A committed write, a put or a tombstone encoded like the buffered
+// writes, is stored behind the big endian version of its commit.
+const versionLen = 8
+
+func encodeRecord(version uint64, write []byte) []byte {
+	record := make([]byte, versionLen+len(write))
+	binary.BigEndian.PutUint64(record, version)
+	copy(record[versionLen:], write)
+	return record
+}
+
+// decodeRecord returns the version of the record, its value
+// and false if the record is a tombstone.
+func decodeRecord(record []byte) (uint64, []byte, bool) {
+	value, live := decodeWrite(record[versionLen:])
+	return binary.BigEndian.Uint64(record), value, live
+}
+
+// read returns the committed value of the key with its version, the
+// version of a key which has never been written is 0.
+func (db *DB) read(key []byte) ([]byte, uint64, bool) {
+	record, ok := db.tree.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	version, value, live := decodeRecord(record)
+	return value, version, live
+}
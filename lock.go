@@ -0,0 +1,266 @@
+package dreamingdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDeadlock is returned when waiting for a lock would close a cycle
+	// of transactions waiting for each other. The transaction which would
+	// have waited is the victim, it is rolled back.
+	ErrDeadlock = errors.New("deadlock")
+
+	// ErrLockTimeout is returned when a lock isn't granted within the
+	// lock timeout, the transaction is rolled back.
+	ErrLockTimeout = errors.New("lock wait timeout")
+)
+
+const (
+	defaultLockTimeout = time.Second
+)
+
+type lockMode int
+
+const (
+	lockShared lockMode = iota
+	lockExclusive
+)
+
+// conflicts returns true if both modes can't be held by two transactions at once
+func conflicts(a, b lockMode) bool {
+	return a == lockExclusive || b == lockExclusive
+}
+
+// lockRequest is a transaction waiting for a lock
+type lockRequest struct {
+	txn  uint64
+	mode lockMode
+
+	// closed once the lock is granted
+	granted chan struct{}
+}
+
+// keyLock is the lock of a key
+type keyLock struct {
+	holders map[uint64]lockMode
+
+	// the waiting requests in arrival order, upgrades go first
+	queue []*lockRequest
+}
+
+// compatible returns true if the transaction can hold the lock in the mode
+// along with the other holders.
+func (l *keyLock) compatible(txn uint64, mode lockMode) bool {
+	for holder, held := range l.holders {
+		if holder != txn && conflicts(mode, held) {
+			return false
+		}
+	}
+	return true
+}
+
+// lockManager grants shared and exclusive key locks to transactions,
+// which hold them until they end. A transaction about to wait for a lock
+// checks the wait-for graph first, and gets ErrDeadlock instead of waiting
+// if its wait would close a cycle, so deadlocks never form.
+type lockManager struct {
+	mu sync.Mutex
+
+	locks map[string]*keyLock
+
+	// the key each waiting transaction waits for
+	waiting map[uint64]string
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		locks:   make(map[string]*keyLock),
+		waiting: make(map[uint64]string),
+	}
+}
+
+// acquire locks the key in the mode for the transaction, waiting at most
+// timeout for the lock unless timeout is 0. A transaction holding the key
+// shared upgrades it to exclusive.
+func (lm *lockManager) acquire(txn uint64, key string, mode lockMode, timeout time.Duration) error {
+	lm.mu.Lock()
+	req, granted := lm.request(txn, key, mode, true)
+	if granted {
+		lm.mu.Unlock()
+		return nil
+	}
+	if lm.closesCycle(txn) {
+		lm.dequeue(key, req)
+		lm.mu.Unlock()
+		return ErrDeadlock
+	}
+	lm.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-req.granted:
+		return nil
+	case <-expired:
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	select {
+	case <-req.granted:
+		// granted while the timer fired
+		return nil
+	default:
+	}
+	lm.dequeue(key, req)
+	return ErrLockTimeout
+}
+
+// tryAcquire locks the key in the mode for the transaction if it can be
+// granted at once, and returns false otherwise.
+func (lm *lockManager) tryAcquire(txn uint64, key string, mode lockMode) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	_, granted := lm.request(txn, key, mode, false)
+	return granted
+}
+
+// request grants the lock if it's compatible with the holders and no
+// other request waits before it. Otherwise the request is queued if wait
+// is true, and returned. lm.mu must be held.
+func (lm *lockManager) request(txn uint64, key string, mode lockMode, wait bool) (*lockRequest, bool) {
+	l := lm.locks[key]
+	if l == nil {
+		l = &keyLock{holders: make(map[uint64]lockMode)}
+		lm.locks[key] = l
+	}
+	held, holds := l.holders[txn]
+	if holds && held >= mode {
+		return nil, true
+	}
+	if l.compatible(txn, mode) && (holds || len(l.queue) == 0) {
+		l.holders[txn] = mode
+		return nil, true
+	}
+	if !wait {
+		lm.forget(key, l)
+		return nil, false
+	}
+
+	req := &lockRequest{txn: txn, mode: mode, granted: make(chan struct{})}
+	if holds {
+		l.queue = append([]*lockRequest{req}, l.queue...)
+	} else {
+		l.queue = append(l.queue, req)
+	}
+	lm.waiting[txn] = key
+	return req, false
+}
+
+// dequeue withdraws the waiting request, which may let the ones
+// behind it through. lm.mu must be held.
+func (lm *lockManager) dequeue(key string, req *lockRequest) {
+	l := lm.locks[key]
+	for i, queued := range l.queue {
+		if queued == req {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			break
+		}
+	}
+	delete(lm.waiting, req.txn)
+	lm.grant(key, l)
+}
+
+// grant grants the waiting requests from the front of the queue
+// as long as they are compatible. lm.mu must be held.
+func (lm *lockManager) grant(key string, l *keyLock) {
+	for len(l.queue) > 0 {
+		req := l.queue[0]
+		if !l.compatible(req.txn, req.mode) {
+			break
+		}
+		l.queue = l.queue[1:]
+		l.holders[req.txn] = req.mode
+		delete(lm.waiting, req.txn)
+		close(req.granted)
+	}
+	lm.forget(key, l)
+}
+
+// forget drops the lock once nobody holds or waits for it
+func (lm *lockManager) forget(key string, l *keyLock) {
+	if len(l.holders) == 0 && len(l.queue) == 0 {
+		delete(lm.locks, key)
+	}
+}
+
+// release releases the locks of the transaction on the keys
+func (lm *lockManager) release(txn uint64, keys []string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for _, key := range keys {
+		if l := lm.locks[key]; l != nil {
+			delete(l.holders, txn)
+			lm.grant(key, l)
+		}
+	}
+}
+
+// waitsFor returns the transactions the waiting transaction waits for:
+// the holders of its key and the requests queued before its own which
+// conflict with it. lm.mu must be held.
+func (lm *lockManager) waitsFor(txn uint64) []uint64 {
+	key, ok := lm.waiting[txn]
+	if !ok {
+		return nil
+	}
+	l := lm.locks[key]
+	var req *lockRequest
+	var ahead []uint64
+	for _, queued := range l.queue {
+		if queued.txn == txn {
+			req = queued
+			break
+		}
+		ahead = append(ahead, queued.txn)
+	}
+
+	var others []uint64
+	for holder, held := range l.holders {
+		if holder != txn && conflicts(req.mode, held) {
+			others = append(others, holder)
+		}
+	}
+	for i, queued := range l.queue[:len(ahead)] {
+		if conflicts(req.mode, queued.mode) {
+			others = append(others, ahead[i])
+		}
+	}
+	return others
+}
+
+// closesCycle returns true if the wait of the transaction
+// closes a cycle in the wait-for graph. lm.mu must be held.
+func (lm *lockManager) closesCycle(txn uint64) bool {
+	visited := make(map[uint64]bool)
+	stack := lm.waitsFor(txn)
+	for len(stack) > 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if next == txn {
+			return true
+		}
+		if visited[next] {
+			continue
+		}
+		visited[next] = true
+		stack = append(stack, lm.waitsFor(next)...)
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package dreamingdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockModes(t *testing.T) {
+	lm := newLockManager()
+	assert.True(t, lm.tryAcquire(1, "a", lockShared))
+	assert.True(t, lm.tryAcquire(2, "a", lockShared))
+	assert.False(t, lm.tryAcquire(3, "a", lockExclusive))
+	// an upgrade waits for the other readers
+	assert.False(t, lm.tryAcquire(1, "a", lockExclusive))
+
+	lm.release(2, []string{"a"})
+	assert.True(t, lm.tryAcquire(1, "a", lockExclusive))
+	assert.True(t, lm.tryAcquire(1, "a", lockShared))
+	assert.False(t, lm.tryAcquire(2, "a", lockShared))
+
+	lm.release(1, []string{"a"})
+	assert.Empty(t, lm.locks)
+}
+
+func TestLockWaitsInOrder(t *testing.T) {
+	lm := newLockManager()
+	assert.True(t, lm.tryAcquire(1, "a", lockExclusive))
+
+	granted := make(chan uint64, 2)
+	for _, txn := range []uint64{2, 3} {
+		go func(txn uint64) {
+			assert.NoError(t, lm.acquire(txn, "a", lockExclusive, 0))
+			granted <- txn
+			lm.release(txn, []string{"a"})
+		}(txn)
+		waitFor(t, lm, txn)
+	}
+	// a shared request doesn't overtake the queued writers
+	assert.False(t, lm.tryAcquire(4, "a", lockShared))
+
+	lm.release(1, []string{"a"})
+	assert.Equal(t, uint64(2), <-granted)
+	assert.Equal(t, uint64(3), <-granted)
+}
+
+func TestLockTimeout(t *testing.T) {
+	lm := newLockManager()
+	assert.True(t, lm.tryAcquire(1, "a", lockShared))
+	start := time.Now()
+	assert.ErrorIs(t, lm.acquire(2, "a", lockExclusive, 20*time.Millisecond), ErrLockTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	// the withdrawn request doesn't hold the readers back
+	assert.True(t, lm.tryAcquire(3, "a", lockShared))
+	assert.Empty(t, lm.waiting)
+}
+
+func TestLockDeadlock(t *testing.T) {
+	lm := newLockManager()
+	assert.True(t, lm.tryAcquire(1, "a", lockExclusive))
+	assert.True(t, lm.tryAcquire(2, "b", lockExclusive))
+	assert.True(t, lm.tryAcquire(3, "c", lockExclusive))
+
+	// 1 waits for 2 which waits for 3, which would close the cycle
+	done := make(chan error, 2)
+	go func() {
+		done <- lm.acquire(1, "b", lockExclusive, 0)
+	}()
+	waitFor(t, lm, 1)
+	go func() {
+		done <- lm.acquire(2, "c", lockShared, 0)
+	}()
+	waitFor(t, lm, 2)
+	assert.ErrorIs(t, lm.acquire(3, "a", lockShared, 0), ErrDeadlock)
+
+	// the victim rolls back and the others go through
+	lm.release(3, []string{"c"})
+	assert.NoError(t, <-done)
+	lm.release(2, []string{"b", "c"})
+	assert.NoError(t, <-done)
+	lm.release(1, []string{"a", "b"})
+	assert.Empty(t, lm.locks)
+
+	// two readers upgrading the same key deadlock
+	assert.True(t, lm.tryAcquire(1, "a", lockShared))
+	assert.True(t, lm.tryAcquire(2, "a", lockShared))
+	go func() {
+		done <- lm.acquire(1, "a", lockExclusive, 0)
+	}()
+	waitFor(t, lm, 1)
+	assert.ErrorIs(t, lm.acquire(2, "a", lockExclusive, 0), ErrDeadlock)
+	lm.release(2, []string{"a"})
+	assert.NoError(t, <-done)
+}
+
+// waitFor waits until the transaction waits for a lock
+func waitFor(t *testing.T, lm *lockManager, txn uint64) {
+	assert.Eventually(t, func() bool {
+		lm.mu.Lock()
+		defer lm.mu.Unlock()
+		_, ok := lm.waiting[txn]
+		return ok
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,104 @@
+package mvcc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// The versions of the keys are stored under encoded keys which sort like
+// the user keys and then from the newest version to the oldest. A 0x00
+// byte of the user key is escaped as 0x00 0xFF, the user key ends with the
+// terminator 0x00 0x01, and the timestamp follows inverted in big endian.
+// The terminator sorts before any escaped byte, so a user key sorts before
+// the longer ones it prefixes.
+
+const (
+	escape     = 0x00
+	escaped    = 0xFF
+	terminator = 0x01
+
+	// one past the terminator, it bounds all the versions of a user key
+	afterVersions = 0x02
+
+	tsLen = 8
+)
+
+var errCorrupted = errors.New("corrupted version key")
+
+// encodeKey returns the encoded key of the version of the user key at ts
+func encodeKey(key []byte, ts uint64) []byte {
+	encoded := appendUserKey(make([]byte, 0, len(key)+2+tsLen), key, terminator)
+	var inverted [tsLen]byte
+	binary.BigEndian.PutUint64(inverted[:], math.MaxUint64-ts)
+	return append(encoded, inverted[:]...)
+}
+
+// afterKey returns the smallest encoded key after all the versions of the user key
+func afterKey(key []byte) []byte {
+	return appendUserKey(make([]byte, 0, len(key)+2), key, afterVersions)
+}
+
+// appendUserKey appends the escaped user key and the given end marker
+func appendUserKey(dst, key []byte, end byte) []byte {
+	for _, b := range key {
+		dst = append(dst, b)
+		if b == escape {
+			dst = append(dst, escaped)
+		}
+	}
+	return append(dst, escape, end)
+}
+
+// decodeKey returns the user key and the timestamp of the encoded key
+func decodeKey(encoded []byte) ([]byte, uint64, error) {
+	if len(encoded) < 2+tsLen {
+		return nil, 0, errCorrupted
+	}
+	key := make([]byte, 0, len(encoded)-2-tsLen)
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != escape {
+			key = append(key, encoded[i])
+			continue
+		}
+		if i+1 == len(encoded) {
+			return nil, 0, errCorrupted
+		}
+		switch encoded[i+1] {
+		case escaped:
+			key = append(key, escape)
+			i++
+		case terminator:
+			if len(encoded)-i-2 != tsLen {
+				return nil, 0, errCorrupted
+			}
+			return key, math.MaxUint64 - binary.BigEndian.Uint64(encoded[i+2:]), nil
+		default:
+			return nil, 0, errCorrupted
+		}
+	}
+	return nil, 0, errCorrupted
+}
+
+// A version is stored with a leading kind byte, followed by
+// the value for a put and by nothing for a deletion.
+const (
+	kindPut = iota
+	kindDelete
+)
+
+func encodePut(value []byte) []byte {
+	return append([]byte{kindPut}, value...)
+}
+
+func encodeDelete() []byte {
+	return []byte{kindDelete}
+}
+
+// decodeValue returns the value of the version and false for a deletion
+func decodeValue(encoded []byte) ([]byte, bool) {
+	if encoded[0] == kindDelete {
+		return nil, false
+	}
+	return encoded[1:], true
+}
@@ -0,0 +1,53 @@
+package mvcc
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyEncoding(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	type version struct {
+		key []byte
+		ts  uint64
+	}
+	versions := make([]version, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		// small alphabets make shared prefixes and escaped bytes common
+		key := make([]byte, r.Intn(4))
+		for j := range key {
+			key[j] = []byte{0x00, 0x01, 0x02, 0xFF}[r.Intn(4)]
+		}
+		ts := []uint64{0, 1, 2, math.MaxUint64}[r.Intn(4)]
+		versions = append(versions, version{key, ts})
+
+		decoded, decodedTs, err := decodeKey(encodeKey(key, ts))
+		assert.NoError(t, err)
+		assert.Equal(t, key, decoded)
+		assert.Equal(t, ts, decodedTs)
+	}
+
+	// encoded keys sort by key and then from the newest version
+	sort.Slice(versions, func(i, j int) bool {
+		return bytes.Compare(encodeKey(versions[i].key, versions[i].ts), encodeKey(versions[j].key, versions[j].ts)) < 0
+	})
+	for i := 1; i < len(versions); i++ {
+		previous, current := versions[i-1], versions[i]
+		cmp := bytes.Compare(previous.key, current.key)
+		assert.True(t, cmp < 0 || cmp == 0 && previous.ts >= current.ts)
+		if cmp < 0 {
+			assert.True(t, bytes.Compare(afterKey(previous.key), encodeKey(current.key, current.ts)) <= 0)
+		}
+	}
+
+	for _, corrupted := range [][]byte{nil, {0x00, 0x01}, append([]byte{0x00, 0x03}, make([]byte, 8)...)} {
+		_, _, err := decodeKey(corrupted)
+		assert.Error(t, err)
+	}
+}
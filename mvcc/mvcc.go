@@ -0,0 +1,121 @@
+package mvcc
+
+import (
+	"bytes"
+	"math"
+
+	"dreamingdb/bptree"
+)
+
+// Store keeps every version of the keys written to it, stamped with the
+// timestamp of the write, so a read at a timestamp sees the keys as they
+// were then. The versions live in a single BPlusTree under encoded keys,
+// which must be ordered bytewise, so the tree must not get SetComparator.
+// Versions are never removed, a deletion is a version of its own.
+type Store struct {
+	tree *bptree.BPlusTree
+}
+
+// New returns an empty store whose tree is built with the given options,
+// a concurrent mode makes the store safe for concurrent use.
+func New(options ...bptree.Option) (*Store, error) {
+	tree, err := bptree.NewBPlusTree(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{tree: tree}, nil
+}
+
+// Put writes the value as the version of the key at ts. A version
+// already written at ts is overwritten.
+func (s *Store) Put(key, value []byte, ts uint64) {
+	if key == nil {
+		return
+	}
+	s.tree.Put(encodeKey(key, ts), encodePut(value))
+}
+
+// Delete writes the deletion of the key as its version at ts.
+func (s *Store) Delete(key []byte, ts uint64) {
+	if key == nil {
+		return
+	}
+	s.tree.Put(encodeKey(key, ts), encodeDelete())
+}
+
+// Get returns the value of the newest version of the key written at
+// or before ts and true, or nil and false if there is none or if it is
+// a deletion.
+func (s *Store) Get(key []byte, ts uint64) ([]byte, bool) {
+	if key == nil {
+		return nil, false
+	}
+	var value []byte
+	found := false
+	s.tree.Scan(encodeKey(key, ts), afterKey(key), bptree.ScanOptions{}, func(_, encoded []byte) bool {
+		value, found = decodeValue(encoded)
+		return false
+	})
+	return value, found
+}
+
+// Scan traverses the keys in [start, end) as they were at ts in ascending
+// key order, a nil start or end leaves that side of the range open. The
+// traversal stops as soon as action returns false.
+func (s *Store) Scan(start, end []byte, ts uint64, action func(key, value []byte) bool) {
+	var endKey []byte
+	if end != nil {
+		endKey = encodeKey(end, math.MaxUint64)
+	}
+	it := s.tree.Iterator()
+	if start != nil {
+		it.Seek(encodeKey(start, math.MaxUint64))
+	}
+
+	for it.Valid() {
+		encoded := it.Key()
+		if endKey != nil && bytes.Compare(encoded, endKey) >= 0 {
+			return
+		}
+		key, version, err := decodeKey(encoded)
+		if err != nil {
+			// the tree only holds keys encoded by the store
+			panic(err)
+		}
+		if version > ts {
+			// skip the versions written after ts
+			it.Seek(encodeKey(key, ts))
+			continue
+		}
+		if value, ok := decodeValue(it.Value()); ok && !action(key, value) {
+			return
+		}
+		it.Seek(afterKey(key))
+	}
+}
+
+// ReadAt returns a read-only view of the store at ts.
+func (s *Store) ReadAt(ts uint64) *View {
+	return &View{s: s, ts: ts}
+}
+
+// View reads the keys of a store as they were at a timestamp.
+type View struct {
+	s  *Store
+	ts uint64
+}
+
+// Timestamp returns the timestamp the view reads at.
+func (v *View) Timestamp() uint64 {
+	return v.ts
+}
+
+// Get is Store.Get at the timestamp of the view.
+func (v *View) Get(key []byte) ([]byte, bool) {
+	return v.s.Get(key, v.ts)
+}
+
+// Scan is Store.Scan at the timestamp of the view.
+func (v *View) Scan(start, end []byte, action func(key, value []byte) bool) {
+	v.s.Scan(start, end, v.ts, action)
+}
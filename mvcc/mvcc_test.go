@@ -0,0 +1,135 @@
+package mvcc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"dreamingdb/bptree"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	s, err := New(bptree.SetOrder(3))
+	assert.NoError(t, err)
+
+	s.Put([]byte("a"), []byte("a1"), 1)
+	s.Put([]byte("b"), []byte("b1"), 1)
+	s.Put([]byte("a"), []byte("a3"), 3)
+	s.Delete([]byte("b"), 4)
+	s.Put([]byte("b"), []byte("b5"), 5)
+	s.Put([]byte("c"), []byte("c2"), 2)
+	s.Put([]byte("ab"), []byte("ab6"), 6)
+
+	cases := []struct {
+		ts       uint64
+		expected string
+	}{
+		{0, ""},
+		{1, "a=a1 b=b1"},
+		{2, "a=a1 b=b1 c=c2"},
+		{3, "a=a3 b=b1 c=c2"},
+		{4, "a=a3 c=c2"},
+		{5, "a=a3 b=b5 c=c2"},
+		{6, "a=a3 ab=ab6 b=b5 c=c2"},
+	}
+	for _, c := range cases {
+		view := s.ReadAt(c.ts)
+		assert.Equal(t, c.ts, view.Timestamp())
+		assert.Equal(t, c.expected, scanned(view, nil, nil), "ts %d", c.ts)
+	}
+
+	value, ok := s.Get([]byte("b"), 4)
+	assert.False(t, ok)
+	assert.Nil(t, value)
+	value, ok = s.Get([]byte("b"), 100)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("b5"), value)
+	_, ok = s.Get([]byte("d"), 100)
+	assert.False(t, ok)
+
+	view := s.ReadAt(6)
+	assert.Equal(t, "ab=ab6 b=b5", scanned(view, []byte("ab"), []byte("c")))
+	assert.Equal(t, "a=a3 ab=ab6", scanned(view, nil, []byte("b")))
+	assert.Equal(t, "c=c2", scanned(view, []byte("b\x00"), nil))
+
+	count := 0
+	view.Scan(nil, nil, func(key, value []byte) bool {
+		count++
+		return count < 2
+	})
+	assert.Equal(t, 2, count)
+}
+
+func TestStoreKeysWithZeroBytes(t *testing.T) {
+	s, _ := New()
+	keys := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x01", "a\x00b"}
+	for i, key := range keys {
+		s.Put([]byte(key), []byte(key), uint64(i))
+		s.Put([]byte(key), []byte("new"), uint64(i+10))
+	}
+
+	var scannedKeys []string
+	s.Scan(nil, nil, 9, func(key, value []byte) bool {
+		assert.Equal(t, key, value)
+		scannedKeys = append(scannedKeys, string(key))
+		return true
+	})
+	assert.Equal(t, keys, scannedKeys)
+}
+
+func TestStoreSnapshotReadsWhileWriting(t *testing.T) {
+	s, _ := New(bptree.SetConcurrency(bptree.CopyOnWrite))
+	key := func(k int) []byte {
+		return []byte(fmt.Sprintf("%03d", k))
+	}
+	for k := 0; k < 100; k++ {
+		s.Put(key(k), []byte("1"), 1)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ts := uint64(2); ts < 50; ts++ {
+			for k := 0; k < 100; k++ {
+				if k%2 == 0 {
+					s.Delete(key(k), ts)
+				} else {
+					s.Put(key(k), []byte(fmt.Sprint(ts)), ts)
+				}
+			}
+		}
+	}()
+
+	// the view at ts 1 never changes
+	view := s.ReadAt(1)
+	for round := 0; round < 20; round++ {
+		count := 0
+		view.Scan(nil, nil, func(k, value []byte) bool {
+			assert.Equal(t, key(count), k)
+			assert.Equal(t, []byte("1"), value)
+			count++
+			return true
+		})
+		assert.Equal(t, 100, count)
+	}
+	wg.Wait()
+}
+
+// scanned returns the pairs of kv of the view or the transaction
+// in the range as "key=value"
+func scanned(view interface {
+	Scan(start, end []byte, action func(key, value []byte) bool)
+}, start, end []byte) string {
+	var pairs string
+	view.Scan(start, end, func(key, value []byte) bool {
+		if pairs != "" {
+			pairs += " "
+		}
+		pairs += fmt.Sprintf("%s=%s", key, value)
+		return true
+	})
+	return pairs
+}
@@ -0,0 +1,357 @@
+package mvcc
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"dreamingdb/bptree"
+)
+
+var (
+	// ErrWriteConflict is returned by Commit when a key the transaction
+	// writes was written by a transaction committed since it began.
+	ErrWriteConflict = errors.New("write conflicts with a committed transaction")
+
+	// ErrSerialization is returned by Commit when the transaction would be
+	// part of a dangerous structure: a transaction with an rw-antidependency
+	// from a concurrent one and another to a concurrent one, which may make
+	// the history unserializable.
+	ErrSerialization = errors.New("transaction may not be serializable")
+
+	// ErrTxnDone is returned by Commit once the transaction
+	// has been committed or rolled back.
+	ErrTxnDone = errors.New("transaction is already done")
+)
+
+// TxnManager runs serializable snapshot isolation transactions over a
+// Store. Every transaction reads the snapshot of the last commit before it
+// began, and leaves SIREAD locks on the keys it reads and the ranges it
+// scans, which never block anybody. A commit finds the rw-antidependencies
+// between its transaction and the concurrent ones through these locks, a
+// transaction which reads a key a concurrent one writes depends on it, and
+// aborts when one of them gets both an incoming and an outgoing one. An
+// active transaction only gets outgoing ones, so when a committed one would
+// be the pivot, it's the committing transaction which aborts.
+type TxnManager struct {
+	store *Store
+
+	mu sync.Mutex
+
+	// the timestamp of the last commit
+	clock uint64
+
+	active map[*Txn]struct{}
+
+	// the committed transactions still concurrent with an active one
+	committed []*Txn
+}
+
+// NewTxnManager returns a manager over an empty store whose tree is built
+// with the given options. The tree is CopyOnWrite unless the options choose
+// another concurrent mode.
+func NewTxnManager(options ...bptree.Option) (*TxnManager, error) {
+	options = append([]bptree.Option{bptree.SetConcurrency(bptree.CopyOnWrite)}, options...)
+	store, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &TxnManager{
+		store:  store,
+		active: make(map[*Txn]struct{}),
+	}, nil
+}
+
+// Txn is a serializable snapshot isolation transaction. Its writes are
+// buffered until Commit, its reads see the snapshot it began with overlaid
+// with its own writes. A Txn must not be used concurrently.
+type Txn struct {
+	m *TxnManager
+
+	// the snapshot read and the timestamp of the commit
+	start, commit uint64
+
+	// the SIREAD locks, guarded by m.mu
+	reads  map[string]struct{}
+	ranges []keyRange
+
+	// the buffered writes, encoded as the values of the store
+	writes *bptree.BPlusTree
+
+	// whether a concurrent transaction has an rw-antidependency
+	// on this one, and the other way around, guarded by m.mu
+	inConflict, outConflict bool
+
+	done bool
+}
+
+// keyRange is a scanned range of keys
+type keyRange struct {
+	start, end []byte
+
+	// whether the range holds end, where the scan stopped
+	includeEnd bool
+}
+
+// contains returns true if the key is in the range
+func (r keyRange) contains(key []byte) bool {
+	if r.start != nil && bytes.Compare(key, r.start) < 0 {
+		return false
+	}
+	if r.end == nil {
+		return true
+	}
+	cmp := bytes.Compare(key, r.end)
+	return cmp < 0 || cmp == 0 && r.includeEnd
+}
+
+// Begin starts a transaction reading the snapshot of the last commit.
+func (m *TxnManager) Begin() *Txn {
+	writes, _ := bptree.NewBPlusTree()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txn := &Txn{
+		m:      m,
+		start:  m.clock,
+		reads:  make(map[string]struct{}),
+		writes: writes,
+	}
+	m.active[txn] = struct{}{}
+	return txn
+}
+
+// mustBeActive panics if the transaction is done
+func (txn *Txn) mustBeActive() {
+	if txn.done {
+		panic("transaction is already done")
+	}
+}
+
+// Get returns the value of the key and true, or nil and false if the key
+// doesn't exist. The transaction's own writes take precedence.
+func (txn *Txn) Get(key []byte) ([]byte, bool) {
+	txn.mustBeActive()
+	if key == nil {
+		return nil, false
+	}
+	if write, ok := txn.writes.Get(key); ok {
+		return decodeValue(write)
+	}
+
+	txn.m.mu.Lock()
+	txn.reads[string(key)] = struct{}{}
+	txn.m.mu.Unlock()
+	return txn.m.store.Get(key, txn.start)
+}
+
+// Put buffers a write of the value to the key.
+func (txn *Txn) Put(key, value []byte) {
+	txn.mustBeActive()
+	txn.writes.Put(key, encodePut(value))
+}
+
+// Delete buffers a deletion of the key.
+func (txn *Txn) Delete(key []byte) {
+	txn.mustBeActive()
+	txn.writes.Put(key, encodeDelete())
+}
+
+// Scan traverses the pairs of kv whose keys are in [start, end) in
+// ascending key order, merging the snapshot with the transaction's own
+// writes. A nil start or end leaves that side of the range open. The
+// traversal stops as soon as action returns false, and only the part of
+// the range traversed is locked.
+func (txn *Txn) Scan(start, end []byte, action func(key, value []byte) bool) {
+	txn.mustBeActive()
+	buffered := txn.writes.Iterator()
+	if start != nil {
+		buffered.Seek(start)
+	}
+	var stopped []byte
+
+	// passes the buffered writes before key, or all if key is nil
+	passBuffered := func(key []byte) bool {
+		for buffered.Valid() && (end == nil || bytes.Compare(buffered.Key(), end) < 0) &&
+			(key == nil || bytes.Compare(buffered.Key(), key) < 0) {
+			key, write := buffered.Next()
+			if value, ok := decodeValue(write); ok && !action(key, value) {
+				stopped = key
+				return false
+			}
+		}
+		return true
+	}
+	txn.m.store.Scan(start, end, txn.start, func(key, value []byte) bool {
+		if !passBuffered(key) {
+			return false
+		}
+		if buffered.Valid() && bytes.Equal(buffered.Key(), key) {
+			_, write := buffered.Next()
+			var ok bool
+			if value, ok = decodeValue(write); !ok {
+				return true
+			}
+		}
+		if !action(key, value) {
+			stopped = key
+			return false
+		}
+		return true
+	})
+	if stopped == nil {
+		passBuffered(nil)
+	}
+
+	scan := keyRange{start: start, end: end}
+	if stopped != nil {
+		scan.end, scan.includeEnd = stopped, true
+	}
+	txn.m.mu.Lock()
+	txn.ranges = append(txn.ranges, scan)
+	txn.m.mu.Unlock()
+}
+
+// readsKey returns true if the transaction holds a SIREAD lock on the key,
+// m.mu must be held.
+func (txn *Txn) readsKey(key []byte) bool {
+	if _, ok := txn.reads[string(key)]; ok {
+		return true
+	}
+	for _, r := range txn.ranges {
+		if r.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// readsAnyWrite returns true if the transaction holds a SIREAD lock on a
+// key the other one writes, m.mu must be held.
+func (txn *Txn) readsAnyWrite(other *Txn) bool {
+	found := false
+	other.writes.Scan(nil, nil, bptree.ScanOptions{}, func(key, _ []byte) bool {
+		found = txn.readsKey(key)
+		return !found
+	})
+	return found
+}
+
+// Commit applies the writes of the transaction atomically at a new
+// timestamp. It returns ErrWriteConflict if a concurrent transaction
+// committed a write to a key it writes, and ErrSerialization if it
+// would be part of a dangerous structure.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	m := txn.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.end(txn)
+
+	for _, other := range m.committed {
+		if other.commit > txn.start && other.writesAny(txn) {
+			return ErrWriteConflict
+		}
+	}
+
+	// the rw-antidependencies from the concurrent transactions reading
+	// the keys written, and to the committed ones writing the keys read
+	var readers, writers []*Txn
+	for other := range m.active {
+		if other != txn && other.readsAnyWrite(txn) {
+			readers = append(readers, other)
+		}
+	}
+	for _, other := range m.committed {
+		if other.commit <= txn.start {
+			continue
+		}
+		if other.readsAnyWrite(txn) {
+			readers = append(readers, other)
+		}
+		if txn.readsAnyWrite(other) {
+			writers = append(writers, other)
+		}
+	}
+
+	in, out := txn.inConflict || len(readers) > 0, txn.outConflict || len(writers) > 0
+	if in && out {
+		return ErrSerialization
+	}
+	// a committed transaction can't abort anymore, this one does
+	for _, reader := range readers {
+		if reader.commit != 0 && reader.inConflict {
+			return ErrSerialization
+		}
+	}
+	for _, writer := range writers {
+		if writer.outConflict {
+			return ErrSerialization
+		}
+	}
+
+	txn.inConflict, txn.outConflict = in, out
+	for _, reader := range readers {
+		reader.outConflict = true
+	}
+	for _, writer := range writers {
+		writer.inConflict = true
+	}
+
+	// read-only commits take a timestamp too, so that
+	// the transactions they are concurrent with are known
+	m.clock++
+	txn.commit = m.clock
+	txn.writes.Scan(nil, nil, bptree.ScanOptions{}, func(key, write []byte) bool {
+		m.store.tree.Put(encodeKey(key, txn.commit), write)
+		return true
+	})
+	m.committed = append(m.committed, txn)
+	return nil
+}
+
+// writesAny returns true if both transactions write a key in common
+func (txn *Txn) writesAny(other *Txn) bool {
+	found := false
+	other.writes.Scan(nil, nil, bptree.ScanOptions{}, func(key, _ []byte) bool {
+		_, found = txn.writes.Get(key)
+		return !found
+	})
+	return found
+}
+
+// Rollback discards the transaction, it does nothing once the
+// transaction is done, so it may be deferred right after Begin.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.m.mu.Lock()
+	defer txn.m.mu.Unlock()
+	txn.m.end(txn)
+}
+
+// end retires the transaction and forgets the committed transactions
+// no active one is concurrent with anymore, m.mu must be held.
+func (m *TxnManager) end(txn *Txn) {
+	txn.done = true
+	delete(m.active, txn)
+
+	oldest := m.clock
+	for active := range m.active {
+		if active.start < oldest {
+			oldest = active.start
+		}
+	}
+	concurrent := m.committed[:0]
+	for _, committed := range m.committed {
+		if committed.commit > oldest {
+			concurrent = append(concurrent, committed)
+		}
+	}
+	for i := len(concurrent); i < len(m.committed); i++ {
+		m.committed[i] = nil
+	}
+	m.committed = concurrent
+}
@@ -0,0 +1,179 @@
+package mvcc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnSnapshot(t *testing.T) {
+	m, err := NewTxnManager()
+	assert.NoError(t, err)
+	setup := m.Begin()
+	setup.Put([]byte("a"), []byte("1"))
+	setup.Put([]byte("c"), []byte("3"))
+	assert.NoError(t, setup.Commit())
+	assert.ErrorIs(t, setup.Commit(), ErrTxnDone)
+	assert.Panics(t, func() { setup.Get([]byte("a")) })
+
+	reader, writer := m.Begin(), m.Begin()
+	writer.Put([]byte("b"), []byte("2"))
+	writer.Delete([]byte("a"))
+	assert.Equal(t, "b=2 c=3", scanned(writer, nil, nil))
+	assert.NoError(t, writer.Commit())
+
+	// the reader keeps its snapshot
+	value, ok := reader.Get([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	assert.Equal(t, "a=1 c=3", scanned(reader, nil, nil))
+	assert.NoError(t, reader.Commit())
+	assert.Empty(t, m.active)
+	assert.Empty(t, m.committed)
+
+	rolledBack := m.Begin()
+	rolledBack.Put([]byte("d"), []byte("4"))
+	rolledBack.Rollback()
+	rolledBack.Rollback()
+	assert.Equal(t, "b=2 c=3", scanned(m.Begin(), nil, nil))
+}
+
+func TestTxnWriteConflict(t *testing.T) {
+	m, _ := NewTxnManager()
+	first, second := m.Begin(), m.Begin()
+	first.Put([]byte("x"), []byte("1"))
+	second.Put([]byte("x"), []byte("2"))
+	assert.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), ErrWriteConflict)
+
+	// no conflict once the first one committed before
+	third := m.Begin()
+	third.Put([]byte("x"), []byte("3"))
+	assert.NoError(t, third.Commit())
+}
+
+func TestTxnWriteSkew(t *testing.T) {
+	m, _ := NewTxnManager()
+	setup := m.Begin()
+	setup.Put([]byte("alice"), []byte("on call"))
+	setup.Put([]byte("bob"), []byte("on call"))
+	assert.NoError(t, setup.Commit())
+
+	// each checks the other is on call before leaving,
+	// under snapshot isolation both would leave
+	first, second := m.Begin(), m.Begin()
+	first.Get([]byte("alice"))
+	first.Get([]byte("bob"))
+	second.Get([]byte("alice"))
+	second.Get([]byte("bob"))
+	first.Put([]byte("alice"), []byte("off"))
+	second.Put([]byte("bob"), []byte("off"))
+	assert.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), ErrSerialization)
+
+	// the same with a phantom, both count the rows of a range and insert
+	// into it, the first to commit while the other is active wins
+	first, second = m.Begin(), m.Begin()
+	assert.Equal(t, "alice=off bob=on call", scanned(first, nil, []byte("c")))
+	assert.Equal(t, "alice=off bob=on call", scanned(second, nil, []byte("c")))
+	first.Put([]byte("ann"), []byte("on call"))
+	second.Put([]byte("bill"), []byte("on call"))
+	assert.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), ErrSerialization)
+
+	// disjoint ranges don't conflict
+	first, second = m.Begin(), m.Begin()
+	scanned(first, []byte("a"), []byte("b"))
+	scanned(second, []byte("b"), []byte("c"))
+	first.Put([]byte("amy"), []byte("on call"))
+	second.Put([]byte("ben"), []byte("on call"))
+	assert.NoError(t, first.Commit())
+	assert.NoError(t, second.Commit())
+}
+
+func TestTxnDangerousStructureWithCommittedPivot(t *testing.T) {
+	m, _ := NewTxnManager()
+	setup := m.Begin()
+	setup.Put([]byte("x"), []byte("0"))
+	setup.Put([]byte("y"), []byte("0"))
+	assert.NoError(t, setup.Commit())
+
+	// in reads y which pivot writes, pivot reads x which out writes
+	in, pivot, out := m.Begin(), m.Begin(), m.Begin()
+	in.Get([]byte("y"))
+	pivot.Get([]byte("x"))
+	pivot.Put([]byte("y"), []byte("1"))
+	out.Put([]byte("x"), []byte("1"))
+	assert.NoError(t, pivot.Commit())
+	assert.NoError(t, in.Commit())
+	// the committed pivot can't abort anymore
+	assert.ErrorIs(t, out.Commit(), ErrSerialization)
+}
+
+func TestTxnConcurrentTransfers(t *testing.T) {
+	m, _ := NewTxnManager()
+	accounts, initial := 10, 10
+	account := func(i int) []byte {
+		return []byte(fmt.Sprintf("account%02d", i))
+	}
+	amount := func(value []byte) int {
+		return int(binary.BigEndian.Uint64(value))
+	}
+	encode := func(amount int) []byte {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(amount))
+		return value
+	}
+
+	setup := m.Begin()
+	for i := 0; i < accounts; i++ {
+		setup.Put(account(i), encode(initial))
+	}
+	assert.NoError(t, setup.Commit())
+
+	// withdrawals keep the sum of two accounts above 0,
+	// which write skew would break
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for done := 0; done < 200; {
+				from := r.Intn(accounts)
+				txn := m.Begin()
+				fromValue, _ := txn.Get(account(from))
+				pairValue, _ := txn.Get(account(from ^ 1))
+				// let the others interleave
+				runtime.Gosched()
+				if amount(fromValue)+amount(pairValue) > 0 {
+					txn.Put(account(from), encode(amount(fromValue)-1))
+				}
+				if txn.Commit() == nil {
+					done++
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	txn := m.Begin()
+	total := 0
+	txn.Scan(nil, nil, func(key, value []byte) bool {
+		total += amount(value)
+		return true
+	})
+	assert.NoError(t, txn.Commit())
+	assert.GreaterOrEqual(t, total, 0)
+	for i := 0; i < accounts; i += 2 {
+		first, _ := m.store.Get(account(i), m.clock)
+		second, _ := m.store.Get(account(i+1), m.clock)
+		assert.GreaterOrEqual(t, amount(first)+amount(second), 0)
+	}
+	assert.Empty(t, m.committed)
+}
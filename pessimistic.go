@@ -0,0 +1,159 @@
+package dreamingdb
+
+import (
+	"dreamingdb/bptree"
+)
+
+// PessimisticTxn is a transaction under strict two-phase locking. It locks
+// every key it reads shared and every key it writes exclusive before going
+// on, and holds the locks until it ends, so its commit never conflicts.
+// Waiting for a lock may fail with ErrDeadlock or ErrLockTimeout, which
+// roll the transaction back. Scans lock the keys they find but not the
+// gaps between them. A PessimisticTxn must not be used concurrently.
+type PessimisticTxn struct {
+	db *DB
+	id uint64
+
+	// the keys locked with their modes, released when the transaction ends
+	locked map[string]lockMode
+
+	// the buffered writes, a leading kind byte tells puts from deletions
+	writes *bptree.BPlusTree
+
+	done bool
+}
+
+// BeginPessimistic starts a pessimistic transaction.
+func (db *DB) BeginPessimistic() *PessimisticTxn {
+	writes := db.newWrites()
+	return &PessimisticTxn{
+		db:     db,
+		id:     db.nextTxnID(),
+		locked: make(map[string]lockMode),
+		writes: writes,
+	}
+}
+
+// mustBeActive panics if the transaction is done
+func (txn *PessimisticTxn) mustBeActive() {
+	if txn.done {
+		panic("transaction is already done")
+	}
+}
+
+// lock locks the key in the mode, or rolls the transaction back
+func (txn *PessimisticTxn) lock(key []byte, mode lockMode) error {
+	if held, ok := txn.locked[string(key)]; ok && held >= mode {
+		return nil
+	}
+	err := txn.db.locks.acquire(txn.id, string(key), mode, txn.db.lockTimeout)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	txn.locked[string(key)] = mode
+	return nil
+}
+
+// Get locks the key shared and returns its value and true, or nil and false
+// if the key doesn't exist. The transaction's own writes take precedence.
+func (txn *PessimisticTxn) Get(key []byte) ([]byte, bool, error) {
+	return txn.get(key, lockShared)
+}
+
+// GetForUpdate is Get locking the key exclusive, so that two transactions
+// reading a key to write it back queue up instead of deadlocking when both
+// upgrade their shared locks.
+func (txn *PessimisticTxn) GetForUpdate(key []byte) ([]byte, bool, error) {
+	return txn.get(key, lockExclusive)
+}
+
+func (txn *PessimisticTxn) get(key []byte, mode lockMode) ([]byte, bool, error) {
+	txn.mustBeActive()
+	if key == nil {
+		return nil, false, nil
+	}
+	if write, ok := txn.writes.Get(key); ok {
+		value, ok := decodeWrite(write)
+		return value, ok, nil
+	}
+
+	if err := txn.lock(key, mode); err != nil {
+		return nil, false, err
+	}
+	value, _, ok := txn.db.read(key)
+	return value, ok, nil
+}
+
+// Put locks the key exclusive and buffers a write of the value to it.
+func (txn *PessimisticTxn) Put(key, value []byte) error {
+	txn.mustBeActive()
+	if err := txn.lock(key, lockExclusive); err != nil {
+		return err
+	}
+	txn.writes.Put(key, append([]byte{kindPut}, value...))
+	return nil
+}
+
+// Delete locks the key exclusive and buffers a deletion of it.
+func (txn *PessimisticTxn) Delete(key []byte) error {
+	txn.mustBeActive()
+	if err := txn.lock(key, lockExclusive); err != nil {
+		return err
+	}
+	txn.writes.Put(key, []byte{kindDelete})
+	return nil
+}
+
+// Scan traverses the pairs of kv whose keys are in [start, end) in
+// ascending key order, merging the committed keys with the transaction's
+// own writes, and locks each committed key shared before passing it to
+// action. A nil start or end leaves that side of the range open. The
+// traversal stops as soon as action returns false.
+func (txn *PessimisticTxn) Scan(start, end []byte, action func(key, value []byte) bool) error {
+	txn.mustBeActive()
+	_, err := txn.db.mergeScan(txn.writes, start, end, func(key, _ []byte) ([]byte, bool, error) {
+		if err := txn.lock(key, lockShared); err != nil {
+			return nil, false, err
+		}
+		// the key may have changed while waiting for the lock
+		value, _, ok := txn.db.read(key)
+		return value, ok, nil
+	}, action)
+	return err
+}
+
+// Commit applies the writes of the transaction atomically and releases
+// its locks.
+func (txn *PessimisticTxn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	db := txn.db
+	db.commitLatch.Lock()
+	db.apply(txn.writes)
+	db.commitLatch.Unlock()
+	txn.end()
+	return nil
+}
+
+// Rollback discards the transaction and releases its locks, it does
+// nothing once the transaction is done, so it may be deferred right after
+// BeginPessimistic.
+func (txn *PessimisticTxn) Rollback() {
+	if !txn.done {
+		txn.end()
+	}
+}
+
+// end releases the locks of the transaction
+func (txn *PessimisticTxn) end() {
+	txn.done = true
+	txn.writes = nil
+	keys := make([]string, 0, len(txn.locked))
+	for key := range txn.locked {
+		keys = append(keys, key)
+	}
+	txn.db.locks.release(txn.id, keys)
+	txn.locked = nil
+}
@@ -0,0 +1,113 @@
+package dreamingdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPessimisticTxn(t *testing.T) {
+	db, _ := New()
+	txn := db.BeginPessimistic()
+	assert.NoError(t, txn.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, txn.Put([]byte("c"), []byte("3")))
+	assert.NoError(t, txn.Commit())
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	assert.Panics(t, func() { txn.Get([]byte("a")) })
+	assert.Empty(t, db.locks.locks)
+
+	txn = db.BeginPessimistic()
+	assert.NoError(t, txn.Put([]byte("b"), []byte("2")))
+	assert.NoError(t, txn.Delete([]byte("a")))
+	value, ok, err := txn.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("2"), value)
+	var pairs []string
+	assert.NoError(t, txn.Scan(nil, nil, func(key, value []byte) bool {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+		return true
+	}))
+	assert.Equal(t, []string{"b=2", "c=3"}, pairs)
+
+	// an optimistic commit can't write over the locks
+	other := db.Begin()
+	other.Put([]byte("c"), []byte("33"))
+	assert.ErrorIs(t, other.Commit(), ErrConflict)
+	other = db.Begin()
+	other.Put([]byte("d"), []byte("4"))
+	assert.NoError(t, other.Commit())
+
+	txn.Rollback()
+	txn.Rollback()
+	assert.Empty(t, db.locks.locks)
+	assert.Equal(t, 3, db.Size())
+}
+
+func TestPessimisticTxnLockErrors(t *testing.T) {
+	db, _ := New()
+	db.SetLockTimeout(20 * time.Millisecond)
+
+	first, second := db.BeginPessimistic(), db.BeginPessimistic()
+	_, _, err := first.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, second.Put([]byte("a"), []byte("1")), ErrLockTimeout)
+	assert.ErrorIs(t, second.Commit(), ErrTxnDone)
+	first.Rollback()
+
+	// each one waits for the key locked by the other
+	db.SetLockTimeout(0)
+	first, second = db.BeginPessimistic(), db.BeginPessimistic()
+	assert.NoError(t, first.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, second.Put([]byte("b"), []byte("2")))
+	done := make(chan error)
+	go func() {
+		done <- first.Put([]byte("b"), []byte("1"))
+	}()
+	waitFor(t, db.locks, first.id)
+	assert.ErrorIs(t, second.Put([]byte("a"), []byte("2")), ErrDeadlock)
+	assert.NoError(t, <-done)
+	assert.NoError(t, first.Commit())
+
+	value, _, _ := db.read([]byte("b"))
+	assert.Equal(t, []byte("1"), value)
+	assert.Empty(t, db.locks.locks)
+}
+
+func TestPessimisticTxnHotKey(t *testing.T) {
+	db, _ := New()
+	db.SetLockTimeout(0)
+	key := []byte("sku")
+	encode := func(stock uint64) []byte {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, stock)
+		return value
+	}
+	setup := db.BeginPessimistic()
+	assert.NoError(t, setup.Put(key, encode(100)))
+	assert.NoError(t, setup.Commit())
+
+	// every decrement commits, none of them aborts
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				txn := db.BeginPessimistic()
+				value, _, err := txn.GetForUpdate(key)
+				assert.NoError(t, err)
+				assert.NoError(t, txn.Put(key, encode(binary.BigEndian.Uint64(value)-1)))
+				assert.NoError(t, txn.Commit())
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _, _ := db.read(key)
+	assert.Equal(t, uint64(0), binary.BigEndian.Uint64(value))
+}
@@ -0,0 +1,287 @@
+package dreamingdb
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+
+	"dreamingdb/bptree"
+)
+
+var (
+	// ErrConflict is returned by Commit when a key the transaction read,
+	// or a range it scanned, was changed by a transaction committed since.
+	ErrConflict = errors.New("transaction conflicts with a committed one")
+
+	// ErrTxnDone is returned by Commit once the transaction
+	// has been committed or rolled back.
+	ErrTxnDone = errors.New("transaction is already done")
+)
+
+// Txn is an optimistic transaction. Its writes are buffered until Commit,
+// its reads see the committed keys overlaid with its own writes, and take
+// no latch. Commit validates that nothing it read has changed since and
+// applies its writes at once, otherwise it fails with ErrConflict and the
+// transaction may be retried. A Txn must not be used concurrently.
+type Txn struct {
+	db *DB
+	id uint64
+
+	// the versions of the committed keys read, 0 for
+	// the keys which have never been written
+	reads map[string]uint64
+
+	// the ranges scanned with the versions of the committed keys found
+	scans []scanRecord
+
+	// the buffered writes, a leading kind byte tells puts from deletions
+	writes *bptree.BPlusTree
+
+	done bool
+}
+
+// scanRecord is a scanned range of committed keys with their versions,
+// tombstones included
+type scanRecord struct {
+	start, end []byte
+
+	// whether the scan stopped at end, which it saw
+	includeEnd bool
+
+	keys     [][]byte
+	versions []uint64
+}
+
+const (
+	kindPut = iota
+	kindDelete
+)
+
+// Begin starts a transaction.
+func (db *DB) Begin() *Txn {
+	writes := db.newWrites()
+	return &Txn{
+		db:     db,
+		id:     db.nextTxnID(),
+		reads:  make(map[string]uint64),
+		writes: writes,
+	}
+}
+
+// mustBeActive panics if the transaction is done
+func (txn *Txn) mustBeActive() {
+	if txn.done {
+		panic("transaction is already done")
+	}
+}
+
+// Get returns the value of the key and true, or nil and false if the key
+// doesn't exist. The transaction's own writes take precedence.
+func (txn *Txn) Get(key []byte) ([]byte, bool) {
+	txn.mustBeActive()
+	if key == nil {
+		return nil, false
+	}
+	if write, ok := txn.writes.Get(key); ok {
+		return decodeWrite(write)
+	}
+
+	value, version, ok := txn.db.read(key)
+	if _, read := txn.reads[string(key)]; !read {
+		txn.reads[string(key)] = version
+	}
+	return value, ok
+}
+
+// Put buffers a write of the value to the key.
+func (txn *Txn) Put(key, value []byte) {
+	txn.mustBeActive()
+	txn.writes.Put(key, append([]byte{kindPut}, value...))
+}
+
+// Delete buffers a deletion of the key.
+func (txn *Txn) Delete(key []byte) {
+	txn.mustBeActive()
+	txn.writes.Put(key, []byte{kindDelete})
+}
+
+// decodeWrite returns the value of the buffered write and false for a deletion
+func decodeWrite(write []byte) ([]byte, bool) {
+	if write[0] == kindDelete {
+		return nil, false
+	}
+	return write[1:], true
+}
+
+// Scan traverses the pairs of kv whose keys are in [start, end) in
+// ascending key order, merging the committed keys with the transaction's
+// own writes. A nil start or end leaves that side of the range open. The
+// traversal stops as soon as action returns false, and only the part of
+// the range traversed is validated at commit.
+func (txn *Txn) Scan(start, end []byte, action func(key, value []byte) bool) {
+	txn.mustBeActive()
+	scan := scanRecord{start: start, end: end}
+	stopped, _ := txn.db.mergeScan(txn.writes, start, end, func(key, record []byte) ([]byte, bool, error) {
+		version, value, live := decodeRecord(record)
+		scan.keys = append(scan.keys, key)
+		scan.versions = append(scan.versions, version)
+		return value, live, nil
+	}, action)
+	if stopped != nil {
+		scan.end, scan.includeEnd = stopped, true
+	}
+	txn.scans = append(txn.scans, scan)
+}
+
+// mergeScan traverses the committed keys in [start, end) merged with the
+// buffered writes in the key order of the tree. committed turns a committed
+// key and its record into the value to merge, or false to skip the key. It
+// returns the key action stopped at, nil if the traversal ran to the end,
+// and the first error returned by committed, which stops the traversal.
+func (db *DB) mergeScan(writes *bptree.BPlusTree, start, end []byte,
+	committed func(key, record []byte) ([]byte, bool, error), action func(key, value []byte) bool) ([]byte, error) {
+	it, buffered := db.tree.Iterator(), writes.Iterator()
+	if start != nil {
+		it.Seek(start)
+		buffered.Seek(start)
+	}
+	inRange := func(it *bptree.Iterator) bool {
+		return it.Valid() && (end == nil || db.tree.Compare(it.Key(), end) < 0)
+	}
+
+	for {
+		hasCommitted, hasBuffered := inRange(it), inRange(buffered)
+		if !hasCommitted && !hasBuffered {
+			return nil, nil
+		}
+		cmp := -1
+		if hasCommitted && hasBuffered {
+			cmp = db.tree.Compare(it.Key(), buffered.Key())
+		} else if hasBuffered {
+			cmp = 1
+		}
+
+		var key, value []byte
+		live := true
+		if cmp <= 0 {
+			var record []byte
+			var err error
+			key, record = it.Next()
+			if value, live, err = committed(key, record); err != nil {
+				return nil, err
+			}
+		}
+		if cmp >= 0 {
+			var write []byte
+			key, write = buffered.Next()
+			value, live = decodeWrite(write)
+		}
+
+		if live && !action(key, value) {
+			return key, nil
+		}
+	}
+}
+
+// Commit validates the transaction and applies its writes atomically. It
+// returns ErrConflict if a key read or a range scanned has changed since,
+// or if a key written is locked by a PessimisticTxn.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+
+	db := txn.db
+	db.commitLatch.Lock()
+	defer db.commitLatch.Unlock()
+
+	if !txn.validate() {
+		return ErrConflict
+	}
+
+	// the keys locked by pessimistic transactions are off limits
+	var locked []string
+	defer func() {
+		db.locks.release(txn.id, locked)
+	}()
+	conflict := false
+	txn.writes.Scan(nil, nil, bptree.ScanOptions{}, func(key, _ []byte) bool {
+		if !db.locks.tryAcquire(txn.id, string(key), lockExclusive) {
+			conflict = true
+			return false
+		}
+		locked = append(locked, string(key))
+		return true
+	})
+	if conflict {
+		return ErrConflict
+	}
+
+	db.apply(txn.writes)
+	return nil
+}
+
+// newWrites returns an empty tree to buffer the writes of a transaction
+func (db *DB) newWrites() *bptree.BPlusTree {
+	writes, _ := bptree.NewBPlusTree(bptree.SetComparator(db.tree.Compare))
+	return writes
+}
+
+// apply writes the buffered writes with the version of a new commit,
+// the commit latch must be held. A deletion replaces the value of the
+// key by a tombstone, so the key doesn't go back to version 0.
+func (db *DB) apply(writes *bptree.BPlusTree) {
+	if writes.Size() == 0 {
+		return
+	}
+	db.version++
+	writes.Scan(nil, nil, bptree.ScanOptions{}, func(key, write []byte) bool {
+		_, _, wasLive := db.read(key)
+		_, live := decodeWrite(write)
+		if !wasLive && !live {
+			// the key stays deleted
+			return true
+		}
+		db.tree.Put(key, encodeRecord(db.version, write))
+		if live && !wasLive {
+			atomic.AddInt64(&db.size, 1)
+		} else if !live {
+			atomic.AddInt64(&db.size, -1)
+		}
+		return true
+	})
+}
+
+// validate returns true if the keys read and the ranges scanned still
+// hold the same versions, the commit latch must be held.
+func (txn *Txn) validate() bool {
+	for key, version := range txn.reads {
+		if _, current, _ := txn.db.read([]byte(key)); current != version {
+			return false
+		}
+	}
+
+	for _, scan := range txn.scans {
+		i := 0
+		valid := true
+		opts := bptree.ScanOptions{IncludeEnd: scan.includeEnd}
+		txn.db.tree.Scan(scan.start, scan.end, opts, func(key, record []byte) bool {
+			version, _, _ := decodeRecord(record)
+			valid = i < len(scan.keys) && bytes.Equal(key, scan.keys[i]) && version == scan.versions[i]
+			i++
+			return valid
+		})
+		if !valid || i != len(scan.keys) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rollback discards the transaction, it does nothing once the
+// transaction is done, so it may be deferred right after Begin.
+func (txn *Txn) Rollback() {
+	txn.done = true
+	txn.writes = nil
+}
@@ -0,0 +1,250 @@
+package dreamingdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"dreamingdb/bptree"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnReadYourWrites(t *testing.T) {
+	db, err := New()
+	assert.NoError(t, err)
+	txn := db.Begin()
+	txn.Put([]byte("a"), []byte("1"))
+	txn.Put([]byte("c"), []byte("3"))
+	assert.NoError(t, txn.Commit())
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	assert.Panics(t, func() { txn.Get([]byte("a")) })
+
+	txn = db.Begin()
+	defer txn.Rollback()
+	txn.Put([]byte("b"), []byte("2"))
+	txn.Put([]byte("c"), []byte("33"))
+	txn.Delete([]byte("a"))
+
+	_, ok := txn.Get([]byte("a"))
+	assert.False(t, ok)
+	value, ok := txn.Get([]byte("c"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("33"), value)
+	assert.Equal(t, "b=2 c=33", scanned(txn, nil, nil))
+	assert.Equal(t, "b=2", scanned(txn, []byte("a"), []byte("c")))
+
+	// nothing shows through before the commit
+	other := db.Begin()
+	assert.Equal(t, "a=1 c=3", scanned(other, nil, nil))
+	other.Rollback()
+
+	assert.NoError(t, txn.Commit())
+	assert.Equal(t, 2, db.Size())
+	other = db.Begin()
+	assert.Equal(t, "b=2 c=33", scanned(other, nil, nil))
+}
+
+func TestTxnRollback(t *testing.T) {
+	db, _ := New()
+	txn := db.Begin()
+	txn.Put([]byte("a"), []byte("1"))
+	txn.Rollback()
+	txn.Rollback()
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	assert.Equal(t, 0, db.Size())
+}
+
+func TestTxnConflicts(t *testing.T) {
+	db, _ := New()
+	setup := db.Begin()
+	setup.Put([]byte("x"), []byte("0"))
+	setup.Put([]byte("y"), []byte("0"))
+	assert.NoError(t, setup.Commit())
+
+	// both read x and write it, the second one to commit loses
+	first, second := db.Begin(), db.Begin()
+	first.Get([]byte("x"))
+	second.Get([]byte("x"))
+	first.Put([]byte("x"), []byte("1"))
+	second.Put([]byte("x"), []byte("2"))
+	assert.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), ErrConflict)
+
+	// blind writes don't conflict
+	first, second = db.Begin(), db.Begin()
+	first.Put([]byte("y"), []byte("1"))
+	second.Put([]byte("y"), []byte("2"))
+	assert.NoError(t, first.Commit())
+	assert.NoError(t, second.Commit())
+
+	// a missing key read is validated too
+	first, second = db.Begin(), db.Begin()
+	_, ok := first.Get([]byte("z"))
+	assert.False(t, ok)
+	first.Put([]byte("y"), []byte("3"))
+	second.Put([]byte("z"), []byte("1"))
+	assert.NoError(t, second.Commit())
+	assert.ErrorIs(t, first.Commit(), ErrConflict)
+
+	// a key put into a scanned range is a phantom
+	first, second = db.Begin(), db.Begin()
+	assert.Equal(t, "x=1", scanned(first, []byte("w"), []byte("y")))
+	first.Put([]byte("y"), []byte("4"))
+	second.Put([]byte("xx"), []byte("1"))
+	assert.NoError(t, second.Commit())
+	assert.ErrorIs(t, first.Commit(), ErrConflict)
+
+	// but not after where the scan stopped
+	first, second = db.Begin(), db.Begin()
+	first.Scan(nil, nil, func(key, value []byte) bool {
+		return false
+	})
+	first.Put([]byte("y"), []byte("5"))
+	second.Put([]byte("yy"), []byte("1"))
+	assert.NoError(t, second.Commit())
+	assert.NoError(t, first.Commit())
+}
+
+func TestTxnDeletedKeyKeepsItsVersion(t *testing.T) {
+	db, _ := New()
+	k, x, y := []byte("k"), []byte("x"), []byte("y")
+
+	// t1 reads k missing, t2 puts k, t3 reads k and y and writes x,
+	// t4 deletes k and t1 writes y, which would close the cycle
+	// t1 -> t2 -> t3 -> t1 if k went back to version 0 once deleted
+	t1 := db.Begin()
+	_, ok := t1.Get(k)
+	assert.False(t, ok)
+
+	t2 := db.Begin()
+	t2.Put(k, []byte("1"))
+	assert.NoError(t, t2.Commit())
+
+	t3 := db.Begin()
+	t3.Get(k)
+	t3.Get(y)
+	t3.Put(x, []byte("1"))
+	assert.NoError(t, t3.Commit())
+
+	t4 := db.Begin()
+	t4.Delete(k)
+	assert.NoError(t, t4.Commit())
+	assert.Equal(t, 1, db.Size())
+
+	t1.Put(y, []byte("1"))
+	assert.ErrorIs(t, t1.Commit(), ErrConflict)
+
+	// the same holds for a scan which saw no key
+	t1 = db.Begin()
+	assert.Equal(t, "", scanned(t1, []byte("j"), []byte("l")))
+	t2 = db.Begin()
+	t2.Put(k, []byte("2"))
+	assert.NoError(t, t2.Commit())
+	t4 = db.Begin()
+	t4.Delete(k)
+	assert.NoError(t, t4.Commit())
+	t1.Put(y, []byte("2"))
+	assert.ErrorIs(t, t1.Commit(), ErrConflict)
+
+	// tombstones are neither read nor scanned
+	txn := db.Begin()
+	_, ok = txn.Get(k)
+	assert.False(t, ok)
+	assert.Equal(t, "x=1", scanned(txn, nil, nil))
+	assert.Equal(t, 1, db.Size())
+}
+
+func TestTxnCustomComparator(t *testing.T) {
+	reverse := func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}
+	db, _ := New(bptree.SetComparator(reverse))
+	setup := db.Begin()
+	setup.Put([]byte("a"), []byte("1"))
+	setup.Put([]byte("c"), []byte("3"))
+	assert.NoError(t, setup.Commit())
+
+	txn := db.Begin()
+	txn.Put([]byte("b"), []byte("2"))
+	txn.Put([]byte("d"), []byte("4"))
+	assert.Equal(t, "d=4 c=3 b=2 a=1", scanned(txn, nil, nil))
+	assert.Equal(t, "c=3 b=2", scanned(txn, []byte("c"), []byte("a")))
+	assert.NoError(t, txn.Commit())
+	assert.Equal(t, 4, db.Size())
+}
+
+func TestTxnConcurrentTransfers(t *testing.T) {
+	db, _ := New()
+	accounts, initial := 10, 100
+	account := func(i int) []byte {
+		return []byte(fmt.Sprintf("account%02d", i))
+	}
+	amount := func(value []byte) int {
+		return int(binary.BigEndian.Uint64(value))
+	}
+	encode := func(amount int) []byte {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(amount))
+		return value
+	}
+
+	setup := db.Begin()
+	for i := 0; i < accounts; i++ {
+		setup.Put(account(i), encode(initial))
+	}
+	assert.NoError(t, setup.Commit())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for done := 0; done < 200; {
+				from, to := r.Intn(accounts), r.Intn(accounts)
+				txn := db.Begin()
+				fromValue, _ := txn.Get(account(from))
+				toValue, _ := txn.Get(account(to))
+				if from != to && amount(fromValue) > 0 {
+					txn.Put(account(from), encode(amount(fromValue)-1))
+					txn.Put(account(to), encode(amount(toValue)+1))
+				}
+				if txn.Commit() == nil {
+					done++
+				}
+			}
+		}(w)
+	}
+
+	// audits scanning every account always see the same total
+	for round := 0; round < 50; round++ {
+		txn := db.Begin()
+		total := 0
+		txn.Scan(nil, nil, func(key, value []byte) bool {
+			total += amount(value)
+			return true
+		})
+		if txn.Commit() == nil {
+			assert.Equal(t, accounts*initial, total)
+		}
+	}
+	wg.Wait()
+}
+
+// scanned returns the pairs of kv seen by the transaction
+// in the range as "key=value"
+func scanned(txn *Txn, start, end []byte) string {
+	var pairs string
+	txn.Scan(start, end, func(key, value []byte) bool {
+		if pairs != "" {
+			pairs += " "
+		}
+		pairs += fmt.Sprintf("%s=%s", key, value)
+		return true
+	})
+	return pairs
+}
@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A batch is logged as one record holding its writes in order, each one
+// a kind byte, the uvarint length of the key and the key, and for a put
+// the uvarint length of the value and the value.
+
+const (
+	kindPut = iota
+	kindDelete
+)
+
+var errBadBatch = errors.New("malformed batch")
+
+// Batch is a group of writes applied atomically by Tree.Write.
+type Batch struct {
+	payload []byte
+	count   int
+}
+
+// Put adds a write of the value to the key, a nil key is ignored.
+func (b *Batch) Put(key, value []byte) {
+	if key == nil {
+		return
+	}
+	b.payload = append(b.payload, kindPut)
+	b.payload = appendBytes(b.payload, key)
+	b.payload = appendBytes(b.payload, value)
+	b.count++
+}
+
+// Delete adds a deletion of the key, a nil key is ignored.
+func (b *Batch) Delete(key []byte) {
+	if key == nil {
+		return
+	}
+	b.payload = append(b.payload, kindDelete)
+	b.payload = appendBytes(b.payload, key)
+	b.count++
+}
+
+// Len returns the number of writes of the batch.
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Reset empties the batch for reuse.
+func (b *Batch) Reset() {
+	b.payload = b.payload[:0]
+	b.count = 0
+}
+
+func appendBytes(dst, b []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(b)))
+	return append(append(dst, length[:n]...), b...)
+}
+
+// readBytes reads a length prefixed slice from the start of data
+// and returns it with the rest of data.
+func readBytes(data []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return nil, nil, errBadBatch
+	}
+	end := n + int(length)
+	return data[n:end:end], data[end:], nil
+}
+
+// forEach calls put or del for every write of the logged batch in order
+func forEach(payload []byte, put func(key, value []byte), del func(key []byte)) error {
+	for len(payload) > 0 {
+		kind := payload[0]
+		key, rest, err := readBytes(payload[1:])
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case kindPut:
+			var value []byte
+			if value, rest, err = readBytes(rest); err != nil {
+				return err
+			}
+			put(key, value)
+		case kindDelete:
+			del(key)
+		default:
+			return errBadBatch
+		}
+		payload = rest
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package wal
+
+import (
+	"errors"
+	"time"
+)
+
+// Under SyncAlways, the records appended concurrently are committed as a
+// group. Appends queue their records and wait, while a single flusher
+// writes the records of the oldest group at once, syncs them with a single
+// fsync, and releases the appends of the group together. The appends made
+// while a group is synced form the next one, so the more appends wait on
+// the disk the larger the groups get.
+
+const (
+	defaultMaxGroupSize = 1024
+)
+
+// SetMaxGroupSize sets the number of records past which the records
+// appended go to the next group, 1 syncs every record on its own.
+func SetMaxGroupSize(size int) Option {
+	return func(c *config) error {
+		if size < 1 {
+			return errors.New("max group size must be positive")
+		}
+		c.maxGroupSize = size
+		return nil
+	}
+}
+
+// SetMaxGroupDelay sets how long the flusher waits for more records to
+// fill up a group before syncing it. A delay trades the latency of lone
+// appends for larger groups, there is none by default.
+func SetMaxGroupDelay(delay time.Duration) Option {
+	return func(c *config) error {
+		if delay < 0 {
+			return errors.New("max group delay can't be negative")
+		}
+		c.maxGroupDelay = delay
+		return nil
+	}
+}
+
+// group is records synced together
+type group struct {
+	records []byte
+	count   int
+
+	// closed once the records are synced, or err is set
+	done chan struct{}
+	err  error
+}
+
+// wait waits until the records of the group are synced, a nil group has
+// nothing to wait for.
+func (g *group) wait() error {
+	if g == nil {
+		return nil
+	}
+	<-g.done
+	return g.err
+}
+
+// Stats are the counters of the group commit of a log.
+type Stats struct {
+	// the number of groups synced and of records in them
+	Groups, Records uint64
+}
+
+// AverageGroupSize returns the mean number of records synced together.
+func (s Stats) AverageGroupSize() float64 {
+	if s.Groups == 0 {
+		return 0
+	}
+	return float64(s.Records) / float64(s.Groups)
+}
+
+// Stats returns the counters of the group commit, which only runs under
+// SyncAlways.
+func (l *Log) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{Groups: l.groups, Records: l.records}
+}
+
+// enqueue adds the record to the last group of the queue, or to a new
+// group if it is full, and wakes the flusher up.
+func (l *Log) enqueue(record []byte) (*group, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	var g *group
+	if n := len(l.queue); n > 0 && l.queue[n-1].count < l.config.maxGroupSize {
+		g = l.queue[n-1]
+	} else {
+		g = &group{done: make(chan struct{})}
+		l.queue = append(l.queue, g)
+	}
+	g.records = appendRecord(g.records, record)
+	g.count++
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return g, nil
+}
+
+// flushGroups flushes the queued groups in order until the log is closed
+func (l *Log) flushGroups() {
+	defer close(l.done)
+	for {
+		stopped := false
+		select {
+		case <-l.wake:
+			l.gather()
+		case <-l.stop:
+			stopped = true
+		}
+		for g := l.dequeue(); g != nil; g = l.dequeue() {
+			l.flush(g)
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// gather waits for the first group to fill up, for the max group
+// delay at most.
+func (l *Log) gather() {
+	if l.config.maxGroupDelay == 0 {
+		return
+	}
+	timer := time.NewTimer(l.config.maxGroupDelay)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		full := len(l.queue) > 0 && l.queue[0].count >= l.config.maxGroupSize
+		l.mu.Unlock()
+		if full {
+			return
+		}
+		select {
+		case <-l.wake:
+		case <-timer.C:
+			return
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// dequeue returns the oldest group of the queue, or nil if it's empty
+func (l *Log) dequeue() *group {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) == 0 {
+		return nil
+	}
+	g := l.queue[0]
+	l.queue[0] = nil
+	l.queue = l.queue[1:]
+	return g
+}
+
+// flush writes and syncs the records of the group and releases its appends
+func (l *Log) flush(g *group) {
+	l.mu.Lock()
+	err := l.err
+	l.mu.Unlock()
+	if err == nil {
+		l.ioLatch.Lock()
+		if err = l.write(g.records); err == nil {
+			err = l.sync()
+		}
+		l.ioLatch.Unlock()
+	}
+
+	l.mu.Lock()
+	if err == nil {
+		l.groups++
+		l.records += uint64(g.count)
+	} else if l.err == nil {
+		l.err = err
+	}
+	l.mu.Unlock()
+
+	g.err = err
+	close(g.done)
+}
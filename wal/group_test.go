@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLog(dir, replayInto(nil), SetMaxGroupDelay(5*time.Millisecond), SetMaxGroupSize(16))
+	assert.NoError(t, err)
+	writers, appends := 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				assert.NoError(t, l.Append([]byte(fmt.Sprintf("%d %02d", w, i))))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(writers*appends), stats.Records)
+	assert.Greater(t, stats.AverageGroupSize(), 1.0)
+	assert.LessOrEqual(t, stats.AverageGroupSize(), 16.0)
+	assert.NoError(t, l.Close())
+
+	// the records of every writer are logged in order
+	var records []string
+	l, _ = OpenLog(dir, replayInto(&records))
+	assert.Len(t, records, writers*appends)
+	next := make([]int, writers)
+	for _, record := range records {
+		var w, i int
+		fmt.Sscanf(record, "%d %d", &w, &i)
+		assert.Equal(t, next[w], i)
+		next[w]++
+	}
+	assert.NoError(t, l.Close())
+}
+
+func TestGroupCommitMaxGroupSize(t *testing.T) {
+	l, _ := OpenLog(t.TempDir(), replayInto(nil), SetMaxGroupSize(1))
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				assert.NoError(t, l.Append([]byte("record")))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, Stats{Groups: 40, Records: 40}, l.Stats())
+	assert.Equal(t, 1.0, l.Stats().AverageGroupSize())
+	assert.NoError(t, l.Close())
+
+	assert.Equal(t, 0.0, Stats{}.AverageGroupSize())
+	_, err := OpenLog(t.TempDir(), replayInto(nil), SetMaxGroupSize(0))
+	assert.Error(t, err)
+	_, err = OpenLog(t.TempDir(), replayInto(nil), SetMaxGroupDelay(-1))
+	assert.Error(t, err)
+}
+
+func TestGroupCommitFailure(t *testing.T) {
+	l, _ := OpenLog(t.TempDir(), replayInto(nil))
+	assert.NoError(t, l.Append([]byte("record")))
+
+	// a failed write fails the log for good
+	l.segment.Close()
+	err := l.Append([]byte("record"))
+	assert.Error(t, err)
+	assert.Equal(t, err, l.Append([]byte("record")))
+	assert.Equal(t, Stats{Groups: 1, Records: 1}, l.Stats())
+	l.Close()
+}
+
+func TestTreeGroupCommitAppliesSyncedWrites(t *testing.T) {
+	tree, _ := Open(t.TempDir())
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+
+	// a write isn't visible until its group is synced
+	tree.log.ioLatch.Lock()
+	done := make(chan error)
+	go func() {
+		done <- tree.Put([]byte("b"), []byte("2"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, ok := tree.Get([]byte("b"))
+	assert.False(t, ok)
+	tree.log.ioLatch.Unlock()
+	assert.NoError(t, <-done)
+	_, ok = tree.Get([]byte("b"))
+	assert.True(t, ok)
+
+	// nor ever if logging it fails
+	tree.log.segment.Close()
+	assert.Error(t, tree.Put([]byte("c"), []byte("3")))
+	assert.Error(t, tree.Delete([]byte("a")))
+	_, ok = tree.Get([]byte("c"))
+	assert.False(t, ok)
+	assert.Equal(t, 2, tree.Size())
+	tree.Close()
+}
+
+func TestTreeGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	tree, _ := Open(dir, SetMaxGroupDelay(5*time.Millisecond))
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				assert.NoError(t, tree.Put([]byte(fmt.Sprintf("%d %d", w, i)), []byte("value")))
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Greater(t, tree.Stats().AverageGroupSize(), 1.0)
+	assert.NoError(t, tree.Close())
+
+	tree, _ = Open(dir)
+	assert.Equal(t, 80, tree.Size())
+	assert.NoError(t, tree.Close())
+}
@@ -0,0 +1,534 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dreamingdb/bptree"
+)
+
+// A log is a directory of segment files named after their sequence number,
+// each one a run of records. A record is the big endian length of its
+// payload, the CRC-32C of the payload, and the payload. After every sync,
+// the mark file of the log records the last segment and its size synced,
+// its CRC-32C following them. A crash may damage any record written to the
+// last segment past the mark, as the flusher writes several records at
+// once, the segment is truncated at the first one when the log is opened.
+// A damaged record before the mark, or in another segment, corrupts the
+// log.
+
+const (
+	segmentSuffix = ".wal"
+	headerLen     = 8
+
+	markFile = "mark"
+	markLen  = 8 + 8 + 4
+
+	defaultSegmentSize  = 64 << 20
+	defaultSyncInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrCorrupted is returned when opening a log whose records are
+	// damaged where a crash can't have torn them, before the mark.
+	ErrCorrupted = errors.New("corrupted log")
+
+	// ErrEmptyRecord is returned when appending an empty record.
+	ErrEmptyRecord = errors.New("empty record")
+
+	// ErrClosed is returned when using a closed log.
+	ErrClosed = errors.New("log is closed")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SyncPolicy tells when the appended records are synced to the disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs every record before Append returns, a record
+	// appended survives a crash of the machine.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs in the background every sync interval, a crash
+	// of the machine loses the records of the last interval at most.
+	SyncInterval
+
+	// SyncNever leaves syncing to the operating system, the records
+	// survive a crash of the process but not of the machine.
+	SyncNever
+)
+
+// config holds the options of a log and of the tree over it
+type config struct {
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	segmentSize  int64
+	treeOptions  []bptree.Option
+
+	// bound the groups of records synced together under SyncAlways
+	maxGroupSize  int
+	maxGroupDelay time.Duration
+}
+
+type Option func(c *config) error
+
+// SetSyncPolicy sets when the records are synced, SyncAlways by default.
+func SetSyncPolicy(policy SyncPolicy) Option {
+	return func(c *config) error {
+		if policy < SyncAlways || policy > SyncNever {
+			return errors.New("unknown sync policy")
+		}
+		c.syncPolicy = policy
+		return nil
+	}
+}
+
+// SetSyncInterval sets how often the records are synced under SyncInterval
+func SetSyncInterval(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval <= 0 {
+			return errors.New("sync interval must be positive")
+		}
+		c.syncInterval = interval
+		return nil
+	}
+}
+
+// SetSegmentSize sets the size past which the log moves on to a new segment
+func SetSegmentSize(size int64) Option {
+	return func(c *config) error {
+		if size <= headerLen {
+			return errors.New("segment size is too small")
+		}
+		c.segmentSize = size
+		return nil
+	}
+}
+
+// SetTreeOptions sets the options of the tree built by Open
+func SetTreeOptions(options ...bptree.Option) Option {
+	return func(c *config) error {
+		c.treeOptions = options
+		return nil
+	}
+}
+
+func newConfig(options []Option) (*config, error) {
+	c := &config{
+		syncPolicy:   SyncAlways,
+		syncInterval: defaultSyncInterval,
+		segmentSize:  defaultSegmentSize,
+		maxGroupSize: defaultMaxGroupSize,
+	}
+	for _, opt := range options {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Log is a write-ahead log of records, safe for concurrent use. Under
+// SyncAlways the records appended concurrently are synced together, see
+// group commit.
+type Log struct {
+	dir    string
+	config *config
+
+	// guards the segment, appends write to it under SyncInterval and
+	// SyncNever, and the flusher under SyncAlways
+	ioLatch sync.Mutex
+
+	// the segment appended to, its sequence number and size
+	segment *os.File
+	seq     uint64
+	size    int64
+
+	// the mark file, which is not synced itself: a crash may leave it
+	// behind the segments, never ahead of them
+	mark *os.File
+
+	// whether records were appended since the last sync
+	dirty bool
+
+	// guards the fields below
+	mu sync.Mutex
+
+	// the groups of records waiting for the flusher
+	queue []*group
+
+	// the first error writing or syncing the log, which fails it for good
+	err error
+
+	// the number of groups flushed and of records in them
+	groups, records uint64
+
+	closed bool
+
+	// wakes the flusher up
+	wake chan struct{}
+
+	// stop and done the background goroutine
+	stop, done chan struct{}
+}
+
+// OpenLog opens the log in dir, creating it if needed. It passes every
+// record of the log to replay in order, truncating a torn tail, before
+// the log accepts new records.
+func OpenLog(dir string, replay func(record []byte) error, options ...Option) (*Log, error) {
+	c, err := newConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	seqs, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir: dir, config: c}
+	markSeq, markSize := readMark(dir)
+	for i, seq := range seqs {
+		// the segments before the last were complete once the log moved on
+		synced := int64(math.MaxInt64)
+		if i == len(seqs)-1 {
+			synced = 0
+			if seq == markSeq {
+				synced = markSize
+			}
+		}
+		size, err := l.replaySegment(seq, synced, replay)
+		if err != nil {
+			return nil, err
+		}
+		l.seq, l.size = seq, size
+	}
+	if len(seqs) == 0 {
+		l.seq = 1
+	}
+	l.segment, err = os.OpenFile(l.path(l.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l.mark, err = os.OpenFile(filepath.Join(dir, markFile), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		l.segment.Close()
+		return nil, err
+	}
+	if len(seqs) == 0 {
+		if err := syncDir(dir); err != nil {
+			l.segment.Close()
+			l.mark.Close()
+			return nil, err
+		}
+	}
+
+	switch c.syncPolicy {
+	case SyncAlways:
+		l.wake = make(chan struct{}, 1)
+		l.stop, l.done = make(chan struct{}), make(chan struct{})
+		go l.flushGroups()
+	case SyncInterval:
+		l.stop, l.done = make(chan struct{}), make(chan struct{})
+		go l.syncPeriodically()
+	}
+	return l, nil
+}
+
+// segments returns the sequence numbers of the segments in dir in order
+func segments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		var seq uint64
+		if _, err := fmt.Sscanf(name, "%d"+segmentSuffix, &seq); err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs, nil
+}
+
+func (l *Log) path(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// replaySegment passes the records of the segment to replay and returns
+// its size. A damaged record past the synced size may have been torn by a
+// crash, the segment is truncated there, one before corrupts the log.
+func (l *Log) replaySegment(seq uint64, synced int64, replay func(record []byte) error) (int64, error) {
+	data, err := os.ReadFile(l.path(seq))
+	if err != nil {
+		return 0, err
+	}
+	offset := 0
+	for offset < len(data) {
+		record, ok := decodeRecord(data[offset:])
+		if !ok {
+			if int64(offset) < synced {
+				return 0, fmt.Errorf("%w: segment %d at %d", ErrCorrupted, seq, offset)
+			}
+			if err := truncate(l.path(seq), int64(offset)); err != nil {
+				return 0, err
+			}
+			break
+		}
+		if err := replay(record); err != nil {
+			return 0, err
+		}
+		offset += headerLen + len(record)
+	}
+	return int64(offset), nil
+}
+
+// decodeRecord returns the payload of the record at the start of data,
+// and false if it is torn or damaged.
+func decodeRecord(data []byte) ([]byte, bool) {
+	if len(data) < headerLen {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint32(data)
+	if length == 0 || uint64(length) > uint64(len(data)-headerLen) {
+		return nil, false
+	}
+	payload := data[headerLen : headerLen+int(length)]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// readMark returns the segment and its size recorded by the mark file
+// in dir, or zeros if there is none or it is damaged.
+func readMark(dir string) (uint64, int64) {
+	mark, err := os.ReadFile(filepath.Join(dir, markFile))
+	if err != nil || len(mark) != markLen ||
+		crc32.Checksum(mark[:16], crcTable) != binary.BigEndian.Uint32(mark[16:]) {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(mark), int64(binary.BigEndian.Uint64(mark[8:]))
+}
+
+// writeMark records the size of the segment as synced,
+// l.ioLatch must be held.
+func (l *Log) writeMark() error {
+	var mark [markLen]byte
+	binary.BigEndian.PutUint64(mark[:], l.seq)
+	binary.BigEndian.PutUint64(mark[8:], uint64(l.size))
+	binary.BigEndian.PutUint32(mark[16:], crc32.Checksum(mark[:16], crcTable))
+	_, err := l.mark.WriteAt(mark[:], 0)
+	return err
+}
+
+// appendRecord appends the record of the payload to dst
+func appendRecord(dst, payload []byte) []byte {
+	var header [headerLen]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+	return append(append(dst, header[:]...), payload...)
+}
+
+func truncate(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the entries of the directory, so created files survive
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// Append appends the record to the log, and syncs it under SyncAlways.
+// Once writing or syncing the log fails, every Append returns the error.
+func (l *Log) Append(record []byte) error {
+	g, err := l.submit(record)
+	if err != nil {
+		return err
+	}
+	return g.wait()
+}
+
+// submit queues the record for the flusher under SyncAlways and returns
+// its group, otherwise it writes the record and returns a nil group.
+// The records are logged in the order they are submitted.
+func (l *Log) submit(record []byte) (*group, error) {
+	if len(record) == 0 {
+		return nil, ErrEmptyRecord
+	}
+	if l.config.syncPolicy == SyncAlways {
+		return l.enqueue(record)
+	}
+
+	l.ioLatch.Lock()
+	defer l.ioLatch.Unlock()
+	if err := l.check(); err != nil {
+		return nil, err
+	}
+	err := l.write(appendRecord(nil, record))
+	l.fail(err)
+	return nil, err
+}
+
+// check returns the error appends fail with, if any
+func (l *Log) check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.err
+}
+
+// fail fails the log for good if err isn't nil
+func (l *Log) fail(err error) {
+	if err == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+// write writes the records to the segment, moving on to a new segment
+// first if the current one is full. l.ioLatch must be held.
+func (l *Log) write(records []byte) error {
+	if l.size > 0 && l.size+int64(len(records)) > l.config.segmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.segment.Write(records)
+	l.size += int64(n)
+	l.dirty = l.dirty || n > 0
+	return err
+}
+
+// rotate closes the current segment and creates the next one,
+// l.ioLatch must be held.
+func (l *Log) rotate() error {
+	if l.config.syncPolicy != SyncNever {
+		if err := l.sync(); err != nil {
+			return err
+		}
+	}
+	if err := l.segment.Close(); err != nil {
+		return err
+	}
+	segment, err := os.OpenFile(l.path(l.seq+1), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	l.segment, l.seq, l.size = segment, l.seq+1, 0
+	return syncDir(l.dir)
+}
+
+// sync syncs the segment if records were appended since the last sync,
+// l.ioLatch must be held.
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.segment.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return l.writeMark()
+}
+
+// Sync syncs the records appended so far whatever the sync policy.
+func (l *Log) Sync() error {
+	l.ioLatch.Lock()
+	defer l.ioLatch.Unlock()
+	if err := l.check(); err != nil {
+		return err
+	}
+	err := l.sync()
+	l.fail(err)
+	return err
+}
+
+func (l *Log) syncPeriodically() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.config.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a failed sync fails the log,
+			// which the next append reports
+			l.Sync()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Close syncs the log and closes it.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	// the flusher drains the queue before it stops
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+	l.ioLatch.Lock()
+	defer l.ioLatch.Unlock()
+	err := l.sync()
+	if closeErr := l.segment.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := l.mark.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLog(dir, replayInto(nil), SetSegmentSize(64))
+	assert.NoError(t, err)
+	var expected []string
+	for i := 0; i < 20; i++ {
+		record := fmt.Sprintf("record %02d", i)
+		assert.NoError(t, l.Append([]byte(record)))
+		expected = append(expected, record)
+	}
+	assert.ErrorIs(t, l.Append(nil), ErrEmptyRecord)
+	assert.NoError(t, l.Close())
+	assert.ErrorIs(t, l.Close(), ErrClosed)
+	assert.ErrorIs(t, l.Append([]byte("late")), ErrClosed)
+
+	// 17 bytes a record, 3 records a segment, and the mark
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 8)
+
+	var records []string
+	l, err = OpenLog(dir, replayInto(&records), SetSegmentSize(64))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, records)
+	assert.NoError(t, l.Append([]byte("record 20")))
+	assert.NoError(t, l.Close())
+
+	records = nil
+	l, err = OpenLog(dir, replayInto(&records))
+	assert.NoError(t, err)
+	assert.Equal(t, append(expected, "record 20"), records)
+	assert.NoError(t, l.Close())
+}
+
+func TestLogTornTail(t *testing.T) {
+	for _, tear := range []struct {
+		name string
+		tear func(data []byte) []byte
+	}{
+		{"header", func(data []byte) []byte { return data[:len(data)-12] }},
+		{"payload", func(data []byte) []byte { return data[:len(data)-2] }},
+		{"checksum", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xFF
+			return data
+		}},
+		{"zeros", func(data []byte) []byte { return append(data[:32], make([]byte, 16)...) }},
+	} {
+		t.Run(tear.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, _ := OpenLog(dir, replayInto(nil), SetSyncPolicy(SyncNever))
+			for i := 0; i < 3; i++ {
+				assert.NoError(t, l.Append([]byte(fmt.Sprintf("record %d", i))))
+			}
+			crash(l)
+
+			path := filepath.Join(dir, fmt.Sprintf("%020d.wal", 1))
+			data, _ := os.ReadFile(path)
+			assert.NoError(t, os.WriteFile(path, tear.tear(data), 0o644))
+
+			var records []string
+			l, err := OpenLog(dir, replayInto(&records))
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"record 0", "record 1"}, records)
+			assert.NoError(t, l.Append([]byte("record 3")))
+			assert.NoError(t, l.Close())
+
+			records = nil
+			l, _ = OpenLog(dir, replayInto(&records))
+			assert.Equal(t, []string{"record 0", "record 1", "record 3"}, records)
+			assert.NoError(t, l.Close())
+		})
+	}
+}
+
+func TestLogCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenLog(dir, replayInto(nil), SetSegmentSize(32))
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, l.Append([]byte(fmt.Sprintf("record %d", i))))
+	}
+	assert.NoError(t, l.Close())
+
+	// only the last segment may be torn
+	path := filepath.Join(dir, fmt.Sprintf("%020d.wal", 1))
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	_, err := OpenLog(dir, replayInto(nil))
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestLogCorruptedLastSegment(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenLog(dir, replayInto(nil))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, l.Append([]byte(fmt.Sprintf("record %d", i))))
+	}
+	assert.NoError(t, l.Close())
+
+	// a crash can't damage the records synced
+	path := filepath.Join(dir, fmt.Sprintf("%020d.wal", 1))
+	data, _ := os.ReadFile(path)
+	for _, offset := range []int{2*16 + 12, 2*16 + 3} {
+		damaged := append([]byte(nil), data...)
+		damaged[offset] ^= 0x01
+		assert.NoError(t, os.WriteFile(path, damaged, 0o644))
+		_, err := OpenLog(dir, replayInto(nil))
+		assert.ErrorIs(t, err, ErrCorrupted)
+
+		// and the log is left as it was
+		after, _ := os.ReadFile(path)
+		assert.Equal(t, damaged, after)
+	}
+}
+
+func TestLogTornGroup(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenLog(dir, replayInto(nil))
+	assert.NoError(t, l.Append([]byte("record 0")))
+
+	// the flusher writes a group of two records, and the
+	// machine crashes before they are synced
+	l.ioLatch.Lock()
+	assert.NoError(t, l.write(appendRecord(appendRecord(nil, []byte("record 1")), []byte("record 2"))))
+	l.ioLatch.Unlock()
+	crash(l)
+
+	// the first record of the group is damaged, the second one isn't
+	path := filepath.Join(dir, fmt.Sprintf("%020d.wal", 1))
+	data, _ := os.ReadFile(path)
+	data[16+headerLen] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+
+	var records []string
+	l, err := OpenLog(dir, replayInto(&records))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"record 0"}, records)
+	assert.NoError(t, l.Append([]byte("record 3")))
+	assert.NoError(t, l.Close())
+
+	// once synced, the same damage corrupts the log
+	data, _ = os.ReadFile(path)
+	data[16+headerLen] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	_, err = OpenLog(dir, replayInto(nil))
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestLogSyncPolicies(t *testing.T) {
+	for _, options := range [][]Option{
+		{SetSyncPolicy(SyncAlways)},
+		{SetSyncPolicy(SyncInterval), SetSyncInterval(time.Millisecond)},
+		{SetSyncPolicy(SyncNever)},
+	} {
+		dir := t.TempDir()
+		l, err := OpenLog(dir, replayInto(nil), options...)
+		assert.NoError(t, err)
+		assert.NoError(t, l.Append([]byte("record")))
+		if l.stop != nil {
+			// the background sync catches up
+			assert.Eventually(t, func() bool {
+				l.ioLatch.Lock()
+				defer l.ioLatch.Unlock()
+				return !l.dirty
+			}, time.Second, time.Millisecond)
+		}
+		assert.NoError(t, l.Sync())
+		assert.NoError(t, l.Close())
+
+		var records []string
+		l, _ = OpenLog(dir, replayInto(&records), options...)
+		assert.Equal(t, []string{"record"}, records)
+		assert.NoError(t, l.Close())
+	}
+
+	_, err := OpenLog(t.TempDir(), replayInto(nil), SetSyncPolicy(SyncNever+1))
+	assert.Error(t, err)
+	_, err = OpenLog(t.TempDir(), replayInto(nil), SetSyncInterval(0))
+	assert.Error(t, err)
+	_, err = OpenLog(t.TempDir(), replayInto(nil), SetSegmentSize(8))
+	assert.Error(t, err)
+}
+
+// crash closes the files of the log as a crash of the machine would leave
+// them, neither syncing the records appended nor marking them synced
+func crash(l *Log) {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+	l.segment.Close()
+	l.mark.Close()
+}
+
+// replayInto returns a replay collecting the records into records
+func replayInto(records *[]string) func(record []byte) error {
+	return func(record []byte) error {
+		if records != nil {
+			*records = append(*records, string(record))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+package wal
+
+import (
+	"sync"
+
+	"dreamingdb/bptree"
+)
+
+// Tree is a BPlusTree whose writes are appended to a log before they are
+// applied, so Open rebuilds it as it was. Writes are safe for concurrent
+// use, reads concurrent with writes need a concurrent mode of the tree set
+// with SetTreeOptions.
+type Tree struct {
+	tree *bptree.BPlusTree
+	log  *Log
+
+	// keeps the order of the writes in the log the same as the tickets
+	writeLatch sync.Mutex
+
+	// the ticket of the next write submitted to the log, guarded by
+	// writeLatch, and of the next write to apply, guarded by applyLatch
+	submitted, applied uint64
+
+	// serializes the writes to the tree in the order of their tickets
+	applyLatch sync.Mutex
+	turn       *sync.Cond
+}
+
+// Open opens the tree logged in dir, creating the directory if needed,
+// and replays the log into a new tree.
+func Open(dir string, options ...Option) (*Tree, error) {
+	c, err := newConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := bptree.NewBPlusTree(c.treeOptions...)
+	if err != nil {
+		return nil, err
+	}
+	log, err := OpenLog(dir, func(record []byte) error {
+		return apply(tree, record)
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree{tree: tree, log: log}
+	t.turn = sync.NewCond(&t.applyLatch)
+	return t, nil
+}
+
+// apply applies the writes of the logged batch to the tree
+func apply(tree *bptree.BPlusTree, payload []byte) error {
+	return forEach(payload, func(key, value []byte) {
+		tree.Put(key, value)
+	}, func(key []byte) {
+		tree.Delete(key)
+	})
+}
+
+// Put writes the value to the key.
+func (t *Tree) Put(key, value []byte) error {
+	var b Batch
+	b.Put(key, value)
+	return t.Write(&b)
+}
+
+// Delete deletes the key.
+func (t *Tree) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return t.Write(&b)
+}
+
+// Write logs the writes of the batch as one record and applies them in
+// order. After a crash either all of them are replayed or none. The writes
+// are only applied once they are logged, synced under SyncAlways, so
+// readers never see writes a crash would lose, and nothing is applied if
+// logging fails.
+func (t *Tree) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	t.writeLatch.Lock()
+	g, err := t.log.submit(b.payload)
+	if err != nil {
+		t.writeLatch.Unlock()
+		return err
+	}
+	ticket := t.submitted
+	t.submitted++
+	t.writeLatch.Unlock()
+
+	// the sync is waited for outside the latch, so
+	// that concurrent writes join the same group
+	err = g.wait()
+
+	// the writes are applied in the order they are logged. Once a group
+	// fails, the log fails every later one, so no write applied is missing
+	// from the log.
+	t.applyLatch.Lock()
+	defer t.applyLatch.Unlock()
+	for t.applied != ticket {
+		t.turn.Wait()
+	}
+	if err == nil {
+		err = apply(t.tree, b.payload)
+	}
+	t.applied++
+	t.turn.Broadcast()
+	return err
+}
+
+// Get returns the value of the key and true, or nil and false if the key
+// doesn't exist.
+func (t *Tree) Get(key []byte) ([]byte, bool) {
+	return t.tree.Get(key)
+}
+
+// Scan is BPlusTree.Scan.
+func (t *Tree) Scan(start, end []byte, opts bptree.ScanOptions, action func(key, value []byte) bool) {
+	t.tree.Scan(start, end, opts, action)
+}
+
+// Iterator is BPlusTree.Iterator.
+func (t *Tree) Iterator() *bptree.Iterator {
+	return t.tree.Iterator()
+}
+
+// Size returns the number of keys.
+func (t *Tree) Size() int {
+	return t.tree.Size()
+}
+
+// Stats returns the counters of the group commit of the log.
+func (t *Tree) Stats() Stats {
+	return t.log.Stats()
+}
+
+// Sync syncs the writes logged so far whatever the sync policy.
+func (t *Tree) Sync() error {
+	return t.log.Sync()
+}
+
+// Close syncs and closes the log, the tree must not be used afterwards.
+func (t *Tree) Close() error {
+	return t.log.Close()
+}
@@ -0,0 +1,111 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"dreamingdb/bptree"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeReopen(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := Open(dir, SetTreeOptions(bptree.SetOrder(3)))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, tree.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(t, tree.Delete([]byte(fmt.Sprintf("%03d", i))))
+	}
+	var b Batch
+	b.Put([]byte("001"), []byte("one"))
+	b.Delete([]byte("003"))
+	b.Put(nil, []byte("ignored"))
+	b.Put([]byte("100"), []byte("100"))
+	assert.Equal(t, 3, b.Len())
+	assert.NoError(t, tree.Write(&b))
+	b.Reset()
+	assert.NoError(t, tree.Write(&b))
+	assert.NoError(t, tree.Close())
+
+	tree, err = Open(dir, SetTreeOptions(bptree.SetOrder(3)))
+	assert.NoError(t, err)
+	assert.Equal(t, 50, tree.Size())
+	value, ok := tree.Get([]byte("001"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("one"), value)
+	_, ok = tree.Get([]byte("003"))
+	assert.False(t, ok)
+	_, ok = tree.Get([]byte("004"))
+	assert.False(t, ok)
+	count := 0
+	tree.Scan([]byte("090"), nil, bptree.ScanOptions{}, func(key, value []byte) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 6, count)
+	assert.True(t, tree.Iterator().Valid())
+	assert.NoError(t, tree.Close())
+}
+
+func TestTreeTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	tree, _ := Open(dir, SetSyncPolicy(SyncNever))
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	var b Batch
+	b.Put([]byte("b"), []byte("2"))
+	b.Put([]byte("c"), []byte("3"))
+	assert.NoError(t, tree.Write(&b))
+	crash(tree.log)
+
+	// a crash in the middle of the batch loses all of it
+	path := filepath.Join(dir, fmt.Sprintf("%020d.wal", 1))
+	data, _ := os.ReadFile(path)
+	assert.NoError(t, os.WriteFile(path, data[:len(data)-3], 0o644))
+	tree, err := Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tree.Size())
+	assert.NoError(t, tree.Close())
+}
+
+func TestTreeConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	options := []Option{
+		SetSyncPolicy(SyncNever),
+		SetTreeOptions(bptree.SetConcurrency(bptree.LatchCrabbing)),
+	}
+	tree, _ := Open(dir, options...)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				// every writer overwrites the same keys
+				assert.NoError(t, tree.Put([]byte(fmt.Sprint(i)), []byte(fmt.Sprint(w))))
+			}
+		}(w)
+	}
+	wg.Wait()
+	expected := make(map[string]string)
+	tree.Scan(nil, nil, bptree.ScanOptions{}, func(key, value []byte) bool {
+		expected[string(key)] = string(value)
+		return true
+	})
+	assert.NoError(t, tree.Close())
+
+	// the log replays the writes in the order they were applied
+	tree, _ = Open(dir, options...)
+	replayed := make(map[string]string)
+	tree.Scan(nil, nil, bptree.ScanOptions{}, func(key, value []byte) bool {
+		replayed[string(key)] = string(value)
+		return true
+	})
+	assert.Equal(t, expected, replayed)
+	assert.NoError(t, tree.Close())
+}